@@ -80,7 +80,7 @@ func TestAdminChannels(t *testing.T) {
 	DB.LogMode(true)
 	DB.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
 	DB.DropTableIfExists(&Channel{})
-	DB.AutoMigrate(&Channel{})
+	MigrateAll()
 
 	frisby.Global.SetHeader("Content-Type", "application/json").
 		SetHeader("Accept", "application/json").
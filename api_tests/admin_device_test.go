@@ -33,7 +33,7 @@ func TestAdminToDevice(t *testing.T) {
 	DB.LogMode(true)
 	DB.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
 	DB.DropTableIfExists(&Channel{})
-	DB.AutoMigrate(&Channel{})
+	MigrateAll()
 
 	InitializeIndexClient()
 
@@ -36,7 +36,7 @@ func TestApiToDevice(t *testing.T) {
 	DB.LogMode(true)
 	DB.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
 	DB.DropTableIfExists(&Channel{})
-	DB.AutoMigrate(&Channel{})
+	MigrateAll()
 
 	InitializeIndexClient()
 
@@ -34,7 +34,7 @@ func TestHttpConnection(t *testing.T) {
 	DB.LogMode(true)
 	DB.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
 	DB.DropTableIfExists(&Channel{})
-	DB.AutoMigrate(&Channel{})
+	MigrateAll()
 
 	InitializeIndexClient()
 
@@ -90,7 +90,7 @@ func TestWsConnection(t *testing.T) {
 	DB.LogMode(true)
 	DB.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
 	DB.DropTableIfExists(&Channel{})
-	DB.AutoMigrate(&Channel{})
+	MigrateAll()
 	// Initialize elasticsearch index client
 	InitializeIndexClient()
 	// Create a test channel
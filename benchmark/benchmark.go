@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
@@ -48,6 +49,7 @@ func main() {
 	I := flag.Int("I", 1000, "wait milliseconds interval between each connection, randomized")
 	b := flag.String("b", "", "ip addresses used to bind clients, defaults to localhost")
 	s := flag.Duration("s", 10*time.Second, "the sleep time after messages are all set for each client")
+	M := flag.Duration("M", 5*time.Second, "interval between memory samples of the server, 0 disables them")
 
 	flag.Parse()
 
@@ -167,6 +169,36 @@ func main() {
 		log.Fatalln("Unable to get created channel Id. Please check server log.")
 	}
 
+	var memBefore, memPeak map[string]float64
+	samplerDone := make(chan struct{})
+	var samplerWg sync.WaitGroup
+	if *M > 0 {
+		memBefore, err = memorySummary(*host, httpPort, auth)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		// keeps the sample with the most connections, which is taken when
+		// the clients are all connected
+		samplerWg.Add(1)
+		go func() {
+			defer samplerWg.Done()
+			for {
+				select {
+				case <-samplerDone:
+					return
+				case <-time.After(*M):
+					sample, err := memorySummary(*host, httpPort, auth)
+					if err != nil {
+						log.Println(err.Error())
+					} else if memPeak == nil || sample["connections"] > memPeak["connections"] {
+						memPeak = sample
+					}
+				}
+			}
+		}()
+	}
+
 	log.Println("Starting clients...")
 	clients := make([]*WsClient, *c)
 	var wg sync.WaitGroup
@@ -199,6 +231,8 @@ func main() {
 
 	log.Println("Waiting for clients to complete...")
 	wg.Wait()
+	close(samplerDone)
+	samplerWg.Wait()
 
 	log.Println("collecting test results...")
 	report := make(map[string]interface{})
@@ -242,12 +276,40 @@ func main() {
 	report["total_msg_sent"] = msgSent
 	report["total_ping_sent"] = pingSent
 
+	if memBefore != nil && memPeak != nil {
+		conns := memPeak["connections"] - memBefore["connections"]
+		used := (memPeak["heap_alloc"] + memPeak["stack_inuse"]) - (memBefore["heap_alloc"] + memBefore["stack_inuse"])
+		report["memory_before"] = memBefore
+		report["memory_peak"] = memPeak
+		if conns > 0 {
+			report["bytes_per_conn"] = int64(used / conns)
+			report["goroutines_per_conn"] = (memPeak["goroutines"] - memBefore["goroutines"]) / conns
+		}
+	}
+
 	fmt.Println("******************************************************************")
 	js, _ := json.MarshalIndent(report, "", "  ")
 	fmt.Println(string(js))
 	fmt.Println("******************************************************************")
 }
 
+// Gets the memory of the server after a garbage collection, so the heap only
+// counts what the connections keep alive.
+func memorySummary(host, port, auth string) (map[string]float64, error) {
+	url := fmt.Sprintf("http://%s:%s/summary/memory?gc=true", host, port)
+	response, bodyBytes, errs := gorequest.New().Get(url).Set("Authentication", auth).EndBytes()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if response.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("unable to get the memory summary, status %d", response.StatusCode))
+	}
+
+	var summary map[string]float64
+	err := json.Unmarshal(bodyBytes, &summary)
+	return summary, err
+}
+
 type WsClient struct {
 	Dialer      *Dialer
 	Server      string
@@ -0,0 +1,194 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	"github.com/eywa/connections"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Requests forwarded by another node carry the name of that node in this
+// header, they are never forwarded again.
+const ForwardedHeader = "X-Eywa-Forwarded-By"
+
+// Name of the node answering an internal request.
+const NodeNameHeader = "X-Eywa-Node"
+
+// Shared secret of the cluster, required on every internal request.
+const SecretHeader = "X-Eywa-Cluster-Secret"
+
+var SupportedRegistries = []string{"gossip", "static"}
+
+var notEnabledErr = errors.New("cluster mode is not enabled")
+
+type Node struct {
+	Name  string `json:"name"`
+	Addr  string `json:"addr"`
+	Local bool   `json:"local"`
+	Alive bool   `json:"alive"`
+}
+
+// Registry keeps track of the members of the cluster and which node each
+// device is connected to. It listens to the local connection managers to
+// learn about the devices of this node.
+type Registry interface {
+	connections.ConnectionListener
+
+	Start() error
+	Stop()
+	// Finds the node a device is connected to, devices on the local node
+	// are never returned.
+	Lookup(cmId, id string) (*Node, bool)
+	Nodes() []*Node
+}
+
+var lock sync.RWMutex
+var registry Registry
+var local *Node
+
+func Initialize() error {
+	if !Config().Cluster.Enabled {
+		return nil
+	}
+
+	name := Config().Cluster.NodeName
+	if len(name) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		name = hostname + ":" + strconv.Itoa(Config().Service.ApiPort)
+	}
+
+	addr := strings.TrimRight(Config().Cluster.AdvertiseAddr, "/")
+	if len(addr) == 0 {
+		scheme := "http"
+		if len(Config().Security.SSL.CertFile) > 0 && len(Config().Security.SSL.KeyFile) > 0 {
+			scheme = "https"
+		}
+		addr = fmt.Sprintf("%s://%s:%d", scheme, Config().Service.Host, Config().Service.ApiPort)
+	}
+
+	node := &Node{Name: name, Addr: addr, Local: true, Alive: true}
+	peers := parsePeers(Config().Cluster.Peers, addr)
+
+	var r Registry
+	switch Config().Cluster.Registry {
+	case "gossip":
+		r = NewGossipRegistry(node, peers)
+	case "static":
+		r = NewStaticRegistry(node, peers)
+	default:
+		return errors.New(fmt.Sprintf("unsupported cluster registry: %s, supported registries are %s", Config().Cluster.Registry, strings.Join(SupportedRegistries, ",")))
+	}
+
+	if err := r.Start(); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	registry = r
+	local = node
+	forwardTransport = newForwardTransport()
+	lock.Unlock()
+
+	connections.SetConnectionListener(r)
+	return nil
+}
+
+func Close() {
+	lock.Lock()
+	r := registry
+	registry = nil
+	lock.Unlock()
+
+	if r != nil {
+		connections.SetConnectionListener(nil)
+		r.Stop()
+	}
+}
+
+func Enabled() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return registry != nil
+}
+
+func LocalNode() *Node {
+	lock.RLock()
+	defer lock.RUnlock()
+	return local
+}
+
+func Lookup(cmId, id string) (*Node, bool) {
+	lock.RLock()
+	r := registry
+	lock.RUnlock()
+
+	if r == nil {
+		return nil, false
+	}
+	return r.Lookup(cmId, id)
+}
+
+func Nodes() []*Node {
+	lock.RLock()
+	r := registry
+	lock.RUnlock()
+
+	if r == nil {
+		return []*Node{}
+	}
+	return r.Nodes()
+}
+
+// Checks the shared secret of an internal request.
+func Authenticate(r *http.Request) bool {
+	secret := Config().Cluster.Secret
+	given := r.Header.Get(SecretHeader)
+	return len(secret) > 0 && subtle.ConstantTimeCompare([]byte(secret), []byte(given)) == 1
+}
+
+func deviceKey(cmId, id string) string {
+	return cmId + "/" + id
+}
+
+func parsePeers(str string, self string) []string {
+	peers := make([]string, 0)
+	for _, p := range strings.Split(str, ",") {
+		p = strings.TrimRight(strings.TrimSpace(p), "/")
+		if len(p) > 0 && p != self {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func newClusterRequest(method, url string, v interface{}) (*http.Request, error) {
+	var body *bytes.Buffer
+	if v != nil {
+		js, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(js)
+	} else {
+		body = bytes.NewBuffer([]byte{})
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SecretHeader, Config().Cluster.Secret)
+	return req, nil
+}
@@ -0,0 +1,243 @@
+package cluster
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func gossipServer(r *GossipRegistry) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !Authenticate(req) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		msg := &GossipMessage{}
+		json.NewDecoder(req.Body).Decode(msg)
+		json.NewEncoder(w).Encode(r.Gossip(msg))
+	}))
+}
+
+func TestCluster(t *testing.T) {
+
+	SetConfig(&Conf{
+		Cluster: &ClusterConf{
+			Enabled: true,
+			Secret:  "secret",
+			Timeouts: &ClusterTimeoutConf{
+				Gossip:  &JSONDuration{time.Second},
+				Node:    &JSONDuration{10 * time.Second},
+				Lookup:  &JSONDuration{time.Second},
+				Forward: &JSONDuration{time.Second},
+			},
+		},
+	})
+
+	Convey("spreads devices between nodes with gossip", t, func() {
+		a := NewGossipRegistry(&Node{Name: "a", Local: true}, []string{})
+		b := NewGossipRegistry(&Node{Name: "b", Local: true}, []string{})
+		c := NewGossipRegistry(&Node{Name: "c", Local: true}, []string{})
+		sa, sb, sc := gossipServer(a), gossipServer(b), gossipServer(c)
+		defer sa.Close()
+		defer sb.Close()
+		defer sc.Close()
+		a.local.Addr, a.nodes["a"].Addr = sa.URL, sa.URL
+		b.local.Addr, b.nodes["b"].Addr = sb.URL, sb.URL
+		c.local.Addr, c.nodes["c"].Addr = sc.URL, sc.URL
+		// a and c only know b
+		a.seeds = []string{sb.URL}
+		c.seeds = []string{sb.URL}
+
+		a.Registered("ch", "dev1")
+		c.Registered("ch", "dev2")
+		a.round()
+		c.round()
+		a.round()
+
+		node, found := b.Lookup("ch", "dev1")
+		So(found, ShouldBeTrue)
+		So(node.Name, ShouldEqual, "a")
+		So(node.Addr, ShouldEqual, sa.URL)
+
+		node, found = a.Lookup("ch", "dev2")
+		So(found, ShouldBeTrue)
+		So(node.Name, ShouldEqual, "c")
+
+		_, found = a.Lookup("ch", "dev1")
+		So(found, ShouldBeFalse)
+
+		names := []string{}
+		for _, n := range a.Nodes() {
+			names = append(names, n.Name)
+			So(n.Alive, ShouldBeTrue)
+		}
+		So(names, ShouldResemble, []string{"a", "b", "c"})
+
+		a.Unregistered("ch", "dev1")
+		a.round()
+		_, found = b.Lookup("ch", "dev1")
+		So(found, ShouldBeFalse)
+
+		c.Stop()
+		_, found = b.Lookup("ch", "dev2")
+		So(found, ShouldBeFalse)
+	})
+
+	Convey("ignores gossip about the local node", t, func() {
+		a := NewGossipRegistry(&Node{Name: "a", Local: true}, []string{})
+		a.Registered("ch", "dev1")
+		a.Gossip(&GossipMessage{
+			From: "b",
+			States: []*GossipState{
+				{GossipDigest: GossipDigest{Name: "a", Heartbeat: 100, Version: 100}, Full: true},
+				{GossipDigest: GossipDigest{Name: "b", Heartbeat: 1, Version: 1}, Full: true, Devices: []string{"ch/dev1", "ch/dev2"}},
+			},
+		})
+
+		_, found := a.Lookup("ch", "dev1")
+		So(found, ShouldBeFalse)
+		node, found := a.Lookup("ch", "dev2")
+		So(found, ShouldBeTrue)
+		So(node.Name, ShouldEqual, "b")
+	})
+
+	Convey("gossips the device changes since the version of the peer", t, func() {
+		defer func(size int) { gossipChangeLogSize = size }(gossipChangeLogSize)
+		gossipChangeLogSize = 2
+
+		a := NewGossipRegistry(&Node{Name: "a", Local: true}, []string{})
+		b := NewGossipRegistry(&Node{Name: "b", Local: true}, []string{})
+		a.Registered("ch", "dev1")
+		a.Registered("ch", "dev2")
+
+		// b doesn't know a yet, all the changes since version 0 are logged
+		resp := a.Gossip(&GossipMessage{From: "b", Digests: []*GossipDigest{{Name: "b"}}})
+		So(len(resp.States), ShouldEqual, 1)
+		So(resp.States[0].Delta, ShouldBeTrue)
+		So(resp.States[0].Since, ShouldEqual, 0)
+		So(len(resp.States[0].Added), ShouldEqual, 2)
+		b.Gossip(&GossipMessage{From: "a", States: resp.States})
+		_, found := b.Lookup("ch", "dev2")
+		So(found, ShouldBeTrue)
+
+		a.Unregistered("ch", "dev1")
+		resp = a.Gossip(&GossipMessage{From: "b", Digests: b.digests()})
+		So(len(resp.States), ShouldEqual, 1)
+		So(resp.States[0].Delta, ShouldBeTrue)
+		So(resp.States[0].Since, ShouldEqual, 2)
+		So(resp.States[0].Added, ShouldBeEmpty)
+		So(resp.States[0].Removed, ShouldResemble, []string{"ch/dev1"})
+
+		// a delta past the version of b is dropped
+		a.Registered("ch", "dev3")
+		gap := a.state(a.nodes["a"], 3)
+		b.Gossip(&GossipMessage{From: "a", States: []*GossipState{gap}})
+		So(b.nodes["a"].Version, ShouldEqual, 2)
+		_, found = b.Lookup("ch", "dev3")
+		So(found, ShouldBeFalse)
+
+		// the changes b misses aren't logged anymore, it gets all devices
+		a.Registered("ch", "dev4")
+		resp = a.Gossip(&GossipMessage{From: "b", Digests: b.digests()})
+		So(resp.States[0].Full, ShouldBeTrue)
+		So(len(resp.States[0].Devices), ShouldEqual, 3)
+		b.Gossip(&GossipMessage{From: "a", States: resp.States})
+		So(b.nodes["a"].Version, ShouldEqual, 5)
+		_, found = b.Lookup("ch", "dev1")
+		So(found, ShouldBeFalse)
+		_, found = b.Lookup("ch", "dev3")
+		So(found, ShouldBeTrue)
+	})
+
+	Convey("replaces the devices of a node that restarted", t, func() {
+		a := NewGossipRegistry(&Node{Name: "a", Local: true}, []string{})
+		b := NewGossipRegistry(&Node{Name: "b", Local: true}, []string{})
+		a.Registered("ch", "dev1")
+		a.Registered("ch", "dev2")
+		resp := a.Gossip(&GossipMessage{From: "b", Digests: b.digests()})
+		b.Gossip(&GossipMessage{From: "a", States: resp.States})
+		_, found := b.Lookup("ch", "dev1")
+		So(found, ShouldBeTrue)
+
+		// a starts over, its versions are behind what b knows
+		restarted := NewGossipRegistry(&Node{Name: "a", Local: true}, []string{})
+		So(restarted.nodes["a"].Incarnation, ShouldBeGreaterThan, a.nodes["a"].Incarnation)
+		restarted.Registered("ch", "dev3")
+
+		resp = b.Gossip(&GossipMessage{From: "a", Digests: restarted.digests()})
+		_, found = b.Lookup("ch", "dev1")
+		So(found, ShouldBeFalse)
+		So(len(resp.Wants), ShouldEqual, 1)
+		So(resp.Wants[0].Name, ShouldEqual, "a")
+
+		b.Gossip(&GossipMessage{From: "a", States: []*GossipState{restarted.stateFor(restarted.nodes["a"], resp.Wants[0])}})
+		So(b.nodes["a"].Version, ShouldEqual, 1)
+		_, found = b.Lookup("ch", "dev2")
+		So(found, ShouldBeFalse)
+		node, found := b.Lookup("ch", "dev3")
+		So(found, ShouldBeTrue)
+		So(node.Name, ShouldEqual, "a")
+
+		// late gossip about the earlier run is stale
+		b.Gossip(&GossipMessage{From: "c", States: []*GossipState{a.state(a.nodes["a"], 0)}})
+		_, found = b.Lookup("ch", "dev1")
+		So(found, ShouldBeFalse)
+	})
+
+	Convey("waits on the node holding the device as long as the request asks", t, func() {
+		defer func(d time.Duration) { Config().Cluster.Timeouts.Forward.Duration = d }(Config().Cluster.Timeouts.Forward.Duration)
+		Config().Cluster.Timeouts.Forward.Duration = 50 * time.Millisecond
+
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte(req.Header.Get(ForwardedHeader)))
+		}))
+		defer peer.Close()
+
+		lock.Lock()
+		local, forwardTransport = &Node{Name: "local", Local: true}, newForwardTransport()
+		lock.Unlock()
+		node := &Node{Name: "peer", Addr: peer.URL}
+
+		w := httptest.NewRecorder()
+		Forward(w, httptest.NewRequest("GET", "/channels/ch/devices/dev1/poll", nil), node)
+		So(w.Code, ShouldEqual, http.StatusGatewayTimeout)
+
+		w = httptest.NewRecorder()
+		Forward(w, httptest.NewRequest("GET", "/channels/ch/devices/dev1/poll?timeout=100ms", nil), node)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldEqual, "local")
+
+		w = httptest.NewRecorder()
+		Forward(w, httptest.NewRequest("GET", "/channels/ch/devices/dev1/poll?timeout=soon", nil), node)
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("looks up devices by asking the static peers", t, func() {
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if Authenticate(req) && req.URL.Path == "/cluster/channels/ch/devices/dev1" {
+				w.Header().Set(NodeNameHeader, "peer")
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer peer.Close()
+
+		r := NewStaticRegistry(&Node{Name: "local", Local: true}, parsePeers(peer.URL+"/, http://local", "http://local"))
+		So(len(r.peers), ShouldEqual, 1)
+
+		node, found := r.Lookup("ch", "dev1")
+		So(found, ShouldBeTrue)
+		So(node.Name, ShouldEqual, "peer")
+		So(node.Addr, ShouldEqual, peer.URL)
+
+		_, found = r.Lookup("ch", "dev2")
+		So(found, ShouldBeFalse)
+	})
+}
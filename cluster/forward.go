@@ -0,0 +1,89 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	. "github.com/eywa/configs"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+var forwardTransport http.RoundTripper
+
+func newForwardTransport() http.RoundTripper {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+}
+
+// How long the node holding the device has to answer the headers. Requests
+// waiting on the device with a timeout get that much longer, otherwise a
+// long poll or a request to the device would be cut short by the forward.
+func forwardTimeout(r *http.Request) (time.Duration, error) {
+	timeout := Config().Cluster.Timeouts.Forward.Duration
+	if timeoutStr := r.URL.Query().Get("timeout"); len(timeoutStr) > 0 {
+		t, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return 0, err
+		}
+		timeout += t
+	}
+	return timeout, nil
+}
+
+// Whether the request was already forwarded by another node.
+func Forwarded(r *http.Request) bool {
+	return len(r.Header.Get(ForwardedHeader)) > 0
+}
+
+// Hands the request over to the node holding the device. The original
+// request uri is kept, so it is served by the same route on the other node,
+// websocket upgrades included.
+func Forward(w http.ResponseWriter, r *http.Request, node *Node) {
+	target, err := url.Parse(node.Addr + r.RequestURI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	timeout, err := forwardTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lock.RLock()
+	name := local.Name
+	transport := forwardTransport
+	lock.RUnlock()
+
+	// the timeout only covers the headers, upgraded connections and
+	// streamed answers carry on past it
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timer := time.AfterFunc(timeout, cancel)
+	defer timer.Stop()
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL = target
+			req.Host = target.Host
+			req.Header.Set(ForwardedHeader, name)
+		},
+		Transport: transport,
+		ModifyResponse: func(*http.Response) error {
+			timer.Stop()
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if ctx.Err() != nil && r.Context().Err() == nil {
+				http.Error(w, fmt.Sprintf("node %s didn't answer in %s", node.Name, timeout), http.StatusGatewayTimeout)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+		},
+	}
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+}
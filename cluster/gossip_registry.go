@@ -0,0 +1,543 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	"github.com/eywa/loggers"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of peers every gossip round talks to.
+var gossipFanout = 3
+
+// Dead nodes are forgotten after being silent for this many node timeouts.
+var gossipForgetFactor = 3
+
+// Number of device changes kept per node to answer peers with deltas. A peer
+// further behind gets the full device list.
+var gossipChangeLogSize = 1024
+
+// Summary of what a node knows about another node. The incarnation is set
+// when the node starts, the heartbeat grows every gossip round and the
+// version grows every time the devices of the node change. Heartbeats and
+// versions only compare within an incarnation, a node that restarts starts
+// them over under a higher one.
+type GossipDigest struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	Incarnation uint64 `json:"incarnation"`
+	Heartbeat   uint64 `json:"heartbeat"`
+	Version     uint64 `json:"version"`
+}
+
+// A state carries either all the devices of the node when Full is set, or
+// when Delta is set the devices added and removed since the version Since,
+// which only applies to a receiver at that version. A state with neither is
+// a heartbeat.
+type GossipState struct {
+	GossipDigest
+	Full    bool     `json:"full"`
+	Devices []string `json:"devices,omitempty"`
+	Delta   bool     `json:"delta,omitempty"`
+	Since   uint64   `json:"since,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// One gossip round is a push of digests answered by the newer states and the
+// digests of the nodes the receiver wants, then a push of the wanted states.
+// The wanted digests carry the version the receiver has, so that the states
+// are sent as deltas from it.
+type GossipMessage struct {
+	From    string          `json:"from"`
+	Digests []*GossipDigest `json:"digests,omitempty"`
+	States  []*GossipState  `json:"states,omitempty"`
+	Wants   []*GossipDigest `json:"wants,omitempty"`
+}
+
+type gossipChange struct {
+	version uint64
+	key     string
+	present bool
+}
+
+type gossipNode struct {
+	GossipDigest
+	devices   map[string]struct{}
+	updatedAt time.Time
+	// the latest device changes, the ones up to logBase are gone
+	changes []gossipChange
+	logBase uint64
+}
+
+// Records a device change made at the current version of the node.
+func (n *gossipNode) record(key string, present bool) {
+	n.changes = append(n.changes, gossipChange{version: n.Version, key: key, present: present})
+	if len(n.changes) <= gossipChangeLogSize {
+		return
+	}
+
+	// the changes of a version are dropped together
+	drop := len(n.changes) - gossipChangeLogSize
+	for drop < len(n.changes) && n.changes[drop].version == n.changes[drop-1].version {
+		drop += 1
+	}
+	n.logBase = n.changes[drop-1].version
+	n.changes = append([]gossipChange{}, n.changes[drop:]...)
+}
+
+type GossipRegistry struct {
+	sync.Mutex
+	local  *Node
+	seeds  []string
+	nodes  map[string]*gossipNode
+	owners map[string]string
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewGossipRegistry(local *Node, seeds []string) *GossipRegistry {
+	r := &GossipRegistry{
+		local:  local,
+		seeds:  seeds,
+		nodes:  make(map[string]*gossipNode),
+		owners: make(map[string]string),
+		done:   make(chan struct{}),
+	}
+
+	now := time.Now()
+	r.nodes[local.Name] = &gossipNode{
+		GossipDigest: GossipDigest{Name: local.Name, Addr: local.Addr, Incarnation: uint64(now.UnixNano())},
+		devices:      make(map[string]struct{}),
+		updatedAt:    now,
+	}
+	return r
+}
+
+func (r *GossipRegistry) Start() error {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(Config().Cluster.Timeouts.Gossip.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.round()
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stops gossiping after telling the peers this node holds no devices anymore.
+func (r *GossipRegistry) Stop() {
+	close(r.done)
+	r.wg.Wait()
+
+	r.Lock()
+	self := r.nodes[r.local.Name]
+	if len(self.devices) > 0 {
+		self.Version += 1
+		for key, _ := range self.devices {
+			delete(r.owners, key)
+			self.record(key, false)
+		}
+		self.devices = make(map[string]struct{})
+	}
+	r.Unlock()
+
+	r.round()
+}
+
+func (r *GossipRegistry) Registered(cmId, id string) {
+	key := deviceKey(cmId, id)
+
+	r.Lock()
+	defer r.Unlock()
+
+	self := r.nodes[r.local.Name]
+	self.devices[key] = struct{}{}
+	self.Version += 1
+	self.record(key, true)
+	r.owners[key] = r.local.Name
+}
+
+func (r *GossipRegistry) Unregistered(cmId, id string) {
+	key := deviceKey(cmId, id)
+
+	r.Lock()
+	defer r.Unlock()
+
+	self := r.nodes[r.local.Name]
+	delete(self.devices, key)
+	self.Version += 1
+	self.record(key, false)
+	if r.owners[key] == r.local.Name {
+		delete(r.owners, key)
+	}
+}
+
+func (r *GossipRegistry) Lookup(cmId, id string) (*Node, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	name, found := r.owners[deviceKey(cmId, id)]
+	if !found || name == r.local.Name {
+		return nil, false
+	}
+
+	n, found := r.nodes[name]
+	if !found || !r.alive(n, time.Now()) {
+		return nil, false
+	}
+	return &Node{Name: n.Name, Addr: n.Addr, Alive: true}, true
+}
+
+func (r *GossipRegistry) Nodes() []*Node {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	nodes := make([]*Node, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		nodes = append(nodes, &Node{
+			Name:  n.Name,
+			Addr:  n.Addr,
+			Local: n.Name == r.local.Name,
+			Alive: r.alive(n, now),
+		})
+	}
+	sort.Sort(nodesByName(nodes))
+	return nodes
+}
+
+// caller must hold the lock
+func (r *GossipRegistry) alive(n *gossipNode, now time.Time) bool {
+	return n.Name == r.local.Name || now.Sub(n.updatedAt) < Config().Cluster.Timeouts.Node.Duration
+}
+
+// caller must hold the lock
+func (r *GossipRegistry) digests() []*GossipDigest {
+	ds := make([]*GossipDigest, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		d := n.GossipDigest
+		ds = append(ds, &d)
+	}
+	return ds
+}
+
+// caller must hold the lock
+func (r *GossipRegistry) heartbeat(n *gossipNode) *GossipState {
+	return &GossipState{GossipDigest: n.GossipDigest}
+}
+
+// The devices of the node for a peer at version since. The changes made
+// after since are sent when they are all still logged, all the devices
+// otherwise.
+// caller must hold the lock
+func (r *GossipRegistry) state(n *gossipNode, since uint64) *GossipState {
+	s := &GossipState{GossipDigest: n.GossipDigest}
+	if since >= n.logBase && since < n.Version {
+		latest := make(map[string]bool)
+		for _, c := range n.changes {
+			if c.version > since {
+				latest[c.key] = c.present
+			}
+		}
+
+		s.Delta, s.Since = true, since
+		for key, present := range latest {
+			if present {
+				s.Added = append(s.Added, key)
+			} else {
+				s.Removed = append(s.Removed, key)
+			}
+		}
+		return s
+	}
+
+	s.Full = true
+	s.Devices = make([]string, 0, len(n.devices))
+	for key, _ := range n.devices {
+		s.Devices = append(s.Devices, key)
+	}
+	return s
+}
+
+// The devices of the node for a peer that knows it as the digest d. A peer
+// that knows another incarnation of the node starts it over from version 0.
+// caller must hold the lock
+func (r *GossipRegistry) stateFor(n *gossipNode, d *GossipDigest) *GossipState {
+	if d.Incarnation != n.Incarnation {
+		return r.state(n, 0)
+	}
+	return r.state(n, d.Version)
+}
+
+// caller must hold the lock
+func (r *GossipRegistry) addDevice(n *gossipNode, key string) {
+	n.devices[key] = struct{}{}
+	// devices on the local node are always served locally
+	if owner, found := r.owners[key]; !found || owner != r.local.Name {
+		r.owners[key] = n.Name
+	}
+}
+
+// caller must hold the lock
+func (r *GossipRegistry) removeDevice(n *gossipNode, key string) {
+	delete(n.devices, key)
+	if r.owners[key] == n.Name {
+		delete(r.owners, key)
+	}
+}
+
+// A delta only applies on top of the version it was made from, a delta past
+// that version is dropped and the node catches up on the next exchange. A
+// higher incarnation replaces what is known about the node, the states of a
+// lower one are stale.
+// caller must hold the lock
+func (r *GossipRegistry) merge(s *GossipState, now time.Time) {
+	// nobody knows better about the local node
+	if s.Name == r.local.Name {
+		return
+	}
+
+	n, found := r.nodes[s.Name]
+	if !found {
+		n = &gossipNode{
+			GossipDigest: GossipDigest{Name: s.Name, Addr: s.Addr, Incarnation: s.Incarnation},
+			devices:      make(map[string]struct{}),
+			updatedAt:    now,
+		}
+		r.nodes[s.Name] = n
+	}
+
+	if s.Incarnation < n.Incarnation {
+		return
+	}
+	restarted := s.Incarnation > n.Incarnation
+	if restarted {
+		for key, _ := range n.devices {
+			r.removeDevice(n, key)
+		}
+		n.Incarnation, n.Heartbeat, n.Version = s.Incarnation, 0, 0
+		n.changes, n.logBase = nil, 0
+	}
+
+	if s.Full && (s.Version > n.Version || !found || restarted) {
+		for key, _ := range n.devices {
+			r.removeDevice(n, key)
+		}
+		for _, key := range s.Devices {
+			r.addDevice(n, key)
+		}
+		n.Version = s.Version
+		n.changes, n.logBase = nil, s.Version
+	} else if s.Delta && s.Since == n.Version && s.Version > n.Version {
+		n.Version = s.Version
+		for _, key := range s.Added {
+			r.addDevice(n, key)
+			n.record(key, true)
+		}
+		for _, key := range s.Removed {
+			r.removeDevice(n, key)
+			n.record(key, false)
+		}
+	}
+
+	if s.Heartbeat > n.Heartbeat {
+		n.Heartbeat = s.Heartbeat
+		n.Addr = s.Addr
+		n.updatedAt = now
+	}
+}
+
+// caller must hold the lock
+func (r *GossipRegistry) forget(now time.Time) {
+	timeout := time.Duration(gossipForgetFactor) * Config().Cluster.Timeouts.Node.Duration
+	for name, n := range r.nodes {
+		if name != r.local.Name && now.Sub(n.updatedAt) > timeout {
+			for key, _ := range n.devices {
+				if r.owners[key] == name {
+					delete(r.owners, key)
+				}
+			}
+			delete(r.nodes, name)
+		}
+	}
+}
+
+// Answers a gossip message from a peer.
+func (r *GossipRegistry) Gossip(msg *GossipMessage) *GossipMessage {
+	now := time.Now()
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, s := range msg.States {
+		r.merge(s, now)
+	}
+
+	if len(msg.Digests) == 0 {
+		return &GossipMessage{From: r.local.Name}
+	}
+
+	resp := &GossipMessage{From: r.local.Name, States: []*GossipState{}, Wants: []*GossipDigest{}}
+	seen := make(map[string]bool, len(msg.Digests))
+	for _, d := range msg.Digests {
+		seen[d.Name] = true
+		n, found := r.nodes[d.Name]
+		if !found {
+			if d.Name != r.local.Name {
+				resp.Wants = append(resp.Wants, &GossipDigest{Name: d.Name})
+			}
+			continue
+		}
+
+		if d.Incarnation > n.Incarnation && d.Name != r.local.Name {
+			// the node restarted, what was known about it is gone
+			r.merge(&GossipState{GossipDigest: *d}, now)
+			if d.Version > 0 {
+				resp.Wants = append(resp.Wants, &GossipDigest{Name: d.Name, Incarnation: d.Incarnation})
+			}
+			continue
+		}
+
+		if d.Incarnation < n.Incarnation || n.Version > d.Version {
+			resp.States = append(resp.States, r.stateFor(n, d))
+		} else if n.Heartbeat > d.Heartbeat {
+			resp.States = append(resp.States, r.heartbeat(n))
+		}
+
+		if d.Incarnation == n.Incarnation && d.Version > n.Version {
+			resp.Wants = append(resp.Wants, &GossipDigest{Name: d.Name, Incarnation: n.Incarnation, Version: n.Version})
+		}
+		if d.Incarnation == n.Incarnation && d.Heartbeat > n.Heartbeat {
+			r.merge(&GossipState{GossipDigest: *d}, now)
+		}
+	}
+
+	// nodes the peer doesn't know about yet
+	for name, n := range r.nodes {
+		if !seen[name] {
+			resp.States = append(resp.States, r.state(n, 0))
+		}
+	}
+	return resp
+}
+
+func (r *GossipRegistry) round() {
+	now := time.Now()
+
+	r.Lock()
+	r.forget(now)
+	self := r.nodes[r.local.Name]
+	self.Heartbeat += 1
+	self.updatedAt = now
+
+	targets := make([]string, 0)
+	known := make(map[string]bool)
+	for _, n := range r.nodes {
+		if n.Name != r.local.Name && r.alive(n, now) {
+			targets = append(targets, n.Addr)
+			known[n.Addr] = true
+		}
+	}
+	// keep talking to the seeds so that partitions heal
+	for _, seed := range r.seeds {
+		if !known[seed] {
+			targets = append(targets, seed)
+		}
+	}
+	digests := r.digests()
+	r.Unlock()
+
+	for i, j := range rand.Perm(len(targets)) {
+		if i >= gossipFanout {
+			break
+		}
+		if err := r.exchange(targets[j], digests); err != nil {
+			loggers.Logger.Debug(fmt.Sprintf("gossip with %s failed: %s", targets[j], err.Error()))
+		}
+	}
+}
+
+func (r *GossipRegistry) exchange(addr string, digests []*GossipDigest) error {
+	resp, err := r.send(addr, &GossipMessage{From: r.local.Name, Digests: digests})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	r.Lock()
+	for _, s := range resp.States {
+		r.merge(s, now)
+	}
+
+	if len(resp.Wants) == 0 {
+		r.Unlock()
+		return nil
+	}
+
+	push := &GossipMessage{From: r.local.Name, States: []*GossipState{}}
+	for _, w := range resp.Wants {
+		if n, found := r.nodes[w.Name]; found {
+			push.States = append(push.States, r.stateFor(n, w))
+		}
+	}
+	r.Unlock()
+
+	_, err = r.send(addr, push)
+	return err
+}
+
+func (r *GossipRegistry) send(addr string, msg *GossipMessage) (*GossipMessage, error) {
+	req, err := newClusterRequest("POST", addr+"/cluster/gossip", msg)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: Config().Cluster.Timeouts.Lookup.Duration}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("unexpected response status %d", resp.StatusCode))
+	}
+
+	reply := &GossipMessage{}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	return reply, err
+}
+
+// Answers a gossip message when the gossip registry is in use.
+func Gossip(msg *GossipMessage) (*GossipMessage, error) {
+	lock.RLock()
+	r := registry
+	lock.RUnlock()
+
+	g, ok := r.(*GossipRegistry)
+	if !ok {
+		return nil, notEnabledErr
+	}
+	return g.Gossip(msg), nil
+}
+
+type nodesByName []*Node
+
+func (ns nodesByName) Len() int           { return len(ns) }
+func (ns nodesByName) Swap(i, j int)      { ns[i], ns[j] = ns[j], ns[i] }
+func (ns nodesByName) Less(i, j int) bool { return ns[i].Name < ns[j].Name }
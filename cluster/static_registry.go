@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"fmt"
+	. "github.com/eywa/configs"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// How long the owner of a device found by asking the peers is remembered.
+var staticLookupCacheTime = 5 * time.Second
+
+type staticLookup struct {
+	node      *Node
+	expiresAt time.Time
+}
+
+// StaticRegistry works with a fixed list of peers and keeps no shared state,
+// a device is looked up by asking every peer whether it holds the device.
+type StaticRegistry struct {
+	sync.Mutex
+	local *Node
+	peers []string
+	cache map[string]*staticLookup
+}
+
+func NewStaticRegistry(local *Node, peers []string) *StaticRegistry {
+	return &StaticRegistry{
+		local: local,
+		peers: peers,
+		cache: make(map[string]*staticLookup),
+	}
+}
+
+func (r *StaticRegistry) Start() error { return nil }
+func (r *StaticRegistry) Stop()        {}
+
+func (r *StaticRegistry) Registered(cmId, id string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.cache, deviceKey(cmId, id))
+}
+
+func (r *StaticRegistry) Unregistered(cmId, id string) {}
+
+func (r *StaticRegistry) Lookup(cmId, id string) (*Node, bool) {
+	key := deviceKey(cmId, id)
+	now := time.Now()
+
+	r.Lock()
+	if l, found := r.cache[key]; found {
+		if l.expiresAt.After(now) {
+			r.Unlock()
+			return l.node, true
+		}
+		delete(r.cache, key)
+	}
+	r.Unlock()
+
+	found := make(chan *Node, len(r.peers))
+	var wg sync.WaitGroup
+	wg.Add(len(r.peers))
+	for _, peer := range r.peers {
+		go func(addr string) {
+			defer wg.Done()
+			if node, ok := r.ask(addr, cmId, id); ok {
+				found <- node
+			}
+		}(peer)
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	node, ok := <-found
+	if !ok {
+		return nil, false
+	}
+
+	r.Lock()
+	r.cache[key] = &staticLookup{node: node, expiresAt: now.Add(staticLookupCacheTime)}
+	r.Unlock()
+	return node, true
+}
+
+func (r *StaticRegistry) ask(addr, cmId, id string) (*Node, bool) {
+	req, err := newClusterRequest("GET", fmt.Sprintf("%s/cluster/channels/%s/devices/%s", addr, url.PathEscape(cmId), url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set(ForwardedHeader, r.local.Name)
+
+	client := &http.Client{Timeout: Config().Cluster.Timeouts.Lookup.Duration}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+	return &Node{Name: resp.Header.Get(NodeNameHeader), Addr: addr, Alive: true}, true
+}
+
+func (r *StaticRegistry) Nodes() []*Node {
+	nodes := []*Node{r.local}
+	for _, peer := range r.peers {
+		nodes = append(nodes, &Node{Name: peer, Addr: peer})
+	}
+	return nodes
+}
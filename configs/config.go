@@ -39,6 +39,7 @@ func ReadConfig(buf io.Reader) (*Conf, error) {
 		Host:       v.GetString("service.host"),
 		ApiPort:    v.GetInt("service.api_port"),
 		DevicePort: v.GetInt("service.device_port"),
+		MqttPort:   v.GetInt("service.mqtt_port"),
 		PidFile:    v.GetString("service.pid_file"),
 		Assets:     v.GetString("service.assets"),
 		Templates:  v.GetString("service.templates"),
@@ -68,18 +69,34 @@ func ReadConfig(buf io.Reader) (*Conf, error) {
 
 	indexConfig := &IndexConf{
 		Disable:          v.GetBool("indices.disable"),
+		Store:            v.GetString("indices.store"),
+		StoreFile:        v.GetString("indices.store_file"),
 		Host:             v.GetString("indices.host"),
 		Port:             v.GetInt("indices.port"),
 		NumberOfShards:   v.GetInt("indices.number_of_shards"),
 		NumberOfReplicas: v.GetInt("indices.number_of_replicas"),
 		TTLEnabled:       v.GetBool("indices.ttl_enabled"),
 		TTL:              &JSONDuration{v.GetDuration("indices.ttl")},
+		Bulk: &BulkIndexConf{
+			Size:          v.GetInt("indices.bulk.size"),
+			FlushInterval: &JSONDuration{v.GetDuration("indices.bulk.flush_interval")},
+			QueueSize:     v.GetInt("indices.bulk.queue_size"),
+			SpillFile:     v.GetString("indices.bulk.spill_file"),
+			MaxSpillSize:  int64(v.GetInt("indices.bulk.max_spill_size")),
+		},
 	}
 
 	connConfig := &ConnectionsConf{
+		IdleTimeout: &JSONDuration{v.GetDuration("connections.idle_timeout")},
+		Dispatch: &DispatchConf{
+			Shards:    v.GetInt("connections.dispatch.shards"),
+			QueueSize: v.GetInt("connections.dispatch.queue_size"),
+			Overflow:  v.GetString("connections.dispatch.overflow"),
+		},
 		Http: &HttpConnectionConf{
 			Timeouts: &HttpConnectionTimeoutConf{
 				LongPolling: &JSONDuration{v.GetDuration("connections.http.timeouts.long_polling")},
+				Push:        &JSONDuration{v.GetDuration("connections.http.timeouts.push")},
 			},
 		},
 		Websocket: &WsConnectionConf{
@@ -89,14 +106,93 @@ func ReadConfig(buf io.Reader) (*Conf, error) {
 				Read:     &JSONDuration{v.GetDuration("connections.websocket.timeouts.read")},
 				Request:  &JSONDuration{v.GetDuration("connections.websocket.timeouts.request")},
 				Response: &JSONDuration{v.GetDuration("connections.websocket.timeouts.response")},
+				Ping:     &JSONDuration{v.GetDuration("connections.websocket.timeouts.ping")},
 			},
 			BufferSizes: &WsConnectionBufferSizeConf{
-				Write: v.GetInt("connections.websocket.buffer_sizes.write"),
-				Read:  v.GetInt("connections.websocket.buffer_sizes.read"),
+				Write:     v.GetInt("connections.websocket.buffer_sizes.write"),
+				Read:      v.GetInt("connections.websocket.buffer_sizes.read"),
+				MaxPooled: v.GetInt("connections.websocket.buffer_sizes.max_pooled"),
+			},
+			Transport:   v.GetString("connections.websocket.transport"),
+			PollWorkers: v.GetInt("connections.websocket.poll_workers"),
+		},
+		Mqtt: &MqttConnectionConf{
+			MaxPacketSize: v.GetInt("connections.mqtt.max_packet_size"),
+			Timeouts: &MqttConnectionTimeoutConf{
+				Connect: &JSONDuration{v.GetDuration("connections.mqtt.timeouts.connect")},
+				Write:   &JSONDuration{v.GetDuration("connections.mqtt.timeouts.write")},
+				Read:    &JSONDuration{v.GetDuration("connections.mqtt.timeouts.read")},
 			},
 		},
 	}
 
+	webhookConfig := &WebhookConf{
+		QueueSize:       v.GetInt("webhooks.queue_size"),
+		MaxRetries:      v.GetInt("webhooks.max_retries"),
+		DeliveryLogSize: v.GetInt("webhooks.delivery_log_size"),
+		Timeouts: &WebhookTimeoutConf{
+			Request:         &JSONDuration{v.GetDuration("webhooks.timeouts.request")},
+			RetryBackoff:    &JSONDuration{v.GetDuration("webhooks.timeouts.retry_backoff")},
+			MaxRetryBackoff: &JSONDuration{v.GetDuration("webhooks.timeouts.max_retry_backoff")},
+		},
+	}
+
+	commandConfig := &CommandConf{
+		MaxDepth:      v.GetInt("commands.max_depth"),
+		TTL:           &JSONDuration{v.GetDuration("commands.ttl")},
+		MaxTTL:        &JSONDuration{v.GetDuration("commands.max_ttl")},
+		Retention:     &JSONDuration{v.GetDuration("commands.retention")},
+		SweepInterval: &JSONDuration{v.GetDuration("commands.sweep_interval")},
+	}
+
+	fanOutConfig := &FanOutConf{
+		Parallelism:    v.GetInt("fan_out.parallelism"),
+		Timeout:        &JSONDuration{v.GetDuration("fan_out.timeout")},
+		AsyncThreshold: v.GetInt("fan_out.async_threshold"),
+		JobRetention:   &JSONDuration{v.GetDuration("fan_out.job_retention")},
+	}
+
+	rpcConfig := &RpcConf{
+		Timeout:         &JSONDuration{v.GetDuration("rpc.timeout")},
+		MaxResponseSize: v.GetInt("rpc.max_response_size"),
+		MaxParamsSize:   v.GetInt("rpc.max_params_size"),
+		Workers:         v.GetInt("rpc.workers"),
+	}
+
+	firmwareConfig := &FirmwareConf{
+		Dir:            v.GetString("firmware.dir"),
+		MaxSize:        int64(v.GetInt("firmware.max_size")),
+		HaltMinDevices: v.GetInt("firmware.halt_min_devices"),
+	}
+
+	monitorConfig := &MonitorConf{
+		Interval:       &JSONDuration{v.GetDuration("monitors.interval")},
+		NotifyTimeout:  &JSONDuration{v.GetDuration("monitors.notify_timeout")},
+		AlertRetention: &JSONDuration{v.GetDuration("monitors.alert_retention")},
+	}
+
+	streamConfig := &StreamConf{
+		BufferSize:   v.GetInt("streams.buffer_size"),
+		Backlog:      v.GetInt("streams.backlog"),
+		ResumeWindow: &JSONDuration{v.GetDuration("streams.resume_window")},
+		KeepAlive:    &JSONDuration{v.GetDuration("streams.keep_alive")},
+	}
+
+	clusterConfig := &ClusterConf{
+		Enabled:       v.GetBool("cluster.enabled"),
+		NodeName:      v.GetString("cluster.node_name"),
+		AdvertiseAddr: v.GetString("cluster.advertise_addr"),
+		Registry:      v.GetString("cluster.registry"),
+		Peers:         v.GetString("cluster.peers"),
+		Secret:        v.GetString("cluster.secret"),
+		Timeouts: &ClusterTimeoutConf{
+			Gossip:  &JSONDuration{v.GetDuration("cluster.timeouts.gossip")},
+			Node:    &JSONDuration{v.GetDuration("cluster.timeouts.node")},
+			Lookup:  &JSONDuration{v.GetDuration("cluster.timeouts.lookup")},
+			Forward: &JSONDuration{v.GetDuration("cluster.timeouts.forward")},
+		},
+	}
+
 	logEywa := &LogConf{
 		Filename:   v.GetString("logging.eywa.filename"),
 		MaxSize:    v.GetInt("logging.eywa.maxsize"),
@@ -130,6 +226,14 @@ func ReadConfig(buf io.Reader) (*Conf, error) {
 		Connections: connConfig,
 		Indices:     indexConfig,
 		Database:    dbConfig,
+		Webhooks:    webhookConfig,
+		Commands:    commandConfig,
+		FanOut:      fanOutConfig,
+		Rpc:         rpcConfig,
+		Firmware:    firmwareConfig,
+		Monitors:    monitorConfig,
+		Streams:     streamConfig,
+		Cluster:     clusterConfig,
 		Logging: &LogsConf{
 			Eywa:     logEywa,
 			Indices:  logIndices,
@@ -233,6 +337,14 @@ type Conf struct {
 	Connections *ConnectionsConf `json:"connections" assign:"connections;;"`
 	Indices     *IndexConf       `json:"indices" assign:"indices;;"`
 	Database    *DbConf          `json:"database" assign:"database;;-"`
+	Webhooks    *WebhookConf     `json:"webhooks" assign:"webhooks;;"`
+	Commands    *CommandConf     `json:"commands" assign:"commands;;"`
+	FanOut      *FanOutConf      `json:"fan_out" assign:"fan_out;;"`
+	Rpc         *RpcConf         `json:"rpc" assign:"rpc;;"`
+	Firmware    *FirmwareConf    `json:"firmware" assign:"firmware;;"`
+	Monitors    *MonitorConf     `json:"monitors" assign:"monitors;;"`
+	Streams     *StreamConf      `json:"streams" assign:"streams;;"`
+	Cluster     *ClusterConf     `json:"cluster" assign:"cluster;;-"`
 	Logging     *LogsConf        `json:"logging" assign:"logging;;-"`
 }
 
@@ -242,27 +354,59 @@ type DbConf struct {
 }
 
 type IndexConf struct {
-	Disable          bool          `json:"disable" assign:"disable;;"`
-	Host             string        `json:"host" assign:"host;;-"`
-	Port             int           `json:"port" assign:"port;;-"`
-	NumberOfShards   int           `json:"number_of_shards" assign:"number_of_shards;;-"`
-	NumberOfReplicas int           `json:"number_of_replicas" assign:"number_of_replicas;;-"`
-	TTLEnabled       bool          `json:"ttl_enabled" assign:"ttl_enabled;;-"`
-	TTL              *JSONDuration `json:"ttl" assign:"ttl;jsonduration;-"`
+	Disable          bool           `json:"disable" assign:"disable;;"`
+	Store            string         `json:"store" assign:"store;;-"`
+	StoreFile        string         `json:"store_file" assign:"store_file;;-"`
+	Host             string         `json:"host" assign:"host;;-"`
+	Port             int            `json:"port" assign:"port;;-"`
+	NumberOfShards   int            `json:"number_of_shards" assign:"number_of_shards;;-"`
+	NumberOfReplicas int            `json:"number_of_replicas" assign:"number_of_replicas;;-"`
+	TTLEnabled       bool           `json:"ttl_enabled" assign:"ttl_enabled;;-"`
+	TTL              *JSONDuration  `json:"ttl" assign:"ttl;jsonduration;-"`
+	Bulk             *BulkIndexConf `json:"bulk" assign:"bulk;;"`
+}
+
+type BulkIndexConf struct {
+	Size          int           `json:"size" assign:"size;;"`
+	FlushInterval *JSONDuration `json:"flush_interval" assign:"flush_interval;jsonduration;"`
+	QueueSize     int           `json:"queue_size" assign:"queue_size;;-"`
+	SpillFile     string        `json:"spill_file" assign:"spill_file;;-"`
+	MaxSpillSize  int64         `json:"max_spill_size" assign:"max_spill_size;;-"`
 }
 
 type ServiceConf struct {
 	Host       string `json:"host" assign:"host;;-"`
 	ApiPort    int    `json:"api_port" assign:"api_port;;-"`
 	DevicePort int    `json:"device_port" assign:"device_port;;-"`
+	MqttPort   int    `json:"mqtt_port" assign:"mqtt_port;;-"`
 	PidFile    string `json:"-" assign:"pid_file;;-"`
 	Assets     string `json:"-" assign:"assets;;-"`
 	Templates  string `json:"-" assign:"templates;;-"`
 }
 
 type ConnectionsConf struct {
-	Http      *HttpConnectionConf `json:"http" assign:"http;;"`
-	Websocket *WsConnectionConf   `json:"websocket" assign:"websocket;;"`
+	IdleTimeout *JSONDuration       `json:"idle_timeout" assign:"idle_timeout;jsonduration;"`
+	Dispatch    *DispatchConf       `json:"dispatch" assign:"dispatch;;-"`
+	Http        *HttpConnectionConf `json:"http" assign:"http;;"`
+	Websocket   *WsConnectionConf   `json:"websocket" assign:"websocket;;"`
+	Mqtt        *MqttConnectionConf `json:"mqtt" assign:"mqtt;;"`
+}
+
+type DispatchConf struct {
+	Shards    int    `json:"shards" assign:"shards;;-"`
+	QueueSize int    `json:"queue_size" assign:"queue_size;;-"`
+	Overflow  string `json:"overflow" assign:"overflow;;-"`
+}
+
+type MqttConnectionConf struct {
+	MaxPacketSize int                        `json:"max_packet_size" assign:"max_packet_size;;"`
+	Timeouts      *MqttConnectionTimeoutConf `json:"timeouts" assign:"timeouts;;"`
+}
+
+type MqttConnectionTimeoutConf struct {
+	Connect *JSONDuration `json:"connect" assign:"connect;jsonduration;"`
+	Write   *JSONDuration `json:"write" assign:"write;jsonduration;"`
+	Read    *JSONDuration `json:"read" assign:"read;jsonduration;"`
 }
 
 type HttpConnectionConf struct {
@@ -271,12 +415,18 @@ type HttpConnectionConf struct {
 
 type HttpConnectionTimeoutConf struct {
 	LongPolling *JSONDuration `json:"long_polling" assign:"long_polling;jsonduration;"`
+	// how long a push or a call waits for its message to be handled
+	Push *JSONDuration `json:"push" assign:"push;jsonduration;"`
 }
 
 type WsConnectionConf struct {
 	RequestQueueSize int                         `json:"request_queue_size" assign:"request_queue_size;;"`
 	Timeouts         *WsConnectionTimeoutConf    `json:"timeouts" assign:"timeouts;;"`
 	BufferSizes      *WsConnectionBufferSizeConf `json:"buffer_sizes" assign:"buffer_sizes;;"`
+	// goroutines, a reader and a writer for each connection, or epoll, where
+	// the sockets are read by PollWorkers workers, on linux only.
+	Transport   string `json:"transport" assign:"transport;;-"`
+	PollWorkers int    `json:"poll_workers" assign:"poll_workers;;-"`
 }
 
 type WsConnectionTimeoutConf struct {
@@ -284,11 +434,84 @@ type WsConnectionTimeoutConf struct {
 	Read     *JSONDuration `json:"read" assign:"read;jsonduration;"`
 	Request  *JSONDuration `json:"request" assign:"request;jsonduration;"`
 	Response *JSONDuration `json:"response" assign:"response;jsonduration;"`
+	Ping     *JSONDuration `json:"ping" assign:"ping;jsonduration;"`
 }
 
 type WsConnectionBufferSizeConf struct {
-	Write int `json:"write" assign:"write;;"`
-	Read  int `json:"read" assign:"read;;"`
+	Write     int `json:"write" assign:"write;;"`
+	Read      int `json:"read" assign:"read;;"`
+	MaxPooled int `json:"max_pooled" assign:"max_pooled;;"`
+}
+
+type WebhookConf struct {
+	QueueSize       int                 `json:"queue_size" assign:"queue_size;;-"`
+	MaxRetries      int                 `json:"max_retries" assign:"max_retries;;"`
+	DeliveryLogSize int                 `json:"delivery_log_size" assign:"delivery_log_size;;-"`
+	Timeouts        *WebhookTimeoutConf `json:"timeouts" assign:"timeouts;;"`
+}
+
+type WebhookTimeoutConf struct {
+	Request         *JSONDuration `json:"request" assign:"request;jsonduration;"`
+	RetryBackoff    *JSONDuration `json:"retry_backoff" assign:"retry_backoff;jsonduration;"`
+	MaxRetryBackoff *JSONDuration `json:"max_retry_backoff" assign:"max_retry_backoff;jsonduration;"`
+}
+
+type CommandConf struct {
+	MaxDepth      int           `json:"max_depth" assign:"max_depth;;"`
+	TTL           *JSONDuration `json:"ttl" assign:"ttl;jsonduration;"`
+	MaxTTL        *JSONDuration `json:"max_ttl" assign:"max_ttl;jsonduration;"`
+	Retention     *JSONDuration `json:"retention" assign:"retention;jsonduration;"`
+	SweepInterval *JSONDuration `json:"sweep_interval" assign:"sweep_interval;jsonduration;-"`
+}
+
+type FanOutConf struct {
+	Parallelism    int           `json:"parallelism" assign:"parallelism;;"`
+	Timeout        *JSONDuration `json:"timeout" assign:"timeout;jsonduration;"`
+	AsyncThreshold int           `json:"async_threshold" assign:"async_threshold;;"`
+	JobRetention   *JSONDuration `json:"job_retention" assign:"job_retention;jsonduration;-"`
+}
+
+type RpcConf struct {
+	Timeout         *JSONDuration `json:"timeout" assign:"timeout;jsonduration;"`
+	MaxResponseSize int           `json:"max_response_size" assign:"max_response_size;;"`
+	MaxParamsSize   int           `json:"max_params_size" assign:"max_params_size;;"`
+	Workers         int           `json:"workers" assign:"workers;;-"`
+}
+
+type FirmwareConf struct {
+	Dir            string `json:"dir" assign:"dir;;-"`
+	MaxSize        int64  `json:"max_size" assign:"max_size;;"`
+	HaltMinDevices int    `json:"halt_min_devices" assign:"halt_min_devices;;"`
+}
+
+type MonitorConf struct {
+	Interval       *JSONDuration `json:"interval" assign:"interval;jsonduration;-"`
+	NotifyTimeout  *JSONDuration `json:"notify_timeout" assign:"notify_timeout;jsonduration;"`
+	AlertRetention *JSONDuration `json:"alert_retention" assign:"alert_retention;jsonduration;"`
+}
+
+type StreamConf struct {
+	BufferSize   int           `json:"buffer_size" assign:"buffer_size;;"`
+	Backlog      int           `json:"backlog" assign:"backlog;;-"`
+	ResumeWindow *JSONDuration `json:"resume_window" assign:"resume_window;jsonduration;-"`
+	KeepAlive    *JSONDuration `json:"keep_alive" assign:"keep_alive;jsonduration;"`
+}
+
+type ClusterConf struct {
+	Enabled       bool                `json:"enabled" assign:"enabled;;-"`
+	NodeName      string              `json:"node_name" assign:"node_name;;-"`
+	AdvertiseAddr string              `json:"advertise_addr" assign:"advertise_addr;;-"`
+	Registry      string              `json:"registry" assign:"registry;;-"`
+	Peers         string              `json:"peers" assign:"peers;;-"`
+	Secret        string              `json:"-" assign:"secret;;-"`
+	Timeouts      *ClusterTimeoutConf `json:"timeouts" assign:"timeouts;;-"`
+}
+
+type ClusterTimeoutConf struct {
+	Gossip  *JSONDuration `json:"gossip" assign:"gossip;jsonduration;-"`
+	Node    *JSONDuration `json:"node" assign:"node;jsonduration;-"`
+	Lookup  *JSONDuration `json:"lookup" assign:"lookup;jsonduration;-"`
+	Forward *JSONDuration `json:"forward" assign:"forward;jsonduration;-"`
 }
 
 type LogsConf struct {
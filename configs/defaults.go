@@ -5,6 +5,7 @@ service:
   host: localhost
   api_port: 8080
   device_port: 8081
+  mqtt_port: 0
   pid_file: /var/eywa/eywa.pid
   assets: {{ .eywa_home }}/assets
 security:
@@ -20,9 +21,15 @@ security:
     key_file:
   api_key: dRiftingcLouds
 connections:
+  idle_timeout: 90s
+  dispatch:
+    shards: 16
+    queue_size: 1024
+    overflow: block
   http:
     timeouts:
       long_polling: 600s
+      push: 10s
   websocket:
     request_queue_size: 8
     timeouts:
@@ -30,20 +37,87 @@ connections:
       read: 300s
       request: 4s
       response: 16s
+      ping: 30s
     buffer_sizes:
       read: 1024
       write: 1024
+      max_pooled: 65536
+    transport: goroutines
+    poll_workers: 4
+  mqtt:
+    max_packet_size: 65536
+    timeouts:
+      connect: 10s
+      write: 4s
+      read: 300s
 indices:
   disable: false
+  store: elasticsearch
+  store_file: /var/eywa/indices.db
   host: localhost
   port: 9200
   number_of_shards: 8
   number_of_replicas: 0
   ttl_enabled: false
   ttl: 0s
+  bulk:
+    size: 500
+    flush_interval: 1s
+    queue_size: 10000
+    spill_file: /var/eywa/indices.spill
+    max_spill_size: 104857600
 database:
   db_type: sqlite3
   db_file: /var/eywa/eywa.db
+webhooks:
+  queue_size: 256
+  max_retries: 5
+  delivery_log_size: 100
+  timeouts:
+    request: 5s
+    retry_backoff: 1s
+    max_retry_backoff: 60s
+commands:
+  max_depth: 100
+  ttl: 24h
+  max_ttl: 168h
+  retention: 168h
+  sweep_interval: 1m
+fan_out:
+  parallelism: 64
+  timeout: 10s
+  async_threshold: 1000
+  job_retention: 1h
+rpc:
+  timeout: 5s
+  max_response_size: 65536
+  max_params_size: 65536
+  workers: 16
+firmware:
+  dir: /var/eywa/firmware
+  max_size: 67108864
+  halt_min_devices: 5
+monitors:
+  interval: 30s
+  notify_timeout: 5s
+  alert_retention: 720h
+streams:
+  buffer_size: 256
+  backlog: 1024
+  resume_window: 1m
+  keep_alive: 30s
+cluster:
+  enabled: false
+  node_name:
+  advertise_addr:
+  registry: gossip
+  peers:
+  secret: cHanGeMeiNcLuSteR
+  timeouts:
+    gossip: 1s
+    node: 10s
+    lookup: 2s
+    forward: 30s
 logging:
   eywa:
     filename: /var/eywa/eywa.log
@@ -1,9 +1,16 @@
 package connections
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/google/btree"
 	. "github.com/eywa/configs"
 	. "github.com/eywa/utils"
+	"io"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -48,3 +55,219 @@ func BenchmarkNewWsConnection(b *testing.B) {
 		cm.NewWebsocketConnection(strconv.Itoa(n), &fakeWsConn{}, func(Connection, Message, error) {}, nil)
 	}
 }
+
+// A websocket that never hears from its device, like most of them.
+type idleWsConn struct {
+	fakeWsConn
+	closeOnce sync.Once
+	closech   chan struct{}
+}
+
+func (f *idleWsConn) Close() error {
+	f.closeOnce.Do(func() { close(f.closech) })
+	return nil
+}
+
+func (f *idleWsConn) NextReader() (int, io.Reader, error) {
+	<-f.closech
+	return 0, nil, io.EOF
+}
+
+func (f *idleWsConn) ReadMessage() (int, []byte, error) {
+	<-f.closech
+	return 0, nil, io.EOF
+}
+
+// Reports what an idle websocket connection costs in heap and stacks.
+func BenchmarkWsConnectionMemory(b *testing.B) {
+	SetConfig(&Conf{
+		Connections: &ConnectionsConf{
+			Websocket: &WsConnectionConf{
+				RequestQueueSize: 8,
+				Timeouts: &WsConnectionTimeoutConf{
+					Write:    &JSONDuration{2 * time.Second},
+					Read:     &JSONDuration{300 * time.Second},
+					Request:  &JSONDuration{1 * time.Second},
+					Response: &JSONDuration{2 * time.Second},
+				},
+				BufferSizes: &WsConnectionBufferSizeConf{
+					Write: 1024,
+					Read:  1024,
+				},
+			},
+		},
+	})
+
+	const conns = 10000
+	var used uint64
+	for n := 0; n < b.N; n++ {
+		cm, _ := NewConnectionManager("default")
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for i := 0; i < conns; i++ {
+			cm.NewWebsocketConnection(strconv.Itoa(i), &idleWsConn{closech: make(chan struct{})}, func(Connection, Message, error) {}, nil)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		used += (after.HeapAlloc + after.StackInuse) - (before.HeapAlloc + before.StackInuse)
+
+		CloseConnectionManager("default")
+	}
+	b.ReportMetric(float64(used)/float64(b.N*conns), "bytes/conn")
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	frame := bytes.Repeat([]byte("1|id|upload"), 100)
+	for _, maxPooled := range []int{0, 65536} {
+		SetConfig(&Conf{
+			Connections: &ConnectionsConf{
+				Websocket: &WsConnectionConf{
+					BufferSizes: &WsConnectionBufferSizeConf{MaxPooled: maxPooled},
+				},
+			},
+		})
+
+		b.Run(fmt.Sprintf("max_pooled=%d", maxPooled), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				readFrame(bytes.NewReader(frame))
+			}
+		})
+	}
+}
+
+// The registry as it was before sharding, one lock around a btree, kept to
+// compare the registries under concurrent connects and lookups. Run with
+// -cpu 1,8 or so to see how they scale.
+type lockedRegistry struct {
+	sync.Mutex
+	conns *btree.BTree
+}
+
+func (r *lockedRegistry) replace(conn Connection, limit int) (Connection, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if limit > 0 && r.conns.Len() >= limit && r.conns.Get(&Lesser{id: conn.Identifier()}) == nil {
+		return nil, ConnectionLimitErr
+	}
+	old := r.conns.ReplaceOrInsert(conn.(btree.Item))
+	notifyRegistered("bench", conn.Identifier())
+	if old != nil {
+		return old.(Connection), nil
+	}
+	return nil, nil
+}
+
+func (r *lockedRegistry) get(id string) (Connection, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if it := r.conns.Get(&Lesser{id: id}); it != nil {
+		return it.(Connection), true
+	}
+	return nil, false
+}
+
+func (r *lockedRegistry) remove(conn Connection) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.conns.Delete(&Lesser{id: conn.Identifier()}) == nil {
+		return false
+	}
+	notifyUnregistered("bench", conn.Identifier())
+	return true
+}
+
+type benchRegistry interface {
+	replace(Connection, int) (Connection, error)
+	get(string) (Connection, bool)
+	remove(Connection) bool
+}
+
+func benchRegistries(b *testing.B, bench func(*testing.B, benchRegistry)) {
+	b.Run("locked", func(b *testing.B) {
+		bench(b, &lockedRegistry{conns: btree.New(degree)})
+	})
+	b.Run("sharded", func(b *testing.B) {
+		bench(b, newConnectionRegistry("bench"))
+	})
+}
+
+// Devices connecting and disconnecting from many goroutines at once, as in a
+// reconnect storm.
+func BenchmarkRegistryConnect(b *testing.B) {
+	benchRegistries(b, func(b *testing.B, r benchRegistry) {
+		var next int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				conn := &Lesser{id: strconv.FormatInt(atomic.AddInt64(&next, 1), 10)}
+				r.replace(conn, 0)
+				r.remove(conn)
+			}
+		})
+	})
+}
+
+func BenchmarkRegistryLookup(b *testing.B) {
+	benchRegistries(b, func(b *testing.B, r benchRegistry) {
+		size := 100000
+		for i := 0; i < size; i++ {
+			r.replace(&Lesser{id: strconv.Itoa(i)}, 0)
+		}
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				r.get(strconv.Itoa(i * 7919 % size))
+				i += 1
+			}
+		})
+	})
+}
+
+// Lookups with one in ten devices reconnecting.
+func BenchmarkRegistryConnectAndLookup(b *testing.B) {
+	benchRegistries(b, func(b *testing.B, r benchRegistry) {
+		size := 100000
+		for i := 0; i < size; i++ {
+			r.replace(&Lesser{id: strconv.Itoa(i)}, 0)
+		}
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				id := strconv.Itoa(i * 7919 % size)
+				if i%10 == 0 {
+					r.replace(&Lesser{id: id}, 0)
+				} else {
+					r.get(id)
+				}
+				i += 1
+			}
+		})
+	})
+}
+
+func BenchmarkParallelFindConnection(b *testing.B) {
+	cm, _ := NewConnectionManager("default")
+	defer CloseConnectionManager("default")
+
+	size := 100000
+	for i := 0; i < size; i++ {
+		cm.conns.replace(&Lesser{id: strconv.Itoa(i)}, 0)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cm.FindConnection(strconv.Itoa(i * 7919 % size))
+			i += 1
+		}
+	})
+}
@@ -6,7 +6,7 @@ import (
 	"time"
 )
 
-var SupportedConnectionTypes = []string{"websocket", "http"}
+var SupportedConnectionTypes = []string{"websocket", "http", "mqtt"}
 
 type Connection interface {
 	Identifier() string
@@ -32,6 +32,25 @@ type Requester interface {
 	Request([]byte, time.Duration) ([]byte, error)
 }
 
+// Responder is a connection that answers the calls of its device, the
+// answer is correlated with the call by its message id.
+type Responder interface {
+	Respond(id string, answer []byte, err error) error
+}
+
+// Settler is a connection whose client waits for its message to go through
+// the message handlers, the end of the chain tells it the error the message
+// ended up with.
+type Settler interface {
+	Settle(m Message, e error)
+}
+
+// Pinger is a connection the server keeps alive with its own pings.
+type Pinger interface {
+	Ping() error
+	RoundTripTime() time.Duration
+}
+
 // dummy struct to help find real connection in the btree
 type Lesser struct {
 	id string
@@ -2,53 +2,139 @@ package connections
 
 import (
 	"errors"
-	"github.com/google/btree"
+	"fmt"
 	"github.com/gorilla/websocket"
 	. "github.com/eywa/configs"
 	"github.com/eywa/pubsub"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var closedCMErr = errors.New("connection manager is closed")
+var ConnectionLimitErr = errors.New("connection limit is reached")
 var degree = 32
 
+// connections pinged at once by the keepalive
+const pingParallelism = 32
+
 type ConnectionManager struct {
-	id     string
-	closed bool
-	conns  *btree.BTree
-	sync.Mutex
+	// Number of connections rejected because of the limit.
+	rejected int64
+	// Max number of registered connections, 0 means unlimited.
+	limit int64
+	// Connections not heard from for this long are closed by the reaper, 0
+	// means the configured idle timeout.
+	idleTimeout int64
+	closed      int32
+
+	id    string
+	conns *connectionRegistry
+	// Closed to stop the keepalive loop.
+	closech chan struct{}
+	// Runs the message handlers of the connections in order.
+	dispatcher *dispatcher
+	// Registrations share it, closing takes it alone, so that no connection
+	// registers once the connections to close are collected.
+	lifecycle sync.RWMutex
 }
 
 func (cm *ConnectionManager) Id() string { return cm.id }
 
-func (cm *ConnectionManager) NewWebsocketConnection(id string, ws wsConn, h MessageHandler, meta map[string]string) (*WebsocketConnection, error) {
-	p := pubsub.NewBasicPublisher(
-		strings.Replace(cm.id, "/", "-", -1) + "/" +
-			strings.Replace(id, "/", "-", -1))
+func (cm *ConnectionManager) SetConnectionLimit(limit int) {
+	atomic.StoreInt64(&cm.limit, int64(limit))
+}
 
-	conn := &WebsocketConnection{
-		cm:             cm,
-		ws:             ws,
-		identifier:     id,
-		createdAt:      time.Now(),
-		lastPingedAt:   time.Now(),
-		h:              h,
-		metadata:       meta,
-		BasicPublisher: p,
+func (cm *ConnectionManager) ConnectionLimit() int {
+	return int(atomic.LoadInt64(&cm.limit))
+}
 
-		wch: make(chan *websocketMessageReq, Config().Connections.Websocket.RequestQueueSize),
-		msgChans: &syncRespChanMap{
-			m: make(map[string]chan *websocketMessageResp),
-		},
+func (cm *ConnectionManager) SetIdleTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&cm.idleTimeout, int64(timeout))
+}
+
+func (cm *ConnectionManager) IdleTimeout() time.Duration {
+	if timeout := time.Duration(atomic.LoadInt64(&cm.idleTimeout)); timeout > 0 {
+		return timeout
+	}
+	_, idle := keepaliveConf()
+	return idle
+}
+
+func (cm *ConnectionManager) DispatcherStats() *DispatcherStats {
+	return cm.dispatcher.stats()
+}
+
+// Hands a message over to the handler of its connection. Connects and
+// disconnects are published to the presence streams first.
+func (cm *ConnectionManager) dispatch(h MessageHandler, c Connection, m Message, err error) {
+	if m != nil && (m.Type() == TypeConnectMessage || m.Type() == TypeDisconnectMessage) {
+		publishPresence(cm.id, c, m)
+	}
+	cm.dispatcher.dispatch(h, c, m, err)
+}
+
+func (cm *ConnectionManager) Rejected() int64 {
+	return atomic.LoadInt64(&cm.rejected)
+}
+
+// Admit checks if a new connection with the given id can be registered
+// without going over the connection limit. It is meant to be called by
+// handlers before upgrading the request, so that the client gets a proper
+// http error. The same check is done again when the connection registers.
+func (cm *ConnectionManager) Admit(id string) error {
+	if cm.Closed() {
+		return closedCMErr
+	}
+
+	// a device reconnecting with an id that is already registered replaces
+	// the old connection, so it is always admitted
+	if limit := cm.ConnectionLimit(); limit > 0 && cm.conns.len() >= limit {
+		if _, found := cm.conns.get(id); !found {
+			atomic.AddInt64(&cm.rejected, 1)
+			return ConnectionLimitErr
+		}
+	}
+	return nil
+}
+
+// Registers a connection, replacing the one registered with the same id,
+// which is returned.
+func (cm *ConnectionManager) register(conn Connection) (Connection, error) {
+	cm.lifecycle.RLock()
+	defer cm.lifecycle.RUnlock()
+
+	if cm.Closed() {
+		return nil, closedCMErr
+	}
+
+	old, err := cm.conns.replace(conn, cm.ConnectionLimit())
+	if err == ConnectionLimitErr {
+		atomic.AddInt64(&cm.rejected, 1)
+	}
+	return old, err
+}
+
+func (cm *ConnectionManager) NewWebsocketConnection(id string, ws wsConn, h MessageHandler, meta map[string]string) (*WebsocketConnection, error) {
+	conn := &WebsocketConnection{
+		cm:           cm,
+		ws:           ws,
+		identifier:   id,
+		createdAt:    time.Now(),
+		lastPingedAt: time.Now().UnixNano(),
+		h:            h,
+		metadata:     meta,
+		encoding:     WebsocketSubprotocols[ws.Subprotocol()],
+
+		wch:      make(chan *websocketMessageReq, Config().Connections.Websocket.RequestQueueSize),
 		closewch: make(chan bool, 1),
 		rch:      make(chan struct{}),
 	}
 
 	ws.SetPingHandler(func(payload string) error {
-		conn.lastPingedAt = time.Now()
+		conn.pinged(time.Now())
 		//extend the read deadline after each ping
 		err := ws.SetReadDeadline(time.Now().Add(Config().Connections.Websocket.Timeouts.Read.Duration))
 		if err != nil {
@@ -60,25 +146,91 @@ func (cm *ConnectionManager) NewWebsocketConnection(id string, ws wsConn, h Mess
 			[]byte(strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)),
 			time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
 	})
+	ws.SetPongHandler(conn.handlePong)
 
-	cm.Lock()
-
-	if cm.closed {
-		cm.Unlock()
+	_conn, err := cm.register(conn)
+	if err == closedCMErr {
 		ws.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
 		ws.Close()
-		return nil, closedCMErr
+		return nil, err
+	} else if err != nil {
+		ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()),
+			time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
+		ws.Close()
+		return nil, err
 	}
 
-	_conn := cm.conns.ReplaceOrInsert(conn)
+	if _conn != nil {
+		go _conn.close(false)
+	}
 
-	cm.Unlock()
+	conn.start()
+
+	return conn, nil
+}
 
-	if _conn != nil  {
-		go _conn.(Connection).close(false)
+// Makes the websocket connection of the configured transport. The sockets
+// the poller can't read, like tls ones, keep the goroutines.
+func (cm *ConnectionManager) NewWebsocket(id string, ws wsConn, h MessageHandler, meta map[string]string) (Connection, error) {
+	if transport, _ := wsTransportConf(); transport == WsTransportEpoll {
+		if _, err := websocketPoller(); err == nil {
+			if _, ok := pollableConn(ws); ok {
+				return cm.NewPolledWebsocketConnection(id, ws, h, meta)
+			}
+		}
+	}
+	return cm.NewWebsocketConnection(id, ws, h, meta)
+}
+
+func (cm *ConnectionManager) NewPolledWebsocketConnection(id string, ws wsConn, h MessageHandler, meta map[string]string) (*PolledWebsocketConnection, error) {
+	poller, err := websocketPoller()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, ok := pollableConn(ws)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("websocket connection of %s can't be polled", id))
+	}
+
+	conn := &PolledWebsocketConnection{
+		cm:           cm,
+		ws:           ws,
+		raw:          raw,
+		identifier:   id,
+		createdAt:    time.Now(),
+		lastPingedAt: time.Now().UnixNano(),
+		h:            h,
+		metadata:     meta,
+		encoding:     WebsocketSubprotocols[ws.Subprotocol()],
 	}
 
+	_conn, err := cm.register(conn)
+	if err == closedCMErr {
+		ws.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
+		ws.Close()
+		return nil, err
+	} else if err != nil {
+		ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()),
+			time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
+		ws.Close()
+		return nil, err
+	}
+
+	if _conn != nil {
+		go _conn.close(false)
+	}
+
+	// the connect message goes before anything the poller reads
 	conn.start()
+	if err = poller.add(conn); err != nil {
+		conn.close(true)
+		return nil, err
+	}
 
 	return conn, nil
 }
@@ -96,72 +248,123 @@ func (cm *ConnectionManager) NewHttpConnection(id string, httpConn *httpConn, h
 		createdAt:      time.Now(),
 		cm:             cm,
 		BasicPublisher: p,
+		settled:        make(chan error, 1),
+	}
+	if httpConn._type == HttpCall {
+		conn.answers = make(chan *httpAnswer, 1)
+	}
+
+	if httpConn._type == HttpPoll {
+		if err := cm.Admit(id); err != nil {
+			httpConn.close()
+			return nil, err
+		}
 	}
 
 	conn.start()
 
-	if httpConn._type == HttpPush {
+	if httpConn._type == HttpPush || httpConn._type == HttpCall {
 		conn.close(false)
 		return conn, nil
 	}
 
-	cm.Lock()
-	if cm.closed {
-		cm.Unlock()
+	_conn, err := cm.register(conn)
+	if err != nil {
 		conn.close(false)
-		return nil, closedCMErr
+		return nil, err
+	}
+
+	if _conn != nil {
+		go _conn.close(false)
 	}
 
-	_conn := cm.conns.ReplaceOrInsert(conn)
-	cm.Unlock()
+	return conn, nil
+}
+
+func (cm *ConnectionManager) NewMqttConnection(id string, mqttConn *mqttConn, h MessageHandler, meta map[string]string) (*MqttConnection, error) {
+	p := pubsub.NewBasicPublisher(
+		strings.Replace(cm.id, "/", "-", -1) + "/" +
+			strings.Replace(id, "/", "-", -1))
+
+	conn := &MqttConnection{
+		cm:             cm,
+		conn:           mqttConn,
+		identifier:     id,
+		createdAt:      time.Now(),
+		lastPingedAt:   time.Now().UnixNano(),
+		h:              h,
+		metadata:       meta,
+		BasicPublisher: p,
+
+		topicPrefix: fmt.Sprintf("channels/%s/devices/%s/", cm.id, id),
+		subs:        &mqttSubscriptions{filters: make([]string, 0)},
+		msgChans: &syncMqttRespChanMap{
+			m: make(map[string]chan *mqttMessage),
+		},
+	}
+
+	_conn, err := cm.register(conn)
+	if err != nil {
+		mqttConn.Refuse(MqttRefusedServerUnavailable)
+		return nil, err
+	}
 
 	if _conn != nil {
-		go _conn.(Connection).close(false)
+		go _conn.close(false)
 	}
 
+	conn.start()
+
 	return conn, nil
 }
 
 func (cm *ConnectionManager) FindConnection(id string) (Connection, bool) {
-	cm.Lock()
-	defer cm.Unlock()
+	return cm.conns.get(id)
+}
 
-	_conn := cm.conns.Get(&Lesser{id: id})
-	if _conn == nil {
-		return nil, false
+// Kick closes the connection of a device the same way it would be closed when
+// the device goes away. Returns false if the device is not connected.
+func (cm *ConnectionManager) Kick(id string) bool {
+	conn, found := cm.FindConnection(id)
+	if !found {
+		return false
 	}
 
-	return _conn.(Connection), true
+	conn.close(true)
+	return true
 }
 
-func (cm *ConnectionManager) Count() int {
-	cm.Lock()
-	defer cm.Unlock()
+// Filter returns the connections that fn picks, in the order of their ids.
+func (cm *ConnectionManager) Filter(fn func(Connection) bool) []Connection {
+	conns := make([]Connection, 0)
+	for _, conn := range cm.conns.all() {
+		if fn(conn) {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
 
-	return cm.conns.Len()
+func (cm *ConnectionManager) Count() int {
+	return cm.conns.len()
 }
 
 func (cm *ConnectionManager) close() error {
-	cm.Lock()
+	cm.lifecycle.Lock()
 
-	if cm.closed {
-		cm.Unlock()
+	if cm.Closed() {
+		cm.lifecycle.Unlock()
 		return nil
 	}
 
-	cm.closed = true
+	atomic.StoreInt32(&cm.closed, 1)
+	close(cm.closech)
 
 	var wg sync.WaitGroup
-	conns := make([]Connection, cm.conns.Len())
-	i := 0
-	cm.conns.Ascend(func(it btree.Item) bool {
-		conns[i] = it.(Connection)
-		i += 1
-		return true
-	})
+	conns := cm.conns.all()
 	wg.Add(len(conns))
 
-	cm.Unlock()
+	cm.lifecycle.Unlock()
 
 	for _, conn := range conns {
 		go func(c Connection) {
@@ -172,53 +375,106 @@ func (cm *ConnectionManager) close() error {
 	}
 
 	wg.Wait()
+	cm.dispatcher.close()
 
 	return nil
 }
 
 func (cm *ConnectionManager) unregister(c Connection) {
-	cm.Lock()
-	defer cm.Unlock()
-
-	cm.conns.Delete(&Lesser{id: c.Identifier()})
+	cm.conns.remove(c)
 }
 
 func (cm *ConnectionManager) Closed() bool {
-	return cm.closed
+	return atomic.LoadInt32(&cm.closed) == 1
 }
 
+// At most size connections with ids after lastId, in the order of their ids.
 func (cm *ConnectionManager) Scan(lastId string, size int) []Connection {
-	cm.Lock()
-	defer cm.Unlock()
+	return cm.conns.scan(lastId, size)
+}
 
-	conns := make([]Connection, 0)
-	if len(lastId) == 0 {
-		i := 0
-		cm.conns.Ascend(func(it btree.Item) bool {
-			i += 1
-			if i > size {
-				return false
+// The ping interval and the default idle timeout, zero when they are not
+// configured.
+func keepaliveConf() (ping time.Duration, idle time.Duration) {
+	cfg := Config()
+	if cfg == nil || cfg.Connections == nil {
+		return
+	}
+
+	if cfg.Connections.IdleTimeout != nil {
+		idle = cfg.Connections.IdleTimeout.Duration
+	}
+	if ws := cfg.Connections.Websocket; ws != nil && ws.Timeouts != nil && ws.Timeouts.Ping != nil {
+		ping = ws.Timeouts.Ping.Duration
+	}
+	return
+}
+
+// Pings the websocket connections and reaps the idle ones, on every ping
+// interval. The settings are read on each round so config updates apply.
+func (cm *ConnectionManager) keepalive() {
+	for {
+		interval, _ := keepaliveConf()
+		if interval <= 0 {
+			interval = time.Minute
+		}
+
+		select {
+		case <-cm.closech:
+			return
+		case <-time.After(interval):
+			if ping, _ := keepaliveConf(); ping > 0 {
+				cm.ping()
 			}
+			cm.reap(time.Now())
+		}
+	}
+}
+
+// Pings the connections a few at a time, so that a slow peer only holds up
+// its own ping until the write timeout.
+func (cm *ConnectionManager) ping() {
+	conns := cm.Filter(func(c Connection) bool {
+		_, ok := c.(Pinger)
+		return ok
+	})
 
-			conns = append(conns, it.(Connection))
-			return true
-		})
-	} else {
-		i := 0
-		cm.conns.AscendGreaterOrEqual(&Lesser{id: lastId}, func(it btree.Item) bool {
-			conn := it.(Connection)
-			if conn.Identifier() == lastId {
-				return true
-			} else {
-				i += 1
-				if i > size {
-					return false
-				}
-				conns = append(conns, conn)
-				return true
+	sem := make(chan struct{}, pingParallelism)
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(c Connection) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := c.(Pinger).Ping(); err != nil {
+				c.close(true)
 			}
-		})
+		}(conn)
 	}
+	wg.Wait()
+}
 
-	return conns
+// Closes the connections not heard from within the idle timeout. Only the
+// connections the server pings are reaped, http connections come and go with
+// their requests and mqtt clients ping on their own keep alive interval.
+func (cm *ConnectionManager) reap(now time.Time) int {
+	idle := cm.IdleTimeout()
+	if idle <= 0 {
+		return 0
+	}
+
+	conns := cm.Filter(func(c Connection) bool {
+		if _, ok := c.(Pinger); !ok {
+			return false
+		}
+		return now.Sub(c.LastPingedAt()) > idle
+	})
+
+	for _, conn := range conns {
+		conn.close(true)
+	}
+	return len(conns)
 }
@@ -1,11 +1,17 @@
 package connections
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/websocket"
 	. "github.com/smartystreets/goconvey/convey"
 	. "github.com/eywa/configs"
 	. "github.com/eywa/utils"
+	"io"
 	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -94,6 +100,149 @@ func TestConnectionManager(t *testing.T) {
 		So(ok, ShouldBeFalse)
 	})
 
+	Convey("rejects new connections over the connection limit.", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+		cm.SetConnectionLimit(2)
+
+		_, err := cm.NewWebsocketConnection("conn1", &fakeWsConn{}, h, meta)
+		So(err, ShouldBeNil)
+		_, err = cm.NewWebsocketConnection("conn2", &fakeWsConn{}, h, meta)
+		So(err, ShouldBeNil)
+		So(cm.Count(), ShouldEqual, 2)
+
+		So(cm.Admit("conn3"), ShouldEqual, ConnectionLimitErr)
+		ws := &fakeWsConn{}
+		_, err = cm.NewWebsocketConnection("conn3", ws, h, meta)
+		So(err, ShouldEqual, ConnectionLimitErr)
+		So(ws.closed, ShouldBeTrue)
+
+		ch := make(chan []byte, 1)
+		poll := &httpConn{
+			_type: HttpPoll,
+			ch:    ch,
+			body:  []byte("poll message"),
+		}
+		_, err = cm.NewHttpConnection("conn4", poll, func(Connection, Message, error) {}, nil)
+		So(err, ShouldEqual, ConnectionLimitErr)
+		_, ok := <-ch
+		So(ok, ShouldBeFalse)
+		So(cm.Count(), ShouldEqual, 2)
+		So(cm.Rejected(), ShouldEqual, 3)
+
+		// reconnecting with a registered id replaces the old connection
+		So(cm.Admit("conn1"), ShouldBeNil)
+		_, err = cm.NewWebsocketConnection("conn1", &fakeWsConn{}, h, meta)
+		So(err, ShouldBeNil)
+		So(cm.Count(), ShouldEqual, 2)
+
+		// raising the limit admits new connections again
+		cm.SetConnectionLimit(3)
+		_, err = cm.NewWebsocketConnection("conn3", &fakeWsConn{}, h, meta)
+		So(err, ShouldBeNil)
+		So(cm.Count(), ShouldEqual, 3)
+	})
+
+	Convey("kicks connected devices.", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		conn, _ := cm.NewWebsocketConnection("conn1", &fakeWsConn{}, h, meta)
+		So(cm.Kick("conn1"), ShouldBeTrue)
+		So(conn.Closed(), ShouldBeTrue)
+		So(cm.Count(), ShouldEqual, 0)
+		So(cm.Kick("conn1"), ShouldBeFalse)
+	})
+
+	Convey("pings connections and reaps the idle ones.", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		conn1, _ := cm.NewWebsocketConnection("conn1", &fakeWsConn{}, h, meta)
+		conn2, _ := cm.NewWebsocketConnection("conn2", &fakeWsConn{}, h, meta)
+		So(conn1.Ping(), ShouldBeNil)
+
+		sent := time.Now().Add(-20 * time.Millisecond).UnixNano()
+		So(conn1.handlePong(strconv.FormatInt(sent, 10)), ShouldBeNil)
+		So(conn1.RoundTripTime(), ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+		So(conn2.RoundTripTime(), ShouldEqual, 0)
+
+		cm.SetIdleTimeout(time.Minute)
+		So(cm.reap(time.Now()), ShouldEqual, 0)
+
+		conn2.pinged(time.Now().Add(-2 * time.Minute))
+		So(cm.reap(time.Now()), ShouldEqual, 1)
+		So(conn2.Closed(), ShouldBeTrue)
+		So(conn1.Closed(), ShouldBeFalse)
+		So(cm.Count(), ShouldEqual, 1)
+	})
+
+	Convey("pings slow peers alongside the others.", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		for i := 0; i < 2*pingParallelism; i++ {
+			cm.NewWebsocketConnection(fmt.Sprintf("conn%d", i), &fakeWsConn{controlSleepTime: 50 * time.Millisecond}, h, meta)
+		}
+
+		start := time.Now()
+		cm.ping()
+		So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+		So(cm.Count(), ShouldEqual, 2*pingParallelism)
+	})
+
+	Convey("notifies the listener outside of the registry locks.", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		l := &lookupListener{cm: cm}
+		SetConnectionListener(l)
+		defer SetConnectionListener(nil)
+
+		done := make(chan struct{})
+		go func() {
+			conn, _ := cm.NewWebsocketConnection("conn1", &fakeWsConn{}, h, meta)
+			conn.close(true)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+
+		So(l.seen, ShouldResemble, []string{"registered conn1 true", "unregistered conn1 false"})
+	})
+
+	Convey("dispatches the connect message before anything the connection reads.", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+		cm.SetConnectionLimit(50)
+
+		var m sync.Mutex
+		seen := make(map[string][]MessageType)
+		h := func(c Connection, msg Message, e error) {
+			if msg != nil {
+				m.Lock()
+				seen[c.Identifier()] = append(seen[c.Identifier()], msg.Type())
+				m.Unlock()
+			}
+		}
+
+		for i := 0; i < 20; i++ {
+			cm.NewWebsocketConnection("conn"+strconv.Itoa(i), &eagerWsConn{fakeWsConn: fakeWsConn{uploaded: true}}, h, meta)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		m.Lock()
+		defer m.Unlock()
+		So(len(seen), ShouldEqual, 20)
+		for _, types := range seen {
+			So(len(types), ShouldBeGreaterThanOrEqualTo, 2)
+			So(types[0], ShouldEqual, TypeConnectMessage)
+			So(types[1], ShouldEqual, TypeUploadMessage)
+		}
+	})
+
 	Convey("test scan connections", t, func() {
 		cm, _ := NewConnectionManager("default")
 		defer CloseConnectionManager("default")
@@ -163,3 +312,37 @@ func TestConnectionManager(t *testing.T) {
 
 	})
 }
+
+// Looks the device up in the connection manager it is told about.
+type lookupListener struct {
+	cm   *ConnectionManager
+	seen []string
+	sync.Mutex
+}
+
+func (l *lookupListener) Registered(cmId, id string) {
+	_, found := l.cm.FindConnection(id)
+	l.Lock()
+	l.seen = append(l.seen, fmt.Sprintf("registered %s %t", id, found))
+	l.Unlock()
+}
+
+func (l *lookupListener) Unregistered(cmId, id string) {
+	_, found := l.cm.FindConnection(id)
+	l.Lock()
+	l.seen = append(l.seen, fmt.Sprintf("unregistered %s %t", id, found))
+	l.Unlock()
+}
+
+// Has an upload to read as soon as the connection starts.
+type eagerWsConn struct {
+	fakeWsConn
+	reads int32
+}
+
+func (f *eagerWsConn) NextReader() (int, io.Reader, error) {
+	if atomic.AddInt32(&f.reads, 1) == 1 {
+		return websocket.BinaryMessage, bytes.NewReader([]byte(fmt.Sprintf("%d|1|upload", TypeUploadMessage))), nil
+	}
+	return f.fakeWsConn.NextReader()
+}
@@ -0,0 +1,177 @@
+package connections
+
+import (
+	"github.com/google/btree"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var connectionShards = 64
+
+type connectionShard struct {
+	sync.RWMutex
+	conns map[string]Connection
+	// ordered by id, only walked by scans
+	index *btree.BTree
+	// keeps the listener notifications of the shard in order, it is taken
+	// before the shard is unlocked so the listener runs without the shard
+	notifyLock sync.Mutex
+}
+
+// Unlocks the shard, then tells the listener about the change.
+func (s *connectionShard) unlockAndNotify(notify func()) {
+	s.notifyLock.Lock()
+	s.Unlock()
+	defer s.notifyLock.Unlock()
+	notify()
+}
+
+// connectionRegistry keeps the connections of a connection manager in shards picked by
+// the hash of their ids. Registrations and lookups only lock the shard of the
+// id, the count is kept atomically and scans merge the ordered indices of the
+// shards.
+type connectionRegistry struct {
+	cmId   string
+	count  int64
+	shards []*connectionShard
+}
+
+func newConnectionRegistry(cmId string) *connectionRegistry {
+	r := &connectionRegistry{
+		cmId:   cmId,
+		shards: make([]*connectionShard, connectionShards),
+	}
+	for i := range r.shards {
+		r.shards[i] = &connectionShard{
+			conns: make(map[string]Connection),
+			index: btree.New(degree),
+		}
+	}
+	return r
+}
+
+// fnv-1a of the id, inlined to keep lookups free of allocations
+func (r *connectionRegistry) shard(id string) *connectionShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return r.shards[h%uint32(len(r.shards))]
+}
+
+func (r *connectionRegistry) len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+func (r *connectionRegistry) get(id string) (Connection, bool) {
+	s := r.shard(id)
+	s.RLock()
+	defer s.RUnlock()
+
+	conn, found := s.conns[id]
+	return conn, found
+}
+
+// Takes room for one more connection, unless limit connections are already
+// registered. A limit of 0 means unlimited.
+func (r *connectionRegistry) reserve(limit int) bool {
+	for {
+		n := atomic.LoadInt64(&r.count)
+		if limit > 0 && n >= int64(limit) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&r.count, n, n+1) {
+			return true
+		}
+	}
+}
+
+// Registers a connection and returns the one it replaces. A device
+// reconnecting with an id that is already registered replaces the old
+// connection, so it is always admitted.
+func (r *connectionRegistry) replace(conn Connection, limit int) (Connection, error) {
+	id := conn.Identifier()
+	s := r.shard(id)
+	s.Lock()
+
+	old, found := s.conns[id]
+	if !found && !r.reserve(limit) {
+		s.Unlock()
+		return nil, ConnectionLimitErr
+	}
+
+	s.conns[id] = conn
+	s.index.ReplaceOrInsert(conn.(btree.Item))
+	s.unlockAndNotify(func() { notifyRegistered(r.cmId, id) })
+	return old, nil
+}
+
+// Unregisters a connection, unless it has been replaced already.
+func (r *connectionRegistry) remove(conn Connection) bool {
+	id := conn.Identifier()
+	s := r.shard(id)
+	s.Lock()
+
+	if current, found := s.conns[id]; !found || current != conn {
+		s.Unlock()
+		return false
+	}
+
+	delete(s.conns, id)
+	s.index.Delete(conn.(btree.Item))
+	atomic.AddInt64(&r.count, -1)
+	s.unlockAndNotify(func() { notifyUnregistered(r.cmId, id) })
+	return true
+}
+
+// At most size connections with ids after lastId, in the order of their ids.
+func (r *connectionRegistry) scan(lastId string, size int) []Connection {
+	conns := make([]Connection, 0)
+	if size <= 0 {
+		return conns
+	}
+
+	for _, s := range r.shards {
+		s.RLock()
+		n := 0
+		s.index.AscendGreaterOrEqual(&Lesser{id: lastId}, func(it btree.Item) bool {
+			conn := it.(Connection)
+			if len(lastId) > 0 && conn.Identifier() == lastId {
+				return true
+			}
+			conns = append(conns, conn)
+			n += 1
+			return n < size
+		})
+		s.RUnlock()
+	}
+
+	sortConnections(conns)
+	if len(conns) > size {
+		conns = conns[:size]
+	}
+	return conns
+}
+
+// All the connections in the order of their ids.
+func (r *connectionRegistry) all() []Connection {
+	conns := make([]Connection, 0, r.len())
+	for _, s := range r.shards {
+		s.RLock()
+		for _, conn := range s.conns {
+			conns = append(conns, conn)
+		}
+		s.RUnlock()
+	}
+
+	sortConnections(conns)
+	return conns
+}
+
+func sortConnections(conns []Connection) {
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Identifier() < conns[j].Identifier()
+	})
+}
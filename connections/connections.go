@@ -3,7 +3,6 @@ package connections
 import (
 	"errors"
 	"fmt"
-	"github.com/google/btree"
 	"github.com/gorilla/websocket"
 	. "github.com/eywa/configs"
 	"io/ioutil"
@@ -17,6 +16,9 @@ var connManagers = make(map[string]*ConnectionManager)
 
 var serverClosedErr = errors.New("server closed")
 
+var listenerLock sync.RWMutex
+var listener ConnectionListener
+
 var WsUp *websocket.Upgrader
 var HttpUp *HttpUpgrader
 
@@ -39,6 +41,12 @@ func (u *HttpUpgrader) Upgrade(w http.ResponseWriter, r *http.Request, _type Htt
 			ch:    make(chan []byte, 1),
 			body:  body,
 		}, nil
+	} else if _type == HttpCall {
+		// the method comes from ?call=, the body is the params
+		return &httpConn{
+			_type: HttpCall,
+			body:  append([]byte(r.URL.Query().Get("call")+"|"), body...),
+		}, nil
 	} else {
 		return nil, errors.New(fmt.Sprintf("unsupported http connection type %d", _type))
 	}
@@ -48,9 +56,11 @@ func InitWsUpgraders() {
 	WsUp = &websocket.Upgrader{
 		ReadBufferSize:  Config().Connections.Websocket.BufferSizes.Read,
 		WriteBufferSize: Config().Connections.Websocket.BufferSizes.Write,
+		Subprotocols:    []string{SubprotocolCbor, SubprotocolMsgpack},
 	}
 
 	HttpUp = &HttpUpgrader{}
+	MqttUp = &MqttUpgrader{}
 }
 
 func InitializeCMs(ids []string) error {
@@ -85,7 +95,12 @@ func CloseCMs() {
 }
 
 func NewConnectionManager(id string) (*ConnectionManager, error) {
-	cm := &ConnectionManager{id: id, conns: btree.New(degree)}
+	cm := &ConnectionManager{
+		id:         id,
+		conns:      newConnectionRegistry(id),
+		closech:    make(chan struct{}),
+		dispatcher: newDispatcher(),
+	}
 
 	cmLock.Lock()
 	defer cmLock.Unlock()
@@ -99,6 +114,7 @@ func NewConnectionManager(id string) (*ConnectionManager, error) {
 	}
 
 	connManagers[id] = cm
+	go cm.keepalive()
 	return cm, nil
 }
 
@@ -127,7 +143,7 @@ func Counts() (map[string]int, int) {
 	counts := make(map[string]int)
 	for id, cm := range cms {
 		counts[id] = cm.Count()
-		total += cm.Count()
+		total += counts[id]
 	}
 
 	return counts, total
@@ -139,3 +155,34 @@ func FindConnectionManager(id string) (*ConnectionManager, bool) {
 	cm, found := connManagers[id]
 	return cm, found
 }
+
+// ConnectionListener gets notified when devices register on or unregister
+// from this node. It is called after the shard of the device is unlocked,
+// under a lock that keeps the notifications of a shard in order. Lookups are
+// fine, but it must neither block nor register or unregister connections.
+type ConnectionListener interface {
+	Registered(cmId, id string)
+	Unregistered(cmId, id string)
+}
+
+func SetConnectionListener(l ConnectionListener) {
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+	listener = l
+}
+
+func notifyRegistered(cmId, id string) {
+	listenerLock.RLock()
+	defer listenerLock.RUnlock()
+	if listener != nil {
+		listener.Registered(cmId, id)
+	}
+}
+
+func notifyUnregistered(cmId, id string) {
+	listenerLock.RLock()
+	defer listenerLock.RUnlock()
+	if listener != nil {
+		listener.Unregistered(cmId, id)
+	}
+}
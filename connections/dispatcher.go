@@ -0,0 +1,299 @@
+package connections
+
+import (
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/loggers"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happens to a message that finds the queue of its shard full. The
+// connect and disconnect messages are queued whatever the policy, even past
+// the size of the queue, so they are never dropped and a handler closing a
+// connection of its own full shard doesn't deadlock it.
+const (
+	// the connection waits for room in the queue, a message waiting longer
+	// than dispatchStallTimeout is dropped
+	OverflowBlock = "block"
+	// the oldest queued message of the shard is dropped
+	OverflowDropOldest = "drop_oldest"
+	// the message is dropped and the connection is closed
+	OverflowClose = "close"
+)
+
+var SupportedOverflowPolicies = []string{OverflowBlock, OverflowDropOldest, OverflowClose}
+
+type dispatchJob struct {
+	h        MessageHandler
+	c        Connection
+	m        Message
+	err      error
+	queuedAt time.Time
+}
+
+// The connect and disconnect messages keep the history of a connection
+// complete, they are never held back, evicted or dropped.
+func (job *dispatchJob) lifecycle() bool {
+	return job.m != nil && (job.m.Type() == TypeConnectMessage || job.m.Type() == TypeDisconnectMessage)
+}
+
+// How long a message waits for room in a full shard before it is dropped.
+// The wait only ends this way when the shard is stuck, most likely because
+// one of its handlers dispatches into it. Connect and disconnect messages
+// never wait.
+var dispatchStallTimeout = 10 * time.Second
+
+// dispatchShard is the queue of one worker. The waiting messages are woken
+// up through the room channel, which is closed and replaced every time a
+// message leaves the queue.
+type dispatchShard struct {
+	sync.Mutex
+	jobs     []*dispatchJob
+	size     int
+	closed   bool
+	notEmpty *sync.Cond
+	room     chan struct{}
+}
+
+func newDispatchShard(size int) *dispatchShard {
+	s := &dispatchShard{size: size, room: make(chan struct{})}
+	s.notEmpty = sync.NewCond(s)
+	return s
+}
+
+// Takes the next message of the queue, waiting for one when it is empty.
+// False is returned once the shard is closed and drained.
+func (s *dispatchShard) pop() (*dispatchJob, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for len(s.jobs) == 0 && !s.closed {
+		s.notEmpty.Wait()
+	}
+	if len(s.jobs) == 0 {
+		return nil, false
+	}
+	job := s.jobs[0]
+	s.jobs[0] = nil
+	s.jobs = s.jobs[1:]
+	s.makeRoom()
+	return job, true
+}
+
+// Evicts the oldest message which isn't a connect or a disconnect.
+func (s *dispatchShard) evict() bool {
+	for i, job := range s.jobs {
+		if !job.lifecycle() {
+			s.jobs = append(s.jobs[:i], s.jobs[i+1:]...)
+			s.makeRoom()
+			return true
+		}
+	}
+	return false
+}
+
+func (s *dispatchShard) makeRoom() {
+	close(s.room)
+	s.room = make(chan struct{})
+}
+
+func (s *dispatchShard) push(job *dispatchJob) {
+	s.jobs = append(s.jobs, job)
+	s.notEmpty.Signal()
+}
+
+func (s *dispatchShard) queued() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.jobs)
+}
+
+func (s *dispatchShard) close() {
+	s.Lock()
+	s.closed = true
+	s.makeRoom()
+	s.notEmpty.Broadcast()
+	s.Unlock()
+}
+
+// dispatcher runs the message handlers of a connection manager on a fixed
+// number of shards. The messages of a connection always go to the same
+// shard, so the handlers see them in the order they arrived.
+type dispatcher struct {
+	shards []*dispatchShard
+	policy string
+	wg     sync.WaitGroup
+
+	dispatched int64
+	dropped    int64
+	closed     int64
+	stalled    int64
+	lagTotal   int64
+	lagMax     int64
+}
+
+type DispatcherStats struct {
+	Shards     int     `json:"shards"`
+	Queued     int     `json:"queued"`
+	Dispatched int64   `json:"dispatched"`
+	Dropped    int64   `json:"dropped"`
+	Closed     int64   `json:"closed"`
+	Stalled    int64   `json:"stalled"`
+	AvgLag     float64 `json:"avg_lag"`
+	MaxLag     float64 `json:"max_lag"`
+}
+
+// The dispatch settings, falling back to a single shard without a bound when
+// they are not configured.
+func dispatchConf() (shards int, queueSize int, policy string) {
+	shards, queueSize, policy = 1, 1024, OverflowBlock
+	cfg := Config()
+	if cfg == nil || cfg.Connections == nil || cfg.Connections.Dispatch == nil {
+		return
+	}
+
+	conf := cfg.Connections.Dispatch
+	if conf.Shards > 0 {
+		shards = conf.Shards
+	}
+	if conf.QueueSize > 0 {
+		queueSize = conf.QueueSize
+	}
+	for _, p := range SupportedOverflowPolicies {
+		if p == conf.Overflow {
+			policy = p
+		}
+	}
+	return
+}
+
+func newDispatcher() *dispatcher {
+	shards, queueSize, policy := dispatchConf()
+	d := &dispatcher{
+		shards: make([]*dispatchShard, shards),
+		policy: policy,
+	}
+	for i := range d.shards {
+		d.shards[i] = newDispatchShard(queueSize)
+		d.wg.Add(1)
+		go d.work(d.shards[i])
+	}
+	return d
+}
+
+func (d *dispatcher) work(shard *dispatchShard) {
+	defer d.wg.Done()
+	for {
+		job, ok := shard.pop()
+		if !ok {
+			return
+		}
+
+		lag := int64(time.Since(job.queuedAt))
+		atomic.AddInt64(&d.lagTotal, lag)
+		for {
+			max := atomic.LoadInt64(&d.lagMax)
+			if lag <= max || atomic.CompareAndSwapInt64(&d.lagMax, max, lag) {
+				break
+			}
+		}
+
+		job.h(job.c, job.m, job.err)
+		atomic.AddInt64(&d.dispatched, 1)
+	}
+}
+
+func (d *dispatcher) shard(c Connection) *dispatchShard {
+	f := fnv.New32a()
+	f.Write([]byte(c.Identifier()))
+	return d.shards[f.Sum32()%uint32(len(d.shards))]
+}
+
+// Queues a message for the handler of its connection. The connect and
+// disconnect messages are queued right away, past the size of a full queue,
+// so that the history of a connection stays complete. Under the block policy
+// a message which waits longer than dispatchStallTimeout is dropped and
+// logged as an error instead of blocking its shard forever, which happens
+// when a handler dispatches into its own full shard.
+func (d *dispatcher) dispatch(h MessageHandler, c Connection, m Message, err error) {
+	job := &dispatchJob{h: h, c: c, m: m, err: err, queuedAt: time.Now()}
+	shard := d.shard(c)
+
+	var stall <-chan time.Time
+	shard.Lock()
+	for {
+		if shard.closed {
+			shard.Unlock()
+			go h(c, m, err)
+			return
+		}
+		if len(shard.jobs) < shard.size || job.lifecycle() {
+			shard.push(job)
+			shard.Unlock()
+			return
+		}
+
+		switch d.policy {
+		case OverflowDropOldest:
+			if shard.evict() {
+				atomic.AddInt64(&d.dropped, 1)
+				continue
+			}
+		case OverflowClose:
+			shard.Unlock()
+			atomic.AddInt64(&d.dropped, 1)
+			atomic.AddInt64(&d.closed, 1)
+			go c.close(true)
+			return
+		}
+
+		// wait for room, the lock is released so that the worker and the
+		// other connections of the shard go on
+		if stall == nil {
+			timer := time.NewTimer(dispatchStallTimeout)
+			defer timer.Stop()
+			stall = timer.C
+		}
+		room := shard.room
+		shard.Unlock()
+		select {
+		case <-room:
+		case <-stall:
+			atomic.AddInt64(&d.dropped, 1)
+			atomic.AddInt64(&d.stalled, 1)
+			if Logger != nil {
+				Logger.Error(fmt.Sprintf("dispatcher shard of connection %s is stuck for %s, message is dropped, a message handler may be dispatching into its own shard", c.Identifier(), dispatchStallTimeout))
+			}
+			return
+		}
+		shard.Lock()
+	}
+}
+
+// Stops taking messages and waits for the queued ones to be handled.
+func (d *dispatcher) close() {
+	for _, shard := range d.shards {
+		shard.close()
+	}
+	d.wg.Wait()
+}
+
+func (d *dispatcher) stats() *DispatcherStats {
+	s := &DispatcherStats{
+		Shards:     len(d.shards),
+		Dispatched: atomic.LoadInt64(&d.dispatched),
+		Dropped:    atomic.LoadInt64(&d.dropped),
+		Closed:     atomic.LoadInt64(&d.closed),
+		Stalled:    atomic.LoadInt64(&d.stalled),
+		MaxLag:     float64(atomic.LoadInt64(&d.lagMax)) / float64(time.Millisecond),
+	}
+	for _, shard := range d.shards {
+		s.Queued += shard.queued()
+	}
+	if s.Dispatched > 0 {
+		s.AvgLag = float64(atomic.LoadInt64(&d.lagTotal)) / float64(s.Dispatched) / float64(time.Millisecond)
+	}
+	return s
+}
@@ -0,0 +1,196 @@
+package connections
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type closingConn struct {
+	Lesser
+	closed int32
+}
+
+func (c *closingConn) close(bool) error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	defer SetConfig(Config())
+
+	dispatchConf := func(shards, queueSize int, overflow string) {
+		SetConfig(&Conf{
+			Connections: &ConnectionsConf{
+				Dispatch: &DispatchConf{
+					Shards:    shards,
+					QueueSize: queueSize,
+					Overflow:  overflow,
+				},
+			},
+		})
+	}
+
+	upload := &websocketMessage{_type: TypeUploadMessage}
+
+	Convey("runs the handlers of a connection in order.", t, func() {
+		dispatchConf(4, 16, OverflowBlock)
+		d := newDispatcher()
+
+		var m sync.Mutex
+		seen := make(map[string][]int)
+		for i := 0; i < 100; i++ {
+			c := &Lesser{id: "conn" + strconv.Itoa(i%5)}
+			n := i
+			d.dispatch(func(c Connection, _ Message, _ error) {
+				m.Lock()
+				seen[c.Identifier()] = append(seen[c.Identifier()], n)
+				m.Unlock()
+			}, c, upload, nil)
+		}
+		d.close()
+
+		So(len(seen), ShouldEqual, 5)
+		for _, ns := range seen {
+			So(len(ns), ShouldEqual, 20)
+			for i := 1; i < len(ns); i++ {
+				So(ns[i], ShouldBeGreaterThan, ns[i-1])
+			}
+		}
+		So(d.stats().Dispatched, ShouldEqual, 100)
+		So(d.stats().Queued, ShouldEqual, 0)
+	})
+
+	Convey("drops the oldest messages when the queue is full.", t, func() {
+		dispatchConf(1, 2, OverflowDropOldest)
+		d := newDispatcher()
+
+		block := make(chan struct{})
+		var handled []string
+		h := func(c Connection, m Message, _ error) {
+			<-block
+			handled = append(handled, string(m.Payload()))
+		}
+
+		c := &Lesser{id: "conn"}
+		for i := 0; i < 5; i++ {
+			d.dispatch(h, c, &websocketMessage{_type: TypeUploadMessage, payload: []byte(strconv.Itoa(i))}, nil)
+			// let the worker pick up the first message
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(block)
+		d.close()
+
+		So(handled, ShouldResemble, []string{"0", "3", "4"})
+		So(d.stats().Dropped, ShouldEqual, 2)
+	})
+
+	Convey("keeps the connect and disconnect messages when dropping the oldest.", t, func() {
+		dispatchConf(1, 2, OverflowDropOldest)
+		d := newDispatcher()
+
+		block := make(chan struct{})
+		var handled []string
+		h := func(c Connection, m Message, _ error) {
+			<-block
+			handled = append(handled, m.TypeString()+string(m.Payload()))
+		}
+
+		c := &Lesser{id: "conn"}
+		d.dispatch(h, c, upload, nil)
+		time.Sleep(10 * time.Millisecond)
+		d.dispatch(h, c, &websocketMessage{_type: TypeConnectMessage}, nil)
+		for i := 0; i < 3; i++ {
+			d.dispatch(h, c, &websocketMessage{_type: TypeUploadMessage, payload: []byte(strconv.Itoa(i))}, nil)
+		}
+		close(block)
+		d.close()
+
+		So(handled, ShouldResemble, []string{"upload", "connect", "upload2"})
+		So(d.stats().Dropped, ShouldEqual, 2)
+	})
+
+	Convey("queues the connect and disconnect messages past a full queue.", t, func() {
+		dispatchConf(1, 1, OverflowClose)
+		d := newDispatcher()
+
+		block := make(chan struct{})
+		var handled []string
+		h := func(c Connection, m Message, _ error) {
+			<-block
+			handled = append(handled, m.TypeString())
+		}
+
+		c := &closingConn{Lesser: Lesser{id: "conn"}}
+		d.dispatch(h, c, upload, nil)
+		time.Sleep(10 * time.Millisecond)
+		d.dispatch(h, c, &websocketMessage{_type: TypeConnectMessage}, nil)
+		d.dispatch(h, c, &websocketMessage{_type: TypeDisconnectMessage}, nil)
+		So(d.stats().Queued, ShouldEqual, 2)
+		So(atomic.LoadInt32(&c.closed), ShouldEqual, 0)
+
+		close(block)
+		d.close()
+		So(handled, ShouldResemble, []string{"upload", "connect", "disconnect"})
+		So(d.stats().Dropped, ShouldEqual, 0)
+	})
+
+	Convey("drops the message of a handler dispatching into its own full shard.", t, func() {
+		defer func(timeout time.Duration) { dispatchStallTimeout = timeout }(dispatchStallTimeout)
+		dispatchStallTimeout = 50 * time.Millisecond
+
+		dispatchConf(1, 1, OverflowBlock)
+		d := newDispatcher()
+
+		c := &Lesser{id: "conn"}
+		var handled int32
+		noop := func(Connection, Message, error) { atomic.AddInt32(&handled, 1) }
+		d.dispatch(func(c Connection, m Message, err error) {
+			d.dispatch(noop, c, upload, nil)
+			d.dispatch(noop, c, upload, nil)
+			// the disconnect message doesn't wait for room
+			d.dispatch(noop, c, &websocketMessage{_type: TypeDisconnectMessage}, nil)
+		}, c, upload, nil)
+		time.Sleep(100 * time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			d.close()
+			close(done)
+		}()
+		closed := false
+		select {
+		case <-done:
+			closed = true
+		case <-time.After(time.Second):
+		}
+
+		So(closed, ShouldBeTrue)
+		So(atomic.LoadInt32(&handled), ShouldEqual, 2)
+		So(d.stats().Stalled, ShouldEqual, 1)
+	})
+
+	Convey("closes the connection when the queue is full.", t, func() {
+		dispatchConf(1, 1, OverflowClose)
+		d := newDispatcher()
+
+		block := make(chan struct{})
+		h := func(Connection, Message, error) { <-block }
+
+		c := &closingConn{Lesser: Lesser{id: "conn"}}
+		for i := 0; i < 3; i++ {
+			d.dispatch(h, c, upload, nil)
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		So(atomic.LoadInt32(&c.closed), ShouldEqual, 1)
+		So(d.stats().Closed, ShouldEqual, 1)
+
+		close(block)
+		d.close()
+	})
+}
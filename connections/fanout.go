@@ -0,0 +1,244 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+const (
+	FanOutRunning = "running"
+	FanOutDone    = "done"
+)
+
+var fanOutNotAllowedErr = errors.New("connection is not allowed to take the message")
+
+// FanOutResult is the outcome of a fan-out on one device. Response is only
+// set for requests. Node is set for the devices of the other nodes of the
+// cluster, a node that couldn't be reached gets a result without device.
+type FanOutResult struct {
+	DeviceId string `json:"device_id"`
+	Node     string `json:"node,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+// FanOutJob sends or requests the same message to many connections. Results
+// are collected as the devices answer, so a running job can be polled.
+type FanOutJob struct {
+	Id         string          `json:"id"`
+	Status     string          `json:"status"`
+	Total      int             `json:"total"`
+	Succeeded  int             `json:"succeeded"`
+	Failed     int             `json:"failed"`
+	Results    []*FanOutResult `json:"results"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt time.Time       `json:"finished_at"`
+
+	done chan struct{}
+	sync.Mutex
+}
+
+// Fan-out jobs are kept in memory for polling until the retention passes.
+var fanOutJobs = &fanOutJobMap{jobs: make(map[string]*FanOutJob)}
+
+type fanOutJobMap struct {
+	sync.Mutex
+	jobs map[string]*FanOutJob
+}
+
+func (m *fanOutJobMap) put(job *FanOutJob, retention time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	// finished jobs past the retention are dropped on the way
+	for id, j := range m.jobs {
+		j.Lock()
+		expired := j.Status == FanOutDone && time.Since(j.FinishedAt) > retention
+		j.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+	m.jobs[job.Id] = job
+}
+
+func FindFanOutJob(id string) (*FanOutJob, bool) {
+	fanOutJobs.Lock()
+	defer fanOutJobs.Unlock()
+
+	job, found := fanOutJobs.jobs[id]
+	return job, found
+}
+
+// FanOutOp is run on each connection of a fan-out, it is given the time left
+// before the fan-out gives up on the connection and should return by then.
+type FanOutOp func(Connection, time.Duration) ([]byte, error)
+
+// FanOutRemote runs the fan-out on another node and returns its job.
+type FanOutRemote func() (*FanOutJob, error)
+
+// FanOut runs op on every connection, at most parallelism of them at a time,
+// giving up on a connection after timeout. The remotes are run alongside, one
+// per node, and their results are added to the job. The job is returned right
+// away, Wait blocks until every connection and node is done.
+func FanOut(conns []Connection, parallelism int, timeout time.Duration, retention time.Duration, op FanOutOp, remotes map[string]FanOutRemote) *FanOutJob {
+	job := &FanOutJob{
+		Id:        uuid.NewV4().String(),
+		Status:    FanOutRunning,
+		Total:     len(conns),
+		Results:   make([]*FanOutResult, 0, len(conns)),
+		CreatedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	fanOutJobs.put(job, retention)
+
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	go func() {
+		var wg sync.WaitGroup
+		for node, remote := range remotes {
+			wg.Add(1)
+			go func(node string, remote FanOutRemote) {
+				defer wg.Done()
+				rjob, err := remote()
+				job.merge(node, rjob, err)
+			}(node, remote)
+		}
+
+		sem := make(chan struct{}, parallelism)
+		for _, conn := range conns {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(c Connection) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				resp, err := fanOutWithTimeout(c, timeout, op)
+				job.add(c.Identifier(), resp, err)
+			}(conn)
+		}
+		wg.Wait()
+
+		job.Lock()
+		job.Status = FanOutDone
+		job.FinishedAt = time.Now()
+		job.Unlock()
+		close(job.done)
+	}()
+
+	return job
+}
+
+// The connection counts as failed once the timeout passes, but its slot is
+// only given back when op returns, so that slow devices never run more than
+// parallelism operations at a time.
+func fanOutWithTimeout(c Connection, timeout time.Duration, op FanOutOp) ([]byte, error) {
+	if timeout <= 0 {
+		return op(c, timeout)
+	}
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	ch := make(chan *result, 1)
+	go func() {
+		resp, err := op(c, timeout)
+		ch <- &result{resp: resp, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.resp, r.err
+	case <-timer.C:
+		<-ch
+		return nil, errors.New(fmt.Sprintf("timed out after %s", timeout))
+	}
+}
+
+func (j *FanOutJob) add(deviceId string, resp []byte, err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	r := &FanOutResult{DeviceId: deviceId}
+	if err != nil {
+		r.Error = err.Error()
+		j.Failed += 1
+	} else {
+		r.Response = string(resp)
+		j.Succeeded += 1
+	}
+	j.Results = append(j.Results, r)
+}
+
+// Adds the results of the job of another node.
+func (j *FanOutJob) merge(node string, remote *FanOutJob, err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	// an unreachable node counts as one failed target
+	if err != nil {
+		j.Total += 1
+		j.Failed += 1
+		j.Results = append(j.Results, &FanOutResult{Node: node, Error: err.Error()})
+		return
+	}
+
+	j.Total += remote.Total
+	j.Succeeded += remote.Succeeded
+	j.Failed += remote.Failed
+	for _, r := range remote.Results {
+		r.Node = node
+		j.Results = append(j.Results, r)
+	}
+}
+
+func (j *FanOutJob) Wait() {
+	<-j.done
+}
+
+// Snapshot of the job that is safe to render while it is still running.
+func (j *FanOutJob) Copy() *FanOutJob {
+	j.Lock()
+	defer j.Unlock()
+
+	return &FanOutJob{
+		Id:         j.Id,
+		Status:     j.Status,
+		Total:      j.Total,
+		Succeeded:  j.Succeeded,
+		Failed:     j.Failed,
+		Results:    append([]*FanOutResult{}, j.Results...),
+		CreatedAt:  j.CreatedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+// Fan-out operations for the Sender and Requester connections.
+func FanOutSender(msg []byte) FanOutOp {
+	return func(c Connection, _ time.Duration) ([]byte, error) {
+		sender, ok := c.(Sender)
+		if !ok {
+			return nil, fanOutNotAllowedErr
+		}
+		return nil, sender.Send(msg)
+	}
+}
+
+func FanOutRequester(msg []byte) FanOutOp {
+	return func(c Connection, timeout time.Duration) ([]byte, error) {
+		requester, ok := c.(Requester)
+		if !ok {
+			return nil, fanOutNotAllowedErr
+		}
+		return requester.Request(msg, timeout)
+	}
+}
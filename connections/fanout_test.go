@@ -0,0 +1,153 @@
+package connections
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	SetConfig(&Conf{
+		Connections: &ConnectionsConf{
+			Websocket: &WsConnectionConf{
+				RequestQueueSize: 8,
+				Timeouts: &WsConnectionTimeoutConf{
+					Write:    &JSONDuration{2 * time.Second},
+					Read:     &JSONDuration{300 * time.Second},
+					Request:  &JSONDuration{1 * time.Second},
+					Response: &JSONDuration{2 * time.Second},
+				},
+				BufferSizes: &WsConnectionBufferSizeConf{
+					Write: 1024,
+					Read:  1024,
+				},
+			},
+		},
+	})
+
+	conns := []Connection{}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		conns = append(conns, &Lesser{id: id})
+	}
+
+	Convey("runs the operation on every connection within the parallelism.", t, func() {
+		var running, maxRunning int32
+		op := func(c Connection, _ time.Duration) ([]byte, error) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+
+			if c.Identifier() == "c" {
+				return nil, errors.New("failed")
+			}
+			return []byte("resp " + c.Identifier()), nil
+		}
+
+		job := FanOut(conns, 2, time.Second, time.Hour, op, nil)
+		job.Wait()
+
+		So(maxRunning, ShouldEqual, 2)
+		So(job.Status, ShouldEqual, FanOutDone)
+		So(job.Total, ShouldEqual, 5)
+		So(job.Succeeded, ShouldEqual, 4)
+		So(job.Failed, ShouldEqual, 1)
+
+		results := job.Copy().Results
+		sort.Sort(fanOutResultsById(results))
+		So(results[0].Response, ShouldEqual, "resp a")
+		So(results[2].Error, ShouldEqual, "failed")
+
+		found, ok := FindFanOutJob(job.Id)
+		So(ok, ShouldBeTrue)
+		So(found, ShouldEqual, job)
+	})
+
+	Convey("gives up on slow connections.", t, func() {
+		var given time.Duration
+		var slowDone int32
+		op := func(c Connection, timeout time.Duration) ([]byte, error) {
+			if c.Identifier() == "a" {
+				given = timeout
+				time.Sleep(200 * time.Millisecond)
+				atomic.StoreInt32(&slowDone, 1)
+			}
+			return nil, nil
+		}
+
+		job := FanOut(conns, 5, 50*time.Millisecond, 0, op, nil)
+		job.Wait()
+		So(job.Succeeded, ShouldEqual, 4)
+		So(job.Failed, ShouldEqual, 1)
+		So(given, ShouldEqual, 50*time.Millisecond)
+		// the slot of the slow connection is held until it returns
+		So(atomic.LoadInt32(&slowDone), ShouldEqual, 1)
+
+		// finished jobs past the retention are dropped by the next job
+		FanOut(nil, 1, 0, 0, op, nil).Wait()
+		_, ok := FindFanOutJob(job.Id)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("adds the results of the other nodes.", t, func() {
+		op := func(c Connection, _ time.Duration) ([]byte, error) { return nil, nil }
+		remotes := map[string]FanOutRemote{
+			"node2": func() (*FanOutJob, error) {
+				return &FanOutJob{
+					Total:     2,
+					Succeeded: 1,
+					Failed:    1,
+					Results: []*FanOutResult{
+						&FanOutResult{DeviceId: "x"},
+						&FanOutResult{DeviceId: "y", Error: "failed"},
+					},
+				}, nil
+			},
+			"node3": func() (*FanOutJob, error) { return nil, errors.New("unreachable") },
+		}
+
+		job := FanOut(conns[:1], 1, time.Second, time.Hour, op, remotes)
+		job.Wait()
+		So(job.Total, ShouldEqual, 4)
+		So(job.Succeeded, ShouldEqual, 2)
+		So(job.Failed, ShouldEqual, 2)
+
+		results := job.Copy().Results
+		sort.Sort(fanOutResultsById(results))
+		So(results[0].Node, ShouldEqual, "node3")
+		So(results[0].Error, ShouldEqual, "unreachable")
+		So(results[1].DeviceId, ShouldEqual, "a")
+		So(results[1].Node, ShouldEqual, "")
+		So(results[2].Node, ShouldEqual, "node2")
+	})
+
+	Convey("filters connections of a connection manager.", t, func() {
+		cm, _ := NewConnectionManager("fanout")
+		defer CloseConnectionManager("fanout")
+
+		h := func(c Connection, m Message, e error) {}
+		cm.NewWebsocketConnection("ws1", &fakeWsConn{}, h, map[string]string{"site": "sf"})
+		cm.NewWebsocketConnection("ws2", &fakeWsConn{}, h, map[string]string{"site": "nyc"})
+
+		conns := cm.Filter(func(c Connection) bool { return c.Metadata()["site"] == "sf" })
+		So(len(conns), ShouldEqual, 1)
+		So(conns[0].Identifier(), ShouldEqual, "ws1")
+		So(len(cm.Filter(func(Connection) bool { return true })), ShouldEqual, 2)
+	})
+}
+
+type fanOutResultsById []*FanOutResult
+
+func (rs fanOutResultsById) Len() int           { return len(rs) }
+func (rs fanOutResultsById) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs fanOutResultsById) Less(i, j int) bool { return rs[i].DeviceId < rs[j].DeviceId }
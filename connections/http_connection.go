@@ -16,14 +16,27 @@ type HttpConnectionType uint8
 const (
 	HttpPush HttpConnectionType = iota
 	HttpPoll
+	// a call of the device, answered in the response
+	HttpCall
 )
 
 var HttpConnectionTypes = map[HttpConnectionType]string{
 	HttpPush: "http push",
 	HttpPoll: "http poll",
+	HttpCall: "http call",
 }
 
 var httpPollClosedErr = errors.New("http poll connection is closed")
+var httpNotCallErr = errors.New("only http call connection answers calls")
+
+// Nothing came out of the message handlers in time, the message could have
+// been dropped by a full dispatcher.
+var HttpSettleTimeoutErr = errors.New("message was not handled in time")
+
+type httpAnswer struct {
+	answer []byte
+	err    error
+}
 
 type httpConn struct {
 	_type HttpConnectionType
@@ -63,6 +76,13 @@ type HttpConnection struct {
 	closeOnce  sync.Once
 	*pubsub.BasicPublisher
 
+	// the message the request carries and the error it ended up with once
+	// handled, a call is answered on its own channel
+	message Message
+	settled chan error
+	answers chan *httpAnswer
+	indexed int
+
 	cm *ConnectionManager
 }
 
@@ -80,6 +100,8 @@ func (c *HttpConnection) LastPingedAt() time.Time { return c.createdAt }
 
 func (c *HttpConnection) ConnectionManager() *ConnectionManager { return c.cm }
 
+func (c *HttpConnection) Body() []byte { return c.httpConn.read() }
+
 func (c *HttpConnection) Less(than btree.Item) bool {
 	conn := than.(Connection)
 	return strings.Compare(c.identifier, conn.Identifier()) < 0
@@ -114,10 +136,79 @@ func (c *HttpConnection) Send(msg []byte) error {
 	if err == nil {
 		err = c.httpConn.write(p)
 	}
-	go c.h(c, m, err)
+	c.cm.dispatch(c.h, c, m, err)
 	return err
 }
 
+// Answers the call of an http call connection.
+func (c *HttpConnection) Respond(id string, answer []byte, err error) error {
+	if c.httpConn._type != HttpCall {
+		return httpNotCallErr
+	}
+
+	select {
+	case c.answers <- &httpAnswer{answer: answer, err: err}:
+	default:
+	}
+	return nil
+}
+
+func (c *HttpConnection) Settle(m Message, e error) {
+	if m == nil || m != c.message {
+		return
+	}
+
+	select {
+	case c.settled <- e:
+	default:
+	}
+}
+
+// Takes the number of points the upload of the request is indexed as.
+func (c *HttpConnection) Indexed(m Message, n int) {
+	if m == c.message {
+		c.indexed = n
+	}
+}
+
+// Number of points the upload of the request is indexed as, known once it is
+// settled.
+func (c *HttpConnection) IndexedPoints() int { return c.indexed }
+
+// Waits for the message of the request to go through the message handlers,
+// returning the error it ended up with.
+func (c *HttpConnection) Settled(timeout time.Duration) error {
+	select {
+	case e := <-c.settled:
+		return e
+	case <-time.After(timeout):
+		return HttpSettleTimeoutErr
+	}
+}
+
+// Waits for the answer to the call of an http call connection. A call the
+// message handlers fail before it is routed is never answered, its error is
+// returned instead.
+func (c *HttpConnection) Answer(timeout time.Duration) ([]byte, error) {
+	if c.httpConn._type != HttpCall {
+		return nil, httpNotCallErr
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case a := <-c.answers:
+			return a.answer, a.err
+		case e := <-c.settled:
+			if e != nil {
+				return nil, e
+			}
+		case <-deadline:
+			return nil, HttpSettleTimeoutErr
+		}
+	}
+}
+
 func (c *HttpConnection) unregister() {
 	// To avoid race condition where a new connection has registered
 	// under the same id and current connection become orphan, in which
@@ -138,7 +229,7 @@ func (c *HttpConnection) close(unregister bool) error {
 			c.unregister()
 		}
 		if c.httpConn._type == HttpPoll {
-			go c.h(c, &httpMessage{_type: TypeDisconnectMessage}, nil)
+			c.cm.dispatch(c.h, c, &httpMessage{_type: TypeDisconnectMessage}, nil)
 		}
 
 		go func() {
@@ -156,11 +247,13 @@ func (c *HttpConnection) ConnectionType() string {
 
 func (c *HttpConnection) start() {
 	if c.httpConn._type == HttpPoll {
-		go c.h(c, &httpMessage{_type: TypeConnectMessage}, nil)
+		c.cm.dispatch(c.h, c, &httpMessage{_type: TypeConnectMessage}, nil)
 	}
 
-	go func() {
-		m := &httpMessage{_type: TypeUploadMessage, raw: c.httpConn.read()}
-		c.h(c, m, m.Unmarshal())
-	}()
+	m := &httpMessage{_type: TypeUploadMessage, raw: c.httpConn.read()}
+	if c.httpConn._type == HttpCall {
+		m._type = TypeCallMessage
+	}
+	c.message = m
+	c.cm.dispatch(c.h, c, m, m.Unmarshal())
 }
@@ -1,6 +1,7 @@
 package connections
 
 import (
+	"errors"
 	. "github.com/smartystreets/goconvey/convey"
 	"reflect"
 	"sync"
@@ -190,4 +191,41 @@ func TestHttpConnection(t *testing.T) {
 		sentWg.Wait()
 		So(err, ShouldBeNil)
 	})
+
+	Convey("answers http calls through the message handlers", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		h := func(c Connection, m Message, e error) {
+			if m.Type() == TypeCallMessage {
+				call, _ := ParseRpcCall(c, m)
+				c.(Responder).Respond(m.Id(), call.Params, nil)
+			}
+			c.(Settler).Settle(m, e)
+		}
+		callConn, err := cm.NewHttpConnection("test", &httpConn{_type: HttpCall, body: []byte("echo|hello")}, h, nil)
+		So(err, ShouldBeNil)
+		So(cm.Count(), ShouldEqual, 0)
+
+		answer, err := callConn.Answer(time.Second)
+		So(err, ShouldBeNil)
+		So(string(answer), ShouldEqual, "hello")
+	})
+
+	Convey("fails http calls with the error the message handlers settle them with", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		dropped := errors.New("dropped")
+		h := func(c Connection, m Message, e error) {
+			c.(Settler).Settle(m, dropped)
+		}
+		callConn, _ := cm.NewHttpConnection("test", &httpConn{_type: HttpCall, body: []byte("echo|hello")}, h, nil)
+		_, err := callConn.Answer(time.Second)
+		So(err, ShouldEqual, dropped)
+
+		callConn, _ = cm.NewHttpConnection("test", &httpConn{_type: HttpCall, body: []byte("echo|hello")}, func(Connection, Message, error) {}, nil)
+		_, err = callConn.Answer(5 * time.Millisecond)
+		So(err, ShouldEqual, HttpSettleTimeoutErr)
+	})
 }
@@ -10,6 +10,7 @@ import (
 var SupportedHttpMessageTypes = map[MessageType]string{
 	TypeUploadMessage:     "upload",
 	TypeSendMessage:       "send",
+	TypeCallMessage:       "call",
 	TypeConnectMessage:    "connect",
 	TypeDisconnectMessage: "disconnect",
 }
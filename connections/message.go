@@ -7,6 +7,7 @@ const (
 	TypeRequestMessage  MessageType = 2 // downstream
 	TypeSendMessage     MessageType = 3 // downstream
 	TypeResponseMessage MessageType = 4 // upstream
+	TypeCallMessage     MessageType = 5 // upstream
 
 	// these two messages are only used for connection states internally
 	TypeConnectMessage    MessageType = 8
@@ -18,6 +19,7 @@ var SupportedMessageTypes = map[MessageType]string{
 	TypeResponseMessage:   "response",
 	TypeSendMessage:       "send",
 	TypeRequestMessage:    "request",
+	TypeCallMessage:       "call",
 	TypeConnectMessage:    "connect",
 	TypeDisconnectMessage: "disconnect",
 }
@@ -31,3 +33,14 @@ type Message interface {
 	Marshal() ([]byte, error)
 	Unmarshal() error
 }
+
+const (
+	EncodingCbor    = "cbor"
+	EncodingMsgpack = "msgpack"
+)
+
+// EncodedMessage is a message whose payload is in a binary encoding rather
+// than JSON or URL-encoded forms. An empty encoding means a text payload.
+type EncodedMessage interface {
+	Encoding() string
+}
@@ -1,6 +1,9 @@
 package connections
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -11,6 +14,15 @@ type Middleware struct {
 	handlerFunc func(MessageHandler) MessageHandler
 }
 
+// Middlewares registered by name, channels pick their message handlers from
+// here.
+var registry = &middlewareRegistry{middlewares: make(map[string]*Middleware)}
+
+type middlewareRegistry struct {
+	sync.RWMutex
+	middlewares map[string]*Middleware
+}
+
 type MiddlewareStack struct {
 	m           sync.Mutex
 	middlewares []*Middleware
@@ -100,3 +112,42 @@ func NewMiddleware(name string, h func(MessageHandler) MessageHandler) *Middlewa
 		handlerFunc: h,
 	}
 }
+
+func (m *Middleware) Name() string { return m.name }
+
+// Registers a middleware under its name, usually from an init function.
+func RegisterMiddleware(m *Middleware) error {
+	if len(m.name) == 0 {
+		return errors.New("middleware name is empty")
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, found := registry.middlewares[m.name]; found {
+		return errors.New(fmt.Sprintf("middleware %s is already registered", m.name))
+	}
+	registry.middlewares[m.name] = m
+	return nil
+}
+
+func FindMiddleware(name string) (*Middleware, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	m, found := registry.middlewares[name]
+	return m, found
+}
+
+// Names of all registered middlewares in alphabetical order.
+func RegisteredMiddlewares() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	names := make([]string, 0, len(registry.middlewares))
+	for name, _ := range registry.middlewares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -74,4 +74,20 @@ func TestMiddlewares(t *testing.T) {
 			[]string{"<m2>", "<m1>", "h", "</m1>", "</m2>"}),
 			ShouldBeTrue)
 	})
+
+	Convey("registers middlewares by name", t, func() {
+		m := NewMiddleware("registry_test", nil)
+		So(RegisterMiddleware(m), ShouldBeNil)
+		So(RegisterMiddleware(NewMiddleware("registry_test", nil)), ShouldNotBeNil)
+		So(RegisterMiddleware(NewMiddleware("", nil)), ShouldNotBeNil)
+
+		found, ok := FindMiddleware("registry_test")
+		So(ok, ShouldBeTrue)
+		So(found, ShouldEqual, m)
+		So(found.Name(), ShouldEqual, "registry_test")
+
+		_, ok = FindMiddleware("not_registered")
+		So(ok, ShouldBeFalse)
+		So(RegisteredMiddlewares(), ShouldContain, "registry_test")
+	})
 }
@@ -0,0 +1,444 @@
+package connections
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/google/btree"
+	. "github.com/eywa/configs"
+	"github.com/eywa/pubsub"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var mqttConnClosedErr = errors.New("mqtt connection is closed")
+var mqttUnexpectedMessageErr = errors.New("unexpected response message received from mqtt connection, probably due to response timeout?")
+
+var MqttUp *MqttUpgrader
+
+type MqttUpgrader struct{}
+
+// Upgrade reads the CONNECT packet from a freshly accepted socket. The
+// caller is expected to authenticate the client with the returned mqttConn
+// and either register it to a connection manager or Refuse it.
+func (u *MqttUpgrader) Upgrade(nc net.Conn) (*mqttConn, error) {
+	conn := &mqttConn{
+		nc: nc,
+		r:  bufio.NewReader(nc),
+	}
+
+	err := nc.SetReadDeadline(time.Now().Add(Config().Connections.Mqtt.Timeouts.Connect.Duration))
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	p, err := readMqttPacket(conn.r, Config().Connections.Mqtt.MaxPacketSize)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	conn.connect, err = parseMqttConnect(p)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if conn.connect.protocol != "MQTT" || conn.connect.level != 4 {
+		conn.Refuse(MqttRefusedProtocolVersion)
+		return nil, errors.New(fmt.Sprintf("unsupported mqtt protocol %s level %d", conn.connect.protocol, conn.connect.level))
+	}
+
+	return conn, nil
+}
+
+type mqttConn struct {
+	nc      net.Conn
+	r       *bufio.Reader
+	connect *mqttConnectPacket
+	sync.Mutex
+}
+
+func (c *mqttConn) ClientId() string     { return c.connect.clientId }
+func (c *mqttConn) Username() string     { return c.connect.username }
+func (c *mqttConn) Password() string     { return c.connect.password }
+func (c *mqttConn) RemoteAddr() net.Addr { return c.nc.RemoteAddr() }
+
+// Refuse the client with a CONNACK return code and close the socket.
+func (c *mqttConn) Refuse(code byte) {
+	c.write(mqttConnackPacket(code))
+	c.nc.Close()
+}
+
+func (c *mqttConn) read() (*mqttPacket, error) {
+	timeout := Config().Connections.Mqtt.Timeouts.Read.Duration
+	if c.connect.keepAlive > 0 {
+		// MQTT 3.1.1 section 3.1.2.10, one and a half times the keep alive
+		timeout = time.Duration(c.connect.keepAlive) * time.Second * 3 / 2
+	}
+
+	if err := c.nc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	return readMqttPacket(c.r, Config().Connections.Mqtt.MaxPacketSize)
+}
+
+func (c *mqttConn) write(p *mqttPacket) error {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.nc.SetWriteDeadline(time.Now().Add(Config().Connections.Mqtt.Timeouts.Write.Duration))
+	if err != nil {
+		return err
+	}
+	_, err = c.nc.Write(p.Marshal())
+	return err
+}
+
+type mqttSubscriptions struct {
+	sync.Mutex
+	filters []string
+}
+
+func (s *mqttSubscriptions) add(filter string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, f := range s.filters {
+		if f == filter {
+			return
+		}
+	}
+	s.filters = append(s.filters, filter)
+}
+
+func (s *mqttSubscriptions) remove(filter string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, f := range s.filters {
+		if f == filter {
+			s.filters = append(s.filters[:i], s.filters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *mqttSubscriptions) match(topic string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, f := range s.filters {
+		if mqttTopicMatch(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+type syncMqttRespChanMap struct {
+	sync.Mutex
+	m map[string]chan *mqttMessage
+}
+
+func (sm *syncMqttRespChanMap) put(msgId string, ch chan *mqttMessage) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.m[msgId] = ch
+}
+
+func (sm *syncMqttRespChanMap) find(msgId string) (chan *mqttMessage, bool) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	ch, found := sm.m[msgId]
+	return ch, found
+}
+
+func (sm *syncMqttRespChanMap) delete(msgId string) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	delete(sm.m, msgId)
+}
+
+type MqttConnection struct {
+	cm           *ConnectionManager
+	conn         *mqttConn
+	createdAt    time.Time
+	lastPingedAt int64 // unix nanoseconds, accessed atomically
+	closedAt     time.Time
+	identifier   string
+	h            MessageHandler
+	metadata     map[string]string
+	*pubsub.BasicPublisher
+
+	// Every topic of this device starts with
+	// "channels/<channel id>/devices/<device id>/".
+	topicPrefix string
+	subs        *mqttSubscriptions
+	msgChans    *syncMqttRespChanMap
+
+	rStart    sync.WaitGroup
+	closeOnce sync.Once
+	closed    bool
+}
+
+func (c *MqttConnection) Identifier() string { return c.identifier }
+
+func (c *MqttConnection) CreatedAt() time.Time { return c.createdAt }
+
+func (c *MqttConnection) ClosedAt() time.Time { return c.closedAt }
+
+func (c *MqttConnection) LastPingedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastPingedAt))
+}
+
+func (c *MqttConnection) Closed() bool { return c.closed }
+
+func (c *MqttConnection) Metadata() map[string]string { return c.metadata }
+
+func (c *MqttConnection) ConnectionManager() *ConnectionManager { return c.cm }
+
+func (c *MqttConnection) ConnectionType() string { return "mqtt" }
+
+func (c *MqttConnection) Less(than btree.Item) bool {
+	conn := than.(Connection)
+	return strings.Compare(c.identifier, conn.Identifier()) < 0
+}
+
+func (c *MqttConnection) Send(msg []byte) error {
+	m := &mqttMessage{
+		_type:   TypeSendMessage,
+		topic:   c.topicPrefix + mqttMessageTopics[TypeSendMessage],
+		payload: msg,
+	}
+
+	err := c.publish(m)
+	c.cm.dispatch(c.h, c, m, err)
+	return err
+}
+
+func (c *MqttConnection) Request(msg []byte, timeout time.Duration) ([]byte, error) {
+	id := strconv.FormatInt(time.Now().UnixNano(), 16)
+	m := &mqttMessage{
+		_type:   TypeRequestMessage,
+		id:      id,
+		topic:   c.topicPrefix + mqttMessageTopics[TypeRequestMessage] + "/" + id,
+		payload: msg,
+	}
+
+	respCh := make(chan *mqttMessage, 1)
+	c.msgChans.put(id, respCh)
+	defer c.msgChans.delete(id)
+
+	err := c.publish(m)
+	c.cm.dispatch(c.h, c, m, err)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	select {
+	case <-time.After(timeout):
+		return []byte{}, errors.New(fmt.Sprintf("mqtt connection response timed out for %s", timeout))
+	case resp := <-respCh:
+		return resp.payload, nil
+	}
+}
+
+func (c *MqttConnection) publish(m *mqttMessage) error {
+	if c.closed {
+		return mqttConnClosedErr
+	}
+
+	if !c.subs.match(m.topic) {
+		return errors.New(fmt.Sprintf("mqtt client is not subscribed to topic %s", m.topic))
+	}
+
+	payload, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+
+	err = c.conn.write((&mqttPublishPacket{topic: m.topic, payload: payload}).packet())
+	if err != nil {
+		c.close(true)
+	}
+	return err
+}
+
+// Translates a topic published by the device into a message.
+func (c *MqttConnection) topicMessage(pub *mqttPublishPacket) (*mqttMessage, error) {
+	if !strings.HasPrefix(pub.topic, c.topicPrefix) {
+		return nil, errors.New(fmt.Sprintf("mqtt client is not allowed to publish to topic %s", pub.topic))
+	}
+
+	suffix := pub.topic[len(c.topicPrefix):]
+	m := &mqttMessage{topic: pub.topic, payload: pub.payload}
+	if suffix == mqttMessageTopics[TypeUploadMessage] {
+		m._type = TypeUploadMessage
+	} else if strings.HasPrefix(suffix, mqttMessageTopics[TypeResponseMessage]+"/") {
+		m._type = TypeResponseMessage
+		m.id = suffix[len(mqttMessageTopics[TypeResponseMessage])+1:]
+	} else {
+		return nil, errors.New(fmt.Sprintf("unsupported mqtt topic %s", pub.topic))
+	}
+
+	return m, m.Unmarshal()
+}
+
+func (c *MqttConnection) handlePublish(p *mqttPacket) error {
+	pub, err := parseMqttPublish(p)
+	if err != nil {
+		return err
+	}
+
+	if pub.qos > 1 {
+		return errors.New("mqtt qos 2 is not supported")
+	}
+
+	if pub.qos == 1 {
+		if err = c.conn.write(mqttAckPacket(mqttPuback, pub.packetId)); err != nil {
+			return err
+		}
+	}
+
+	m, err := c.topicMessage(pub)
+	if err != nil {
+		if m != nil {
+			c.cm.dispatch(c.h, c, m, err)
+		} else {
+			c.cm.dispatch(c.h, c, nil, err)
+		}
+		return nil
+	}
+
+	if m._type == TypeResponseMessage {
+		ch, found := c.msgChans.find(m.id)
+		if found {
+			c.msgChans.delete(m.id)
+			ch <- m
+			c.cm.dispatch(c.h, c, m, nil)
+		} else {
+			c.cm.dispatch(c.h, c, m, mqttUnexpectedMessageErr)
+		}
+	} else {
+		c.cm.dispatch(c.h, c, m, nil)
+	}
+	return nil
+}
+
+func (c *MqttConnection) handleSubscribe(p *mqttPacket) error {
+	sub, err := parseMqttSubscribe(p)
+	if err != nil {
+		return err
+	}
+
+	if p._type == mqttUnsubscribe {
+		for _, f := range sub.filters {
+			c.subs.remove(f)
+		}
+		return c.conn.write(mqttAckPacket(mqttUnsuback, sub.packetId))
+	}
+
+	// devices can only subscribe to their own topics
+	codes := make([]byte, len(sub.filters))
+	for i, f := range sub.filters {
+		if strings.HasPrefix(f, c.topicPrefix) {
+			c.subs.add(f)
+			codes[i] = 0
+		} else {
+			codes[i] = mqttSubackFailure
+		}
+	}
+	return c.conn.write(mqttAckPacket(mqttSuback, sub.packetId, codes...))
+}
+
+func (c *MqttConnection) rListen() {
+	defer c.rStart.Done()
+	for {
+		p, err := c.conn.read()
+		if err != nil {
+			if !c.closed {
+				c.cm.dispatch(c.h, c, nil, errors.New(fmt.Sprintf("error reading packet from mqtt connection, %s", err.Error())))
+			}
+			c.close(true)
+			return
+		}
+
+		atomic.StoreInt64(&c.lastPingedAt, time.Now().UnixNano())
+
+		switch p._type {
+		case mqttPublish:
+			err = c.handlePublish(p)
+		case mqttSubscribe, mqttUnsubscribe:
+			err = c.handleSubscribe(p)
+		case mqttPingreq:
+			err = c.conn.write(&mqttPacket{_type: mqttPingresp})
+		case mqttPuback:
+			// nothing is published with qos 1
+		case mqttDisconnect:
+			c.close(true)
+			return
+		default:
+			err = errors.New(fmt.Sprintf("unexpected mqtt packet type %d", p._type))
+		}
+
+		if err != nil {
+			c.cm.dispatch(c.h, c, nil, err)
+			c.close(true)
+			return
+		}
+	}
+}
+
+func (c *MqttConnection) unregister() {
+	// To avoid race condition where a new connection has registered
+	// under the same id and current connection become orphan, in which
+	// case the orphan connection has different creatd time with the
+	// registered connection
+	conn, found := c.cm.FindConnection(c.identifier)
+	if found && conn.CreatedAt() == c.createdAt {
+		c.cm.unregister(c)
+	}
+}
+
+func (c *MqttConnection) close(unregister bool) error {
+	c.closeOnce.Do(func() {
+		c.closed = true
+		c.closedAt = time.Now()
+		c.conn.nc.Close()
+		if unregister {
+			c.unregister()
+		}
+		c.cm.dispatch(c.h, c, &mqttMessage{_type: TypeDisconnectMessage}, nil)
+		go func() {
+			time.Sleep(3 * time.Second) // for user experience
+			c.BasicPublisher.Unpublish()
+		}()
+	})
+	return nil
+}
+
+func (c *MqttConnection) wait() {
+	c.rStart.Wait()
+}
+
+func (c *MqttConnection) start() {
+	err := c.conn.write(mqttConnackPacket(MqttAccepted))
+	if err != nil {
+		c.close(true)
+		return
+	}
+
+	c.rStart.Add(1)
+	// the connect message goes before anything the read loop reads
+	c.cm.dispatch(c.h, c, &mqttMessage{_type: TypeConnectMessage}, nil)
+	go c.rListen()
+}
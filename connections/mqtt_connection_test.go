@@ -0,0 +1,219 @@
+package connections
+
+import (
+	"bufio"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMqttClient struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func (f *fakeMqttClient) write(p *mqttPacket) error {
+	_, err := f.nc.Write(p.Marshal())
+	return err
+}
+
+func (f *fakeMqttClient) read() (*mqttPacket, error) {
+	f.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return readMqttPacket(f.r, 0)
+}
+
+func mqttConnectBody(clientId, username, password string) []byte {
+	body := appendMqttString([]byte{}, "MQTT")
+	body = append(body, 4, 0xc2, 0, 60)
+	body = appendMqttString(body, clientId)
+	body = appendMqttString(body, username)
+	return appendMqttString(body, password)
+}
+
+func TestMqttPacket(t *testing.T) {
+
+	Convey("marshals/reads packets with multi-byte remaining length", t, func() {
+		pub := &mqttPublishPacket{topic: "a/b", qos: 1, packetId: 7, payload: make([]byte, 300)}
+		client, server := net.Pipe()
+		go client.Write(pub.packet().Marshal())
+
+		p, err := readMqttPacket(bufio.NewReader(server), 0)
+		So(err, ShouldBeNil)
+		So(p._type, ShouldEqual, mqttPublish)
+		_pub, err := parseMqttPublish(p)
+		So(err, ShouldBeNil)
+		So(_pub.topic, ShouldEqual, "a/b")
+		So(_pub.qos, ShouldEqual, 1)
+		So(_pub.packetId, ShouldEqual, 7)
+		So(len(_pub.payload), ShouldEqual, 300)
+	})
+
+	Convey("parses CONNECT packets", t, func() {
+		c, err := parseMqttConnect(&mqttPacket{_type: mqttConnect, body: mqttConnectBody("dev", "ch", "token")})
+		So(err, ShouldBeNil)
+		So(c.protocol, ShouldEqual, "MQTT")
+		So(c.level, ShouldEqual, 4)
+		So(c.keepAlive, ShouldEqual, 60)
+		So(c.clientId, ShouldEqual, "dev")
+		So(c.username, ShouldEqual, "ch")
+		So(c.password, ShouldEqual, "token")
+
+		_, err = parseMqttConnect(&mqttPacket{_type: mqttConnect, body: []byte{0, 4, 'M'}})
+		So(err, ShouldEqual, mqttMalformedPacketErr)
+	})
+
+	Convey("matches topics with wildcards", t, func() {
+		So(mqttTopicMatch("a/b/c", "a/b/c"), ShouldBeTrue)
+		So(mqttTopicMatch("a/b/c", "a/b/d"), ShouldBeFalse)
+		So(mqttTopicMatch("a/+/c", "a/b/c"), ShouldBeTrue)
+		So(mqttTopicMatch("a/+", "a/b/c"), ShouldBeFalse)
+		So(mqttTopicMatch("a/#", "a/b/c"), ShouldBeTrue)
+		So(mqttTopicMatch("a/#", "a"), ShouldBeTrue)
+		So(mqttTopicMatch("a/b/request/+", "a/b/request/123"), ShouldBeTrue)
+		So(mqttTopicMatch("a/b", "a/b/c"), ShouldBeFalse)
+	})
+}
+
+func TestMqttConnection(t *testing.T) {
+
+	SetConfig(&Conf{
+		Connections: &ConnectionsConf{
+			Mqtt: &MqttConnectionConf{
+				MaxPacketSize: 65536,
+				Timeouts: &MqttConnectionTimeoutConf{
+					Connect: &JSONDuration{2 * time.Second},
+					Write:   &JSONDuration{2 * time.Second},
+					Read:    &JSONDuration{300 * time.Second},
+				},
+			},
+		},
+	})
+
+	Convey("registers mqtt connections and maps topics to messages", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		client, server := net.Pipe()
+		cli := &fakeMqttClient{nc: client, r: bufio.NewReader(client)}
+		go cli.write(&mqttPacket{_type: mqttConnect, body: mqttConnectBody("dev", "default", "token")})
+
+		conn, err := (&MqttUpgrader{}).Upgrade(server)
+		So(err, ShouldBeNil)
+		So(conn.ClientId(), ShouldEqual, "dev")
+		So(conn.Username(), ShouldEqual, "default")
+		So(conn.Password(), ShouldEqual, "token")
+
+		var lock sync.Mutex
+		var uploaded []byte
+		var uploadWg sync.WaitGroup
+		uploadWg.Add(1)
+		h := func(c Connection, m Message, e error) {
+			if m != nil && m.Type() == TypeUploadMessage && e == nil {
+				lock.Lock()
+				uploaded = m.Payload()
+				lock.Unlock()
+				uploadWg.Done()
+			}
+		}
+
+		var mqttConn *MqttConnection
+		done := make(chan struct{})
+		go func() {
+			mqttConn, err = cm.NewMqttConnection("dev", conn, h, nil)
+			close(done)
+		}()
+
+		p, rerr := cli.read()
+		So(rerr, ShouldBeNil)
+		So(p._type, ShouldEqual, mqttConnack)
+		So(p.body[1], ShouldEqual, MqttAccepted)
+		<-done
+		So(err, ShouldBeNil)
+		So(cm.Count(), ShouldEqual, 1)
+		So(mqttConn.ConnectionType(), ShouldEqual, "mqtt")
+
+		// sending without subscription fails
+		So(mqttConn.Send([]byte("no subscriber")), ShouldNotBeNil)
+
+		cli.write(&mqttPacket{
+			_type: mqttSubscribe,
+			flags: 2,
+			body:  append(appendMqttString([]byte{0, 1}, "channels/default/devices/dev/#"), 0),
+		})
+		p, rerr = cli.read()
+		So(rerr, ShouldBeNil)
+		So(p._type, ShouldEqual, mqttSuback)
+		So(p.body[2], ShouldEqual, 0)
+
+		cli.write(&mqttPacket{
+			_type: mqttSubscribe,
+			flags: 2,
+			body:  append(appendMqttString([]byte{0, 2}, "channels/default/devices/other/#"), 0),
+		})
+		p, rerr = cli.read()
+		So(rerr, ShouldBeNil)
+		So(p.body[2], ShouldEqual, mqttSubackFailure)
+
+		cli.write((&mqttPublishPacket{topic: "channels/default/devices/dev/upload", qos: 1, packetId: 3, payload: []byte("temperature=20")}).packet())
+		p, rerr = cli.read()
+		So(rerr, ShouldBeNil)
+		So(p._type, ShouldEqual, mqttPuback)
+		uploadWg.Wait()
+		lock.Lock()
+		So(string(uploaded), ShouldEqual, "temperature=20")
+		lock.Unlock()
+
+		go mqttConn.Send([]byte("send message"))
+		p, rerr = cli.read()
+		So(rerr, ShouldBeNil)
+		pub, _ := parseMqttPublish(p)
+		So(pub.topic, ShouldEqual, "channels/default/devices/dev/send")
+		So(string(pub.payload), ShouldEqual, "send message")
+
+		var resp []byte
+		var reqErr error
+		var reqWg sync.WaitGroup
+		reqWg.Add(1)
+		go func() {
+			resp, reqErr = mqttConn.Request([]byte("request message"), 2*time.Second)
+			reqWg.Done()
+		}()
+		p, rerr = cli.read()
+		So(rerr, ShouldBeNil)
+		pub, _ = parseMqttPublish(p)
+		So(pub.topic, ShouldStartWith, "channels/default/devices/dev/request/")
+		id := pub.topic[len("channels/default/devices/dev/request/"):]
+		cli.write((&mqttPublishPacket{topic: "channels/default/devices/dev/response/" + id, payload: []byte("response message")}).packet())
+		reqWg.Wait()
+		So(reqErr, ShouldBeNil)
+		So(string(resp), ShouldEqual, "response message")
+
+		cli.write(&mqttPacket{_type: mqttPingreq})
+		p, rerr = cli.read()
+		So(rerr, ShouldBeNil)
+		So(p._type, ShouldEqual, mqttPingresp)
+
+		cli.write(&mqttPacket{_type: mqttDisconnect})
+		mqttConn.wait()
+		So(mqttConn.Closed(), ShouldBeTrue)
+		So(cm.Count(), ShouldEqual, 0)
+	})
+
+	Convey("refuses unsupported protocol levels", t, func() {
+		client, server := net.Pipe()
+		cli := &fakeMqttClient{nc: client, r: bufio.NewReader(client)}
+		body := mqttConnectBody("dev", "default", "token")
+		body[6] = 3
+		go cli.write(&mqttPacket{_type: mqttConnect, body: body})
+
+		go (&MqttUpgrader{}).Upgrade(server)
+		p, err := cli.read()
+		So(err, ShouldBeNil)
+		So(p._type, ShouldEqual, mqttConnack)
+		So(p.body[1], ShouldEqual, MqttRefusedProtocolVersion)
+	})
+}
@@ -0,0 +1,88 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var SupportedMqttMessageTypes = map[MessageType]string{
+	TypeUploadMessage:     "upload",
+	TypeResponseMessage:   "response",
+	TypeSendMessage:       "send",
+	TypeRequestMessage:    "request",
+	TypeConnectMessage:    "connect",
+	TypeDisconnectMessage: "disconnect",
+}
+
+// Topic suffixes after "channels/<channel id>/devices/<device id>/"
+var mqttMessageTopics = map[MessageType]string{
+	TypeUploadMessage:   "upload",
+	TypeResponseMessage: "response",
+	TypeSendMessage:     "send",
+	TypeRequestMessage:  "request",
+}
+
+type mqttMessage struct {
+	_type   MessageType
+	id      string
+	topic   string
+	payload []byte
+}
+
+func NewMqttMessage(t MessageType, id string, topic string, payload []byte) *mqttMessage {
+	return &mqttMessage{_type: t, id: id, topic: topic, payload: payload}
+}
+
+func (m *mqttMessage) TypeString() string { return SupportedMqttMessageTypes[m._type] }
+func (m *mqttMessage) Type() MessageType  { return m._type }
+func (m *mqttMessage) Id() string         { return m.id }
+func (m *mqttMessage) Topic() string      { return m.topic }
+func (m *mqttMessage) Payload() []byte    { return m.payload }
+func (m *mqttMessage) Raw() []byte        { return m.payload }
+
+// Marshal returns the PUBLISH payload, the type and id are carried by the topic.
+func (m *mqttMessage) Marshal() ([]byte, error) {
+	if _, found := SupportedMqttMessageTypes[m._type]; !found {
+		return nil, errors.New(fmt.Sprintf("unsupported mqtt message type %d", m._type))
+	}
+
+	if m.payload == nil {
+		if m._type != TypeDisconnectMessage && m._type != TypeConnectMessage {
+			return nil, errors.New(fmt.Sprintf("missing payload for mqtt message type %s", SupportedMqttMessageTypes[m._type]))
+		} else {
+			m.payload = []byte{}
+		}
+	}
+
+	if len(m.id) == 0 {
+		if m._type == TypeRequestMessage || m._type == TypeResponseMessage {
+			return nil, errors.New(fmt.Sprintf("missing message id for mqtt message type %s", SupportedMqttMessageTypes[m._type]))
+		} else {
+			m.id = strconv.FormatInt(time.Now().UnixNano(), 16)
+		}
+	}
+
+	return m.payload, nil
+}
+
+func (m *mqttMessage) Unmarshal() error {
+	if _, found := SupportedMqttMessageTypes[m._type]; !found {
+		return errors.New(fmt.Sprintf("unsupported mqtt message type %d", m._type))
+	}
+
+	if m.payload == nil {
+		m.payload = []byte{}
+	}
+
+	if len(m.id) == 0 {
+		if m._type == TypeResponseMessage {
+			return errors.New(fmt.Sprintf("empty message id for mqtt message type %s", SupportedMqttMessageTypes[m._type]))
+		} else {
+			m.id = strconv.FormatInt(time.Now().UnixNano(), 16)
+		}
+	}
+
+	return nil
+}
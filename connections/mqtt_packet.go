@@ -0,0 +1,288 @@
+package connections
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect     byte = 1
+	mqttConnack     byte = 2
+	mqttPublish     byte = 3
+	mqttPuback      byte = 4
+	mqttPubrec      byte = 5
+	mqttPubrel      byte = 6
+	mqttPubcomp     byte = 7
+	mqttSubscribe   byte = 8
+	mqttSuback      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsuback    byte = 11
+	mqttPingreq     byte = 12
+	mqttPingresp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+// CONNACK return codes
+const (
+	MqttAccepted                  byte = 0
+	MqttRefusedProtocolVersion    byte = 1
+	MqttRefusedIdentifierRejected byte = 2
+	MqttRefusedServerUnavailable  byte = 3
+	MqttRefusedBadCredentials     byte = 4
+	MqttRefusedNotAuthorized      byte = 5
+)
+
+const mqttSubackFailure byte = 0x80
+
+var mqttMalformedPacketErr = errors.New("malformed mqtt packet")
+
+type mqttPacket struct {
+	_type byte
+	flags byte
+	body  []byte
+}
+
+func readMqttPacket(r *bufio.Reader, maxSize int) (*mqttPacket, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// remaining length is encoded in at most 4 bytes, 7 bits each
+	length := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, mqttMalformedPacketErr
+		}
+		d, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(d&127) * multiplier
+		multiplier *= 128
+		if d&128 == 0 {
+			break
+		}
+	}
+
+	if maxSize > 0 && length > maxSize {
+		return nil, errors.New(fmt.Sprintf("mqtt packet of %d bytes exceeds max packet size %d", length, maxSize))
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &mqttPacket{_type: b >> 4, flags: b & 0x0f, body: body}, nil
+}
+
+func (p *mqttPacket) Marshal() []byte {
+	buf := make([]byte, 0, len(p.body)+5)
+	buf = append(buf, p._type<<4|p.flags)
+
+	length := len(p.body)
+	for {
+		d := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			d |= 128
+		}
+		buf = append(buf, d)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(buf, p.body...)
+}
+
+type mqttReader struct {
+	buf []byte
+	err error
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 2 {
+		r.err = mqttMalformedPacketErr
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.buf)
+	r.buf = r.buf[2:]
+	return v
+}
+
+func (r *mqttReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 1 {
+		r.err = mqttMalformedPacketErr
+		return 0
+	}
+	v := r.buf[0]
+	r.buf = r.buf[1:]
+	return v
+}
+
+func (r *mqttReader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = mqttMalformedPacketErr
+		return nil
+	}
+	v := r.buf[:n]
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *mqttReader) string() string {
+	return string(r.bytes())
+}
+
+func appendMqttString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+type mqttConnectPacket struct {
+	protocol  string
+	level     byte
+	flags     byte
+	keepAlive uint16
+	clientId  string
+	username  string
+	password  string
+}
+
+func parseMqttConnect(p *mqttPacket) (*mqttConnectPacket, error) {
+	if p._type != mqttConnect {
+		return nil, errors.New("expected mqtt CONNECT packet")
+	}
+
+	r := &mqttReader{buf: p.body}
+	c := &mqttConnectPacket{}
+	c.protocol = r.string()
+	c.level = r.byte()
+	c.flags = r.byte()
+	c.keepAlive = r.uint16()
+	c.clientId = r.string()
+	// will topic and will message are parsed but not supported
+	if c.flags&0x04 != 0 {
+		r.string()
+		r.bytes()
+	}
+	if c.flags&0x80 != 0 {
+		c.username = r.string()
+	}
+	if c.flags&0x40 != 0 {
+		c.password = string(r.bytes())
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c, nil
+}
+
+type mqttPublishPacket struct {
+	topic    string
+	packetId uint16
+	qos      byte
+	payload  []byte
+}
+
+func parseMqttPublish(p *mqttPacket) (*mqttPublishPacket, error) {
+	r := &mqttReader{buf: p.body}
+	pub := &mqttPublishPacket{qos: (p.flags >> 1) & 0x03}
+	pub.topic = r.string()
+	if pub.qos > 0 {
+		pub.packetId = r.uint16()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	pub.payload = r.buf
+	return pub, nil
+}
+
+func (pub *mqttPublishPacket) packet() *mqttPacket {
+	body := appendMqttString(make([]byte, 0, len(pub.topic)+len(pub.payload)+4), pub.topic)
+	if pub.qos > 0 {
+		body = append(body, byte(pub.packetId>>8), byte(pub.packetId))
+	}
+	body = append(body, pub.payload...)
+	return &mqttPacket{_type: mqttPublish, flags: pub.qos << 1, body: body}
+}
+
+type mqttSubscribePacket struct {
+	packetId uint16
+	filters  []string
+}
+
+func parseMqttSubscribe(p *mqttPacket) (*mqttSubscribePacket, error) {
+	r := &mqttReader{buf: p.body}
+	sub := &mqttSubscribePacket{filters: []string{}}
+	sub.packetId = r.uint16()
+	for r.err == nil && len(r.buf) > 0 {
+		sub.filters = append(sub.filters, r.string())
+		if p._type == mqttSubscribe {
+			// requested qos, everything is granted at qos 0
+			r.byte()
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(sub.filters) == 0 {
+		return nil, mqttMalformedPacketErr
+	}
+	return sub, nil
+}
+
+func mqttConnackPacket(code byte) *mqttPacket {
+	return &mqttPacket{_type: mqttConnack, body: []byte{0, code}}
+}
+
+func mqttAckPacket(_type byte, packetId uint16, codes ...byte) *mqttPacket {
+	body := append([]byte{byte(packetId >> 8), byte(packetId)}, codes...)
+	return &mqttPacket{_type: _type, body: body}
+}
+
+// Matches a topic against a subscription filter with '+' and '#' wildcards.
+func mqttTopicMatch(filter, topic string) bool {
+	fi, ti := 0, 0
+	for fi < len(filter) {
+		if filter[fi] == '#' {
+			return true
+		}
+
+		if filter[fi] == '+' {
+			for ti < len(topic) && topic[ti] != '/' {
+				ti++
+			}
+			fi++
+			continue
+		}
+
+		if ti >= len(topic) || filter[fi] != topic[ti] {
+			// "a/#" also matches its parent "a"
+			return ti == len(topic) && filter[fi:] == "/#"
+		}
+		fi++
+		ti++
+	}
+	return ti == len(topic)
+}
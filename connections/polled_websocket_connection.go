@@ -0,0 +1,378 @@
+package connections
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/btree"
+	"github.com/gorilla/websocket"
+	. "github.com/eywa/configs"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// a reader and a writer goroutine for each connection
+	WsTransportGoroutines = "goroutines"
+	// the sockets are read by the workers of an epoll poller, linux only
+	WsTransportEpoll = "epoll"
+)
+
+var SupportedWsTransports = []string{WsTransportGoroutines, WsTransportEpoll}
+
+// The websocket transport and the number of poll workers, falling back to
+// the goroutines and a worker per cpu when they are not configured.
+func wsTransportConf() (transport string, workers int) {
+	transport, workers = WsTransportGoroutines, runtime.NumCPU()
+	cfg := Config()
+	if cfg == nil || cfg.Connections == nil || cfg.Connections.Websocket == nil {
+		return
+	}
+
+	conf := cfg.Connections.Websocket
+	for _, t := range SupportedWsTransports {
+		if t == conf.Transport {
+			transport = t
+		}
+	}
+	if conf.PollWorkers > 0 {
+		workers = conf.PollWorkers
+	}
+	return
+}
+
+var wsPollerOnce sync.Once
+var sharedWsPoller *wsPoller
+var wsPollerErr error
+
+// The poller of every polled connection, started with the first of them.
+func websocketPoller() (*wsPoller, error) {
+	wsPollerOnce.Do(func() {
+		_, workers := wsTransportConf()
+		sharedWsPoller, wsPollerErr = newWsPoller(workers)
+	})
+	return sharedWsPoller, wsPollerErr
+}
+
+// The socket under a websocket, when the poller can read it. Tls connections
+// can't be polled since the poller reads the raw bytes.
+func pollableConn(ws wsConn) (syscall.RawConn, bool) {
+	sc, ok := ws.UnderlyingConn().(syscall.Conn)
+	if !ok {
+		return nil, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	return raw, true
+}
+
+// A websocket connection without goroutines of its own. The poller hands it
+// to one of its workers when the socket is readable, which parses the frames
+// and dispatches the messages, and the writes are made by the callers, so
+// an idle device only costs its memory. The device sees no difference with
+// a WebsocketConnection.
+type PolledWebsocketConnection struct {
+	cm           *ConnectionManager
+	ws           wsConn
+	raw          syscall.RawConn
+	// the file descriptor of the socket, the key of the connection in the
+	// poller
+	fd           int
+	createdAt    time.Time
+	// Last time anything was heard from the client, in unix nanoseconds.
+	// Accessed atomically.
+	lastPingedAt int64
+	// Round trip time of the last server ping, in nanoseconds. Accessed
+	// atomically.
+	rtt          int64
+	closedAt     time.Time
+	identifier   string
+	h            MessageHandler
+	metadata     map[string]string
+	// Encoding of the binary framing negotiated with the subprotocol, empty
+	// for the text framing.
+	encoding     string
+	lazyPublisher
+
+	// Held by the worker reading the connection, wait() takes it to make sure
+	// that nothing is read after the connection is closed. The poller never
+	// hands a connection to two workers at once.
+	rlock     sync.Mutex
+	frames    wsFrameReader
+	// Serializes the writes of the callers.
+	wlock     sync.Mutex
+	closeOnce sync.Once
+	closed    int32
+
+	msgChans syncRespChanMap
+}
+
+func (c *PolledWebsocketConnection) Identifier() string { return c.identifier }
+
+func (c *PolledWebsocketConnection) CreatedAt() time.Time { return c.createdAt }
+
+func (c *PolledWebsocketConnection) ClosedAt() time.Time { return c.closedAt }
+
+func (c *PolledWebsocketConnection) LastPingedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastPingedAt))
+}
+
+func (c *PolledWebsocketConnection) RoundTripTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+func (c *PolledWebsocketConnection) pinged(t time.Time) {
+	atomic.StoreInt64(&c.lastPingedAt, t.UnixNano())
+}
+
+func (c *PolledWebsocketConnection) Closed() bool { return atomic.LoadInt32(&c.closed) == 1 }
+
+func (c *PolledWebsocketConnection) Metadata() map[string]string { return c.metadata }
+
+func (c *PolledWebsocketConnection) ConnectionManager() *ConnectionManager { return c.cm }
+
+func (c *PolledWebsocketConnection) ConnectionType() string { return "websocket" }
+
+func (c *PolledWebsocketConnection) Topic() string { return publisherTopic(c.cm.id, c.identifier) }
+
+func (c *PolledWebsocketConnection) Attach() { c.attach(c.Topic()) }
+
+func (c *PolledWebsocketConnection) Less(than btree.Item) bool {
+	conn := than.(Connection)
+	return strings.Compare(c.identifier, conn.Identifier()) < 0
+}
+
+// Ping sends a ping carrying the current time, the pong works out the round
+// trip time from it.
+func (c *PolledWebsocketConnection) Ping() error {
+	return c.ws.WriteControl(
+		websocket.PingMessage,
+		[]byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
+		time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
+}
+
+func (c *PolledWebsocketConnection) Send(msg []byte) error {
+	m := &websocketMessage{
+		_type:   TypeSendMessage,
+		payload: msg,
+	}
+	err := c.sendWsMessage(m)
+	c.cm.dispatch(c.h, c, m, err)
+	return err
+}
+
+func (c *PolledWebsocketConnection) Request(msg []byte, timeout time.Duration) ([]byte, error) {
+	m := &websocketMessage{
+		_type:   TypeRequestMessage,
+		id:      strconv.FormatInt(time.Now().UnixNano(), 16),
+		payload: msg,
+	}
+
+	// registered before sending, the response can come back before the
+	// write returns
+	respCh := make(chan *websocketMessageResp, 1)
+	c.msgChans.put(m.id, respCh)
+	defer c.msgChans.delete(m.id)
+
+	err := c.sendWsMessage(m)
+	c.cm.dispatch(c.h, c, m, err)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	select {
+	case <-time.After(timeout):
+		return []byte{}, errors.New(fmt.Sprintf("websocket connection response timed out for %s", timeout))
+	case resp := <-respCh:
+		return resp.msg.payload, nil
+	}
+}
+
+// Answers a call of the device with a response message of the same id, like
+// WebsocketConnection.Respond.
+func (c *PolledWebsocketConnection) Respond(id string, answer []byte, err error) error {
+	msg := &websocketMessage{
+		_type:   TypeResponseMessage,
+		id:      id,
+		payload: answer,
+	}
+	if err != nil {
+		msg.payload, _ = json.Marshal(map[string]string{"error": err.Error()})
+		msg.flags = WsFlagError
+	}
+	if msg.payload == nil {
+		msg.payload = []byte{}
+	}
+
+	if err = c.sendWsMessage(msg); err != nil {
+		c.cm.dispatch(c.h, c, msg, err)
+	}
+	return err
+}
+
+func (c *PolledWebsocketConnection) sendWsMessage(message *websocketMessage) error {
+	if c.Closed() {
+		return wsConnClosedErr
+	}
+
+	// payloads from the server are passed through without being encoded
+	if len(c.encoding) > 0 {
+		message.encoding = c.encoding
+		message.flags |= WsFlagRaw
+	}
+
+	p, err := message.Marshal()
+	if err != nil {
+		return err
+	}
+
+	c.wlock.Lock()
+	err = c.ws.SetWriteDeadline(time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
+	if err == nil {
+		err = c.ws.WriteMessage(websocket.BinaryMessage, p)
+	}
+	c.wlock.Unlock()
+
+	if err != nil {
+		err = &websocketError{message: err.Error()}
+		c.close(true)
+	}
+	return err
+}
+
+// Takes the bytes the poller read from the socket.
+func (c *PolledWebsocketConnection) received(p []byte) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	if c.Closed() {
+		return
+	}
+	c.pinged(time.Now())
+
+	frames, err := c.frames.feed(p)
+	for _, f := range frames {
+		if !c.handleFrame(f) {
+			return
+		}
+	}
+
+	if err != nil {
+		c.ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, err.Error()),
+			time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
+		c.cm.dispatch(c.h, c, nil, &websocketError{message: err.Error()})
+		c.close(true)
+	}
+}
+
+// Takes the error the poller got reading the socket, the connection is gone.
+func (c *PolledWebsocketConnection) readFailed(err error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	if c.Closed() {
+		return
+	}
+	c.cm.dispatch(c.h, c, nil, &websocketError{
+		message: fmt.Sprintf("error reading message from websocket connection, %s", err.Error()),
+	})
+	c.close(true)
+}
+
+// Handles a frame like the reader of a WebsocketConnection does, false when
+// the connection is closed by it.
+func (c *PolledWebsocketConnection) handleFrame(f *wsFrame) bool {
+	writeTimeout := Config().Connections.Websocket.Timeouts.Write.Duration
+
+	switch f.opcode {
+	case websocket.PingMessage:
+		c.ws.WriteControl(
+			websocket.PongMessage,
+			[]byte(strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)),
+			time.Now().Add(writeTimeout))
+		return true
+	case websocket.PongMessage:
+		now := time.Now()
+		if sent, err := strconv.ParseInt(string(f.payload), 10, 64); err == nil && sent <= now.UnixNano() {
+			atomic.StoreInt64(&c.rtt, now.UnixNano()-sent)
+		}
+		return true
+	case websocket.CloseMessage:
+		c.close(true)
+		return false
+	}
+
+	message := &websocketMessage{raw: f.payload, encoding: c.encoding}
+	if err := message.Unmarshal(); err != nil {
+		c.cm.dispatch(c.h, c, message, err)
+	} else if message._type == TypeDisconnectMessage {
+		c.cm.dispatch(c.h, c, message, nil)
+		c.close(true)
+		return false
+	} else if message._type == TypeResponseMessage {
+		ch, found := c.msgChans.find(message.id)
+		if found {
+			c.msgChans.delete(message.id)
+			ch <- &websocketMessageResp{msg: message}
+			c.cm.dispatch(c.h, c, message, nil)
+		} else {
+			c.cm.dispatch(c.h, c, message, wsUnexpectedMessageErr)
+		}
+	} else {
+		c.cm.dispatch(c.h, c, message, nil)
+	}
+	return true
+}
+
+func (c *PolledWebsocketConnection) unregister() {
+	// the same check as WebsocketConnection.unregister, a new connection
+	// could have registered under the same id
+	conn, found := c.cm.FindConnection(c.identifier)
+	if found && conn.CreatedAt() == c.createdAt {
+		c.cm.unregister(c)
+	}
+}
+
+func (c *PolledWebsocketConnection) close(unregister bool) error {
+	c.closeOnce.Do(func() {
+		c.closedAt = time.Now()
+		atomic.StoreInt32(&c.closed, 1)
+
+		// out of the poller before the socket is closed and its descriptor
+		// reused
+		if p, err := websocketPoller(); err == nil {
+			p.remove(c)
+		}
+
+		c.ws.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
+		c.ws.Close()
+
+		if unregister {
+			c.unregister()
+		}
+		c.cm.dispatch(c.h, c, &websocketMessage{_type: TypeDisconnectMessage}, nil)
+		go func() {
+			time.Sleep(3 * time.Second) // for user experience
+			c.Unpublish()
+		}()
+	})
+	return nil
+}
+
+func (c *PolledWebsocketConnection) wait() {
+	c.rlock.Lock()
+	c.rlock.Unlock()
+}
+
+func (c *PolledWebsocketConnection) start() {
+	c.cm.dispatch(c.h, c, &websocketMessage{_type: TypeConnectMessage}, nil)
+}
@@ -0,0 +1,93 @@
+package connections
+
+import (
+	"encoding/json"
+	"github.com/eywa/pubsub"
+	. "github.com/eywa/utils"
+	"sync"
+	"time"
+)
+
+// PresenceEvent tells that a device connected to or disconnected from a
+// channel on this node. Duration is the length of the session in
+// milliseconds, only disconnects have it.
+type PresenceEvent struct {
+	Event          string            `json:"event"`
+	Channel        string            `json:"channel"`
+	DeviceId       string            `json:"device_id"`
+	ConnectionType string            `json:"connection_type"`
+	Metadata       map[string]string `json:"metadata"`
+	Timestamp      int64             `json:"timestamp"`
+	Duration       int64             `json:"duration,omitempty"`
+}
+
+// the topic of the events of every channel
+const allPresenceTopic = "presence/*"
+
+var presenceOnce sync.Once
+var presenceHub *pubsub.StreamHub
+
+func presenceStreams() *pubsub.StreamHub {
+	presenceOnce.Do(func() {
+		conf := pubsub.StreamSettings()
+		presenceHub = pubsub.NewStreamHub(conf.Backlog, conf.ResumeWindow.Duration)
+	})
+	return presenceHub
+}
+
+func presenceTopic(cmId string) string {
+	if len(cmId) == 0 {
+		return allPresenceTopic
+	}
+	return "presence/" + cmId
+}
+
+// Subscribes to the presence events of a connection manager, or of all of
+// them when cmId is empty.
+func SubscribePresence(cmId string, cursor uint64, filter func(*PresenceEvent) bool) *pubsub.StreamSubscription {
+	return presenceStreams().Subscribe(presenceTopic(cmId), cursor, pubsub.StreamSettings().BufferSize, func(e *pubsub.StreamEvent) bool {
+		return filter == nil || filter(e.Value.(*PresenceEvent))
+	})
+}
+
+func UnsubscribePresence(s *pubsub.StreamSubscription) {
+	presenceStreams().Unsubscribe(s)
+}
+
+func publishPresence(cmId string, c Connection, m Message) {
+	hub := presenceStreams()
+	topics := []string{}
+	for _, topic := range []string{presenceTopic(cmId), allPresenceTopic} {
+		if hub.Subscribed(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return
+	}
+
+	now := time.Now()
+	e := &PresenceEvent{
+		Event:          m.TypeString(),
+		Channel:        cmId,
+		DeviceId:       c.Identifier(),
+		ConnectionType: c.ConnectionType(),
+		Metadata:       c.Metadata(),
+		Timestamp:      NanoToMilli(now.UnixNano()),
+	}
+	if m.Type() == TypeDisconnectMessage {
+		closedAt := c.ClosedAt()
+		if closedAt.IsZero() {
+			closedAt = now
+		}
+		e.Duration = NanoToMilli(closedAt.Sub(c.CreatedAt()).Nanoseconds())
+	}
+
+	js, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	for _, topic := range topics {
+		hub.Publish(topic, js, e)
+	}
+}
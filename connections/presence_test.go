@@ -0,0 +1,60 @@
+package connections
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestPresence(t *testing.T) {
+	connect := &websocketMessage{_type: TypeConnectMessage}
+	disconnect := &websocketMessage{_type: TypeDisconnectMessage}
+
+	Convey("publishes connects and disconnects to the channel and to all channels.", t, func() {
+		channel := SubscribePresence("presence1", 0, nil)
+		all := SubscribePresence("", 0, nil)
+		defer UnsubscribePresence(channel)
+		defer UnsubscribePresence(all)
+
+		publishPresence("presence1", &Lesser{id: "dev1"}, connect)
+		publishPresence("presence2", &Lesser{id: "dev2"}, disconnect)
+
+		e := <-channel.Events()
+		p := &PresenceEvent{}
+		So(json.Unmarshal(e.Data, p), ShouldBeNil)
+		So(p.Event, ShouldEqual, "connect")
+		So(p.Channel, ShouldEqual, "presence1")
+		So(p.DeviceId, ShouldEqual, "dev1")
+		So(len(channel.Events()), ShouldEqual, 0)
+
+		So((<-all.Events()).Value.(*PresenceEvent).DeviceId, ShouldEqual, "dev1")
+		So((<-all.Events()).Value.(*PresenceEvent).Event, ShouldEqual, "disconnect")
+	})
+
+	Convey("filters presence events.", t, func() {
+		sub := SubscribePresence("presence3", 0, func(e *PresenceEvent) bool {
+			return e.Event == "disconnect"
+		})
+		defer UnsubscribePresence(sub)
+
+		publishPresence("presence3", &Lesser{id: "dev1"}, connect)
+		publishPresence("presence3", &Lesser{id: "dev1"}, disconnect)
+
+		e := <-sub.Events()
+		So(e.Seq, ShouldEqual, 2)
+		So(e.Value.(*PresenceEvent).Event, ShouldEqual, "disconnect")
+	})
+
+	Convey("resumes from a cursor.", t, func() {
+		sub := SubscribePresence("presence4", 0, nil)
+		publishPresence("presence4", &Lesser{id: "dev1"}, connect)
+		publishPresence("presence4", &Lesser{id: "dev2"}, connect)
+		UnsubscribePresence(sub)
+
+		sub = SubscribePresence("presence4", 1, nil)
+		defer UnsubscribePresence(sub)
+		e := <-sub.Events()
+		So(e.Seq, ShouldEqual, 2)
+		So(e.Value.(*PresenceEvent).DeviceId, ShouldEqual, "dev2")
+	})
+}
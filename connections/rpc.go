@@ -0,0 +1,88 @@
+package connections
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// RpcCall is a call a device makes to the server, the payload of a call
+// message is the method name and the params separated by a pipe.
+type RpcCall struct {
+	ChannelId string
+	DeviceId  string
+	Method    string
+	Params    []byte
+}
+
+func ParseRpcCall(c Connection, m Message) (*RpcCall, error) {
+	payload := m.Payload()
+	method, params := payload, []byte{}
+	if idx := bytes.IndexByte(payload, '|'); idx != -1 {
+		method, params = payload[:idx], payload[idx+1:]
+	}
+	if len(method) == 0 {
+		return nil, errors.New("empty method of call")
+	}
+
+	call := &RpcCall{
+		DeviceId: c.Identifier(),
+		Method:   string(method),
+		Params:   params,
+	}
+	if cm := c.ConnectionManager(); cm != nil {
+		call.ChannelId = cm.Id()
+	}
+	return call, nil
+}
+
+// RpcHandler answers calls routed to it by name.
+type RpcHandler func(*RpcCall) ([]byte, error)
+
+// Rpc handlers registered by name, the calls of a channel are routed to
+// them by its rpc routes.
+var rpcRegistry = &rpcHandlerRegistry{handlers: make(map[string]RpcHandler)}
+
+type rpcHandlerRegistry struct {
+	sync.RWMutex
+	handlers map[string]RpcHandler
+}
+
+// Registers an rpc handler under its name, usually from an init function.
+func RegisterRpcHandler(name string, h RpcHandler) error {
+	if len(name) == 0 {
+		return errors.New("rpc handler name is empty")
+	}
+
+	rpcRegistry.Lock()
+	defer rpcRegistry.Unlock()
+
+	if _, found := rpcRegistry.handlers[name]; found {
+		return errors.New(fmt.Sprintf("rpc handler %s is already registered", name))
+	}
+	rpcRegistry.handlers[name] = h
+	return nil
+}
+
+func FindRpcHandler(name string) (RpcHandler, bool) {
+	rpcRegistry.RLock()
+	defer rpcRegistry.RUnlock()
+
+	h, found := rpcRegistry.handlers[name]
+	return h, found
+}
+
+// Names of all registered rpc handlers in alphabetical order.
+func RegisteredRpcHandlers() []string {
+	rpcRegistry.RLock()
+	defer rpcRegistry.RUnlock()
+
+	names := make([]string, 0, len(rpcRegistry.handlers))
+	for name, _ := range rpcRegistry.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,39 @@
+package connections
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestRpc(t *testing.T) {
+
+	Convey("parses the method and params of a call.", t, func() {
+		c := &Lesser{id: "device"}
+		call, err := ParseRpcCall(c, &websocketMessage{_type: TypeCallMessage, payload: []byte("config|{\"v\":1}|x")})
+		So(err, ShouldBeNil)
+		So(call.DeviceId, ShouldEqual, "device")
+		So(call.Method, ShouldEqual, "config")
+		So(string(call.Params), ShouldEqual, "{\"v\":1}|x")
+
+		call, err = ParseRpcCall(c, &websocketMessage{_type: TypeCallMessage, payload: []byte("license")})
+		So(err, ShouldBeNil)
+		So(call.Method, ShouldEqual, "license")
+		So(len(call.Params), ShouldEqual, 0)
+
+		_, err = ParseRpcCall(c, &websocketMessage{_type: TypeCallMessage, payload: []byte("|params")})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("registers rpc handlers by name.", t, func() {
+		h := func(call *RpcCall) ([]byte, error) { return call.Params, nil }
+		So(RegisterRpcHandler("test_echo", h), ShouldBeNil)
+		So(RegisterRpcHandler("test_echo", h), ShouldNotBeNil)
+		So(RegisterRpcHandler("", h), ShouldNotBeNil)
+
+		found, ok := FindRpcHandler("test_echo")
+		So(ok, ShouldBeTrue)
+		answer, _ := found(&RpcCall{Params: []byte("hi")})
+		So(string(answer), ShouldEqual, "hi")
+		So(RegisteredRpcHandlers(), ShouldContain, "test_echo")
+	})
+}
@@ -1,6 +1,8 @@
 package connections
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/btree"
@@ -8,11 +10,14 @@ import (
 	. "github.com/eywa/configs"
 	"github.com/eywa/pubsub"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 var wsConnClosedErr = errors.New("websocket connection is closed")
@@ -26,6 +31,8 @@ func (e *websocketError) Error() string {
 	return fmt.Sprintf("WebsocketError: %s", e.message)
 }
 
+// Most devices are never requested anything, the map is only made on the
+// first request.
 type syncRespChanMap struct {
 	sync.Mutex
 	m map[string]chan *websocketMessageResp
@@ -35,6 +42,9 @@ func (sm *syncRespChanMap) put(msgId string, ch chan *websocketMessageResp) {
 	sm.Lock()
 	defer sm.Unlock()
 
+	if sm.m == nil {
+		sm.m = make(map[string]chan *websocketMessageResp)
+	}
 	sm.m[msgId] = ch
 }
 
@@ -60,6 +70,89 @@ func (sm *syncRespChanMap) len() int {
 	return len(sm.m)
 }
 
+// The publisher for the consoles attached to a connection, made on the first
+// attach since most connections are never attached.
+type lazyPublisher struct {
+	publisher unsafe.Pointer
+}
+
+func (l *lazyPublisher) basicPublisher() *pubsub.BasicPublisher {
+	return (*pubsub.BasicPublisher)(atomic.LoadPointer(&l.publisher))
+}
+
+func (l *lazyPublisher) attach(topic string) {
+	p := l.basicPublisher()
+	if p == nil {
+		atomic.CompareAndSwapPointer(&l.publisher, nil, unsafe.Pointer(pubsub.NewBasicPublisher(topic)))
+		p = l.basicPublisher()
+	}
+	p.Attach()
+}
+
+func (l *lazyPublisher) Detach() {
+	if p := l.basicPublisher(); p != nil {
+		p.Detach()
+	}
+}
+
+func (l *lazyPublisher) Attached() bool {
+	p := l.basicPublisher()
+	return p != nil && p.Attached()
+}
+
+func (l *lazyPublisher) Publish(cb pubsub.Callback) {
+	if p := l.basicPublisher(); p != nil {
+		p.Publish(cb)
+	}
+}
+
+func (l *lazyPublisher) Unpublish() {
+	if p := l.basicPublisher(); p != nil {
+		p.Unpublish()
+	}
+}
+
+func publisherTopic(cmId string, id string) string {
+	return strings.Replace(cmId, "/", "-", -1) + "/" + strings.Replace(id, "/", "-", -1)
+}
+
+// Frames are read into pooled buffers and copied out at their exact size, so
+// a connection holds no read buffer between frames. Buffers that grew past
+// buffer_sizes.max_pooled are left to the garbage collector, as are pooled
+// buffers that stay unused, and a max_pooled of 0 turns pooling off.
+var readBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func maxPooledReadBuffer() int {
+	conf := Config().Connections.Websocket
+	if conf.BufferSizes == nil {
+		return 0
+	}
+	return conf.BufferSizes.MaxPooled
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	max := maxPooledReadBuffer()
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	buf := readBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	_, err := buf.ReadFrom(r)
+
+	var p []byte
+	if err == nil {
+		p = make([]byte, buf.Len())
+		copy(p, buf.Bytes())
+	}
+	if buf.Cap() <= max {
+		readBuffers.Put(buf)
+	}
+	return p, err
+}
+
 type wsConn interface {
 	Subprotocol() string
 	Close() error
@@ -86,10 +179,14 @@ type WebsocketConnection struct {
 	// Websocket connection creation time. This can be used to compute
 	// total connection alive time for stats
 	createdAt    time.Time
-	// Last ping time. This will be used to check if client is alive
-	// because in most cases, client will close it's socket unexpectedly.
-	// TODO(alexsun): currently, it is not used yet.
-	lastPingedAt time.Time
+	// Last time anything was heard from the client, in unix nanoseconds.
+	// The reaper of the connection manager closes the connection when it
+	// gets too old, because in most cases, client will close it's socket
+	// unexpectedly. Accessed atomically.
+	lastPingedAt int64
+	// Round trip time of the last server ping, in nanoseconds. Accessed
+	// atomically.
+	rtt          int64
 	// Websocket connection closing time. This can be used to compute
 	// total connection alive time for stats.
 	closedAt     time.Time
@@ -101,7 +198,10 @@ type WebsocketConnection struct {
 	// The head message handler.
 	h            MessageHandler
 	metadata     map[string]string
-	*pubsub.BasicPublisher
+	// Encoding of the binary framing negotiated with the subprotocol, empty
+	// for the text framing.
+	encoding     string
+	lazyPublisher
 
 	// Write channel for wListen thread. By closing this channel does terminate
 	// wListen thread.
@@ -126,7 +226,7 @@ type WebsocketConnection struct {
 	// in extreme race condition. no plan to fix it.
 	// simple solution is to limit the size of it,
 	// close the connection when it blows up.
-	msgChans *syncRespChanMap
+	msgChans syncRespChanMap
 }
 
 func (c *WebsocketConnection) Identifier() string { return c.identifier }
@@ -135,7 +235,35 @@ func (c *WebsocketConnection) CreatedAt() time.Time { return c.createdAt }
 
 func (c *WebsocketConnection) ClosedAt() time.Time { return c.closedAt }
 
-func (c *WebsocketConnection) LastPingedAt() time.Time { return c.lastPingedAt }
+func (c *WebsocketConnection) LastPingedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastPingedAt))
+}
+
+func (c *WebsocketConnection) RoundTripTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+func (c *WebsocketConnection) pinged(t time.Time) {
+	atomic.StoreInt64(&c.lastPingedAt, t.UnixNano())
+}
+
+// Ping sends a ping carrying the current time, the pong handler works out the
+// round trip time from it.
+func (c *WebsocketConnection) Ping() error {
+	return c.ws.WriteControl(
+		websocket.PingMessage,
+		[]byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
+		time.Now().Add(Config().Connections.Websocket.Timeouts.Write.Duration))
+}
+
+func (c *WebsocketConnection) handlePong(payload string) error {
+	now := time.Now()
+	c.pinged(now)
+	if sent, err := strconv.ParseInt(payload, 10, 64); err == nil && sent <= now.UnixNano() {
+		atomic.StoreInt64(&c.rtt, now.UnixNano()-sent)
+	}
+	return c.ws.SetReadDeadline(now.Add(Config().Connections.Websocket.Timeouts.Read.Duration))
+}
 
 func (c *WebsocketConnection) Closed() bool { return c.closed }
 
@@ -143,31 +271,52 @@ func (c *WebsocketConnection) Metadata() map[string]string { return c.metadata }
 
 func (c *WebsocketConnection) ConnectionManager() *ConnectionManager { return c.cm }
 
+func (c *WebsocketConnection) Topic() string { return publisherTopic(c.cm.id, c.identifier) }
+
+func (c *WebsocketConnection) Attach() { c.attach(c.Topic()) }
+
 func (c *WebsocketConnection) Less(than btree.Item) bool {
 	conn := than.(Connection)
 	return strings.Compare(c.identifier, conn.Identifier()) < 0
 }
 
 func (c *WebsocketConnection) Send(msg []byte) error {
-	return c.sendAsyncMessage(TypeSendMessage, msg)
+	return c.sendAsyncMessage(&websocketMessage{
+		_type:   TypeSendMessage,
+		payload: msg,
+	})
 }
 
 func (c *WebsocketConnection) Request(msg []byte, timeout time.Duration) ([]byte, error) {
 	return c.sendSyncMessage(TypeRequestMessage, msg, timeout)
 }
 
-func (c *WebsocketConnection) sendAsyncMessage(messageType MessageType, payload []byte) (err error) {
+// Answers a call of the device with a response message of the same id. A
+// failed call is answered with the error in a JSON object, flagged as an
+// error in the binary framing.
+func (c *WebsocketConnection) Respond(id string, answer []byte, err error) error {
+	msg := &websocketMessage{
+		_type:   TypeResponseMessage,
+		id:      id,
+		payload: answer,
+	}
+	if err != nil {
+		msg.payload, _ = json.Marshal(map[string]string{"error": err.Error()})
+		msg.flags = WsFlagError
+	}
+	if msg.payload == nil {
+		msg.payload = []byte{}
+	}
+	return c.sendAsyncMessage(msg)
+}
+
+func (c *WebsocketConnection) sendAsyncMessage(msg *websocketMessage) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = wsConnClosedErr
 		}
 	}()
 
-	msg := &websocketMessage{
-		_type:   messageType,
-		payload: payload,
-	}
-
 	respCh := make(chan *websocketMessageResp, 1)
 
 	timeout := Config().Connections.Websocket.Timeouts.Request.Duration
@@ -243,7 +392,10 @@ func (c *WebsocketConnection) wListen() {
 		if more {
 			err := c.sendWsMessage(req.msg)
 
-			go c.h(c, req.msg, err)
+			// answers to calls are logged by the rpc handler
+			if req.msg._type != TypeResponseMessage || err != nil {
+				c.cm.dispatch(c.h, c, req.msg, err)
+			}
 
 			if err != nil {
 				req.respCh <- &websocketMessageResp{
@@ -270,6 +422,12 @@ func (c *WebsocketConnection) wListen() {
 }
 
 func (c *WebsocketConnection) sendWsMessage(message *websocketMessage) (err error) {
+	// payloads from the server are passed through without being encoded
+	if len(c.encoding) > 0 {
+		message.encoding = c.encoding
+		message.flags |= WsFlagRaw
+	}
+
 	var p []byte
 	p, err = message.Marshal()
 	if err != nil {
@@ -300,14 +458,14 @@ func (c *WebsocketConnection) readWsMessage() (*websocketMessage, error) {
 		}
 	}
 
-	messageType, messageBody, err := c.ws.ReadMessage()
+	messageType, r, err := c.ws.NextReader()
 	if err != nil {
 		return nil, &websocketError{
 			message: fmt.Sprintf("error reading message from websocket connection, %s", err.Error()),
 		}
 	}
 
-	c.lastPingedAt = time.Now()
+	c.pinged(time.Now())
 
 	if messageType == websocket.CloseMessage {
 		return &websocketMessage{
@@ -315,7 +473,14 @@ func (c *WebsocketConnection) readWsMessage() (*websocketMessage, error) {
 		}, nil
 	}
 
-	m := &websocketMessage{raw: messageBody}
+	messageBody, err := readFrame(r)
+	if err != nil {
+		return nil, &websocketError{
+			message: fmt.Sprintf("error reading message from websocket connection, %s", err.Error()),
+		}
+	}
+
+	m := &websocketMessage{raw: messageBody, encoding: c.encoding}
 	err = m.Unmarshal()
 	return m, err
 }
@@ -330,13 +495,13 @@ func (c *WebsocketConnection) rListen() {
 			message, err := c.readWsMessage()
 			if err != nil {
 				if _, ok := err.(*websocketError); ok {
-					go c.h(c, nil, err)
+					c.cm.dispatch(c.h, c, nil, err)
 					c.close(true)
 					return
 				}
-				go c.h(c, message, err)
+				c.cm.dispatch(c.h, c, message, err)
 			} else if message._type == TypeDisconnectMessage {
-				go c.h(c, message, nil)
+				c.cm.dispatch(c.h, c, message, nil)
 				c.close(true)
 				return
 			} else if message._type == TypeResponseMessage {
@@ -344,12 +509,12 @@ func (c *WebsocketConnection) rListen() {
 				if found {
 					c.msgChans.delete(message.id)
 					ch <- &websocketMessageResp{msg: message}
-					go c.h(c, message, nil)
+					c.cm.dispatch(c.h, c, message, nil)
 				} else {
-					go c.h(c, message, wsUnexpectedMessageErr)
+					c.cm.dispatch(c.h, c, message, wsUnexpectedMessageErr)
 				}
 			} else {
-				go c.h(c, message, nil)
+				c.cm.dispatch(c.h, c, message, nil)
 			}
 		}
 	}
@@ -376,10 +541,10 @@ func (c *WebsocketConnection) close(unregister bool) error {
 		if unregister {
 			c.unregister()
 		}
-		go c.h(c, &websocketMessage{_type: TypeDisconnectMessage}, nil)
+		c.cm.dispatch(c.h, c, &websocketMessage{_type: TypeDisconnectMessage}, nil)
 		go func() {
 			time.Sleep(3 * time.Second) // for user experience
-			c.BasicPublisher.Unpublish()
+			c.Unpublish()
 		}()
 	})
 	return nil
@@ -390,14 +555,14 @@ func (c *WebsocketConnection) wait() {
 }
 
 func (c *WebsocketConnection) start() {
-	// Start listening to read channel
-	c.rwStart.Add(1)
-	go c.rListen()
+	c.rwStart.Add(2)
 	// Start listening to write channel
-	c.rwStart.Add(1)
 	go c.wListen()
-	// Start the message handler chain
-	go c.h(c, &websocketMessage{_type: TypeConnectMessage}, nil)
+	// Start the message handler chain, the connect message goes before
+	// anything the read loop reads
+	c.cm.dispatch(c.h, c, &websocketMessage{_type: TypeConnectMessage}, nil)
+	// Start listening to read channel
+	go c.rListen()
 }
 
 func (c *WebsocketConnection) ConnectionType() string {
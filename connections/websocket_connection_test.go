@@ -1,6 +1,7 @@
 package connections
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
@@ -41,20 +42,25 @@ type fakeWsConn struct {
 	randomErr        bool
 	message          []byte
 	syncSleepTime    time.Duration
+	controlSleepTime time.Duration
 	requested        *sync.WaitGroup
 	responsed        bool
 	uploaded         bool
+	subprotocol      string
 	sync.Mutex
 }
 
-func (f *fakeWsConn) Subprotocol() string { return "" }
+func (f *fakeWsConn) Subprotocol() string { return f.subprotocol }
 func (f *fakeWsConn) Close() error {
 	f.closed = true
 	return f.closeErr
 }
 func (f *fakeWsConn) LocalAddr() net.Addr                             { return nil }
 func (f *fakeWsConn) RemoteAddr() net.Addr                            { return nil }
-func (f *fakeWsConn) WriteControl(i int, b []byte, t time.Time) error { return nil }
+func (f *fakeWsConn) WriteControl(i int, b []byte, t time.Time) error {
+	time.Sleep(f.controlSleepTime)
+	return nil
+}
 func (f *fakeWsConn) NextWriter(i int) (io.WriteCloser, error)        { return nil, nil }
 func (f *fakeWsConn) WriteMessage(msgType int, msg []byte) error {
 	f.Lock()
@@ -70,7 +76,8 @@ func (f *fakeWsConn) SetWriteDeadline(t time.Time) error {
 	return f.writeDeadlineErr
 }
 func (f *fakeWsConn) NextReader() (int, io.Reader, error) {
-	return 0, nil, nil
+	t, p, err := f.ReadMessage()
+	return t, bytes.NewReader(p), err
 }
 func (f *fakeWsConn) ReadMessage() (int, []byte, error) {
 	time.Sleep(time.Duration(rand.Intn(200)) * time.Millisecond)
@@ -134,14 +141,18 @@ func TestWsConnection(t *testing.T) {
 	meta := make(map[string]string)
 
 	Convey("errors out for request/response timeout", t, func() {
+		cm, err := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
 		conn := &WebsocketConnection{
+			cm:         cm,
 			ws:         &fakeWsConn{},
 			identifier: "test",
 			h:          h,
 			wch:        make(chan *websocketMessageReq, 1),
 		}
 
-		err := conn.Send([]byte("async"))
+		err = conn.Send([]byte("async"))
 		So(err, ShouldNotBeNil)
 		So(err.Error(), ShouldContainSubstring, "request timed out for 1s")
 
@@ -149,8 +160,6 @@ func TestWsConnection(t *testing.T) {
 		So(err, ShouldNotBeNil)
 		So(err.Error(), ShouldContainSubstring, "request timed out for 1s")
 
-		cm, err := NewConnectionManager("default")
-		defer CloseConnectionManager("default")
 		conn, _ = cm.NewWebsocketConnection("test", &fakeWsConn{syncSleepTime: 5 * time.Second}, h, meta)
 		So(cm.Count(), ShouldEqual, 1)
 
@@ -160,6 +169,23 @@ func TestWsConnection(t *testing.T) {
 		So(conn.msgChans.len(), ShouldEqual, 0)
 	})
 
+	Convey("makes the response map and the publisher only when needed.", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		conn, _ := cm.NewWebsocketConnection("lazy/device", &fakeWsConn{}, h, meta)
+		So(conn.msgChans.m, ShouldBeNil)
+		So(conn.basicPublisher(), ShouldBeNil)
+		So(conn.Attached(), ShouldBeFalse)
+		So(conn.Topic(), ShouldEqual, "default/lazy-device")
+
+		conn.Attach()
+		So(conn.Attached(), ShouldBeTrue)
+		So(conn.basicPublisher().Topic(), ShouldEqual, conn.Topic())
+		conn.Detach()
+		So(conn.Attached(), ShouldBeFalse)
+	})
+
 	Convey("errors out send to closed connection", t, func() {
 		cm, err := NewConnectionManager("default")
 		defer CloseConnectionManager("default")
@@ -231,6 +257,25 @@ func TestWsConnection(t *testing.T) {
 		So(conn.msgChans.len(), ShouldEqual, 0)
 	})
 
+	Convey("answers calls with correlated responses", t, func() {
+		cm, _ := NewConnectionManager("default")
+		defer CloseConnectionManager("default")
+
+		fw := &fakeWsConn{}
+		conn, _ := cm.NewWebsocketConnection("test", fw, h, meta)
+
+		So(conn.Respond("call1", []byte("answer"), nil), ShouldBeNil)
+		So(string(fw.message), ShouldEqual, fmt.Sprintf("%d|call1|answer", TypeResponseMessage))
+
+		So(conn.Respond("call2", nil, errors.New("boom")), ShouldBeNil)
+		So(string(fw.message), ShouldEqual, fmt.Sprintf(`%d|call2|{"error":"boom"}`, TypeResponseMessage))
+
+		fw = &fakeWsConn{subprotocol: SubprotocolCbor}
+		conn, _ = cm.NewWebsocketConnection("binary", fw, h, meta)
+		So(conn.Respond("c3", nil, errors.New("boom")), ShouldBeNil)
+		So(fw.message[:6], ShouldResemble, []byte{byte(TypeResponseMessage), WsFlagRaw | WsFlagError, 2, 'c', '3', '{'})
+	})
+
 	Convey("replacing a connection, will close the old one", t, func() {
 		cm, _ := NewConnectionManager("default")
 		defer CloseConnectionManager("default")
@@ -0,0 +1,150 @@
+package connections
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsOpContinuation = 0
+	wsFinalBit       = 0x80
+	wsRsvBits        = 0x70
+	wsMaskBit        = 0x80
+)
+
+var wsUnmaskedFrameErr = errors.New("websocket frame of the client is not masked")
+
+// A complete message or control frame of a client, the opcode is one of the
+// websocket message types.
+type wsFrame struct {
+	opcode  int
+	payload []byte
+}
+
+// Parses the frames of a client as its bytes come in, for the connections
+// read by the poller, where a frame can take several reads and a read can
+// carry several frames. No extension is negotiated, so the reserved bits are
+// never set.
+type wsFrameReader struct {
+	// bytes of the frame read so far, nil between frames so that an idle
+	// connection holds nothing
+	pending []byte
+	// the fragments of a message that is not complete yet
+	fragments []byte
+	opcode    int
+}
+
+// Takes the bytes read from the socket, p is not kept, and returns the frames
+// they complete.
+func (r *wsFrameReader) feed(p []byte) ([]*wsFrame, error) {
+	buf := p
+	if len(r.pending) > 0 {
+		buf = append(r.pending, p...)
+	}
+
+	frames := []*wsFrame{}
+	for {
+		f, n, err := r.next(buf)
+		if err != nil {
+			r.pending = nil
+			return frames, err
+		}
+		if n == 0 {
+			break
+		}
+		buf = buf[n:]
+		if f != nil {
+			frames = append(frames, f)
+		}
+	}
+
+	if len(buf) == 0 {
+		r.pending = nil
+	} else {
+		r.pending = append([]byte(nil), buf...)
+	}
+	return frames, nil
+}
+
+// Parses the frame at the start of buf, n is 0 until the whole frame is in.
+// The fragments of a message only return a frame with the last one.
+func (r *wsFrameReader) next(buf []byte) (f *wsFrame, n int, err error) {
+	if len(buf) < 2 {
+		return
+	}
+
+	final := buf[0]&wsFinalBit != 0
+	opcode := int(buf[0] & 0x0f)
+	if buf[0]&wsRsvBits != 0 {
+		return nil, 0, errors.New(fmt.Sprintf("unexpected reserved bits 0x%x of websocket frame", buf[0]&wsRsvBits))
+	}
+	if buf[1]&wsMaskBit == 0 {
+		return nil, 0, wsUnmaskedFrameErr
+	}
+
+	header := 2
+	length := uint64(buf[1] & 0x7f)
+	switch length {
+	case 126:
+		header += 2
+		if len(buf) < header {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(buf[2:4]))
+	case 127:
+		header += 8
+		if len(buf) < header {
+			return
+		}
+		length = binary.BigEndian.Uint64(buf[2:10])
+		if length > 1<<62 {
+			return nil, 0, errors.New(fmt.Sprintf("invalid length %d of websocket frame", length))
+		}
+	}
+
+	control := opcode == websocket.CloseMessage || opcode == websocket.PingMessage || opcode == websocket.PongMessage
+	if control && (!final || length > 125) {
+		return nil, 0, errors.New(fmt.Sprintf("invalid websocket control frame %d", opcode))
+	}
+
+	if uint64(len(buf)) < uint64(header+4)+length {
+		return
+	}
+	mask := buf[header : header+4]
+	n = header + 4 + int(length)
+	payload := make([]byte, length)
+	for i, b := range buf[header+4 : n] {
+		payload[i] = b ^ mask[i%4]
+	}
+
+	switch {
+	case control:
+		return &wsFrame{opcode: opcode, payload: payload}, n, nil
+	case opcode == websocket.TextMessage || opcode == websocket.BinaryMessage:
+		if r.opcode != wsOpContinuation {
+			return nil, 0, errors.New("websocket message started before the last one is complete")
+		}
+		if final {
+			return &wsFrame{opcode: opcode, payload: payload}, n, nil
+		}
+		r.opcode = opcode
+		r.fragments = payload
+		return nil, n, nil
+	case opcode == wsOpContinuation:
+		if r.opcode == wsOpContinuation {
+			return nil, 0, errors.New("websocket continuation frame without a message")
+		}
+		r.fragments = append(r.fragments, payload...)
+		if !final {
+			return nil, n, nil
+		}
+		f = &wsFrame{opcode: r.opcode, payload: r.fragments}
+		r.opcode = wsOpContinuation
+		r.fragments = nil
+		return f, n, nil
+	default:
+		return nil, 0, errors.New(fmt.Sprintf("unsupported websocket opcode %d", opcode))
+	}
+}
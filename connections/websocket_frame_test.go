@@ -0,0 +1,106 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+// A frame the way clients send it, masked.
+func clientFrame(final bool, opcode int, payload []byte) []byte {
+	b0 := byte(opcode)
+	if final {
+		b0 |= wsFinalBit
+	}
+	f := []byte{b0}
+
+	switch {
+	case len(payload) < 126:
+		f = append(f, wsMaskBit|byte(len(payload)))
+	case len(payload) < 1<<16:
+		f = append(f, wsMaskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(f[2:], uint16(len(payload)))
+	default:
+		f = append(f, wsMaskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(f[2:], uint64(len(payload)))
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	f = append(f, mask...)
+	for i, b := range payload {
+		f = append(f, b^mask[i%4])
+	}
+	return f
+}
+
+func TestWebsocketFrames(t *testing.T) {
+
+	Convey("parses the frames of a read.", t, func() {
+		r := &wsFrameReader{}
+		p := append(clientFrame(true, websocket.TextMessage, []byte("1|a|hello")), clientFrame(true, websocket.PingMessage, []byte("ping"))...)
+
+		frames, err := r.feed(p)
+		So(err, ShouldBeNil)
+		So(len(frames), ShouldEqual, 2)
+		So(frames[0].opcode, ShouldEqual, websocket.TextMessage)
+		So(string(frames[0].payload), ShouldEqual, "1|a|hello")
+		So(frames[1].opcode, ShouldEqual, websocket.PingMessage)
+		So(string(frames[1].payload), ShouldEqual, "ping")
+		So(r.pending, ShouldBeNil)
+	})
+
+	Convey("keeps the frames split across reads.", t, func() {
+		r := &wsFrameReader{}
+		payload := bytes.Repeat([]byte("x"), 70000)
+		p := clientFrame(true, websocket.BinaryMessage, payload)
+
+		frames := []*wsFrame{}
+		for len(p) > 0 {
+			n := 4096
+			if n > len(p) {
+				n = len(p)
+			}
+			fs, err := r.feed(p[:n])
+			So(err, ShouldBeNil)
+			frames = append(frames, fs...)
+			p = p[n:]
+		}
+		So(len(frames), ShouldEqual, 1)
+		So(bytes.Equal(frames[0].payload, payload), ShouldBeTrue)
+		So(r.pending, ShouldBeNil)
+	})
+
+	Convey("puts fragmented messages together, with control frames in between.", t, func() {
+		r := &wsFrameReader{}
+		p := clientFrame(false, websocket.TextMessage, []byte("1|a|"))
+		p = append(p, clientFrame(true, websocket.PongMessage, []byte("pong"))...)
+		p = append(p, clientFrame(false, wsOpContinuation, []byte("hel"))...)
+		p = append(p, clientFrame(true, wsOpContinuation, []byte("lo"))...)
+
+		frames, err := r.feed(p)
+		So(err, ShouldBeNil)
+		So(len(frames), ShouldEqual, 2)
+		So(frames[0].opcode, ShouldEqual, websocket.PongMessage)
+		So(frames[1].opcode, ShouldEqual, websocket.TextMessage)
+		So(string(frames[1].payload), ShouldEqual, "1|a|hello")
+	})
+
+	Convey("errors out for frames that break the protocol.", t, func() {
+		f := clientFrame(true, websocket.TextMessage, []byte("hello"))
+		f[1] &^= wsMaskBit
+		_, err := (&wsFrameReader{}).feed(f)
+		So(err, ShouldEqual, wsUnmaskedFrameErr)
+
+		_, err = (&wsFrameReader{}).feed(clientFrame(false, websocket.PingMessage, []byte("ping")))
+		So(err, ShouldNotBeNil)
+
+		_, err = (&wsFrameReader{}).feed(clientFrame(true, wsOpContinuation, []byte("hello")))
+		So(err, ShouldNotBeNil)
+
+		_, err = (&wsFrameReader{}).feed(clientFrame(true, 3, []byte("hello")))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "unsupported websocket opcode 3")
+	})
+}
@@ -13,10 +13,32 @@ var SupportedWebsocketMessageTypes = map[MessageType]string{
 	TypeResponseMessage:   "response",
 	TypeSendMessage:       "send",
 	TypeRequestMessage:    "request",
+	TypeCallMessage:       "call",
 	TypeConnectMessage:    "connect",
 	TypeDisconnectMessage: "disconnect",
 }
 
+// Subprotocols a device can pick for the compact binary framing. Without a
+// subprotocol the text framing "type|id|payload" is used.
+const (
+	SubprotocolCbor    = "eywa.cbor.v1"
+	SubprotocolMsgpack = "eywa.msgpack.v1"
+)
+
+var WebsocketSubprotocols = map[string]string{
+	SubprotocolCbor:    EncodingCbor,
+	SubprotocolMsgpack: EncodingMsgpack,
+}
+
+// Flags of the binary framing. A raw payload is passed through as is
+// instead of being encoded with the encoding of the subprotocol, the
+// messages sent by the server are always raw. The error flag marks the
+// answer to a failed call.
+const (
+	WsFlagRaw   byte = 1 << 0
+	WsFlagError byte = 1 << 1
+)
+
 type websocketMessageResp struct {
 	msg *websocketMessage
 	err error
@@ -28,10 +50,12 @@ type websocketMessageReq struct {
 }
 
 type websocketMessage struct {
-	_type   MessageType
-	id      string
-	payload []byte
-	raw     []byte
+	_type    MessageType
+	id       string
+	payload  []byte
+	raw      []byte
+	encoding string
+	flags    byte
 }
 
 func NewWebsocketMessage(t MessageType, id string, payload []byte, raw []byte) *websocketMessage {
@@ -43,6 +67,14 @@ func (m *websocketMessage) Type() MessageType  { return m._type }
 func (m *websocketMessage) Id() string         { return m.id }
 func (m *websocketMessage) Payload() []byte    { return m.payload }
 func (m *websocketMessage) Raw() []byte        { return m.raw }
+func (m *websocketMessage) Flags() byte        { return m.flags }
+
+func (m *websocketMessage) Encoding() string {
+	if m.flags&WsFlagRaw != 0 {
+		return ""
+	}
+	return m.encoding
+}
 
 func (m *websocketMessage) Marshal() ([]byte, error) {
 	if _, found := SupportedWebsocketMessageTypes[m._type]; !found {
@@ -58,13 +90,17 @@ func (m *websocketMessage) Marshal() ([]byte, error) {
 	}
 
 	if len(m.id) == 0 {
-		if m._type == TypeRequestMessage || m._type == TypeResponseMessage {
+		if m._type == TypeRequestMessage || m._type == TypeResponseMessage || m._type == TypeCallMessage {
 			return nil, errors.New(fmt.Sprintf("missing message id for websocket message type %s", SupportedWebsocketMessageTypes[m._type]))
 		} else {
 			m.id = strconv.FormatInt(time.Now().UnixNano(), 16)
 		}
 	}
 
+	if len(m.encoding) > 0 {
+		return m.marshalBinary()
+	}
+
 	p := bytes.Buffer{}
 
 	_, err := p.WriteString(fmt.Sprintf("%d|%s|", m._type, m.id))
@@ -95,6 +131,10 @@ func (m *websocketMessage) Unmarshal() error {
 		}
 	}
 
+	if len(m.encoding) > 0 {
+		return m.unmarshalBinary()
+	}
+
 	pips := 0
 	var pip1, pip2 int
 	for idx, b := range m.raw {
@@ -128,7 +168,52 @@ func (m *websocketMessage) Unmarshal() error {
 	}
 
 	if len(m.id) == 0 {
-		if m._type == TypeRequestMessage || m._type == TypeResponseMessage {
+		if m._type == TypeRequestMessage || m._type == TypeResponseMessage || m._type == TypeCallMessage {
+			return errors.New(fmt.Sprintf("empty message id for websocket message type %s", SupportedWebsocketMessageTypes[m._type]))
+		} else {
+			m.id = strconv.FormatInt(time.Now().UnixNano(), 16)
+		}
+	}
+
+	return nil
+}
+
+// The binary framing is a header of the message type, the flags and the
+// length of the id, one byte each, followed by the id and the payload.
+func (m *websocketMessage) marshalBinary() ([]byte, error) {
+	if len(m.id) > 255 {
+		return nil, errors.New(fmt.Sprintf("message id is longer than 255 bytes for websocket message type %s", SupportedWebsocketMessageTypes[m._type]))
+	}
+
+	p := make([]byte, 0, 3+len(m.id)+len(m.payload))
+	p = append(p, byte(m._type), m.flags, byte(len(m.id)))
+	p = append(p, m.id...)
+	p = append(p, m.payload...)
+
+	m.raw = p
+	return m.raw, nil
+}
+
+func (m *websocketMessage) unmarshalBinary() error {
+	if len(m.raw) < 3 {
+		return errors.New(fmt.Sprintf("expected a header of 3 bytes instead of %d for binary websocket message", len(m.raw)))
+	}
+
+	m._type = MessageType(m.raw[0])
+	m.flags = m.raw[1]
+	idLen := int(m.raw[2])
+	if _, found := SupportedWebsocketMessageTypes[m._type]; !found {
+		return errors.New(fmt.Sprintf("unsupported websocket message type %d", m._type))
+	}
+	if len(m.raw) < 3+idLen {
+		return errors.New(fmt.Sprintf("message id of %d bytes is truncated for websocket message type %s", idLen, SupportedWebsocketMessageTypes[m._type]))
+	}
+
+	m.id = string(m.raw[3 : 3+idLen])
+	m.payload = m.raw[3+idLen:]
+
+	if len(m.id) == 0 {
+		if m._type == TypeRequestMessage || m._type == TypeResponseMessage || m._type == TypeCallMessage {
 			return errors.New(fmt.Sprintf("empty message id for websocket message type %s", SupportedWebsocketMessageTypes[m._type]))
 		} else {
 			m.id = strconv.FormatInt(time.Now().UnixNano(), 16)
@@ -98,4 +98,40 @@ func TestWebsocketMessageSerializations(t *testing.T) {
 		So(m.id, ShouldEqual, "1")
 		So(string(m.payload), ShouldEqual, "abc|def")
 	})
+
+	Convey("websocket messages use the binary framing with an encoding", t, func() {
+		m := &websocketMessage{_type: TypeRequestMessage, id: "abc", payload: []byte{0xa1, 0x01}, encoding: EncodingCbor, flags: WsFlagRaw}
+		raw, err := m.Marshal()
+		So(err, ShouldBeNil)
+		So(raw, ShouldResemble, []byte{byte(TypeRequestMessage), WsFlagRaw, 3, 'a', 'b', 'c', 0xa1, 0x01})
+
+		m = &websocketMessage{raw: raw, encoding: EncodingCbor}
+		err = m.Unmarshal()
+		So(err, ShouldBeNil)
+		So(m._type, ShouldEqual, TypeRequestMessage)
+		So(m.id, ShouldEqual, "abc")
+		So(m.payload, ShouldResemble, []byte{0xa1, 0x01})
+		So(m.Encoding(), ShouldEqual, "")
+
+		m = &websocketMessage{raw: []byte{byte(TypeUploadMessage), 0, 0, 0xa0}, encoding: EncodingMsgpack}
+		err = m.Unmarshal()
+		So(err, ShouldBeNil)
+		So(len(m.id), ShouldBeGreaterThan, 0)
+		So(m.Encoding(), ShouldEqual, EncodingMsgpack)
+
+		m = &websocketMessage{raw: []byte{byte(TypeUploadMessage), 0}, encoding: EncodingCbor}
+		err = m.Unmarshal()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "expected a header of 3 bytes instead of 2 for binary websocket message")
+
+		m = &websocketMessage{raw: []byte{byte(TypeUploadMessage), 0, 5, 'a'}, encoding: EncodingCbor}
+		err = m.Unmarshal()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "message id of 5 bytes is truncated for websocket message type upload")
+
+		m = &websocketMessage{raw: []byte{byte(TypeResponseMessage), 0, 0}, encoding: EncodingCbor}
+		err = m.Unmarshal()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "empty message id for websocket message type response")
+	})
 }
@@ -0,0 +1,181 @@
+// +build linux
+
+package connections
+
+import (
+	. "github.com/eywa/configs"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// bytes a worker reads from a socket at once
+const pollReadSize = 4096
+
+// how long the poller waits for events before it looks for silent sockets
+const pollWaitMillis = 1000
+
+var pollReadBuffers = sync.Pool{
+	New: func() interface{} { return make([]byte, pollReadSize) },
+}
+
+// wsPoller waits on the sockets of the polled websocket connections with
+// epoll and hands the readable ones to a fixed number of workers. A socket
+// is armed for a single event, so that its connection is only read by one
+// worker at a time, and is armed again once the worker is done with it.
+type wsPoller struct {
+	epfd int
+
+	sync.RWMutex
+	conns map[int]*PolledWebsocketConnection
+
+	readable  chan *PolledWebsocketConnection
+	lastSweep time.Time
+}
+
+func newWsPoller(workers int) (*wsPoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &wsPoller{
+		epfd:      epfd,
+		conns:     make(map[int]*PolledWebsocketConnection),
+		readable:  make(chan *PolledWebsocketConnection, 64*workers),
+		lastSweep: time.Now(),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.poll()
+	return p, nil
+}
+
+func (p *wsPoller) add(c *PolledWebsocketConnection) error {
+	var fd int
+	err := c.raw.Control(func(s uintptr) { fd = int(s) })
+	if err != nil {
+		return err
+	}
+	c.fd = fd
+
+	p.Lock()
+	p.conns[fd] = c
+	p.Unlock()
+
+	err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, p.event(fd))
+	if err != nil {
+		p.Lock()
+		delete(p.conns, fd)
+		p.Unlock()
+	}
+	return err
+}
+
+func (p *wsPoller) remove(c *PolledWebsocketConnection) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.conns[c.fd] == c {
+		delete(p.conns, c.fd)
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	}
+}
+
+func (p *wsPoller) rearm(c *PolledWebsocketConnection) {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.conns[c.fd] == c {
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, c.fd, p.event(c.fd))
+	}
+}
+
+func (p *wsPoller) event(fd int) *syscall.EpollEvent {
+	return &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(fd),
+	}
+}
+
+func (p *wsPoller) poll() {
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, pollWaitMillis)
+		if err != nil && err != syscall.EINTR {
+			continue
+		}
+
+		for i := 0; i < n; i++ {
+			p.RLock()
+			c, found := p.conns[int(events[i].Fd)]
+			p.RUnlock()
+			if found {
+				p.readable <- c
+			}
+		}
+
+		p.sweep(time.Now())
+	}
+}
+
+func (p *wsPoller) work() {
+	for c := range p.readable {
+		buf := pollReadBuffers.Get().([]byte)
+
+		var n int
+		var err error
+		rerr := c.raw.Read(func(fd uintptr) bool {
+			n, err = syscall.Read(int(fd), buf)
+			return true
+		})
+		if rerr != nil {
+			err = rerr
+		}
+
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+			p.rearm(c)
+		case err != nil:
+			c.readFailed(err)
+		case n == 0:
+			c.readFailed(syscall.ECONNRESET)
+		default:
+			c.received(buf[:n])
+			p.rearm(c)
+		}
+
+		pollReadBuffers.Put(buf)
+	}
+}
+
+// Closes the connections not heard from within the read timeout, which is
+// what the read deadline of a WebsocketConnection does.
+func (p *wsPoller) sweep(now time.Time) {
+	timeout := Config().Connections.Websocket.Timeouts.Read.Duration
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if timeout <= 0 || now.Sub(p.lastSweep) < interval {
+		return
+	}
+	p.lastSweep = now
+
+	silent := []*PolledWebsocketConnection{}
+	p.RLock()
+	for _, c := range p.conns {
+		if now.Sub(c.LastPingedAt()) > timeout {
+			silent = append(silent, c)
+		}
+	}
+	p.RUnlock()
+
+	// a worker could be reading one of them, the poller doesn't wait for it
+	go func() {
+		for _, c := range silent {
+			c.readFailed(syscall.ETIMEDOUT)
+		}
+	}()
+}
@@ -0,0 +1,194 @@
+// +build linux
+
+package connections
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/websocket"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolledWsConnection(t *testing.T) {
+
+	SetConfig(&Conf{
+		Connections: &ConnectionsConf{
+			Websocket: &WsConnectionConf{
+				RequestQueueSize: 8,
+				Timeouts: &WsConnectionTimeoutConf{
+					Write:    &JSONDuration{2 * time.Second},
+					Read:     &JSONDuration{300 * time.Second},
+					Request:  &JSONDuration{1 * time.Second},
+					Response: &JSONDuration{2 * time.Second},
+				},
+				BufferSizes: &WsConnectionBufferSizeConf{
+					Write: 1024,
+					Read:  1024,
+				},
+				Transport:   WsTransportEpoll,
+				PollWorkers: 2,
+			},
+		},
+	})
+
+	type received struct {
+		m   Message
+		err error
+	}
+	messages := make(chan *received, 16)
+	h := func(c Connection, m Message, e error) {
+		if m != nil && (m.Type() == TypeUploadMessage || m.Type() == TypeDisconnectMessage) || e != nil {
+			messages <- &received{m: m, err: e}
+		}
+	}
+
+	cm, _ := NewConnectionManager("polled")
+	defer CloseConnectionManager("polled")
+
+	conns := make(chan Connection, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn, _ := cm.NewWebsocket("dev", ws, h, nil)
+		conns <- conn
+	}))
+	defer server.Close()
+
+	cli, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	conn := <-conns
+
+	Convey("is polled when the transport is epoll.", t, func() {
+		_, ok := conn.(*PolledWebsocketConnection)
+		So(ok, ShouldBeTrue)
+		So(cm.Count(), ShouldEqual, 1)
+	})
+
+	Convey("reads the messages of the device, however they are framed.", t, func() {
+		cli.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("%d|1|small", TypeUploadMessage)))
+		r := <-messages
+		So(r.err, ShouldBeNil)
+		So(string(r.m.Payload()), ShouldEqual, "small")
+
+		// the client fragments what doesn't fit its write buffer
+		large := bytes.Repeat([]byte("x"), 20000)
+		cli.WriteMessage(websocket.TextMessage, append([]byte(fmt.Sprintf("%d|2|", TypeUploadMessage)), large...))
+		r = <-messages
+		So(r.err, ShouldBeNil)
+		So(bytes.Equal(r.m.Payload(), large), ShouldBeTrue)
+	})
+
+	Convey("sends and requests.", t, func() {
+		err := conn.(Sender).Send([]byte("hello"))
+		So(err, ShouldBeNil)
+		_, p, err := cli.ReadMessage()
+		So(err, ShouldBeNil)
+		So(string(p), ShouldEndWith, "|hello")
+
+		go func() {
+			_, p, err := cli.ReadMessage()
+			if err != nil {
+				return
+			}
+			req := &websocketMessage{raw: p}
+			req.Unmarshal()
+			cli.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("%d|%s|pong", TypeResponseMessage, req.id)))
+		}()
+		resp, err := conn.(Requester).Request([]byte("ping"), time.Second)
+		So(err, ShouldBeNil)
+		So(string(resp), ShouldEqual, "pong")
+		So(conn.(*PolledWebsocketConnection).msgChans.len(), ShouldEqual, 0)
+	})
+
+	Convey("is closed and unregistered when the device leaves.", t, func() {
+		cli.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		r := <-messages
+		So(r.m.Type(), ShouldEqual, TypeDisconnectMessage)
+		So(conn.Closed(), ShouldBeTrue)
+		So(cm.Count(), ShouldEqual, 0)
+
+		err := conn.(Sender).Send([]byte("hello"))
+		So(err, ShouldEqual, wsConnClosedErr)
+	})
+}
+
+// Compares what idle devices cost on each transport over real sockets, the
+// clients are counted as well.
+func BenchmarkWsTransportMemory(b *testing.B) {
+	const conns = 2000
+	for _, transport := range SupportedWsTransports {
+		SetConfig(&Conf{
+			Connections: &ConnectionsConf{
+				Websocket: &WsConnectionConf{
+					RequestQueueSize: 8,
+					Timeouts: &WsConnectionTimeoutConf{
+						Write:    &JSONDuration{2 * time.Second},
+						Read:     &JSONDuration{300 * time.Second},
+						Request:  &JSONDuration{1 * time.Second},
+						Response: &JSONDuration{2 * time.Second},
+					},
+					BufferSizes: &WsConnectionBufferSizeConf{
+						Write: 1024,
+						Read:  1024,
+					},
+					Transport:   transport,
+					PollWorkers: 2,
+				},
+			},
+		})
+
+		b.Run(transport, func(b *testing.B) {
+			var used uint64
+			for n := 0; n < b.N; n++ {
+				cm, _ := NewConnectionManager("bench")
+				registered := make(chan struct{}, conns)
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ws, err := (&websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}).Upgrade(w, r, nil)
+					if err != nil {
+						return
+					}
+					cm.NewWebsocket(r.URL.Query().Get("id"), ws, func(Connection, Message, error) {}, nil)
+					registered <- struct{}{}
+				}))
+
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				clis := []*websocket.Conn{}
+				for i := 0; i < conns; i++ {
+					cli, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws%s?id=%d", strings.TrimPrefix(server.URL, "http"), i), nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					<-registered
+					clis = append(clis, cli)
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				used += (after.HeapAlloc + after.StackInuse) - (before.HeapAlloc + before.StackInuse)
+
+				CloseConnectionManager("bench")
+				for _, cli := range clis {
+					cli.Close()
+				}
+				server.Close()
+			}
+			b.ReportMetric(float64(used)/float64(b.N*conns), "bytes/conn")
+		})
+	}
+}
@@ -0,0 +1,21 @@
+// +build !linux
+
+package connections
+
+import (
+	"errors"
+)
+
+var wsPollerUnsupportedErr = errors.New("the epoll websocket transport is only supported on linux")
+
+// The epoll transport only exists on linux, elsewhere the websockets always
+// fall back to the goroutines.
+type wsPoller struct{}
+
+func newWsPoller(workers int) (*wsPoller, error) {
+	return nil, wsPollerUnsupportedErr
+}
+
+func (p *wsPoller) add(c *PolledWebsocketConnection) error { return wsPollerUnsupportedErr }
+
+func (p *wsPoller) remove(c *PolledWebsocketConnection) {}
@@ -3,6 +3,8 @@ package handlers
 import (
 	"encoding/json"
 	"github.com/zenazn/goji/web"
+	"github.com/eywa/connections"
+	"github.com/eywa/message_handlers"
 	"github.com/eywa/models"
 	. "github.com/eywa/presenters"
 	. "github.com/eywa/utils"
@@ -90,7 +92,7 @@ func GetChannelTagStats(c web.C, w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 	} else {
-		stats, err := q.QueryES()
+		stats, err := q.Query()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 		} else {
@@ -140,10 +142,14 @@ func DeleteChannel(c web.C, w http.ResponseWriter, r *http.Request) {
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
 	} else {
+		hooks := models.ChannelWebhooks(ch.Id)
 		err := ch.Delete()
 		if err != nil {
 			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		} else {
+			for _, hook := range hooks {
+				message_handlers.RemoveWebhookDeliveries(hook.Id)
+			}
 			if r.URL.Query().Get("with_indices") == "true" {
 				err = ch.DeleteIndices()
 			}
@@ -155,3 +161,11 @@ func DeleteChannel(c web.C, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+func ListMessageHandlers(c web.C, w http.ResponseWriter, r *http.Request) {
+	Render.JSON(w, http.StatusOK, map[string][]string{
+		"message_handlers": connections.RegisteredMiddlewares(),
+		"defaults":         models.DefaultMessageHandlers,
+		"core":             models.CoreMessageHandlers,
+	})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/zenazn/goji/web"
+	"github.com/eywa/cluster"
+	"github.com/eywa/connections"
+	. "github.com/eywa/utils"
+	"net/http"
+)
+
+func ClusterGossip(c web.C, w http.ResponseWriter, r *http.Request) {
+	msg := &cluster.GossipMessage{}
+	err := json.NewDecoder(r.Body).Decode(msg)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	resp, err := cluster.Gossip(msg)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusOK, resp)
+	}
+}
+
+// Tells a peer whether the device is connected to this node.
+func ClusterFindDevice(c web.C, w http.ResponseWriter, r *http.Request) {
+	cm, found := connections.FindConnectionManager(c.URLParams["channel_id"])
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	if _, found = cm.FindConnection(c.URLParams["device_id"]); !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "device is not online"})
+	} else {
+		Render.JSON(w, http.StatusOK, map[string]string{"node": cluster.LocalNode().Name})
+	}
+}
+
+func ListClusterNodes(c web.C, w http.ResponseWriter, r *http.Request) {
+	Render.JSON(w, http.StatusOK, cluster.Nodes())
+}
+
+// When the device is connected to another node of the cluster, the request
+// is handed over to that node. Returns true if the request was forwarded.
+func forwardToOwner(c web.C, w http.ResponseWriter, r *http.Request) bool {
+	if !cluster.Enabled() || cluster.Forwarded(r) {
+		return false
+	}
+
+	node, found := cluster.Lookup(c.URLParams["channel_id"], c.URLParams["device_id"])
+	if !found {
+		return false
+	}
+
+	cluster.Forward(w, r, node)
+	return true
+}
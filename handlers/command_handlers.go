@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"github.com/zenazn/goji/web"
+	. "github.com/eywa/configs"
+	"github.com/eywa/connections"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sends the queued commands to a device connected over websocket or mqtt,
+// their sends return once the commands are written to the device. Http
+// connections take theirs with pollCommand.
+func deliverCommands(ch *models.Channel, conn connections.Connection) int {
+	sender, ok := conn.(connections.Sender)
+	if !ok {
+		return 0
+	}
+
+	if _, ok = conn.(*connections.HttpConnection); ok {
+		return 0
+	}
+	return models.DeliverCommands(ch.Id, conn.Identifier(), Config().Commands.MaxDepth, sender.Send)
+}
+
+// The commands answering http polls, until the responses are written.
+var polledCommands = struct {
+	sync.Mutex
+	cmds map[*connections.HttpConnection]*models.Command
+}{cmds: make(map[*connections.HttpConnection]*models.Command)}
+
+// A poll only carries one message back, so it takes the oldest queued command.
+// The command is marked as sent by the poll handler once the response is
+// written, see polledCommand.
+func pollCommand(ch *models.Channel, conn *connections.HttpConnection) bool {
+	if conn.ConnectionType() != connections.HttpConnectionTypes[connections.HttpPoll] {
+		return false
+	}
+
+	cmds := models.PendingCommands(ch.Id, conn.Identifier(), 1)
+	if len(cmds) == 0 {
+		return false
+	}
+
+	cmd := cmds[0]
+	polledCommands.Lock()
+	if _, found := polledCommands.cmds[conn]; found {
+		polledCommands.Unlock()
+		return false
+	}
+	polledCommands.cmds[conn] = cmd
+	polledCommands.Unlock()
+
+	if err := conn.Send([]byte(cmd.Payload)); err != nil {
+		polledCommands.Lock()
+		delete(polledCommands.cmds, conn)
+		polledCommands.Unlock()
+		cmd.Sent(err)
+		return false
+	}
+	return true
+}
+
+// Takes the command sent to a poll, if any.
+func polledCommand(conn *connections.HttpConnection) *models.Command {
+	polledCommands.Lock()
+	defer polledCommands.Unlock()
+
+	cmd := polledCommands.cmds[conn]
+	delete(polledCommands.cmds, conn)
+	return cmd
+}
+
+// Queues the body of a send request for an offline device.
+func queueCommand(ch *models.Channel, cm *connections.ConnectionManager, deviceId string, w http.ResponseWriter, r *http.Request) {
+	var ttl time.Duration
+	if ttlStr := r.URL.Query().Get("ttl"); len(ttlStr) > 0 {
+		var err error
+		ttl, err = time.ParseDuration(ttlStr)
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	cmd := &models.Command{
+		ChannelId:      ch.Id,
+		DeviceId:       deviceId,
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		Payload:        string(bodyBytes),
+	}
+	created, err := models.EnqueueCommand(cmd, ttl)
+	if err == models.CommandQueueFullErr {
+		Render.JSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// the device may have connected in the meantime, a poll gets the command
+	// now but only has it delivered once its response is written
+	if conn, found := cm.FindConnection(deviceId); found {
+		if httpConn, ok := conn.(*connections.HttpConnection); ok {
+			pollCommand(ch, httpConn)
+		} else if deliverCommands(ch, conn) > 0 {
+			cmd.FindById(cmd.Id)
+		}
+	}
+
+	if created {
+		Render.JSON(w, http.StatusAccepted, cmd)
+	} else {
+		Render.JSON(w, http.StatusOK, cmd)
+	}
+}
+
+func findCommand(c web.C) (*models.Command, bool) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		return nil, false
+	}
+
+	id, err := strconv.Atoi(c.URLParams["command_id"])
+	if err != nil {
+		return nil, false
+	}
+
+	cmd := &models.Command{}
+	if found = cmd.FindById(id); !found || cmd.ChannelId != ch.Id || cmd.DeviceId != c.URLParams["device_id"] {
+		return nil, false
+	}
+	return cmd, true
+}
+
+func ListCommands(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if len(status) > 0 && !StringSliceContains(models.SupportedCommandStatuses, status) {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported status: " + status})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, models.DeviceCommands(ch.Id, c.URLParams["device_id"], status))
+}
+
+func GetCommand(c web.C, w http.ResponseWriter, r *http.Request) {
+	cmd, found := findCommand(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "command not found"})
+	} else {
+		Render.JSON(w, http.StatusOK, cmd)
+	}
+}
+
+func CancelCommand(c web.C, w http.ResponseWriter, r *http.Request) {
+	cmd, found := findCommand(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "command not found"})
+		return
+	}
+
+	if err := cmd.Cancel(); err != nil {
+		Render.JSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusOK, cmd)
+	}
+}
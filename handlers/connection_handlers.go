@@ -39,6 +39,29 @@ func ConnectionCount(c web.C, w http.ResponseWriter, r *http.Request) {
 	Render.JSON(w, http.StatusOK, map[string]int{c.URLParams["channel_id"]: cm.Count()})
 }
 
+func ConnectionStats(c web.C, w http.ResponseWriter, r *http.Request) {
+	_, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	cm, found := connections.FindConnectionManager(c.URLParams["channel_id"])
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("connection manager is not initialized for channel: %s", c.URLParams["channel_id"]),
+		})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, map[string]interface{}{
+		"count":            cm.Count(),
+		"connection_limit": cm.ConnectionLimit(),
+		"rejected":         cm.Rejected(),
+		"dispatcher":       cm.DispatcherStats(),
+	})
+}
+
 func ConnectionStatus(c web.C, w http.ResponseWriter, r *http.Request) {
 	ch, found := findCachedChannel(c, "channel_id")
 	if !found {
@@ -49,6 +72,12 @@ func ConnectionStatus(c web.C, w http.ResponseWriter, r *http.Request) {
 	devId := c.URLParams["device_id"]
 	history := r.URL.Query().Get("history")
 
+	if cm, found := connections.FindConnectionManager(c.URLParams["channel_id"]); found {
+		if _, online := cm.FindConnection(devId); !online && forwardToOwner(c, w, r) {
+			return
+		}
+	}
+
 	status, err := models.FindConnectionStatus(ch, devId, history == "true")
 	if err != nil {
 		Render.JSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
@@ -58,7 +87,7 @@ func ConnectionStatus(c web.C, w http.ResponseWriter, r *http.Request) {
 }
 
 func SendToDevice(c web.C, w http.ResponseWriter, r *http.Request) {
-	_, found := findCachedChannel(c, "channel_id")
+	ch, found := findCachedChannel(c, "channel_id")
 	if !found {
 		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
 		return
@@ -75,7 +104,14 @@ func SendToDevice(c web.C, w http.ResponseWriter, r *http.Request) {
 	deviceId := c.URLParams["device_id"]
 	conn, found := cm.FindConnection(deviceId)
 	if !found {
-		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "device is not online"})
+		if forwardToOwner(c, w, r) {
+			return
+		}
+		if r.URL.Query().Get("queue") == "true" {
+			queueCommand(ch, cm, deviceId, w, r)
+		} else {
+			Render.JSON(w, http.StatusNotFound, map[string]string{"error": "device is not online"})
+		}
 		return
 	}
 
@@ -126,7 +162,9 @@ func RequestToDevice(c web.C, w http.ResponseWriter, r *http.Request) {
 	deviceId := c.URLParams["device_id"]
 	conn, found := cm.FindConnection(deviceId)
 	if !found {
-		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "device is not online"})
+		if !forwardToOwner(c, w, r) {
+			Render.JSON(w, http.StatusNotFound, map[string]string{"error": "device is not online"})
+		}
 		return
 	}
 
@@ -207,7 +245,9 @@ func AttachConnection(c web.C, w http.ResponseWriter, r *http.Request) {
 	deviceId := c.URLParams["device_id"]
 	conn, found := cm.FindConnection(deviceId)
 	if !found {
-		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "device is not online"})
+		if !forwardToOwner(c, w, r) {
+			Render.JSON(w, http.StatusNotFound, map[string]string{"error": "device is not online"})
+		}
 		return
 	}
 
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/zenazn/goji/web"
+	"github.com/eywa/connections"
+	. "github.com/eywa/loggers"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Checks the ban list before a device is upgraded, writing the error response
+// for a banned device. A quarantined device gets a message handler that drops
+// its uploads and calls, passing them down with models.DeviceQuarantinedErr so
+// that the logger shows the drop in the attach stream.
+func admitDevice(ch *models.Channel, deviceId string, w http.ResponseWriter) (connections.MessageHandler, bool) {
+	h, err := deviceMessageHandler(ch, deviceId)
+	if err != nil {
+		Render.JSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	return h, true
+}
+
+func deviceMessageHandler(ch *models.Channel, deviceId string) (connections.MessageHandler, error) {
+	ban, found := models.FindCachedDeviceBan(ch.Id, deviceId)
+	if !found {
+		return messageHandler(ch), nil
+	}
+	if ban.Mode != models.BanModeQuarantine {
+		return nil, models.DeviceBannedErr
+	}
+
+	h := messageHandler(ch)
+	return func(c connections.Connection, m connections.Message, e error) {
+		if e == nil && m != nil && (m.Type() == connections.TypeUploadMessage || m.Type() == connections.TypeCallMessage) {
+			e = models.DeviceQuarantinedErr
+		}
+		h(c, m, e)
+	}, nil
+}
+
+func recordDeviceActivity(ch *models.Channel, deviceId, activity string, meta map[string]string) {
+	if err := models.RecordDeviceActivity(ch, deviceId, activity, meta); err != nil {
+		Logger.Error(fmt.Sprintf("failed to record %s of device %s: %s", activity, deviceId, err.Error()))
+	}
+}
+
+func KickDevice(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	cm, found := connections.FindConnectionManager(c.URLParams["channel_id"])
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("connection manager is not initialized for channel: %s", c.URLParams["channel_id"]),
+		})
+		return
+	}
+
+	deviceId := c.URLParams["device_id"]
+	if !cm.Kick(deviceId) {
+		if forwardToOwner(c, w, r) {
+			return
+		}
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "device is not online"})
+		return
+	}
+
+	recordDeviceActivity(ch, deviceId, "kick", map[string]string{"reason": r.URL.Query().Get("reason")})
+	w.WriteHeader(http.StatusOK)
+}
+
+func ListDeviceBans(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, models.ChannelDeviceBans(ch.Id))
+}
+
+func GetDeviceBan(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	ban, found := models.FindDeviceBan(ch.Id, c.URLParams["device_id"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		Render.JSON(w, http.StatusOK, ban)
+	}
+}
+
+// Bans or quarantines a device for ?ttl=, or until the ban is lifted. The
+// device is kicked, so that it either stays out or comes back quarantined.
+func BanDevice(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	cm, found := connections.FindConnectionManager(c.URLParams["channel_id"])
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("connection manager is not initialized for channel: %s", c.URLParams["channel_id"]),
+		})
+		return
+	}
+
+	deviceId := c.URLParams["device_id"]
+	if _, found := cm.FindConnection(deviceId); !found && forwardToOwner(c, w, r) {
+		return
+	}
+
+	var ttl time.Duration
+	if ttlStr := r.URL.Query().Get("ttl"); len(ttlStr) > 0 {
+		var err error
+		ttl, err = time.ParseDuration(ttlStr)
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	ban := &models.DeviceBan{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(ban); err != nil {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	ban.ChannelId = ch.Id
+	ban.DeviceId = deviceId
+
+	if err := models.BanDevice(ban, ttl); err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	cm.Kick(deviceId)
+	recordDeviceActivity(ch, deviceId, ban.Mode, map[string]string{
+		"reason":     ban.Reason,
+		"expires_at": strconv.FormatInt(ban.ExpiresAt, 10),
+	})
+	Render.JSON(w, http.StatusOK, ban)
+}
+
+func LiftDeviceBan(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	deviceId := c.URLParams["device_id"]
+	ban, found := models.FindDeviceBan(ch.Id, deviceId)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := ban.Delete(); err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	recordDeviceActivity(ch, deviceId, "unban", map[string]string{"mode": ban.Mode})
+	w.WriteHeader(http.StatusOK)
+}
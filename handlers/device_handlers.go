@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zenazn/goji/web"
+	. "github.com/eywa/loggers"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A device with its secret, which is taken on create and update but only
+// rendered by create, bulk create and rotate.
+type deviceWithSecret struct {
+	*models.Device
+	Secret string `json:"secret,omitempty"`
+}
+
+// Checks the token of a connecting device and writes the error response when
+// it is rejected.
+func authenticateDevice(ch *models.Channel, deviceId, token string, w http.ResponseWriter) (*models.Device, bool) {
+	d, err := ch.AuthenticateDevice(deviceId, token)
+	switch err {
+	case nil:
+		return d, true
+	case models.DeviceUnauthorizedErr:
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		Render.JSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+	return nil, false
+}
+
+func deviceSeen(d *models.Device) {
+	if d == nil {
+		return
+	}
+	if err := d.Seen(time.Now()); err != nil {
+		Logger.Error(fmt.Sprintf("failed to update last seen of device %s: %s", d.DeviceId, err.Error()))
+	}
+}
+
+func findDevice(c web.C) (*models.Device, bool) {
+	ch, found := findChannel(c)
+	if !found {
+		return nil, false
+	}
+	return models.FindDevice(ch.Id, c.URLParams["device_id"])
+}
+
+func ListDevices(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, models.ChannelDevices(ch.Id))
+}
+
+func CreateDevice(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	d := &models.Device{Enabled: true}
+	body := &deviceWithSecret{Device: d}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(body)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	d.Secret = body.Secret
+
+	err = createDevice(ch, d)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusCreated, &deviceWithSecret{Device: d, Secret: d.Secret})
+	}
+}
+
+func createDevice(ch *models.Channel, d *models.Device) error {
+	d.Id = 0
+	d.ChannelId = ch.Id
+	d.FirstSeen = 0
+	d.LastSeen = 0
+	d.Created = NanoToMilli(time.Now().UTC().UnixNano())
+	d.Modified = d.Created
+	return d.Create()
+}
+
+func UpdateDevice(c web.C, w http.ResponseWriter, r *http.Request) {
+	d, found := findDevice(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := d.Id
+	channelId := d.ChannelId
+	deviceId := d.DeviceId
+	firstSeen := d.FirstSeen
+	lastSeen := d.LastSeen
+	created := d.Created
+	body := &deviceWithSecret{Device: d}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(body)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	// the secret is kept unless a new one is given
+	d.Secret = body.Secret
+	d.Id = id
+	d.ChannelId = channelId
+	d.DeviceId = deviceId
+	d.FirstSeen = firstSeen
+	d.LastSeen = lastSeen
+	d.Created = created
+	d.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+
+	err = d.Update()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusOK, d)
+	}
+}
+
+func GetDevice(c web.C, w http.ResponseWriter, r *http.Request) {
+	d, found := findDevice(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		Render.JSON(w, http.StatusOK, d)
+	}
+}
+
+// Gives the device a new secret, the old one stops working right away.
+func RotateDeviceSecret(c web.C, w http.ResponseWriter, r *http.Request) {
+	d, found := findDevice(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	d.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+	err := d.RotateSecret()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusOK, &deviceWithSecret{Device: d, Secret: d.Secret})
+	}
+}
+
+func DeleteDevice(c web.C, w http.ResponseWriter, r *http.Request) {
+	d, found := findDevice(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := d.Delete()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type bulkDeviceError struct {
+	Row      int    `json:"row"`
+	DeviceId string `json:"device_id"`
+	Error    string `json:"error"`
+}
+
+// Registers many devices at once from a json array of devices, or from a csv
+// with the header device_id,secret,enabled,labels where labels are written as
+// key=value pairs separated by ';'. Devices that fail are reported by row,
+// the others are still created.
+func BulkCreateDevices(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	var devices []*models.Device
+	var rowErrs []*bulkDeviceError
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		devices, rowErrs, err = parseDevicesCsv(r.Body)
+	} else {
+		devices, err = parseDevicesJson(r.Body)
+	}
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	created := []*deviceWithSecret{}
+	for i, d := range devices {
+		if d == nil {
+			continue
+		}
+		if err := createDevice(ch, d); err != nil {
+			rowErrs = append(rowErrs, &bulkDeviceError{Row: i + 1, DeviceId: d.DeviceId, Error: err.Error()})
+		} else {
+			created = append(created, &deviceWithSecret{Device: d, Secret: d.Secret})
+		}
+	}
+	if rowErrs == nil {
+		rowErrs = []*bulkDeviceError{}
+	}
+
+	Render.JSON(w, http.StatusOK, map[string]interface{}{
+		"created": created,
+		"errors":  rowErrs,
+	})
+}
+
+func parseDevicesJson(body io.Reader) ([]*models.Device, error) {
+	raws := []json.RawMessage{}
+	if err := json.NewDecoder(body).Decode(&raws); err != nil {
+		return nil, err
+	}
+
+	devices := make([]*models.Device, len(raws))
+	for i, raw := range raws {
+		d := &models.Device{Enabled: true}
+		body := &deviceWithSecret{Device: d}
+		if err := json.Unmarshal(raw, body); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid device at row %d: %s", i+1, err.Error()))
+		}
+		d.Secret = body.Secret
+		devices[i] = d
+	}
+	return devices, nil
+}
+
+// Rows that can't be parsed are left nil in the returned devices, so that the
+// row numbers stay aligned with the input.
+func parseDevicesCsv(body io.Reader) ([]*models.Device, []*bulkDeviceError, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.New("missing csv header: " + err.Error())
+	}
+
+	cols := make(map[string]int, len(header))
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	if _, found := cols["device_id"]; !found {
+		return nil, nil, errors.New("device_id column is missing in the csv header")
+	}
+
+	column := func(record []string, name string) string {
+		if i, found := cols[name]; found && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	devices := []*models.Device{}
+	rowErrs := []*bulkDeviceError{}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		d := &models.Device{
+			DeviceId: column(record, "device_id"),
+			Secret:   column(record, "secret"),
+			Enabled:  true,
+		}
+		if enabled := column(record, "enabled"); len(enabled) > 0 {
+			if d.Enabled, err = strconv.ParseBool(enabled); err != nil {
+				rowErrs = append(rowErrs, &bulkDeviceError{Row: row, DeviceId: d.DeviceId, Error: "invalid enabled: " + enabled})
+				devices = append(devices, nil)
+				continue
+			}
+		}
+		if labels := column(record, "labels"); len(labels) > 0 {
+			if d.Labels, err = parseDeviceLabels(labels); err != nil {
+				rowErrs = append(rowErrs, &bulkDeviceError{Row: row, DeviceId: d.DeviceId, Error: err.Error()})
+				devices = append(devices, nil)
+				continue
+			}
+		}
+		devices = append(devices, d)
+	}
+	return devices, rowErrs, nil
+}
+
+func parseDeviceLabels(s string) (models.StringMap, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ";") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, errors.New("invalid label: " + pair)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return models.StringMap(labels), nil
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/zenazn/goji/web/middleware"
 	. "github.com/eywa/configs"
 	. "github.com/eywa/connections"
+	"github.com/eywa/message_handlers"
+	"github.com/eywa/models"
 	. "github.com/eywa/utils"
 	"net/http"
 	"strings"
@@ -20,18 +22,22 @@ func HttpPushHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := r.Header.Get("AccessToken")
-	if len(token) == 0 || !StringSliceContains(ch.AccessTokens, token) {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
 	deviceId := c.URLParams["device_id"]
 	if len(deviceId) == 0 {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "empty device id"})
 		return
 	}
 
+	device, authorized := authenticateDevice(ch, deviceId, r.Header.Get("AccessToken"), w)
+	if !authorized {
+		return
+	}
+
+	h, admitted := admitDevice(ch, deviceId, w)
+	if !admitted {
+		return
+	}
+
 	cm, found := FindConnectionManager(c.URLParams["channel_id"])
 	if !found {
 		Render.JSON(w, http.StatusNotFound, map[string]string{
@@ -41,20 +47,98 @@ func HttpPushHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	meta := QueryToMap(r.URL.Query())
+
 	meta["ip"] = strings.Split(r.RemoteAddr, ":")[0]
 	meta["request_id"] = c.Env[middleware.RequestIDKey].(string)
 
+	// a call goes through the message handlers like a push, and is answered
+	// in the body of the response instead of being uploaded
+	if method, found := meta["call"]; found {
+		httpCall(w, r, cm, h, deviceId, method, meta)
+		deviceSeen(device)
+		return
+	}
+
 	conn, err := HttpUp.Upgrade(w, r, HttpPush)
 	if err != nil {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	_, err = cm.NewHttpConnection(deviceId, conn, messageHandler(ch), meta)
+	httpConn, err := cm.NewHttpConnection(deviceId, conn, h, meta)
 	if err != nil {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
+	deviceSeen(device)
+
+	// the push is answered once its message is handled, with the number of
+	// points indexed and the entries of a batch that are not
+	err = httpConn.Settled(Config().Connections.Http.Timeouts.Push.Duration)
+	errs := []*models.PointError{}
+	if pErr, ok := err.(*models.PointsErr); ok {
+		errs = pErr.Errors
+	} else if err != nil {
+		Render.JSON(w, httpMessageStatus(err, http.StatusBadRequest), map[string]string{"error": err.Error()})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, map[string]interface{}{
+		"indexed": httpConn.IndexedPoints(),
+		"errors":  errs,
+	})
+}
+
+func httpCall(w http.ResponseWriter, r *http.Request, cm *ConnectionManager, h MessageHandler, deviceId, method string, meta map[string]string) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(Config().Rpc.MaxParamsSize))
+	conn, err := HttpUp.Upgrade(w, r, HttpCall)
+	if err != nil {
+		Render.JSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+		return
+	}
+
+	httpConn, err := cm.NewHttpConnection(deviceId, conn, h, meta)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	answer, err := httpConn.Answer(Config().Rpc.Timeout.Duration + Config().Connections.Http.Timeouts.Push.Duration)
+	if err != nil {
+		// http calls have no stream of their own, the failure goes to the
+		// stream of the device's live connection if it has one
+		if live, found := cm.FindConnection(deviceId); found {
+			message_handlers.PublishCallError(live, method, err)
+		}
+
+		Render.JSON(w, httpMessageStatus(err, http.StatusBadGateway), map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(answer)
+}
+
+// The status of the response to a push or a call its message handlers failed,
+// the fallback is for the errors of the message itself.
+func httpMessageStatus(err error, fallback int) int {
+	switch err.(type) {
+	case *message_handlers.RateLimitError:
+		return http.StatusTooManyRequests
+	}
+
+	switch err {
+	case message_handlers.RpcNotRoutedErr:
+		return http.StatusNotFound
+	case message_handlers.RpcTimeoutErr, HttpSettleTimeoutErr:
+		return http.StatusGatewayTimeout
+	case message_handlers.RpcBusyErr:
+		return http.StatusServiceUnavailable
+	case models.DeviceQuarantinedErr:
+		return http.StatusForbidden
+	default:
+		return fallback
+	}
 }
 
 func HttpLongPollingHandler(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -65,18 +149,22 @@ func HttpLongPollingHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := r.Header.Get("AccessToken")
-	if len(token) == 0 || !StringSliceContains(ch.AccessTokens, token) {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
 	deviceId := c.URLParams["device_id"]
 	if len(deviceId) == 0 {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "empty device id"})
 		return
 	}
 
+	device, authorized := authenticateDevice(ch, deviceId, r.Header.Get("AccessToken"), w)
+	if !authorized {
+		return
+	}
+
+	h, admitted := admitDevice(ch, deviceId, w)
+	if !admitted {
+		return
+	}
+
 	cm, found := FindConnectionManager(c.URLParams["channel_id"])
 	if !found {
 		Render.JSON(w, http.StatusNotFound, map[string]string{
@@ -85,6 +173,11 @@ func HttpLongPollingHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := cm.Admit(deviceId); err != nil {
+		Render.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+
 	meta := QueryToMap(r.URL.Query())
 
 	timeout := Config().Connections.Http.Timeouts.LongPolling.Duration
@@ -107,17 +200,30 @@ func HttpLongPollingHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	httpConn, err := cm.NewHttpConnection(deviceId, conn, messageHandler(ch), meta)
+	httpConn, err := cm.NewHttpConnection(deviceId, conn, h, meta)
 	if err != nil {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
+	deviceSeen(device)
+
+	// a queued command, the shadow delta or a firmware announcement answers
+	// the poll right away
+	if !pollCommand(ch, httpConn) && !deliverShadowDelta(ch, httpConn) {
+		deliverFirmware(ch, httpConn)
+	}
+
 	resp := httpConn.Poll(timeout)
+	cmd := polledCommand(httpConn)
 
 	if resp == nil {
 		w.WriteHeader(http.StatusNoContent)
 	} else {
-		w.Write(resp)
+		_, err = w.Write(resp)
+		// the command stays queued unless its response made it out
+		if cmd != nil {
+			cmd.Sent(err)
+		}
 	}
 }
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"github.com/satori/go.uuid"
+	"github.com/eywa/connections"
+	. "github.com/eywa/loggers"
+	"github.com/eywa/models"
+	"net"
+)
+
+// MqttHandler takes a socket accepted by the mqtt listener. The CONNECT
+// packet is mapped as:
+//   username  -> channel id
+//   password  -> one of the channel's access tokens, or the secret of a
+//                registered device
+//   client id -> device id
+// After registration the device publishes to
+// channels/<channel id>/devices/<device id>/{upload,response/<message id>}
+// and subscribes to channels/<channel id>/devices/<device id>/{send,request/+}.
+func MqttHandler(nc net.Conn) {
+	conn, err := connections.MqttUp.Upgrade(nc)
+	if err != nil {
+		Logger.Debug("error upgrading mqtt connection: " + err.Error())
+		return
+	}
+
+	chId := conn.Username()
+	ch, found := models.FetchCachedChannelById(models.DecodeHashId(chId))
+	if !found {
+		conn.Refuse(connections.MqttRefusedBadCredentials)
+		return
+	}
+
+	deviceId := conn.ClientId()
+	if len(deviceId) == 0 {
+		conn.Refuse(connections.MqttRefusedIdentifierRejected)
+		return
+	}
+
+	device, err := ch.AuthenticateDevice(deviceId, conn.Password())
+	if err != nil {
+		conn.Refuse(connections.MqttRefusedNotAuthorized)
+		return
+	}
+
+	h, err := deviceMessageHandler(ch, deviceId)
+	if err != nil {
+		conn.Refuse(connections.MqttRefusedNotAuthorized)
+		return
+	}
+
+	cm, found := connections.FindConnectionManager(chId)
+	if !found {
+		conn.Refuse(connections.MqttRefusedServerUnavailable)
+		return
+	}
+
+	meta := map[string]string{"request_id": uuid.NewV4().String()}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		meta["ip"] = host
+	}
+
+	mqttConn, err := cm.NewMqttConnection(deviceId, conn, h, meta)
+	if err != nil {
+		Logger.Debug("error registering mqtt connection: " + err.Error())
+		return
+	}
+
+	deviceSeen(device)
+	deliverCommands(ch, mqttConn)
+	deliverShadowDelta(ch, mqttConn)
+	deliverFirmware(ch, mqttConn)
+}
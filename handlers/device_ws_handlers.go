@@ -17,18 +17,22 @@ func WsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	t := r.Header.Get("AccessToken")
-	if len(t) == 0 || !StringSliceContains(ch.AccessTokens, t) {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
 	deviceId := c.URLParams["device_id"]
 	if len(deviceId) == 0 {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "empty device id"})
 		return
 	}
 
+	device, authorized := authenticateDevice(ch, deviceId, r.Header.Get("AccessToken"), w)
+	if !authorized {
+		return
+	}
+
+	h, admitted := admitDevice(ch, deviceId, w)
+	if !admitted {
+		return
+	}
+
 	cm, found := connections.FindConnectionManager(c.URLParams["channel_id"])
 	if !found {
 		Render.JSON(w, http.StatusNotFound, map[string]string{
@@ -37,6 +41,13 @@ func WsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reject the device before upgrading if the channel is already full,
+	// so that the client gets a proper http status code.
+	if err := cm.Admit(deviceId); err != nil {
+		Render.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+
 	// The actual handshake stop point. The Upgrade function will establish a long
 	// live connection with clients and return 200 code if no error. So client does
 	// not have to wait for the complete hanlder finishes its work. It means that
@@ -54,10 +65,17 @@ func WsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	meta["ip"] = strings.Split(r.RemoteAddr, ":")[0]
 	meta["request_id"] = c.Env[middleware.RequestIDKey].(string)
 
-	// Register the new websocket connection to connection manager.
-	_, err = cm.NewWebsocketConnection(deviceId, ws, messageHandler(ch), meta)
+	// Register the new websocket connection to connection manager, on the
+	// configured transport.
+	conn, err := cm.NewWebsocket(deviceId, ws, h, meta)
 
 	if err != nil {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
 	}
+
+	deviceSeen(device)
+	deliverCommands(ch, conn)
+	deliverShadowDelta(ch, conn)
+	deliverFirmware(ch, conn)
 }
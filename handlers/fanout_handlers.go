@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zenazn/goji/web"
+	"github.com/eywa/cluster"
+	. "github.com/eywa/configs"
+	"github.com/eywa/connections"
+	. "github.com/eywa/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Picks the connections of a fan-out from the query: device_ids=a,b,c,
+// connection_type=websocket and meta.<key>=<value> for the query params the
+// devices connected with. All given conditions have to match, no condition
+// picks every connection of the channel.
+func fanOutFilter(r *http.Request) func(connections.Connection) bool {
+	query := r.URL.Query()
+
+	var ids map[string]bool
+	if idsStr := query.Get("device_ids"); len(idsStr) > 0 {
+		ids = make(map[string]bool)
+		for _, id := range strings.Split(idsStr, ",") {
+			ids[strings.TrimSpace(id)] = true
+		}
+	}
+
+	connType := query.Get("connection_type")
+
+	meta := make(map[string]string)
+	for k := range query {
+		if strings.HasPrefix(k, "meta.") {
+			meta[strings.TrimPrefix(k, "meta.")] = query.Get(k)
+		}
+	}
+
+	return func(conn connections.Connection) bool {
+		if ids != nil && !ids[conn.Identifier()] {
+			return false
+		}
+		if len(connType) > 0 && conn.ConnectionType() != connType {
+			return false
+		}
+		if len(meta) > 0 {
+			m := conn.Metadata()
+			for k, v := range meta {
+				if mv, found := m[k]; !found || mv != v {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
+
+// The fan-out of another node of the cluster. The request is forwarded as it
+// came, the node only reaches its own devices and always waits for them.
+func fanOutRemote(r *http.Request, body []byte, node *cluster.Node) connections.FanOutRemote {
+	return func() (*connections.FanOutJob, error) {
+		// the job outlives the request when it is answered asynchronously
+		req := r.WithContext(context.Background())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		rec := httptest.NewRecorder()
+		cluster.Forward(rec, req, node)
+		if rec.Code != http.StatusOK {
+			return nil, errors.New(fmt.Sprintf("node %s answered %d: %s", node.Name, rec.Code, strings.TrimSpace(rec.Body.String())))
+		}
+
+		job := &connections.FanOutJob{}
+		if err := json.Unmarshal(rec.Body.Bytes(), job); err != nil {
+			return nil, errors.New(fmt.Sprintf("node %s answered an invalid job: %s", node.Name, err.Error()))
+		}
+		return job, nil
+	}
+}
+
+// In cluster mode the devices of the other nodes are reached by forwarding
+// the fan-out to every node, their results are added to the job of this one.
+func fanOut(c web.C, w http.ResponseWriter, r *http.Request, op func([]byte) connections.FanOutOp) {
+	_, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	cm, found := connections.FindConnectionManager(c.URLParams["channel_id"])
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("connection manager is not initialized for channel: %s", c.URLParams["channel_id"]),
+		})
+		return
+	}
+
+	conf := Config().FanOut
+	timeout := conf.Timeout.Duration
+	parallelism := conf.Parallelism
+	query := r.URL.Query()
+	if timeoutStr := query.Get("timeout"); len(timeoutStr) > 0 {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if pStr := query.Get("parallelism"); len(pStr) > 0 {
+		p, err := strconv.Atoi(pStr)
+		if err != nil || p <= 0 {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid parallelism: " + pStr})
+			return
+		}
+		if p < parallelism {
+			parallelism = p
+		}
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	forwarded := cluster.Forwarded(r)
+	var remotes map[string]connections.FanOutRemote
+	if cluster.Enabled() && !forwarded {
+		remotes = make(map[string]connections.FanOutRemote)
+		for _, node := range cluster.Nodes() {
+			if !node.Local {
+				remotes[node.Name] = fanOutRemote(r, bodyBytes, node)
+			}
+		}
+	}
+
+	conns := cm.Filter(fanOutFilter(r))
+	job := connections.FanOut(conns, parallelism, timeout, conf.JobRetention.Duration, op(bodyBytes), remotes)
+
+	// large fleets are answered with the job to poll
+	async := query.Get("async") == "true" || (conf.AsyncThreshold > 0 && len(conns) > conf.AsyncThreshold)
+	if async && !forwarded {
+		Render.JSON(w, http.StatusAccepted, job.Copy())
+		return
+	}
+
+	job.Wait()
+	Render.JSON(w, http.StatusOK, job.Copy())
+}
+
+func FanOutSend(c web.C, w http.ResponseWriter, r *http.Request) {
+	fanOut(c, w, r, connections.FanOutSender)
+}
+
+func FanOutRequest(c web.C, w http.ResponseWriter, r *http.Request) {
+	fanOut(c, w, r, connections.FanOutRequester)
+}
+
+func GetFanOutJob(c web.C, w http.ResponseWriter, r *http.Request) {
+	job, found := connections.FindFanOutJob(c.URLParams["job_id"])
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+	} else {
+		Render.JSON(w, http.StatusOK, job.Copy())
+	}
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/eywa/connections"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"github.com/zenazn/goji/web"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func findFirmware(c web.C, ch *models.Channel) (*models.Firmware, bool) {
+	id, err := strconv.Atoi(c.URLParams["firmware_id"])
+	if err != nil {
+		return nil, false
+	}
+
+	f := &models.Firmware{}
+	if found := f.FindById(id); !found || f.ChannelId != ch.Id {
+		return nil, false
+	}
+	return f, true
+}
+
+func ListFirmwares(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, models.ChannelFirmwares(ch.Id))
+}
+
+// The body of the request is the artifact, its version and optionally its
+// filename and sha256 checksum are given in the query.
+func UploadFirmware(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	query := r.URL.Query()
+	f := &models.Firmware{
+		ChannelId: ch.Id,
+		Version:   query.Get("version"),
+		Filename:  query.Get("filename"),
+	}
+
+	err := models.StoreFirmware(f, r.Body, query.Get("checksum"))
+	if err == models.FirmwareTooLargeErr {
+		Render.JSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+	} else if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusCreated, f)
+	}
+}
+
+func GetFirmware(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	f, found := findFirmware(c, ch)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		Render.JSON(w, http.StatusOK, f)
+	}
+}
+
+func DeleteFirmware(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	f, found := findFirmware(c, ch)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := f.Delete(); err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Serves a firmware to a device, supporting range requests so that devices
+// can resume interrupted downloads.
+func DownloadFirmware(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	deviceId := c.URLParams["device_id"]
+	if _, authorized := authenticateDevice(ch, deviceId, r.Header.Get("AccessToken"), w); !authorized {
+		return
+	}
+
+	f, found := findFirmware(c, ch)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "firmware not found"})
+		return
+	}
+
+	content, err := f.Open()
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer content.Close()
+
+	// resumed downloads don't change the progress
+	if rng := r.Header.Get("Range"); len(rng) == 0 || strings.HasPrefix(rng, "bytes=0-") {
+		models.FirmwareDownloading(ch.Id, f.Id, deviceId)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+f.Checksum+`"`)
+	http.ServeContent(w, r, f.Filename, time.Unix(0, f.Created*int64(time.Millisecond)), content)
+}
+
+func findRollout(c web.C) (*models.Rollout, bool) {
+	ch, found := findChannel(c)
+	if !found {
+		return nil, false
+	}
+
+	id, err := strconv.Atoi(c.URLParams["rollout_id"])
+	if err != nil {
+		return nil, false
+	}
+
+	rollout := &models.Rollout{}
+	if found = rollout.FindById(id); !found || rollout.ChannelId != ch.Id {
+		return nil, false
+	}
+	return rollout, true
+}
+
+// Announces the firmware of a rollout to a device, unless the device is
+// done with it or the rollout doesn't target it.
+func deliverFirmware(ch *models.Channel, conn connections.Connection) bool {
+	sender, ok := conn.(connections.Sender)
+	if !ok || conn.ConnectionType() == connections.HttpConnectionTypes[connections.HttpPush] {
+		return false
+	}
+
+	rollout, found := models.FetchCachedActiveRollout(ch.Id)
+	if !found || !rollout.Targets(conn.Identifier(), conn.Metadata()) {
+		return false
+	}
+	return rollout.Announce(conn.Identifier(), sender.Send)
+}
+
+// Announces a rollout to the targeted devices connected to this node, the
+// others get it when they connect.
+func announceRollout(cmId string, rollout *models.Rollout) {
+	cm, found := connections.FindConnectionManager(cmId)
+	if !found {
+		return
+	}
+
+	conns := cm.Filter(func(conn connections.Connection) bool {
+		return rollout.Targets(conn.Identifier(), conn.Metadata())
+	})
+	go func() {
+		for _, conn := range conns {
+			if sender, ok := conn.(connections.Sender); ok && conn.ConnectionType() != connections.HttpConnectionTypes[connections.HttpPush] {
+				rollout.Announce(conn.Identifier(), sender.Send)
+			}
+		}
+	}()
+}
+
+func ListRollouts(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, models.ChannelRollouts(ch.Id))
+}
+
+func CreateRollout(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	rollout := &models.Rollout{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(rollout)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	rollout.Id = 0
+	rollout.ChannelId = ch.Id
+	rollout.Status = models.RolloutRunning
+	rollout.Reason = ""
+	rollout.Counts = nil
+	rollout.Created = NanoToMilli(time.Now().UTC().UnixNano())
+	rollout.Modified = rollout.Created
+
+	err = rollout.Create()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	announceRollout(c.URLParams["id"], rollout)
+	Render.JSON(w, http.StatusCreated, rollout)
+}
+
+func GetRollout(c web.C, w http.ResponseWriter, r *http.Request) {
+	rollout, found := findRollout(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rollout.Counts = rollout.CountDevices()
+	Render.JSON(w, http.StatusOK, rollout)
+}
+
+func ListRolloutDevices(c web.C, w http.ResponseWriter, r *http.Request) {
+	rollout, found := findRollout(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if len(status) > 0 && !StringSliceContains(models.SupportedRolloutDeviceStatuses, status) {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported status: " + status})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, rollout.Devices(status))
+}
+
+func PauseRollout(c web.C, w http.ResponseWriter, r *http.Request) {
+	changeRollout(c, w, (*models.Rollout).Pause)
+}
+
+func ResumeRollout(c web.C, w http.ResponseWriter, r *http.Request) {
+	if rollout, changed := changeRollout(c, w, (*models.Rollout).Resume); changed {
+		announceRollout(c.URLParams["id"], rollout)
+	}
+}
+
+func AbortRollout(c web.C, w http.ResponseWriter, r *http.Request) {
+	changeRollout(c, w, (*models.Rollout).Abort)
+}
+
+func changeRollout(c web.C, w http.ResponseWriter, change func(*models.Rollout) error) (*models.Rollout, bool) {
+	rollout, found := findRollout(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+
+	if err := change(rollout); err != nil {
+		Render.JSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	Render.JSON(w, http.StatusOK, rollout)
+	return rollout, true
+}
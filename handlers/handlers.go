@@ -3,8 +3,10 @@ package handlers
 import (
 	"github.com/gorilla/websocket"
 	"github.com/zenazn/goji/web"
+	"fmt"
 	. "github.com/eywa/connections"
-	. "github.com/eywa/message_handlers"
+	. "github.com/eywa/loggers"
+	_ "github.com/eywa/message_handlers"
 	"github.com/eywa/models"
 	"net/http"
 )
@@ -30,28 +32,26 @@ func findChannel(c web.C) (*models.Channel, bool) {
 	return ch, found
 }
 
-// Message handler in fact is a stack of middlewares.
+// Message handler in fact is a stack of middlewares, the core ones first and
+// then the ones of the channel, in the order it lists them.
 func messageHandler(ch *models.Channel) MessageHandler {
 	// Initiate a new stack.
 	md := NewMiddlewareStack()
-	set := make(map[string]struct{})
-	// Go through the default message handlers and chain them together.
-	for _, hStr := range DefaultMessageHandlers {
-		set[hStr] = struct{}{}
-		// append the handler to the last one.
-		md.Use(SupportedMessageHandlers[hStr])
+	for _, hStr := range ch.MessageHandlerChain() {
+		if h, found := FindMiddleware(hStr); found {
+			// append the handler to the last one.
+			md.Use(h)
+		} else {
+			Logger.Warn(fmt.Sprintf("unregistered message handler %s on channel %s is skipped", hStr, ch.Name))
+		}
 	}
+	// Ends the message handler chain by telling the connections waiting for
+	// their messages how they went.
+	return md.Chain(settle)
+}
 
-	// Go through the custom message handlers.
-	for _, hStr := range ch.MessageHandlers {
-		if _, found := set[hStr]; !found {
-			if h, ok := SupportedMessageHandlers[hStr]; ok {
-				set[hStr] = struct{}{}
-				// append the handler to the last one.
-				md.Use(h)
-			}
-		}
+func settle(c Connection, m Message, e error) {
+	if s, ok := c.(Settler); ok {
+		s.Settle(m, e)
 	}
-	// Ends the message handler chain with empty function.
-	return md.Chain(nil)
 }
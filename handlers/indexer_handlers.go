@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"github.com/zenazn/goji/web"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"net/http"
+)
+
+func GetIndexerStats(c web.C, w http.ResponseWriter, r *http.Request) {
+	if models.BulkIndex == nil {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "bulk indexer is not running"})
+		return
+	}
+	Render.JSON(w, http.StatusOK, models.BulkIndex.Stats())
+}
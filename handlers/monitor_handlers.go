@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"github.com/zenazn/goji/web"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultAlertLimit = 100
+
+func findMonitor(c web.C) (*models.Monitor, bool) {
+	ch, found := findChannel(c)
+	if !found {
+		return nil, false
+	}
+
+	id, err := strconv.Atoi(c.URLParams["monitor_id"])
+	if err != nil {
+		return nil, false
+	}
+
+	m := &models.Monitor{}
+	if found = m.FindById(id); !found || m.ChannelId != ch.Id {
+		return nil, false
+	}
+	return m, true
+}
+
+func ListNotifiers(c web.C, w http.ResponseWriter, r *http.Request) {
+	Render.JSON(w, http.StatusOK, map[string][]string{
+		"notifiers": models.RegisteredNotifiers(),
+	})
+}
+
+func CreateMonitor(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	m := &models.Monitor{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(m)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	m.Id = 0
+	m.ChannelId = ch.Id
+	m.Created = NanoToMilli(time.Now().UTC().UnixNano())
+	m.Modified = m.Created
+
+	err = m.Create()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusCreated, m)
+	}
+}
+
+func UpdateMonitor(c web.C, w http.ResponseWriter, r *http.Request) {
+	m, found := findMonitor(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := m.Id
+	channelId := m.ChannelId
+	created := m.Created
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(m)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	m.Id = id
+	m.ChannelId = channelId
+	m.Created = created
+	m.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+
+	err = m.Update()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func ListMonitors(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, models.ChannelMonitors(ch.Id))
+}
+
+func GetMonitor(c web.C, w http.ResponseWriter, r *http.Request) {
+	m, found := findMonitor(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		Render.JSON(w, http.StatusOK, m)
+	}
+}
+
+func DeleteMonitor(c web.C, w http.ResponseWriter, r *http.Request) {
+	m, found := findMonitor(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := m.Delete()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func ListMonitorStates(c web.C, w http.ResponseWriter, r *http.Request) {
+	m, found := findMonitor(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		Render.JSON(w, http.StatusOK, m.States())
+	}
+}
+
+// Alert history of a channel, most recent first. It can be narrowed down to
+// a monitor and a state with the monitor_id and state query parameters.
+func ListAlerts(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	query := r.URL.Query()
+	monitorId := 0
+	if str := query.Get("monitor_id"); len(str) > 0 {
+		id, err := strconv.Atoi(str)
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid monitor_id: " + str})
+			return
+		}
+		monitorId = id
+	}
+
+	state := query.Get("state")
+	if len(state) > 0 && state != models.MonitorAlerting && state != models.MonitorResolved {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported state: " + state})
+		return
+	}
+
+	limit := defaultAlertLimit
+	if str := query.Get("limit"); len(str) > 0 {
+		l, err := strconv.Atoi(str)
+		if err != nil || l <= 0 {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit: " + str})
+			return
+		}
+		limit = l
+	}
+
+	Render.JSON(w, http.StatusOK, models.ChannelAlerts(ch.Id, monitorId, state, limit))
+}
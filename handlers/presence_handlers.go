@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"github.com/eywa/connections"
+	. "github.com/eywa/utils"
+	"github.com/gorilla/websocket"
+	"github.com/zenazn/goji/web"
+	"net/http"
+	"strings"
+)
+
+// Picks the presence events from the query: events=connect,disconnect,
+// device_ids=a,b,c and connection_type=websocket.
+func presenceFilter(r *http.Request) func(*connections.PresenceEvent) bool {
+	query := r.URL.Query()
+
+	var events map[string]bool
+	if eventsStr := query.Get("events"); len(eventsStr) > 0 {
+		events = make(map[string]bool)
+		for _, e := range strings.Split(eventsStr, ",") {
+			events[strings.TrimSpace(e)] = true
+		}
+	}
+
+	var ids map[string]bool
+	if idsStr := query.Get("device_ids"); len(idsStr) > 0 {
+		ids = make(map[string]bool)
+		for _, id := range strings.Split(idsStr, ",") {
+			ids[strings.TrimSpace(id)] = true
+		}
+	}
+
+	connType := query.Get("connection_type")
+
+	return func(e *connections.PresenceEvent) bool {
+		if events != nil && !events[e.Event] {
+			return false
+		}
+		if ids != nil && !ids[e.DeviceId] {
+			return false
+		}
+		return len(connType) == 0 || e.ConnectionType == connType
+	}
+}
+
+// Streams the connects and disconnects of the devices of all channels.
+func StreamPresence(c web.C, w http.ResponseWriter, r *http.Request) {
+	streamPresence("", w, r)
+}
+
+// Streams the connects and disconnects of the devices of a channel. Like the
+// point streams, only the devices connected to this node are seen.
+func StreamChannelPresence(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	cmId, err := ch.HashId()
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	streamPresence(cmId, w, r)
+}
+
+func streamPresence(cmId string, w http.ResponseWriter, r *http.Request) {
+	cursor, err := streamCursor(r)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		sub := connections.SubscribePresence(cmId, cursor, presenceFilter(r))
+		streamWebsocket(ws, "presence", sub, cursor, func() { connections.UnsubscribePresence(sub) })
+	} else if _, ok := w.(http.Flusher); !ok {
+		Render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming is not supported"})
+	} else {
+		sub := connections.SubscribePresence(cmId, cursor, presenceFilter(r))
+		streamEvents(w, r, "presence", sub, cursor, func() { connections.UnsubscribePresence(sub) })
+	}
+}
@@ -20,7 +20,7 @@ func QueryValue(c web.C, w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 	} else {
-		value, err := q.QueryES()
+		value, err := q.Query()
 		if err != nil {
 			Render.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		} else {
@@ -46,7 +46,7 @@ func QuerySeries(c web.C, w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 	} else {
-		series, err := q.QueryES()
+		series, err := q.Query()
 		if err != nil {
 			Render.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		} else {
@@ -67,7 +67,7 @@ func QueryRaw(c web.C, w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 	} else {
-		res, err := q.QueryES()
+		res, err := q.Query()
 		if err != nil {
 			Render.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		} else {
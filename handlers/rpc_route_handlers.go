@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/zenazn/goji/web"
+	"github.com/eywa/connections"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func findRpcRoute(c web.C) (*models.RpcRoute, bool) {
+	ch, found := findChannel(c)
+	if !found {
+		return nil, false
+	}
+
+	id, err := strconv.Atoi(c.URLParams["route_id"])
+	if err != nil {
+		return nil, false
+	}
+
+	route := &models.RpcRoute{}
+	if found = route.FindById(id); !found || route.ChannelId != ch.Id {
+		return nil, false
+	}
+	return route, true
+}
+
+func CreateRpcRoute(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	route := &models.RpcRoute{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(route)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	route.Id = 0
+	route.ChannelId = ch.Id
+	route.Created = NanoToMilli(time.Now().UTC().UnixNano())
+	route.Modified = route.Created
+
+	err = route.Create()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusCreated, route)
+	}
+}
+
+func UpdateRpcRoute(c web.C, w http.ResponseWriter, r *http.Request) {
+	route, found := findRpcRoute(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := route.Id
+	channelId := route.ChannelId
+	created := route.Created
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(route)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	route.Id = id
+	route.ChannelId = channelId
+	route.Created = created
+	route.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+
+	err = route.Update()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func ListRpcRoutes(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, models.ChannelRpcRoutes(ch.Id))
+}
+
+func GetRpcRoute(c web.C, w http.ResponseWriter, r *http.Request) {
+	route, found := findRpcRoute(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		Render.JSON(w, http.StatusOK, route)
+	}
+}
+
+func DeleteRpcRoute(c web.C, w http.ResponseWriter, r *http.Request) {
+	route, found := findRpcRoute(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := route.Delete()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func ListRpcHandlers(c web.C, w http.ResponseWriter, r *http.Request) {
+	Render.JSON(w, http.StatusOK, map[string][]string{
+		"rpc_handlers": connections.RegisteredRpcHandlers(),
+	})
+}
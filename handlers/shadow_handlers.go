@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/eywa/connections"
+	"github.com/eywa/models"
+	"github.com/eywa/pubsub"
+	. "github.com/eywa/utils"
+	"github.com/zenazn/goji/web"
+	"net/http"
+)
+
+// Sends the difference between the desired and reported state of a device.
+// A poll that was already answered by a queued command gets it next time.
+func deliverShadowDelta(ch *models.Channel, conn connections.Connection) bool {
+	sender, ok := conn.(connections.Sender)
+	if !ok || conn.ConnectionType() == connections.HttpConnectionTypes[connections.HttpPush] {
+		return false
+	}
+
+	s, found := models.FindDeviceShadow(ch.Id, conn.Identifier())
+	if !found {
+		return false
+	}
+
+	msg, ok := s.DeltaMessage()
+	if !ok {
+		return false
+	}
+	return sender.Send(msg) == nil
+}
+
+func GetShadow(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	s, found := models.FindDeviceShadow(ch.Id, c.URLParams["device_id"])
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "shadow not found"})
+	} else {
+		Render.JSON(w, http.StatusOK, s)
+	}
+}
+
+func PatchDesiredState(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	deviceId := c.URLParams["device_id"]
+	cm, found := connections.FindConnectionManager(c.URLParams["channel_id"])
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("connection manager is not initialized for channel: %s", c.URLParams["channel_id"]),
+		})
+		return
+	}
+
+	// the node the device is connected to delivers the delta
+	conn, online := cm.FindConnection(deviceId)
+	if !online && forwardToOwner(c, w, r) {
+		return
+	}
+
+	patch := make(map[string]interface{})
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s, err := models.PatchDesiredState(ch.Id, deviceId, patch)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if online {
+		deliverShadowDelta(ch, conn)
+	}
+	Render.JSON(w, http.StatusOK, s)
+}
+
+func WatchShadow(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "channel_id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel is not found"})
+		return
+	}
+
+	deviceId := c.URLParams["device_id"]
+	if cm, found := connections.FindConnectionManager(c.URLParams["channel_id"]); found {
+		if _, online := cm.FindConnection(deviceId); !online && forwardToOwner(c, w, r) {
+			return
+		}
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	pubsub.NewWebsocketSubscriber(
+		models.ShadowPublisher(ch.Id, deviceId),
+		ws,
+	).Subscribe(fmt.Sprintf("You are now watching the shadow of device %s...", deviceId))
+}
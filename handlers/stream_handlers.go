@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eywa/connections"
+	. "github.com/eywa/configs"
+	"github.com/eywa/message_handlers"
+	"github.com/eywa/models"
+	"github.com/eywa/pubsub"
+	. "github.com/eywa/utils"
+	"github.com/gorilla/websocket"
+	"github.com/zenazn/goji/web"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var streamedMessageTypes = []string{
+	connections.SupportedMessageTypes[connections.TypeUploadMessage],
+	connections.SupportedMessageTypes[connections.TypeConnectMessage],
+	connections.SupportedMessageTypes[connections.TypeDisconnectMessage],
+}
+
+// Picks the streamed points from the query: device_ids=a,b,c,
+// message_types=upload,connect,disconnect, tags=tag1:eq:a,tag2:eq:b like
+// value queries, and fields=field1,field2 for points that have those fields.
+func pointFilter(ch *models.Channel, r *http.Request) (*message_handlers.PointFilter, error) {
+	query := r.URL.Query()
+	f := &message_handlers.PointFilter{Tags: make(map[string]string)}
+
+	if idsStr := query.Get("device_ids"); len(idsStr) > 0 {
+		f.DeviceIds = make(map[string]bool)
+		for _, id := range strings.Split(idsStr, ",") {
+			f.DeviceIds[strings.TrimSpace(id)] = true
+		}
+	}
+
+	if typesStr := query.Get("message_types"); len(typesStr) > 0 {
+		for _, t := range strings.Split(typesStr, ",") {
+			if !StringSliceContains(streamedMessageTypes, t) {
+				return nil, errors.New(fmt.Sprintf("unsupported message_type: %s, supported message types are %s", t, strings.Join(streamedMessageTypes, ",")))
+			}
+			f.MessageTypes = append(f.MessageTypes, t)
+		}
+	}
+
+	if tagStr := query.Get("tags"); len(tagStr) > 0 {
+		for _, tag := range strings.Split(tagStr, ",") {
+			t := strings.Split(tag, ":")
+			if len(t) != 3 {
+				return nil, errors.New("error parsing tagging: " + tag)
+			} else if t[1] != "eq" {
+				return nil, errors.New("unsupported operator for tagging: " + t[1])
+			} else if !StringSliceContains(ch.Tags, t[0]) {
+				return nil, errors.New("undefined tag: " + t[0] + " on channel: " + ch.Name)
+			}
+			f.Tags[t[0]] = t[2]
+		}
+	}
+
+	if fieldsStr := query.Get("fields"); len(fieldsStr) > 0 {
+		for _, field := range strings.Split(fieldsStr, ",") {
+			if _, found := ch.Fields[field]; !found {
+				return nil, errors.New("undefined field: " + field + " on channel: " + ch.Name)
+			}
+			f.Fields = append(f.Fields, field)
+		}
+	}
+
+	return f, nil
+}
+
+// The cursor is the last event a subscriber got, either from the cursor query
+// param or the Last-Event-ID header event source clients resend.
+func streamCursor(r *http.Request) (uint64, error) {
+	str := r.URL.Query().Get("cursor")
+	if len(str) == 0 {
+		str = r.Header.Get("Last-Event-ID")
+	}
+	if len(str) == 0 {
+		return 0, nil
+	}
+
+	cursor, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid cursor: " + str)
+	}
+	return cursor, nil
+}
+
+// Streams the points of a channel as JSON, over websocket when the request
+// asks for an upgrade and as server-sent events otherwise. Only the points
+// received by this node are streamed, in cluster mode each node has to be
+// subscribed.
+func StreamPoints(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findCachedChannel(c, "id")
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	if !ch.RunsMessageHandler("stream") {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": "channel doesn't run the stream message handler"})
+		return
+	}
+
+	f, err := pointFilter(ch, r)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	cursor, err := streamCursor(r)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		sub := message_handlers.SubscribePoints(ch, cursor, f)
+		streamWebsocket(ws, "point", sub, cursor, func() { message_handlers.UnsubscribePoints(sub) })
+	} else if _, ok := w.(http.Flusher); !ok {
+		Render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming is not supported"})
+	} else {
+		sub := message_handlers.SubscribePoints(ch, cursor, f)
+		streamEvents(w, r, "point", sub, cursor, func() { message_handlers.UnsubscribePoints(sub) })
+	}
+}
+
+// Writes the events of a subscription as websocket messages of the form
+// {"cursor":<seq>,"<name>":<event>}. A subscriber that falls behind is closed
+// with the cursor to resume from.
+func streamWebsocket(ws *websocket.Conn, name string, sub *pubsub.StreamSubscription, cursor uint64, unsubscribe func()) {
+	defer ws.Close()
+	defer unsubscribe()
+
+	// the subscriber only ever closes
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				unsubscribe()
+				return
+			}
+		}
+	}()
+
+	writeTimeout := Config().Connections.Websocket.Timeouts.Write.Duration
+	keepAlive := time.NewTicker(pubsub.StreamSettings().KeepAlive.Duration)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				if sub.Overflowed() {
+					ws.WriteControl(
+						websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseTryAgainLater, fmt.Sprintf("subscriber is too slow, resume from cursor %d", cursor)),
+						time.Now().Add(writeTimeout),
+					)
+				}
+				return
+			}
+
+			js, err := json.Marshal(map[string]interface{}{"cursor": e.Seq, name: json.RawMessage(e.Data)})
+			if err != nil {
+				continue
+			}
+			ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err = ws.WriteMessage(websocket.TextMessage, js); err != nil {
+				return
+			}
+			cursor = e.Seq
+		case <-keepAlive.C:
+			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Writes the events of a subscription as server-sent events named name, with
+// their cursor as id. A subscriber that falls behind gets an overflow event
+// with the cursor to resume from.
+func streamEvents(w http.ResponseWriter, r *http.Request, name string, sub *pubsub.StreamSubscription, cursor uint64, unsubscribe func()) {
+	defer unsubscribe()
+
+	flusher := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(pubsub.StreamSettings().KeepAlive.Duration)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				if sub.Overflowed() {
+					fmt.Fprintf(w, "event: overflow\ndata: {\"cursor\":%d}\n\n", cursor)
+					flusher.Flush()
+				}
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, name, e.Data)
+			cursor = e.Seq
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -6,6 +6,7 @@ import (
 	. "github.com/eywa/utils"
 	"github.com/eywa/connections"
 	"net/http"
+	"runtime"
 )
 
 func GetSummary(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -36,3 +37,24 @@ func GetSummary(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	Render.JSON(w, http.StatusOK, resp)
 }
+
+// Reports the memory of the node next to its device connections, gc=true
+// collects first so the heap only counts what is alive.
+func GetMemorySummary(c web.C, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("gc") == "true" {
+		runtime.GC()
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	_, total := connections.Counts()
+
+	Render.JSON(w, http.StatusOK, map[string]interface{}{
+		"connections": total,
+		"goroutines":  runtime.NumGoroutine(),
+		"heap_alloc":  stats.HeapAlloc,
+		"heap_inuse":  stats.HeapInuse,
+		"stack_inuse": stats.StackInuse,
+		"sys":         stats.Sys,
+	})
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/zenazn/goji/web"
+	"github.com/eywa/message_handlers"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A webhook with its secret, which is taken on create and update but only
+// rendered by create.
+type webhookWithSecret struct {
+	*models.Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+func findWebhook(c web.C) (*models.Webhook, bool) {
+	ch, found := findChannel(c)
+	if !found {
+		return nil, false
+	}
+
+	id, err := strconv.Atoi(c.URLParams["webhook_id"])
+	if err != nil {
+		return nil, false
+	}
+
+	hook := &models.Webhook{}
+	if found = hook.FindById(id); !found || hook.ChannelId != ch.Id {
+		return nil, false
+	}
+	return hook, true
+}
+
+func CreateWebhook(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	hook := &models.Webhook{}
+	body := &webhookWithSecret{Webhook: hook}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(body)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	hook.Id = 0
+	hook.Secret = body.Secret
+	hook.ChannelId = ch.Id
+	hook.Created = NanoToMilli(time.Now().UTC().UnixNano())
+	hook.Modified = hook.Created
+
+	err = hook.Create()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		Render.JSON(w, http.StatusCreated, &webhookWithSecret{Webhook: hook, Secret: hook.Secret})
+	}
+}
+
+func UpdateWebhook(c web.C, w http.ResponseWriter, r *http.Request) {
+	hook, found := findWebhook(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := hook.Id
+	channelId := hook.ChannelId
+	created := hook.Created
+	body := &webhookWithSecret{Webhook: hook}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(body)
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	// the secret is kept unless a new one is given
+	if len(body.Secret) > 0 {
+		hook.Secret = body.Secret
+	}
+	hook.Id = id
+	hook.ChannelId = channelId
+	hook.Created = created
+	hook.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+
+	err = hook.Update()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func ListWebhooks(c web.C, w http.ResponseWriter, r *http.Request) {
+	ch, found := findChannel(c)
+	if !found {
+		Render.JSON(w, http.StatusNotFound, map[string]string{"error": "channel not found"})
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, models.ChannelWebhooks(ch.Id))
+}
+
+func GetWebhook(c web.C, w http.ResponseWriter, r *http.Request) {
+	hook, found := findWebhook(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		Render.JSON(w, http.StatusOK, hook)
+	}
+}
+
+func DeleteWebhook(c web.C, w http.ResponseWriter, r *http.Request) {
+	hook, found := findWebhook(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := hook.Delete()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		message_handlers.RemoveWebhookDeliveries(hook.Id)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func ListWebhookDeliveries(c web.C, w http.ResponseWriter, r *http.Request) {
+	hook, found := findWebhook(c)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		Render.JSON(w, http.StatusOK, message_handlers.WebhookDeliveries(hook.Id))
+	}
+}
@@ -0,0 +1,32 @@
+package message_handlers
+
+import (
+	"fmt"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"github.com/eywa/pubsub"
+)
+
+// Tracks the progress of firmware rollouts from the versions and update
+// failures devices report in their uploads. Like the shadow it never fails
+// the message.
+var FirmwareProgress = NewMiddleware("firmware", func(h MessageHandler) MessageHandler {
+	fn := func(c Connection, m Message, e error) {
+		if e == nil && m != nil && m.Type() == TypeUploadMessage {
+			if ch, found := findCachedChannel(c.ConnectionManager().Id()); found {
+				if version, failure, reported := models.FirmwareReport(m); reported {
+					if err := models.ReportFirmware(ch.Id, c.Identifier(), version, failure); err != nil {
+						if pub, ok := c.(pubsub.Publisher); ok {
+							pub.Publish(func() string {
+								return format("error", []byte(fmt.Sprintf("failed to update rollout progress: %s", err.Error())))
+							})
+						}
+					}
+				}
+			}
+		}
+
+		h(c, m, e)
+	}
+	return MessageHandler(fn)
+})
@@ -0,0 +1,79 @@
+package message_handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFirmwareProgress(t *testing.T) {
+	dbFile := setupTestDB()
+	defer teardownTestDB(dbFile)
+
+	pwd, _ := os.Getwd()
+	Config().Firmware = &FirmwareConf{
+		Dir:            path.Join(pwd, "firmware_test"),
+		MaxSize:        16,
+		HaltMinDevices: 10,
+	}
+	defer os.RemoveAll(Config().Firmware.Dir)
+
+	ch := createTestChannel("firmware", "firmware")
+	cm := testConnectionManager(ch)
+	h := testChain("firmware")
+
+	f := &models.Firmware{ChannelId: ch.Id, Version: "2.0.0"}
+	if err := models.StoreFirmware(f, bytes.NewReader([]byte("firmware")), ""); err != nil {
+		t.Fatal(err)
+	}
+	r := &models.Rollout{ChannelId: ch.Id, FirmwareId: f.Id}
+	if err := r.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(deviceId string) string {
+		for _, d := range r.Devices("") {
+			if d.DeviceId == deviceId {
+				return d.Status
+			}
+		}
+		return ""
+	}
+
+	Convey("offers the firmware and tracks the versions devices report", t, func() {
+		var offer []byte
+		So(r.Announce("dev1", func(msg []byte) error {
+			offer = msg
+			return nil
+		}), ShouldBeTrue)
+
+		announced := map[string]map[string]interface{}{}
+		So(json.Unmarshal(offer, &announced), ShouldBeNil)
+		So(announced["firmware"]["version"], ShouldEqual, "2.0.0")
+		So(announced["firmware"]["checksum"], ShouldEqual, f.Checksum)
+		So(status("dev1"), ShouldEqual, models.RolloutDeviceAnnounced)
+
+		// an older version doesn't change the progress
+		So(sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"firmware_version":"1.0.0"}`), h).Settled(time.Second), ShouldBeNil)
+		So(status("dev1"), ShouldEqual, models.RolloutDeviceAnnounced)
+
+		So(sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"firmware_version":"2.0.0"}`), h).Settled(time.Second), ShouldBeNil)
+		So(status("dev1"), ShouldEqual, models.RolloutDeviceUpdated)
+
+		// updated devices aren't offered the firmware again
+		So(r.Announce("dev1", func([]byte) error { return nil }), ShouldBeFalse)
+	})
+
+	Convey("records the update failures devices report", t, func() {
+		So(r.Announce("dev2", func([]byte) error { return nil }), ShouldBeTrue)
+		So(sendHttp(cm, "dev2", HttpPush, "/", []byte(`{"firmware_error":"checksum mismatch"}`), h).Settled(time.Second), ShouldBeNil)
+		So(status("dev2"), ShouldEqual, models.RolloutDeviceFailed)
+	})
+}
@@ -3,38 +3,44 @@ package message_handlers
 import (
 	"encoding/json"
 	"github.com/satori/go.uuid"
-	"gopkg.in/olivere/elastic.v3"
 	. "github.com/eywa/configs"
 	. "github.com/eywa/connections"
 	. "github.com/eywa/models"
 	"github.com/eywa/pubsub"
 )
 
+// A connection that tells its device how many points of its upload are
+// indexed, like an http push.
+type indexReporter interface {
+	Indexed(m Message, n int)
+}
+
 var Indexer = NewMiddleware("indexer", func(h MessageHandler) MessageHandler {
 	fn := func(c Connection, m Message, e error) {
 		if !Config().Indices.Disable && e == nil && m != nil && (m.Type() == TypeUploadMessage || m.Type() == TypeDisconnectMessage || m.Type() == TypeConnectMessage) {
 			if ch, found := findCachedChannel(c.ConnectionManager().Id()); found {
-				id := uuid.NewV1().String()
-				var p *Point
-				p, e = NewPoint(id, ch, c, m)
-				if e == nil {
-					var js []byte
-					js, e = json.Marshal(p)
-					if e == nil {
-						var resp *elastic.IndexResponse
-						resp, e = IndexClient.Index().
-							Index(TimedIndexName(ch, p.Timestamp)).
-							Type(p.IndexType()).
-							Id(id).
-							BodyString(string(js)).
-							Do()
-
-						if resp != nil && resp.Created {
-							c.(pubsub.Publisher).Publish(func() string {
+				var points []*Point
+				points, e = NewPoints(uuid.NewV1().String(), ch, c, m)
+				// the valid points of a batch are indexed even if others are not
+				pub := c.(pubsub.Publisher)
+				indexed := 0
+				for _, p := range points {
+					js, err := json.Marshal(p)
+					if err == nil {
+						err = BulkIndex.Add(NewIndexDocument(TimedIndexName(ch, p.Timestamp), p.IndexType(), p.Id, js, func() {
+							pub.Publish(func() string {
 								return format("index", js)
 							})
-						}
+						}))
 					}
+					if err != nil {
+						e = err
+					} else {
+						indexed++
+					}
+				}
+				if r, ok := c.(indexReporter); ok {
+					r.Indexed(m, indexed)
 				}
 			} else {
 				e = channelNotFound
@@ -0,0 +1,55 @@
+package message_handlers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIndexer(t *testing.T) {
+	dbFile := setupTestDB()
+	defer teardownTestDB(dbFile)
+
+	Config().Indices.Disable = false
+	var lock sync.Mutex
+	written := 0
+	models.BulkIndex, _ = models.NewBulkIndexer(func(docs []*models.IndexDocument) ([]error, []bool, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		written += len(docs)
+		return make([]error, len(docs)), make([]bool, len(docs)), nil
+	})
+
+	ch := createTestChannel("indexer")
+	cm := testConnectionManager(ch)
+	h := testChain("indexer")
+
+	Convey("settles a push with the points indexed and the entries that are not", t, func() {
+		conn := sendHttp(cm, "dev1", HttpPush, "/", []byte(`[{"temp":1.5},{"temp":"hot"},{"temp":2.5}]`), h)
+		err := conn.Settled(time.Second)
+		pErr, ok := err.(*models.PointsErr)
+		So(ok, ShouldBeTrue)
+		So(len(pErr.Errors), ShouldEqual, 1)
+		So(pErr.Errors[0].Index, ShouldEqual, 1)
+		So(conn.IndexedPoints(), ShouldEqual, 2)
+
+		conn = sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"temp":1.5}`), h)
+		So(conn.Settled(time.Second), ShouldBeNil)
+		So(conn.IndexedPoints(), ShouldEqual, 1)
+	})
+
+	Convey("settles a push with the error of the bulk indexer", t, func() {
+		models.BulkIndex.Close()
+		conn := sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"temp":1.5}`), h)
+		So(conn.Settled(time.Second), ShouldNotBeNil)
+		So(conn.IndexedPoints(), ShouldEqual, 0)
+
+		lock.Lock()
+		defer lock.Unlock()
+		So(written, ShouldEqual, 3)
+	})
+}
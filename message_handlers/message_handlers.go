@@ -9,9 +9,27 @@ import (
 	"time"
 )
 
-var SupportedMessageHandlers = map[string]*Middleware{"indexer": Indexer, "logger": Logger}
+// Built-in message handlers, channels without their own list run them in
+// this order.
+var defaultMessageHandlers = []*Middleware{RateLimiter, Shadow, FirmwareProgress, Monitors, Stream, Indexer, Webhooks, Rpc, Logger}
 
-var DefaultMessageHandlers = []string{"indexer", "logger"}
+var SupportedMessageHandlers = map[string]*Middleware{}
+
+func init() {
+	for _, m := range defaultMessageHandlers {
+		if err := Register(m); err != nil {
+			panic(err)
+		}
+		SupportedMessageHandlers[m.Name()] = m
+		models.RegisterDefaultMessageHandler(m.Name())
+	}
+}
+
+// Makes a message handler available to channels. Third party handlers
+// should call it from their init functions.
+func Register(m *Middleware) error {
+	return RegisterMiddleware(m)
+}
 
 var channelNotFound = errors.New("channel not found when indexing data")
 
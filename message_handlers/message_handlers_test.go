@@ -0,0 +1,127 @@
+package message_handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/waterwheel"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	"github.com/eywa/loggers"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path"
+	"time"
+)
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopWriteCloser) Close() error                { return nil }
+
+// The middlewares look their channels up in the database, every test runs
+// them in a fresh one.
+func setupTestDB() string {
+	pwd, _ := os.Getwd()
+	dbFile := path.Join(pwd, "eywa_test.db")
+
+	SetConfig(&Conf{
+		Database: &DbConf{
+			DbType: "sqlite3",
+			DbFile: dbFile,
+		},
+		Indices: &IndexConf{
+			Disable: true,
+			Bulk: &BulkIndexConf{
+				Size:          10,
+				FlushInterval: &JSONDuration{10 * time.Millisecond},
+				QueueSize:     64,
+			},
+		},
+		Logging: &LogsConf{
+			Database: &LogConf{
+				Level: "error",
+			},
+		},
+		Rpc: &RpcConf{
+			Timeout:         &JSONDuration{100 * time.Millisecond},
+			MaxResponseSize: 1024,
+			MaxParamsSize:   1024,
+			Workers:         2,
+		},
+	})
+
+	loggers.Logger = waterwheel.NewAsyncLogger(nopWriteCloser{}, waterwheel.SimpleFormatter, 64, "error")
+	models.InitializeDB()
+	models.DB.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	models.MigrateAll()
+
+	// channel ids start over with the database, so do the rate buckets
+	resetRateLimiters()
+	return dbFile
+}
+
+func teardownTestDB(dbFile string) {
+	models.CloseDB()
+	os.Remove(dbFile)
+}
+
+// A channel with the given message handlers, its connection manager is
+// started along with it. Channel ids start over with the database, the
+// channel an earlier test cached under the same id is dropped.
+func createTestChannel(name string, handlers ...string) *models.Channel {
+	ch := &models.Channel{
+		Name:            name,
+		Description:     "desc",
+		Tags:            []string{"tag1"},
+		Fields:          map[string]string{"temp": "float", "on": "boolean"},
+		AccessTokens:    []string{"token"},
+		ConnectionLimit: 2,
+		MessageRate:     100,
+		MessageHandlers: handlers,
+	}
+	if err := ch.Create(); err != nil {
+		panic(err)
+	}
+	Cache.Delete(fmt.Sprintf("cache.channel:%d", ch.Id))
+	return ch
+}
+
+func testConnectionManager(ch *models.Channel) *ConnectionManager {
+	id, _ := ch.HashId()
+	cm, _ := FindConnectionManager(id)
+	return cm
+}
+
+// Chains the message handlers like the channels do, the end of the chain
+// settles the messages of http connections.
+func testChain(names ...string) MessageHandler {
+	md := NewMiddlewareStack()
+	for _, name := range names {
+		m, _ := FindMiddleware(name)
+		md.Use(m)
+	}
+	return md.Chain(func(c Connection, m Message, e error) {
+		if s, ok := c.(Settler); ok {
+			s.Settle(m, e)
+		}
+	})
+}
+
+// Sends a message of a device to the handler over an http connection, the
+// way the http handlers do.
+func sendHttp(cm *ConnectionManager, deviceId string, _type HttpConnectionType, url string, body []byte, h MessageHandler) *HttpConnection {
+	r := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	conn, err := (&HttpUpgrader{}).Upgrade(httptest.NewRecorder(), r, _type)
+	if err != nil {
+		panic(err)
+	}
+	httpConn, err := cm.NewHttpConnection(deviceId, conn, h, map[string]string{})
+	if err != nil {
+		panic(err)
+	}
+	return httpConn
+}
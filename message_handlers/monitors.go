@@ -0,0 +1,170 @@
+package message_handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	"github.com/eywa/loggers"
+	"github.com/eywa/models"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	if err := models.RegisterNotifier("log", LogNotifier); err != nil {
+		panic(err)
+	}
+	if err := models.RegisterNotifier("webhook", WebhookNotifier); err != nil {
+		panic(err)
+	}
+}
+
+// Writes the alert to the log.
+func LogNotifier(m *models.Monitor, a *models.Alert) error {
+	msg := fmt.Sprintf("monitor %d %s is %s: %s", m.Id, m.Name, a.State, a.Message)
+	if a.State == models.MonitorAlerting {
+		loggers.Logger.Warn(msg)
+	} else {
+		loggers.Logger.Info(msg)
+	}
+	return nil
+}
+
+// Posts the alert to the url of the monitor, signed like webhook deliveries
+// with the secret of the monitor.
+func WebhookNotifier(m *models.Monitor, a *models.Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", m.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Eywa-Event", "alert")
+	req.Header.Set("X-Eywa-Signature", "sha256="+m.Sign(body))
+
+	client := &http.Client{Timeout: Config().Monitors.NotifyTimeout.Duration}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("unexpected response status %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// Tells every notifier of the monitor about the alert, without blocking the
+// caller.
+func notify(m *models.Monitor, a *models.Alert) {
+	for _, name := range m.Notifiers {
+		n, found := models.FindNotifier(name)
+		if !found {
+			continue
+		}
+
+		go func(name string, n models.Notifier) {
+			if err := n(m, a); err != nil {
+				loggers.Logger.Warn(fmt.Sprintf("notifier %s failed for alert %d of monitor %d: %s", name, a.Id, m.Id, err.Error()))
+			}
+		}(name, n)
+	}
+}
+
+// Records the activity of devices for absence monitors, and compares the
+// uploads with ingest monitors. Like the shadow it never fails the message.
+var Monitors = NewMiddleware("monitors", func(h MessageHandler) MessageHandler {
+	fn := func(c Connection, m Message, e error) {
+		if e == nil && m != nil {
+			if ch, found := findCachedChannel(c.ConnectionManager().Id()); found {
+				models.RecordActivity(ch.Id, c.Identifier(), c.Metadata(), time.Now())
+				if m.Type() == TypeUploadMessage {
+					observePoints(ch, c, m)
+				}
+			}
+		}
+
+		h(c, m, e)
+	}
+	return MessageHandler(fn)
+})
+
+func observePoints(ch *models.Channel, c Connection, m Message) {
+	monitors := []*models.Monitor{}
+	for _, monitor := range models.FetchCachedMonitorsByChannelId(ch.Id) {
+		if monitor.Kind == models.MonitorThreshold && monitor.Evaluation == models.MonitorIngest {
+			monitors = append(monitors, monitor)
+		}
+	}
+	if len(monitors) == 0 {
+		return
+	}
+
+	points, _ := models.NewPoints(uuid.NewV1().String(), ch, c, m)
+	for _, p := range points {
+		for _, monitor := range monitors {
+			alert, err := monitor.ObservePoint(p)
+			if err != nil {
+				loggers.Logger.Warn(fmt.Sprintf("failed to evaluate monitor %d: %s", monitor.Id, err.Error()))
+			} else if alert != nil {
+				notify(monitor, alert)
+			}
+		}
+	}
+}
+
+// Evaluates the periodic monitors of all channels.
+func EvaluateMonitors(now time.Time) {
+	for _, monitor := range models.PeriodicMonitors() {
+		alerts, err := monitor.Evaluate(now)
+		if err != nil {
+			loggers.Logger.Warn(fmt.Sprintf("failed to evaluate monitor %d: %s", monitor.Id, err.Error()))
+		}
+		for _, alert := range alerts {
+			notify(monitor, alert)
+		}
+	}
+}
+
+var monitorsDone chan struct{}
+var monitorsWg sync.WaitGroup
+
+func InitializeMonitors() error {
+	monitorsDone = make(chan struct{})
+	monitorsWg.Add(1)
+	go func() {
+		defer monitorsWg.Done()
+
+		ticker := time.NewTicker(Config().Monitors.Interval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				EvaluateMonitors(now)
+				models.SweepAlerts()
+			case <-monitorsDone:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func CloseMonitors() error {
+	if monitorsDone != nil {
+		close(monitorsDone)
+		monitorsWg.Wait()
+		monitorsDone = nil
+	}
+	return nil
+}
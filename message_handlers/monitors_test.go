@@ -0,0 +1,81 @@
+package message_handlers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"testing"
+	"time"
+)
+
+func TestMonitors(t *testing.T) {
+	dbFile := setupTestDB()
+	defer teardownTestDB(dbFile)
+
+	alerts := make(chan *models.Alert, 8)
+	models.RegisterNotifier("test_alerts", func(m *models.Monitor, a *models.Alert) error {
+		alerts <- a
+		return nil
+	})
+
+	notified := func() []string {
+		states := []string{}
+		for {
+			select {
+			case a := <-alerts:
+				states = append(states, a.State)
+			case <-time.After(50 * time.Millisecond):
+				return states
+			}
+		}
+	}
+
+	ch := createTestChannel("monitors", "monitors")
+	cm := testConnectionManager(ch)
+	h := testChain("monitors")
+
+	push := func(body string) {
+		So(sendHttp(cm, "dev1", HttpPush, "/", []byte(body), h).Settled(time.Second), ShouldBeNil)
+	}
+
+	Convey("alerts and resolves only after the debounced uploads agree", t, func() {
+		m := &models.Monitor{
+			ChannelId:  ch.Id,
+			Name:       "hot",
+			Kind:       models.MonitorThreshold,
+			Field:      "temp",
+			Window:     "5m",
+			Operator:   "gt",
+			Threshold:  30,
+			Evaluation: models.MonitorIngest,
+			Debounce:   2,
+			Notifiers:  []string{"test_alerts"},
+		}
+		So(m.Create(), ShouldBeNil)
+
+		// a single breach is a blip
+		push(`{"temp":35}`)
+		push(`{"temp":20}`)
+		So(notified(), ShouldBeEmpty)
+		So(m.States()[0].State, ShouldEqual, models.MonitorOk)
+
+		push(`{"temp":35}`)
+		So(notified(), ShouldBeEmpty)
+		So(m.States()[0].Streak, ShouldEqual, 1)
+		push(`{"temp":40}`)
+		So(notified(), ShouldResemble, []string{models.MonitorAlerting})
+		So(m.States()[0].State, ShouldEqual, models.MonitorAlerting)
+
+		// uploads without the field aren't evaluated
+		push(`{"on":true}`)
+		push(`{"temp":20}`)
+		So(notified(), ShouldBeEmpty)
+		push(`{"temp":25}`)
+		So(notified(), ShouldResemble, []string{models.MonitorResolved})
+		So(m.States()[0].State, ShouldEqual, models.MonitorResolved)
+
+		push(`{"temp":20}`)
+		So(notified(), ShouldBeEmpty)
+		So(m.States()[0].State, ShouldEqual, models.MonitorOk)
+	})
+}
@@ -0,0 +1,139 @@
+package message_handlers
+
+import (
+	"fmt"
+	. "github.com/eywa/connections"
+	"github.com/eywa/loggers"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"sync"
+	"time"
+)
+
+// Buckets that are not used for this long are full again and can be dropped.
+var rateLimiterIdleTime = 1 * time.Minute
+
+type RateLimitError struct {
+	Scope    string
+	DeviceId string
+	Rate     int
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Scope == "channel" {
+		return fmt.Sprintf("channel message rate limit of %d/s is exceeded, message from device %s is dropped", e.Rate, e.DeviceId)
+	}
+	return fmt.Sprintf("device message rate limit of %d/s is exceeded, message from device %s is dropped", e.Rate, e.DeviceId)
+}
+
+type rateBucket struct {
+	*TokenBucket
+	usedAt    time.Time
+	throttled bool
+}
+
+type rateLimiters struct {
+	sync.Mutex
+	channels map[string]*rateBucket
+	devices  map[string]*rateBucket
+	prunedAt time.Time
+}
+
+var limiters = &rateLimiters{
+	channels: make(map[string]*rateBucket),
+	devices:  make(map[string]*rateBucket),
+	prunedAt: time.Now(),
+}
+
+// Drops every bucket, the limits start over.
+func resetRateLimiters() {
+	limiters.Lock()
+	defer limiters.Unlock()
+	limiters.channels = make(map[string]*rateBucket)
+	limiters.devices = make(map[string]*rateBucket)
+}
+
+func (l *rateLimiters) bucket(m map[string]*rateBucket, key string, rate int, now time.Time) *rateBucket {
+	b, found := m[key]
+	if !found {
+		b = &rateBucket{TokenBucket: NewTokenBucket(float64(rate), rate)}
+		m[key] = b
+	} else if b.Rate() != float64(rate) {
+		b.SetRate(float64(rate), rate)
+	}
+	b.usedAt = now
+	return b
+}
+
+func (l *rateLimiters) prune(now time.Time) {
+	if now.Sub(l.prunedAt) < rateLimiterIdleTime {
+		return
+	}
+	l.prunedAt = now
+
+	for k, b := range l.devices {
+		if now.Sub(b.usedAt) > rateLimiterIdleTime {
+			delete(l.devices, k)
+		}
+	}
+
+	for k, b := range l.channels {
+		if now.Sub(b.usedAt) > rateLimiterIdleTime {
+			delete(l.channels, k)
+		}
+	}
+}
+
+// Every device can upload at most MessageRate messages per second, and the
+// whole channel can take at most MessageRate * ConnectionLimit messages per
+// second. Both limits allow bursts of one second worth of messages.
+func (l *rateLimiters) allow(ch *models.Channel, cmId, deviceId string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	dev := l.bucket(l.devices, cmId+"/"+deviceId, ch.MessageRate, now)
+	if !dev.Take() {
+		if !dev.throttled {
+			dev.throttled = true
+			loggers.Logger.Warn(fmt.Sprintf("device %s on channel %s is throttled at %d messages/s", deviceId, ch.Name, ch.MessageRate))
+		}
+		return &RateLimitError{Scope: "device", DeviceId: deviceId, Rate: ch.MessageRate}
+	}
+	dev.throttled = false
+
+	chRate := ch.MessageRate * ch.ConnectionLimit
+	chn := l.bucket(l.channels, cmId, chRate, now)
+	if !chn.Take() {
+		dev.Return()
+		if !chn.throttled {
+			chn.throttled = true
+			loggers.Logger.Warn(fmt.Sprintf("channel %s is throttled at %d messages/s", ch.Name, chRate))
+		}
+		return &RateLimitError{Scope: "channel", DeviceId: deviceId, Rate: chRate}
+	}
+	chn.throttled = false
+
+	return nil
+}
+
+// Drops upload and call messages over the channel's message rate. Dropped
+// messages are passed down with a *RateLimitError so that the indexer skips
+// them, the rpc answers the call with it and the logger shows the error in the
+// attach stream.
+var RateLimiter = NewMiddleware("rate_limiter", func(h MessageHandler) MessageHandler {
+	fn := func(c Connection, m Message, e error) {
+		if e == nil && m != nil && (m.Type() == TypeUploadMessage || m.Type() == TypeCallMessage) {
+			if ch, found := findCachedChannel(c.ConnectionManager().Id()); found {
+				e = limiters.allow(ch, c.ConnectionManager().Id(), c.Identifier())
+			} else {
+				e = channelNotFound
+			}
+		}
+
+		h(c, m, e)
+	}
+	return MessageHandler(fn)
+})
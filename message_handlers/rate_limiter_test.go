@@ -0,0 +1,57 @@
+package message_handlers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"testing"
+	"time"
+)
+
+// A channel with the given rates.
+func limitedChannel(name string, rate, limit int) *models.Channel {
+	ch := createTestChannel(name)
+	ch.MessageRate = rate
+	ch.ConnectionLimit = limit
+	ch.Update()
+	return ch
+}
+
+func TestRateLimiter(t *testing.T) {
+	dbFile := setupTestDB()
+	defer teardownTestDB(dbFile)
+
+	h := testChain("rate_limiter")
+
+	Convey("rejects the uploads of a device over the message rate", t, func() {
+		ch := limitedChannel("limited_device", 2, 2)
+		cm := testConnectionManager(ch)
+
+		for i := 0; i < 2; i++ {
+			So(sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"temp":1}`), h).Settled(time.Second), ShouldBeNil)
+		}
+		err := sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"temp":1}`), h).Settled(time.Second)
+		So(err, ShouldHaveSameTypeAs, &RateLimitError{})
+		So(err.(*RateLimitError).Scope, ShouldEqual, "device")
+		So(err.(*RateLimitError).DeviceId, ShouldEqual, "dev1")
+
+		// the other devices have their own rate
+		So(sendHttp(cm, "dev2", HttpPush, "/", []byte(`{"temp":1}`), h).Settled(time.Second), ShouldBeNil)
+
+		// the bucket fills up again
+		time.Sleep(600 * time.Millisecond)
+		So(sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"temp":1}`), h).Settled(time.Second), ShouldBeNil)
+	})
+
+	Convey("rejects the uploads over the rate of the whole channel", t, func() {
+		ch := limitedChannel("limited_channel", 1, 2)
+		cm := testConnectionManager(ch)
+
+		So(sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"temp":1}`), h).Settled(time.Second), ShouldBeNil)
+		So(sendHttp(cm, "dev2", HttpPush, "/", []byte(`{"temp":1}`), h).Settled(time.Second), ShouldBeNil)
+		err := sendHttp(cm, "dev3", HttpPush, "/", []byte(`{"temp":1}`), h).Settled(time.Second)
+		So(err, ShouldHaveSameTypeAs, &RateLimitError{})
+		So(err.(*RateLimitError).Scope, ShouldEqual, "channel")
+		So(err.(*RateLimitError).Rate, ShouldEqual, 2)
+	})
+}
@@ -0,0 +1,202 @@
+package message_handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"github.com/eywa/pubsub"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var RpcNotRoutedErr = errors.New("method is not routed")
+var RpcTimeoutErr = errors.New("call timed out")
+var RpcBusyErr = errors.New("too many calls in flight")
+var rpcNotRespondingErr = errors.New("connection can not answer calls")
+
+type rpcJob struct {
+	ch *models.Channel
+	c  Connection
+	m  Message
+}
+
+var rpcPoolOnce sync.Once
+var rpcJobs chan *rpcJob
+
+// The calls are answered by a fixed number of workers, so that a flood of
+// slow calls can't pile up goroutines. A call that finds the queue full is
+// answered with RpcBusyErr.
+func queueCall(job *rpcJob) bool {
+	rpcPoolOnce.Do(func() {
+		workers := 16
+		if cfg := Config(); cfg != nil && cfg.Rpc != nil && cfg.Rpc.Workers > 0 {
+			workers = cfg.Rpc.Workers
+		}
+		rpcJobs = make(chan *rpcJob, 16*workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				for job := range rpcJobs {
+					answerCall(job.ch, job.c, job.m)
+				}
+			}()
+		}
+	})
+
+	select {
+	case rpcJobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func init() {
+	RegisterRpcHandler("echo", func(call *RpcCall) ([]byte, error) {
+		return call.Params, nil
+	})
+	RegisterRpcHandler("time", func(call *RpcCall) ([]byte, error) {
+		return []byte(strconv.FormatInt(NanoToMilli(time.Now().UnixNano()), 10)), nil
+	})
+}
+
+// Call routes a call of a device by the rpc routes of its channel, giving
+// up after the configured timeout.
+func Call(ch *models.Channel, call *RpcCall) ([]byte, error) {
+	route, found := models.FindCachedRpcRoute(ch.Id, call.Method)
+	if !found {
+		return nil, RpcNotRoutedErr
+	}
+
+	type result struct {
+		answer []byte
+		err    error
+	}
+	resultCh := make(chan *result, 1)
+	go func() {
+		answer, err := routeCall(route, call)
+		resultCh <- &result{answer: answer, err: err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.answer, r.err
+	case <-time.After(Config().Rpc.Timeout.Duration):
+		return nil, RpcTimeoutErr
+	}
+}
+
+func routeCall(route *models.RpcRoute, call *RpcCall) ([]byte, error) {
+	switch route.Kind {
+	case models.RpcRouteHandler:
+		h, found := FindRpcHandler(route.Handler)
+		if !found {
+			return nil, errors.New(fmt.Sprintf("rpc handler %s is not registered", route.Handler))
+		}
+		return h(call)
+	case models.RpcRouteWebhook:
+		return postCall(route, call)
+	case models.RpcRouteCanned:
+		return []byte(route.Response), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported rpc route kind %s", route.Kind))
+	}
+}
+
+// The params of the call are posted as they are, the response body is the
+// answer.
+func postCall(route *models.RpcRoute, call *RpcCall) ([]byte, error) {
+	req, err := http.NewRequest("POST", route.Url, bytes.NewReader(call.Params))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Eywa-Channel", call.ChannelId)
+	req.Header.Set("X-Eywa-Device", call.DeviceId)
+	req.Header.Set("X-Eywa-Method", call.Method)
+	req.Header.Set("X-Eywa-Signature", "sha256="+route.Sign(call.Params))
+
+	client := &http.Client{Timeout: Config().Rpc.Timeout.Duration}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, errors.New(fmt.Sprintf("unexpected response status %d", resp.StatusCode))
+	}
+
+	maxSize := Config().Rpc.MaxResponseSize
+	answer, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) > maxSize {
+		return nil, errors.New(fmt.Sprintf("response is larger than %d bytes", maxSize))
+	}
+	return answer, nil
+}
+
+// Shows the failure of a call in the attach stream of a connection.
+func PublishCallError(c Connection, method string, err error) {
+	pub, ok := c.(pubsub.Publisher)
+	if !ok {
+		return
+	}
+	pub.Publish(func() string {
+		return format("error", []byte(fmt.Sprintf("call %s failed: %s", method, err.Error())))
+	})
+}
+
+func answerCall(ch *models.Channel, c Connection, m Message) {
+	call, err := ParseRpcCall(c, m)
+	if err != nil {
+		PublishCallError(c, "", err)
+		c.(Responder).Respond(m.Id(), nil, err)
+		return
+	}
+
+	answer, err := Call(ch, call)
+	if err != nil {
+		PublishCallError(c, call.Method, err)
+	}
+	if err = c.(Responder).Respond(m.Id(), answer, err); err != nil {
+		PublishCallError(c, call.Method, err)
+	}
+}
+
+// Answers the calls of devices. The calls are answered in the background by
+// the rpc workers, so that slow routes don't hold up the other messages, and
+// their failures are published to the attach stream right away. A call that
+// comes down with an error, like one over the rate limit, is answered with it.
+var Rpc = NewMiddleware("rpc", func(h MessageHandler) MessageHandler {
+	fn := func(c Connection, m Message, e error) {
+		if m != nil && m.Type() == TypeCallMessage {
+			r, ok := c.(Responder)
+			if !ok {
+				if e == nil {
+					e = rpcNotRespondingErr
+				}
+			} else if e != nil {
+				r.Respond(m.Id(), nil, e)
+			} else if ch, found := findCachedChannel(c.ConnectionManager().Id()); !found {
+				e = channelNotFound
+				r.Respond(m.Id(), nil, e)
+			} else if !queueCall(&rpcJob{ch: ch, c: c, m: m}) {
+				e = RpcBusyErr
+				r.Respond(m.Id(), nil, e)
+			}
+		}
+
+		h(c, m, e)
+	}
+	return MessageHandler(fn)
+})
@@ -0,0 +1,59 @@
+package message_handlers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"testing"
+	"time"
+)
+
+func TestRpc(t *testing.T) {
+	dbFile := setupTestDB()
+	defer teardownTestDB(dbFile)
+
+	RegisterRpcHandler("test_slow", func(call *RpcCall) ([]byte, error) {
+		time.Sleep(300 * time.Millisecond)
+		return []byte("late"), nil
+	})
+
+	ch := createTestChannel("rpc")
+	cm := testConnectionManager(ch)
+	h := testChain("rate_limiter", "rpc")
+
+	(&models.RpcRoute{ChannelId: ch.Id, Method: "config", Kind: models.RpcRouteCanned, Response: `{"interval":5}`}).Create()
+	(&models.RpcRoute{ChannelId: ch.Id, Method: "echo", Kind: models.RpcRouteHandler, Handler: "echo"}).Create()
+	(&models.RpcRoute{ChannelId: ch.Id, Method: "slow", Kind: models.RpcRouteHandler, Handler: "test_slow"}).Create()
+
+	Convey("answers the calls by the rpc routes of the channel", t, func() {
+		answer, err := sendHttp(cm, "dev1", HttpCall, "/?call=config", nil, h).Answer(time.Second)
+		So(err, ShouldBeNil)
+		So(string(answer), ShouldEqual, `{"interval":5}`)
+
+		answer, err = sendHttp(cm, "dev1", HttpCall, "/?call=echo", []byte("hello"), h).Answer(time.Second)
+		So(err, ShouldBeNil)
+		So(string(answer), ShouldEqual, "hello")
+
+		_, err = sendHttp(cm, "dev1", HttpCall, "/?call=reboot", nil, h).Answer(time.Second)
+		So(err, ShouldEqual, RpcNotRoutedErr)
+	})
+
+	Convey("times out the calls of slow routes", t, func() {
+		_, err := sendHttp(cm, "dev2", HttpCall, "/?call=slow", nil, h).Answer(time.Second)
+		So(err, ShouldEqual, RpcTimeoutErr)
+	})
+
+	Convey("answers the calls over the rate limit with the error", t, func() {
+		limited := createTestChannel("rpc_limited")
+		limited.MessageRate = 1
+		limited.ConnectionLimit = 1
+		limited.Update()
+		(&models.RpcRoute{ChannelId: limited.Id, Method: "config", Kind: models.RpcRouteCanned, Response: "{}"}).Create()
+		cm := testConnectionManager(limited)
+
+		_, err := sendHttp(cm, "dev1", HttpCall, "/?call=config", nil, h).Answer(time.Second)
+		So(err, ShouldBeNil)
+		_, err = sendHttp(cm, "dev1", HttpCall, "/?call=config", nil, h).Answer(time.Second)
+		So(err, ShouldHaveSameTypeAs, &RateLimitError{})
+	})
+}
@@ -0,0 +1,41 @@
+package message_handlers
+
+import (
+	"fmt"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"github.com/eywa/pubsub"
+)
+
+// Merges the fields of uploaded points into the reported state of the
+// device. Invalid points are left to the indexer to report, and a shadow
+// that can't be saved doesn't fail the message, so that the data is still
+// indexed.
+var Shadow = NewMiddleware("shadow", func(h MessageHandler) MessageHandler {
+	fn := func(c Connection, m Message, e error) {
+		if e == nil && m != nil && m.Type() == TypeUploadMessage {
+			if ch, found := findCachedChannel(c.ConnectionManager().Id()); found {
+				points, _ := models.NewPoints(m.Id(), ch, c, m)
+				state := make(map[string]interface{})
+				for _, p := range points {
+					for k, v := range p.Fields {
+						state[k] = v
+					}
+				}
+
+				if len(state) > 0 {
+					if _, err := models.ReportState(ch.Id, c.Identifier(), state); err != nil {
+						if pub, ok := c.(pubsub.Publisher); ok {
+							pub.Publish(func() string {
+								return format("error", []byte(fmt.Sprintf("failed to update shadow: %s", err.Error())))
+							})
+						}
+					}
+				}
+			}
+		}
+
+		h(c, m, e)
+	}
+	return MessageHandler(fn)
+})
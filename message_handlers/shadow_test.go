@@ -0,0 +1,45 @@
+package message_handlers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	dbFile := setupTestDB()
+	defer teardownTestDB(dbFile)
+
+	ch := createTestChannel("shadow", "shadow")
+	cm := testConnectionManager(ch)
+	h := testChain("shadow")
+
+	Convey("reports the uploaded fields and shrinks the delta", t, func() {
+		_, err := models.PatchDesiredState(ch.Id, "dev1", map[string]interface{}{"temp": 20.5, "on": true})
+		So(err, ShouldBeNil)
+
+		So(sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"temp":20.5}`), h).Settled(time.Second), ShouldBeNil)
+		s, found := models.FindDeviceShadow(ch.Id, "dev1")
+		So(found, ShouldBeTrue)
+		So(s.Reported["temp"], ShouldEqual, 20.5)
+		So(s.Delta, ShouldResemble, models.JsonMap{"on": true})
+
+		msg, ok := s.DeltaMessage()
+		So(ok, ShouldBeTrue)
+		So(string(msg), ShouldContainSubstring, `"delta":{"on":true}`)
+
+		So(sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"on":true}`), h).Settled(time.Second), ShouldBeNil)
+		s, _ = models.FindDeviceShadow(ch.Id, "dev1")
+		So(s.Delta, ShouldBeEmpty)
+		_, ok = s.DeltaMessage()
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("leaves the shadow alone for invalid uploads", t, func() {
+		So(sendHttp(cm, "dev2", HttpPush, "/", []byte(`{"temp":"hot"}`), h).Settled(time.Second), ShouldBeNil)
+		_, found := models.FindDeviceShadow(ch.Id, "dev2")
+		So(found, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,120 @@
+package message_handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	"github.com/eywa/pubsub"
+	"github.com/satori/go.uuid"
+	"sync"
+)
+
+var pointStreamsOnce sync.Once
+var pointStreams *pubsub.StreamHub
+
+func streamHub() *pubsub.StreamHub {
+	pointStreamsOnce.Do(func() {
+		conf := pubsub.StreamSettings()
+		pointStreams = pubsub.NewStreamHub(conf.Backlog, conf.ResumeWindow.Duration)
+	})
+	return pointStreams
+}
+
+// What stream filters look at, the point itself is only kept marshaled.
+type StreamedPoint struct {
+	DeviceId    string
+	MessageType string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+}
+
+// Picks the points a subscriber gets, empty conditions match every point and
+// all given conditions have to match.
+type PointFilter struct {
+	DeviceIds    map[string]bool
+	MessageTypes []string
+	Tags         map[string]string
+	Fields       []string
+}
+
+func (f *PointFilter) Matches(p *StreamedPoint) bool {
+	if len(f.DeviceIds) > 0 && !f.DeviceIds[p.DeviceId] {
+		return false
+	}
+
+	if len(f.MessageTypes) > 0 {
+		found := false
+		for _, t := range f.MessageTypes {
+			if t == p.MessageType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for k, v := range f.Tags {
+		if p.Tags[k] != v {
+			return false
+		}
+	}
+
+	for _, field := range f.Fields {
+		if _, found := p.Fields[field]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribes to the points of a channel received by this node.
+func SubscribePoints(ch *models.Channel, cursor uint64, f *PointFilter) *pubsub.StreamSubscription {
+	return streamHub().Subscribe(pointsTopic(ch), cursor, pubsub.StreamSettings().BufferSize, func(e *pubsub.StreamEvent) bool {
+		return f.Matches(e.Value.(*StreamedPoint))
+	})
+}
+
+func UnsubscribePoints(s *pubsub.StreamSubscription) {
+	streamHub().Unsubscribe(s)
+}
+
+// Publishes the points of uploads and connection activities to the streams
+// of the channel. Nothing is parsed when the channel isn't streamed.
+var Stream = NewMiddleware("stream", func(h MessageHandler) MessageHandler {
+	fn := func(c Connection, m Message, e error) {
+		if e == nil && m != nil && (m.Type() == TypeUploadMessage || m.Type() == TypeDisconnectMessage || m.Type() == TypeConnectMessage) {
+			if ch, found := findCachedChannel(c.ConnectionManager().Id()); found {
+				if topic := pointsTopic(ch); streamHub().Subscribed(topic) {
+					publishPoints(topic, ch, c, m)
+				}
+			}
+		}
+
+		h(c, m, e)
+	}
+	return MessageHandler(fn)
+})
+
+func publishPoints(topic string, ch *models.Channel, c Connection, m Message) {
+	points, _ := models.NewPoints(uuid.NewV1().String(), ch, c, m)
+	for _, p := range points {
+		js, err := json.Marshal(p)
+		if err != nil {
+			continue
+		}
+
+		streamHub().Publish(topic, js, &StreamedPoint{
+			DeviceId:    c.Identifier(),
+			MessageType: m.TypeString(),
+			Tags:        p.Tags,
+			Fields:      p.Fields,
+		})
+	}
+}
+
+func pointsTopic(ch *models.Channel) string {
+	return fmt.Sprintf("points/%d", ch.Id)
+}
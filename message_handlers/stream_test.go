@@ -0,0 +1,77 @@
+package message_handlers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/connections"
+	"github.com/eywa/pubsub"
+	"testing"
+	"time"
+)
+
+// The events of a subscription published so far.
+func streamedEvents(s *pubsub.StreamSubscription) []*pubsub.StreamEvent {
+	events := []*pubsub.StreamEvent{}
+	for {
+		select {
+		case e := <-s.Events():
+			events = append(events, e)
+		case <-time.After(50 * time.Millisecond):
+			return events
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	dbFile := setupTestDB()
+	defer teardownTestDB(dbFile)
+
+	ch := createTestChannel("stream", "stream")
+	cm := testConnectionManager(ch)
+	h := testChain("stream")
+
+	push := func(deviceId string, body string) {
+		So(sendHttp(cm, deviceId, HttpPush, "/", []byte(body), h).Settled(time.Second), ShouldBeNil)
+	}
+
+	Convey("streams the points that pass the filter", t, func() {
+		s := SubscribePoints(ch, 0, &PointFilter{
+			DeviceIds:    map[string]bool{"dev1": true},
+			MessageTypes: []string{"upload"},
+			Fields:       []string{"temp"},
+		})
+		defer UnsubscribePoints(s)
+
+		push("dev1", `{"temp":1.5}`)
+		push("dev2", `{"temp":2.5}`)
+		push("dev1", `{"on":true}`)
+
+		events := streamedEvents(s)
+		So(len(events), ShouldEqual, 1)
+		p := events[0].Value.(*StreamedPoint)
+		So(p.DeviceId, ShouldEqual, "dev1")
+		So(p.MessageType, ShouldEqual, "upload")
+		So(p.Fields["temp"], ShouldEqual, 1.5)
+		So(string(events[0].Data), ShouldContainSubstring, `"temp":1.5`)
+	})
+
+	Convey("resumes a stream from the cursor of the last point", t, func() {
+		s := SubscribePoints(ch, 0, &PointFilter{})
+		push("dev3", `{"temp":1}`)
+		events := streamedEvents(s)
+		So(len(events), ShouldEqual, 1)
+		cursor := events[0].Seq
+		UnsubscribePoints(s)
+
+		// points keep being collected for the resume window
+		push("dev3", `{"temp":2}`)
+		push("dev3", `{"temp":3}`)
+
+		s = SubscribePoints(ch, cursor, &PointFilter{})
+		defer UnsubscribePoints(s)
+		events = streamedEvents(s)
+		So(len(events), ShouldEqual, 2)
+		So(events[0].Seq, ShouldEqual, cursor+1)
+		So(events[0].Value.(*StreamedPoint).Fields["temp"], ShouldEqual, 2)
+		So(events[1].Value.(*StreamedPoint).Fields["temp"], ShouldEqual, 3)
+	})
+}
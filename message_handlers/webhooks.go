@@ -0,0 +1,359 @@
+package message_handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	"github.com/eywa/loggers"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A webhook queue without deliveries for this long stops its worker.
+var webhookQueueIdleTime = 10 * time.Minute
+
+// The deliveries share one client per request timeout, so that connections
+// to the webhook servers are kept alive between deliveries. The timeout can
+// be changed at runtime.
+var webhookClients = struct {
+	sync.Mutex
+	clients map[time.Duration]*http.Client
+}{clients: make(map[time.Duration]*http.Client)}
+
+func webhookClient(timeout time.Duration) *http.Client {
+	webhookClients.Lock()
+	defer webhookClients.Unlock()
+
+	client, found := webhookClients.clients[timeout]
+	if !found {
+		client = &http.Client{Timeout: timeout}
+		webhookClients.clients[timeout] = client
+	}
+	return client
+}
+
+var webhooksClosedErr = errors.New("webhook dispatcher is closed")
+var webhookQueueFullErr = errors.New("webhook queue is full")
+
+type WebhookDelivery struct {
+	Id           string `json:"id"`
+	WebhookId    int    `json:"webhook_id"`
+	Event        string `json:"event"`
+	Status       string `json:"status"`
+	Attempts     int    `json:"attempts"`
+	ResponseCode int    `json:"response_code"`
+	Error        string `json:"error,omitempty"`
+	Created      int64  `json:"created"`
+	Finished     int64  `json:"finished"`
+
+	hook *models.Webhook
+	body []byte
+}
+
+// Ring buffer of the most recent deliveries of a webhook.
+type webhookDeliveryLog struct {
+	entries []*WebhookDelivery
+	next    int
+	full    bool
+}
+
+func (l *webhookDeliveryLog) add(d *WebhookDelivery) {
+	if len(l.entries) == 0 {
+		return
+	}
+	l.entries[l.next] = d
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// most recent first
+func (l *webhookDeliveryLog) list() []*WebhookDelivery {
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+
+	ds := make([]*WebhookDelivery, 0, n)
+	for i := 1; i <= n; i++ {
+		ds = append(ds, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return ds
+}
+
+type webhookQueue struct {
+	id         int
+	deliveries chan *WebhookDelivery
+}
+
+type webhookDispatcher struct {
+	sync.Mutex
+	queues map[int]*webhookQueue
+	logs   map[int]*webhookDeliveryLog
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+var dispatcher = &webhookDispatcher{
+	queues: make(map[int]*webhookQueue),
+	logs:   make(map[int]*webhookDeliveryLog),
+	done:   make(chan struct{}),
+}
+
+func (d *webhookDispatcher) enqueue(hook *models.Webhook, event string, body []byte) error {
+	delivery := &WebhookDelivery{
+		Id:        uuid.NewV4().String(),
+		WebhookId: hook.Id,
+		Event:     event,
+		Status:    "pending",
+		Created:   NanoToMilli(time.Now().UnixNano()),
+		hook:      hook,
+		body:      body,
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return webhooksClosedErr
+	}
+
+	q, found := d.queues[hook.Id]
+	if !found {
+		q = &webhookQueue{
+			id:         hook.Id,
+			deliveries: make(chan *WebhookDelivery, Config().Webhooks.QueueSize),
+		}
+		d.queues[hook.Id] = q
+		d.wg.Add(1)
+		go d.work(q)
+	}
+
+	select {
+	case q.deliveries <- delivery:
+		return nil
+	default:
+		delivery.Status = "dropped"
+		delivery.Error = webhookQueueFullErr.Error()
+		delivery.Finished = delivery.Created
+		d.log(delivery)
+		return webhookQueueFullErr
+	}
+}
+
+// caller must hold the lock
+func (d *webhookDispatcher) log(delivery *WebhookDelivery) {
+	l, found := d.logs[delivery.WebhookId]
+	if !found {
+		l = &webhookDeliveryLog{entries: make([]*WebhookDelivery, Config().Webhooks.DeliveryLogSize)}
+		d.logs[delivery.WebhookId] = l
+	}
+	l.add(delivery)
+}
+
+// Deliveries of the same webhook are sent in order, one at a time.
+func (d *webhookDispatcher) work(q *webhookQueue) {
+	defer d.wg.Done()
+
+	idle := time.NewTimer(webhookQueueIdleTime)
+	defer idle.Stop()
+
+	for {
+		select {
+		case delivery := <-q.deliveries:
+			d.deliver(delivery)
+			idle.Reset(webhookQueueIdleTime)
+		case <-idle.C:
+			d.Lock()
+			// a delivery might have been queued while the timer fired
+			if len(q.deliveries) > 0 {
+				d.Unlock()
+				idle.Reset(webhookQueueIdleTime)
+				continue
+			}
+			delete(d.queues, q.id)
+			d.Unlock()
+			return
+		case <-d.done:
+			d.drop(q)
+			return
+		}
+	}
+}
+
+func (d *webhookDispatcher) drop(q *webhookQueue) {
+	d.Lock()
+	defer d.Unlock()
+
+	for {
+		select {
+		case delivery := <-q.deliveries:
+			delivery.Status = "dropped"
+			delivery.Error = webhooksClosedErr.Error()
+			delivery.Finished = NanoToMilli(time.Now().UnixNano())
+			d.log(delivery)
+		default:
+			return
+		}
+	}
+}
+
+func (d *webhookDispatcher) deliver(delivery *WebhookDelivery) {
+	backoff := Config().Webhooks.Timeouts.RetryBackoff.Duration
+	maxBackoff := Config().Webhooks.Timeouts.MaxRetryBackoff.Duration
+
+	for {
+		delivery.Attempts += 1
+		code, err := d.post(delivery)
+		delivery.ResponseCode = code
+		if err == nil {
+			delivery.Status = "succeeded"
+			delivery.Error = ""
+			break
+		}
+
+		delivery.Error = err.Error()
+		if delivery.Attempts > Config().Webhooks.MaxRetries {
+			delivery.Status = "failed"
+			loggers.Logger.Warn(fmt.Sprintf("webhook %d delivery %s failed after %d attempts: %s", delivery.WebhookId, delivery.Id, delivery.Attempts, err.Error()))
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-d.done:
+			delivery.Status = "failed"
+		}
+		if delivery.Status == "failed" {
+			break
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	delivery.Finished = NanoToMilli(time.Now().UnixNano())
+	d.Lock()
+	d.log(delivery)
+	d.Unlock()
+}
+
+func (d *webhookDispatcher) post(delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", delivery.hook.Url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Eywa-Event", delivery.Event)
+	req.Header.Set("X-Eywa-Delivery", delivery.Id)
+	req.Header.Set("X-Eywa-Signature", "sha256="+delivery.hook.Sign(delivery.body))
+
+	resp, err := webhookClient(Config().Webhooks.Timeouts.Request.Duration).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// drained so that the connection is reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New(fmt.Sprintf("unexpected response status %d", resp.StatusCode))
+	}
+	return resp.StatusCode, nil
+}
+
+// Recent deliveries of a webhook, most recent first.
+func WebhookDeliveries(webhookId int) []*WebhookDelivery {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	if l, found := dispatcher.logs[webhookId]; found {
+		return l.list()
+	}
+	return []*WebhookDelivery{}
+}
+
+// Forget the delivery log of a deleted webhook.
+func RemoveWebhookDeliveries(webhookId int) {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	delete(dispatcher.logs, webhookId)
+}
+
+// Stops accepting deliveries, aborts pending retries and waits for in-flight
+// requests to finish.
+func CloseWebhooks() {
+	dispatcher.Lock()
+	if dispatcher.closed {
+		dispatcher.Unlock()
+		return
+	}
+	dispatcher.closed = true
+	close(dispatcher.done)
+	dispatcher.Unlock()
+
+	dispatcher.wg.Wait()
+}
+
+var Webhooks = NewMiddleware("webhooks", func(h MessageHandler) MessageHandler {
+	fn := func(c Connection, m Message, e error) {
+		if e == nil && m != nil {
+			for event, t := range models.SupportedWebhookEvents {
+				if t != m.Type() {
+					continue
+				}
+				if ch, found := findCachedChannel(c.ConnectionManager().Id()); found {
+					dispatchWebhooks(ch, event, c, m)
+				}
+				break
+			}
+		}
+
+		h(c, m, e)
+	}
+	return MessageHandler(fn)
+})
+
+func dispatchWebhooks(ch *models.Channel, event string, c Connection, m Message) {
+	hooks := models.FetchCachedWebhooksByChannelId(ch.Id)
+	if len(hooks) == 0 {
+		return
+	}
+
+	points, err := models.NewPoints(uuid.NewV1().String(), ch, c, m)
+	if err != nil {
+		loggers.Logger.Debug(fmt.Sprintf("skipping webhooks for invalid points of %s message from device %s: %s", event, c.Identifier(), err.Error()))
+	}
+
+	for _, p := range points {
+		var js []byte
+		for _, hook := range hooks {
+			if !hook.Matches(event, p.Tags) {
+				continue
+			}
+
+			if js == nil {
+				if js, err = json.Marshal(p); err != nil {
+					return
+				}
+			}
+
+			if err = dispatcher.enqueue(hook, event, js); err != nil {
+				loggers.Logger.Warn(fmt.Sprintf("webhook %d delivery of %s message from device %s is dropped: %s", hook.Id, event, c.Identifier(), err.Error()))
+			}
+		}
+	}
+}
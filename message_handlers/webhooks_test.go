@@ -0,0 +1,155 @@
+package message_handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	"github.com/eywa/models"
+	. "github.com/eywa/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// A webhook server answering with the given status codes in turn, the last
+// one is repeated.
+type webhookServer struct {
+	*httptest.Server
+	sync.Mutex
+	codes    []int
+	requests []*webhookRequest
+}
+
+func newWebhookServer(codes ...int) *webhookServer {
+	s := &webhookServer{codes: codes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.Lock()
+		s.requests = append(s.requests, &webhookRequest{header: r.Header, body: body, at: time.Now()})
+		code := s.codes[0]
+		if len(s.codes) > 1 {
+			s.codes = s.codes[1:]
+		}
+		s.Unlock()
+		w.WriteHeader(code)
+	}))
+	return s
+}
+
+// Waits for the delivery of a webhook to finish.
+func webhookDelivery(hookId int) *WebhookDelivery {
+	for i := 0; i < 100; i++ {
+		if ds := WebhookDeliveries(hookId); len(ds) > 0 {
+			return ds[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestWebhooks(t *testing.T) {
+	dbFile := setupTestDB()
+	defer teardownTestDB(dbFile)
+
+	Config().Webhooks = &WebhookConf{
+		QueueSize:       1,
+		MaxRetries:      2,
+		DeliveryLogSize: 8,
+		Timeouts: &WebhookTimeoutConf{
+			Request:         &JSONDuration{time.Second},
+			RetryBackoff:    &JSONDuration{20 * time.Millisecond},
+			MaxRetryBackoff: &JSONDuration{30 * time.Millisecond},
+		},
+	}
+
+	ch := createTestChannel("webhooks", "webhooks")
+	cm := testConnectionManager(ch)
+	h := testChain("webhooks")
+
+	Convey("delivers the points of an upload signed with the secret", t, func() {
+		s := newWebhookServer(http.StatusOK)
+		defer s.Close()
+
+		hook := &models.Webhook{ChannelId: ch.Id, Url: s.URL, Secret: "secret", Events: []string{"upload"}}
+		So(hook.Create(), ShouldBeNil)
+		defer hook.Delete()
+
+		conn := sendHttp(cm, "dev1", HttpPush, "/", []byte(`{"temp":1.5}`), h)
+		So(conn.Settled(time.Second), ShouldBeNil)
+
+		d := webhookDelivery(hook.Id)
+		So(d, ShouldNotBeNil)
+		So(d.Status, ShouldEqual, "succeeded")
+		So(d.Attempts, ShouldEqual, 1)
+
+		r := s.requests[0]
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(r.body)
+		So(r.header.Get("X-Eywa-Signature"), ShouldEqual, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		So(r.header.Get("X-Eywa-Event"), ShouldEqual, "upload")
+		So(r.header.Get("X-Eywa-Delivery"), ShouldEqual, d.Id)
+		So(string(r.body), ShouldContainSubstring, `"temp":1.5`)
+	})
+
+	Convey("retries failed deliveries with a growing backoff", t, func() {
+		s := newWebhookServer(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+		defer s.Close()
+
+		hook := &models.Webhook{Id: 1001, Url: s.URL, Secret: "secret"}
+		So(dispatcher.enqueue(hook, "upload", []byte("{}")), ShouldBeNil)
+
+		d := webhookDelivery(hook.Id)
+		So(d, ShouldNotBeNil)
+		So(d.Status, ShouldEqual, "succeeded")
+		So(d.Attempts, ShouldEqual, 3)
+		So(d.ResponseCode, ShouldEqual, http.StatusOK)
+		So(s.requests[1].at.Sub(s.requests[0].at), ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+		So(s.requests[2].at.Sub(s.requests[1].at), ShouldBeGreaterThanOrEqualTo, 30*time.Millisecond)
+	})
+
+	Convey("gives up after the max retries", t, func() {
+		s := newWebhookServer(http.StatusBadGateway)
+		defer s.Close()
+
+		hook := &models.Webhook{Id: 1002, Url: s.URL, Secret: "secret"}
+		So(dispatcher.enqueue(hook, "upload", []byte("{}")), ShouldBeNil)
+
+		d := webhookDelivery(hook.Id)
+		So(d, ShouldNotBeNil)
+		So(d.Status, ShouldEqual, "failed")
+		So(d.Attempts, ShouldEqual, 3)
+		So(d.Error, ShouldEqual, "unexpected response status 502")
+	})
+
+	Convey("drops the deliveries over the queue size", t, func() {
+		block := make(chan struct{})
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}))
+		defer s.Close()
+
+		hook := &models.Webhook{Id: 1003, Url: s.URL, Secret: "secret"}
+		So(dispatcher.enqueue(hook, "upload", []byte("{}")), ShouldBeNil)
+		// the worker is busy with the first delivery, the second one waits
+		time.Sleep(50 * time.Millisecond)
+		So(dispatcher.enqueue(hook, "upload", []byte("{}")), ShouldBeNil)
+		So(dispatcher.enqueue(hook, "upload", []byte("{}")), ShouldEqual, webhookQueueFullErr)
+
+		d := webhookDelivery(hook.Id)
+		So(d.Status, ShouldEqual, "dropped")
+		So(d.Error, ShouldEqual, webhookQueueFullErr.Error())
+		close(block)
+	})
+}
@@ -16,6 +16,12 @@ import (
 
 func AccessLogging(c *web.C, h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		// gossip between cluster nodes is too chatty to be logged
+		if strings.HasPrefix(r.URL.Path, "/cluster/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
 		reqID := middleware.GetReqID(*c)
 
 		logStart(reqID, r)
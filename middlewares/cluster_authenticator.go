@@ -0,0 +1,23 @@
+package middlewares
+
+import (
+	"github.com/zenazn/goji/web"
+	"github.com/eywa/cluster"
+	. "github.com/eywa/utils"
+	"net/http"
+)
+
+func ClusterAuthenticator(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !cluster.Enabled() {
+			Render.JSON(w, http.StatusNotFound, map[string]string{"error": "cluster mode is not enabled"})
+		} else if cluster.Authenticate(r) {
+			w.Header().Set(cluster.NodeNameHeader, cluster.LocalNode().Name)
+			h.ServeHTTP(w, r)
+		} else {
+			Render.JSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid cluster secret"})
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -6,8 +6,7 @@ import (
 )
 
 func migrate() {
-	FatalIfErr(DB.AutoMigrate(
-		&Channel{},
-		&Dashboard{},
-	).Error)
+	FatalIfErr(MigrateAll())
+	FatalIfErr(MigrateMessageHandlers())
+	FatalIfErr(MigrateDeviceSecrets())
 }
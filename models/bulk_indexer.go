@@ -0,0 +1,443 @@
+package models
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/loggers"
+	. "github.com/eywa/utils"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var bulkIndexerClosedErr = errors.New("bulk indexer is closed")
+var bulkIndexerFullErr = errors.New("bulk indexer queue is full")
+
+var BulkIndex *BulkIndexer
+
+type IndexDocument struct {
+	Index string          `json:"index"`
+	Type  string          `json:"type"`
+	Id    string          `json:"id"`
+	Body  json.RawMessage `json:"body"`
+
+	// called once the document is indexed, documents replayed from the
+	// spill file have none.
+	indexed func()
+	// whether the document was read back from the spill file
+	replayed bool
+}
+
+func NewIndexDocument(index, _type, id string, body []byte, indexed func()) *IndexDocument {
+	return &IndexDocument{Index: index, Type: _type, Id: id, Body: body, indexed: indexed}
+}
+
+type BulkIndexerStats struct {
+	QueueDepth  int    `json:"queue_depth"`
+	QueueSize   int    `json:"queue_size"`
+	Indexed     int64  `json:"indexed"`
+	Failed      int64  `json:"failed"`
+	Dropped     int64  `json:"dropped"`
+	Spilled     int64  `json:"spilled"`
+	Replayed    int64  `json:"replayed"`
+	SpillSize   int64  `json:"spill_size"`
+	Flushes     int64  `json:"flushes"`
+	LastFlushAt int64  `json:"last_flush_at"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// Sends one bulk request. A request error means nothing was indexed,
+// otherwise the returned slice has the error of every document, nil for the
+// indexed ones. Retry tells whether a failed document is worth another try.
+type bulkFunc func(docs []*IndexDocument) (errs []error, retry []bool, err error)
+
+// BulkIndexer batches documents into bulk requests, flushing when a batch is
+// full or the flush interval is over. Documents that don't fit in the queue
+// or can't be indexed for now are spilled to disk when a spill file is
+// configured, and replayed once Elasticsearch takes documents again.
+type BulkIndexer struct {
+	queue chan *IndexDocument
+	bulk  bulkFunc
+
+	closeLock sync.RWMutex
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	spillLock sync.Mutex
+	spillFile string
+	maxSpill  int64
+	spillSize int64
+
+	indexed  int64
+	failed   int64
+	dropped  int64
+	spilled  int64
+	replayed int64
+	flushes  int64
+
+	statsLock   sync.Mutex
+	lastFlushAt time.Time
+	lastError   string
+}
+
+func InitializeBulkIndexer() error {
+	bi, err := NewBulkIndexer(DataStore.Write)
+	if err != nil {
+		return err
+	}
+	BulkIndex = bi
+	return nil
+}
+
+func CloseBulkIndexer() error {
+	if BulkIndex == nil {
+		return nil
+	}
+	BulkIndex.Close()
+	return nil
+}
+
+func NewBulkIndexer(bulk bulkFunc) (*BulkIndexer, error) {
+	bi := &BulkIndexer{
+		queue:     make(chan *IndexDocument, Config().Indices.Bulk.QueueSize),
+		bulk:      bulk,
+		done:      make(chan struct{}),
+		spillFile: Config().Indices.Bulk.SpillFile,
+		maxSpill:  Config().Indices.Bulk.MaxSpillSize,
+	}
+
+	if len(bi.spillFile) > 0 {
+		f, err := os.OpenFile(bi.spillFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		bi.spillSize = fi.Size()
+
+		if err := bi.recoverReplay(); err != nil {
+			return nil, err
+		}
+	}
+
+	bi.wg.Add(1)
+	go bi.work()
+	return bi, nil
+}
+
+// Queues a document without blocking.
+func (bi *BulkIndexer) Add(doc *IndexDocument) error {
+	bi.closeLock.RLock()
+	defer bi.closeLock.RUnlock()
+
+	if bi.closed {
+		return bi.overflow([]*IndexDocument{doc}, bulkIndexerClosedErr)
+	}
+
+	select {
+	case bi.queue <- doc:
+		return nil
+	default:
+		return bi.overflow([]*IndexDocument{doc}, bulkIndexerFullErr)
+	}
+}
+
+// Spills documents that can't be indexed now, or drops them when there is no
+// room on disk.
+func (bi *BulkIndexer) overflow(docs []*IndexDocument, reason error) error {
+	if err := bi.spill(docs); err != nil {
+		atomic.AddInt64(&bi.dropped, int64(len(docs)))
+		return reason
+	}
+	return nil
+}
+
+func (bi *BulkIndexer) spill(docs []*IndexDocument) error {
+	if len(bi.spillFile) == 0 {
+		return errors.New("spill file is not configured")
+	}
+
+	buf := make([]byte, 0)
+	for _, doc := range docs {
+		js, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, js...)
+		buf = append(buf, '\n')
+	}
+
+	bi.spillLock.Lock()
+	defer bi.spillLock.Unlock()
+
+	if bi.maxSpill > 0 && bi.spillSize+int64(len(buf)) > bi.maxSpill {
+		return errors.New("spill file is full")
+	}
+
+	f, err := os.OpenFile(bi.spillFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := f.Write(buf)
+	bi.spillSize += int64(n)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if !doc.replayed {
+			atomic.AddInt64(&bi.spilled, 1)
+		}
+	}
+	return nil
+}
+
+func (bi *BulkIndexer) work() {
+	defer bi.wg.Done()
+
+	ticker := time.NewTicker(Config().Indices.Bulk.FlushInterval.Duration)
+	defer ticker.Stop()
+
+	batch := make([]*IndexDocument, 0, Config().Indices.Bulk.Size)
+	for {
+		select {
+		case doc := <-bi.queue:
+			batch = append(batch, doc)
+			if len(batch) >= Config().Indices.Bulk.Size {
+				if bi.flush(batch) {
+					bi.replay()
+				}
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				if bi.flush(batch) {
+					bi.replay()
+				}
+				batch = batch[:0]
+			} else if len(bi.queue) == 0 {
+				bi.replay()
+			}
+		case <-bi.done:
+			// drain whatever is left in the queue
+			for {
+				select {
+				case doc := <-bi.queue:
+					batch = append(batch, doc)
+					if len(batch) >= Config().Indices.Bulk.Size {
+						bi.flush(batch)
+						batch = batch[:0]
+					}
+				default:
+					if len(batch) > 0 {
+						bi.flush(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Sends a batch, returns false when Elasticsearch couldn't take it.
+func (bi *BulkIndexer) flush(batch []*IndexDocument) bool {
+	atomic.AddInt64(&bi.flushes, 1)
+	errs, retry, err := bi.bulk(batch)
+
+	bi.statsLock.Lock()
+	bi.lastFlushAt = time.Now()
+	if err != nil {
+		bi.lastError = err.Error()
+	}
+	bi.statsLock.Unlock()
+
+	if err != nil {
+		Logger.Warn(fmt.Sprintf("bulk indexing of %d documents failed: %s", len(batch), err.Error()))
+		if bi.spill(batch) != nil {
+			atomic.AddInt64(&bi.failed, int64(len(batch)))
+		}
+		return false
+	}
+
+	retries := make([]*IndexDocument, 0)
+	for i, doc := range batch {
+		if errs[i] == nil {
+			atomic.AddInt64(&bi.indexed, 1)
+			if doc.replayed {
+				atomic.AddInt64(&bi.replayed, 1)
+			}
+			if doc.indexed != nil {
+				doc.indexed()
+			}
+		} else if retry[i] {
+			retries = append(retries, doc)
+		} else {
+			atomic.AddInt64(&bi.failed, 1)
+			bi.statsLock.Lock()
+			bi.lastError = errs[i].Error()
+			bi.statsLock.Unlock()
+		}
+	}
+
+	if len(retries) > 0 {
+		if bi.spill(retries) != nil {
+			atomic.AddInt64(&bi.failed, int64(len(retries)))
+		}
+		return false
+	}
+	return true
+}
+
+// A replay that didn't get through its file, because eywa stopped or the
+// file couldn't be read, leaves it behind. Its documents are appended back to
+// the spill file so that they are replayed again, the ones indexed already
+// are indexed twice.
+// caller must hold spillLock
+func (bi *BulkIndexer) recoverReplay() error {
+	replayFile := bi.spillFile + ".replay"
+	src, err := os.Open(replayFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(bi.spillFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	bi.spillSize += n
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(replayFile)
+}
+
+// Feeds the spilled documents back, the spill file is moved aside first so
+// that documents failing again are spilled to a fresh file. The file moved
+// aside is only removed once all of its documents are queued again.
+func (bi *BulkIndexer) replay() {
+	if len(bi.spillFile) == 0 {
+		return
+	}
+
+	bi.spillLock.Lock()
+	if err := bi.recoverReplay(); err != nil {
+		bi.spillLock.Unlock()
+		Logger.Warn(fmt.Sprintf("failed to recover spilled documents: %s", err.Error()))
+		return
+	}
+	if bi.spillSize == 0 {
+		bi.spillLock.Unlock()
+		return
+	}
+	replayFile := bi.spillFile + ".replay"
+	err := os.Rename(bi.spillFile, replayFile)
+	if err == nil {
+		bi.spillSize = 0
+	}
+	bi.spillLock.Unlock()
+
+	if err != nil {
+		Logger.Warn(fmt.Sprintf("failed to replay spilled documents: %s", err.Error()))
+		return
+	}
+
+	f, err := os.Open(replayFile)
+	if err != nil {
+		Logger.Warn(fmt.Sprintf("failed to replay spilled documents: %s", err.Error()))
+		return
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	batch := make([]*IndexDocument, 0, Config().Indices.Bulk.Size)
+	ok := true
+	for scanner.Scan() {
+		doc := &IndexDocument{}
+		if err := json.Unmarshal(scanner.Bytes(), doc); err != nil {
+			atomic.AddInt64(&bi.failed, 1)
+			continue
+		}
+		doc.replayed = true
+
+		// once Elasticsearch is down again, the rest goes back to the spill
+		if !ok {
+			bi.overflow([]*IndexDocument{doc}, bulkIndexerFullErr)
+			continue
+		}
+
+		batch = append(batch, doc)
+		if len(batch) >= Config().Indices.Bulk.Size {
+			ok = bi.flush(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		bi.flush(batch)
+	}
+
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		// the rest is picked up by the next replay
+		Logger.Warn(fmt.Sprintf("failed to replay spilled documents: %s", err.Error()))
+		return
+	}
+	os.Remove(replayFile)
+}
+
+// Stops taking documents and flushes the queue.
+func (bi *BulkIndexer) Close() {
+	bi.closeLock.Lock()
+	if bi.closed {
+		bi.closeLock.Unlock()
+		return
+	}
+	bi.closed = true
+	close(bi.done)
+	bi.closeLock.Unlock()
+
+	bi.wg.Wait()
+}
+
+func (bi *BulkIndexer) Stats() *BulkIndexerStats {
+	bi.spillLock.Lock()
+	spillSize := bi.spillSize
+	bi.spillLock.Unlock()
+
+	bi.statsLock.Lock()
+	defer bi.statsLock.Unlock()
+
+	stats := &BulkIndexerStats{
+		QueueDepth: len(bi.queue),
+		QueueSize:  cap(bi.queue),
+		Indexed:    atomic.LoadInt64(&bi.indexed),
+		Failed:     atomic.LoadInt64(&bi.failed),
+		Dropped:    atomic.LoadInt64(&bi.dropped),
+		Spilled:    atomic.LoadInt64(&bi.spilled),
+		Replayed:   atomic.LoadInt64(&bi.replayed),
+		SpillSize:  spillSize,
+		Flushes:    atomic.LoadInt64(&bi.flushes),
+		LastError:  bi.lastError,
+	}
+	if !bi.lastFlushAt.IsZero() {
+		stats.LastFlushAt = NanoToMilli(bi.lastFlushAt.UnixNano())
+	}
+	return stats
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeBulk struct {
+	sync.Mutex
+	down    bool
+	batches [][]*IndexDocument
+}
+
+func (f *fakeBulk) bulk(docs []*IndexDocument) ([]error, []bool, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.down {
+		return nil, nil, errors.New("unavailable")
+	}
+
+	batch := make([]*IndexDocument, len(docs))
+	copy(batch, docs)
+	f.batches = append(f.batches, batch)
+
+	errs := make([]error, len(docs))
+	retry := make([]bool, len(docs))
+	for i, doc := range docs {
+		if doc.Id == "bad" {
+			errs[i] = errors.New("mapper_parsing_exception")
+		}
+	}
+	return errs, retry, nil
+}
+
+func (f *fakeBulk) count() int {
+	f.Lock()
+	defer f.Unlock()
+	n := 0
+	for _, b := range f.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func TestBulkIndexer(t *testing.T) {
+	pwd, _ := os.Getwd()
+	spillFile := path.Join(pwd, "indices_test.spill")
+	defer os.Remove(spillFile)
+
+	setConf := func(size, queueSize int, interval time.Duration, spill string) {
+		SetConfig(&Conf{
+			Indices: &IndexConf{
+				Bulk: &BulkIndexConf{
+					Size:          size,
+					FlushInterval: &JSONDuration{interval},
+					QueueSize:     queueSize,
+					SpillFile:     spill,
+					MaxSpillSize:  1024 * 1024,
+				},
+			},
+		})
+	}
+
+	Convey("flushes when a batch is full", t, func() {
+		setConf(3, 10, time.Hour, "")
+		f := &fakeBulk{}
+		bi, err := NewBulkIndexer(f.bulk)
+		So(err, ShouldBeNil)
+
+		indexed := make(chan struct{}, 3)
+		for _, id := range []string{"1", "2", "3"} {
+			bi.Add(NewIndexDocument("idx", "upload", id, []byte(`{}`), func() { indexed <- struct{}{} }))
+		}
+		for i := 0; i < 3; i++ {
+			<-indexed
+		}
+
+		So(f.count(), ShouldEqual, 3)
+		So(len(f.batches), ShouldEqual, 1)
+		bi.Close()
+		So(bi.Stats().Indexed, ShouldEqual, 3)
+		So(bi.Stats().Flushes, ShouldEqual, 1)
+	})
+
+	Convey("flushes when the interval is over and drains on close", t, func() {
+		setConf(100, 10, 20*time.Millisecond, "")
+		f := &fakeBulk{}
+		bi, _ := NewBulkIndexer(f.bulk)
+
+		bi.Add(NewIndexDocument("idx", "upload", "1", []byte(`{}`), nil))
+		time.Sleep(100 * time.Millisecond)
+		So(f.count(), ShouldEqual, 1)
+
+		bi.Add(NewIndexDocument("idx", "upload", "bad", []byte(`{}`), nil))
+		bi.Close()
+		So(f.count(), ShouldEqual, 2)
+
+		stats := bi.Stats()
+		So(stats.Indexed, ShouldEqual, 1)
+		So(stats.Failed, ShouldEqual, 1)
+		So(stats.LastError, ShouldEqual, "mapper_parsing_exception")
+	})
+
+	Convey("drops documents once the queue is full", t, func() {
+		setConf(100, 1, time.Hour, "")
+		f := &fakeBulk{}
+		bi, _ := NewBulkIndexer(f.bulk)
+
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			err = bi.Add(NewIndexDocument("idx", "upload", "1", []byte(`{}`), nil))
+		}
+		So(err, ShouldEqual, bulkIndexerFullErr)
+		So(bi.Stats().Dropped, ShouldBeGreaterThan, 0)
+		bi.Close()
+
+		So(bi.Add(NewIndexDocument("idx", "upload", "1", []byte(`{}`), nil)), ShouldEqual, bulkIndexerClosedErr)
+	})
+
+	Convey("spills documents while elasticsearch is down and replays them", t, func() {
+		os.Remove(spillFile)
+		setConf(2, 10, 20*time.Millisecond, spillFile)
+		f := &fakeBulk{down: true}
+		bi, _ := NewBulkIndexer(f.bulk)
+
+		bi.Add(NewIndexDocument("idx", "upload", "1", []byte(`{"a":1}`), nil))
+		bi.Add(NewIndexDocument("idx", "upload", "2", []byte(`{"a":2}`), nil))
+		time.Sleep(100 * time.Millisecond)
+
+		stats := bi.Stats()
+		So(stats.Spilled, ShouldEqual, 2)
+		So(stats.SpillSize, ShouldBeGreaterThan, 0)
+		So(stats.Failed, ShouldEqual, 0)
+		So(stats.Dropped, ShouldEqual, 0)
+		So(f.count(), ShouldEqual, 0)
+
+		f.Lock()
+		f.down = false
+		f.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		bi.Close()
+
+		So(f.count(), ShouldEqual, 2)
+		So(string(f.batches[0][1].Body), ShouldEqual, `{"a":2}`)
+		stats = bi.Stats()
+		So(stats.Replayed, ShouldEqual, 2)
+		So(stats.Indexed, ShouldEqual, 2)
+		So(stats.SpillSize, ShouldEqual, 0)
+	})
+
+	Convey("replays the documents a stopped replay left behind", t, func() {
+		os.Remove(spillFile)
+		defer os.Remove(spillFile + ".replay")
+		setConf(2, 10, 20*time.Millisecond, spillFile)
+
+		left := []byte(`{"index":"idx","type":"upload","id":"1","body":{"a":1}}` + "\n")
+		So(ioutil.WriteFile(spillFile+".replay", left, 0644), ShouldBeNil)
+		f := &fakeBulk{}
+		bi, _ := NewBulkIndexer(f.bulk)
+		So(bi.Stats().SpillSize, ShouldEqual, len(left))
+		_, err := os.Stat(spillFile + ".replay")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		// left behind while eywa runs, it is picked up before the next rename
+		So(ioutil.WriteFile(spillFile+".replay", left, 0644), ShouldBeNil)
+		time.Sleep(100 * time.Millisecond)
+		bi.Close()
+
+		So(f.count(), ShouldEqual, 2)
+		So(bi.Stats().Replayed, ShouldEqual, 2)
+		So(bi.Stats().SpillSize, ShouldEqual, 0)
+		_, err = os.Stat(spillFile + ".replay")
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"strings"
 	"time"
+	"github.com/jinzhu/gorm"
 	"github.com/speps/go-hashids"
-	"gopkg.in/olivere/elastic.v3"
 	"github.com/eywa/connections"
 	. "github.com/eywa/utils"
 )
@@ -16,18 +16,88 @@ var InternalTags = []string{"ip", "device_id", "channel_name", "timestamp", "req
 var Salt = "Cc4D5xBlbCBqYTuimuNPGsio7YoMo8d8"
 var HashLen = 16
 
+// Message handlers of a channel that doesn't choose its own, in the order
+// they are applied. The message handlers add themselves with
+// RegisterDefaultMessageHandler.
+var DefaultMessageHandlers = []string{}
+
+// Message handlers that run first on every channel, whatever it lists.
+var CoreMessageHandlers = []string{"rate_limiter"}
+
+// What every channel stored before channels could choose their own message
+// handlers, MigrateMessageHandlers gives them the defaults instead, once.
+var legacyMessageHandlers = []string{"indexer", "logger"}
+
+// Removes what a feature keeps for a channel, in the transaction deleting
+// the channel.
+type channelDeleteHook func(tx *gorm.DB, c *Channel) error
+
+var channelDeleteHooks = []channelDeleteHook{}
+
+// A message handler the channel can't drop while inUse says the channel
+// relies on it, what names the configuration in the validation error.
+type requiredMessageHandler struct {
+	handler string
+	what    string
+	inUse   func(c *Channel) bool
+}
+
+var requiredMessageHandlers = []*requiredMessageHandler{}
+
+// Adds a message handler to the defaults, after the ones added before.
+// Message handlers call it from their init functions.
+func RegisterDefaultMessageHandler(name string) {
+	if !StringSliceContains(DefaultMessageHandlers, name) {
+		DefaultMessageHandlers = append(DefaultMessageHandlers, name)
+	}
+}
+
+// Runs the hook whenever a channel is deleted, called from the init
+// functions of the models.
+func onChannelDelete(h channelDeleteHook) {
+	channelDeleteHooks = append(channelDeleteHooks, h)
+}
+
+// Deletes the rows of the model that belong to a deleted channel.
+func deleteWithChannel(model interface{}) {
+	onChannelDelete(func(tx *gorm.DB, c *Channel) error {
+		return tx.Where("channel_id = ?", c.Id).Delete(model).Error
+	})
+}
+
+// Keeps channels from dropping the handler while they have rows of the
+// model, that match the query when one is given. Called from the init
+// functions of the models.
+func requireMessageHandler(handler, what string, model interface{}, query string, args ...interface{}) {
+	requiredMessageHandlers = append(requiredMessageHandlers, &requiredMessageHandler{
+		handler: handler,
+		what:    what,
+		inUse: func(c *Channel) bool {
+			db := DB.Model(model).Where("channel_id = ?", c.Id)
+			if len(query) > 0 {
+				db = db.Where(query, args...)
+			}
+			n := 0
+			db.Count(&n)
+			return n > 0
+		},
+	})
+}
+
 type Channel struct {
-	Id              int         `sql:"type:integer primary key autoincrement" json:"-"`
-	Name            string      `sql:"type:varchar(255);unique_index" json:"name"`
-	Description     string      `sql:"type:text" json:"description"`
-	Created         int64       `sql:"type:integer" json:"created"`
-	Modified        int64       `sql:"type:integer" json:"modified"`
-	Tags            StringSlice `sql:"type:text" json:"tags"`
-	Fields          StringMap   `sql:"type:text" json:"fields"`
-	MessageHandlers StringSlice `sql:"type:text" json:"-"`
-	AccessTokens    StringSlice `sql:"type:text" json:"access_tokens"`
-	ConnectionLimit int         `sql:"type:integer" json:"connection_limit"`
-	MessageRate     int         `sql:"type:integer" json:"message_rate"`
+	Id                       int         `sql:"type:integer primary key autoincrement" json:"-"`
+	Name                     string      `sql:"type:varchar(255);unique_index" json:"name"`
+	Description              string      `sql:"type:text" json:"description"`
+	Created                  int64       `sql:"type:integer" json:"created"`
+	Modified                 int64       `sql:"type:integer" json:"modified"`
+	Tags                     StringSlice `sql:"type:text" json:"tags"`
+	Fields                   StringMap   `sql:"type:text" json:"fields"`
+	MessageHandlers          StringSlice `sql:"type:text" json:"message_handlers"`
+	AccessTokens             StringSlice `sql:"type:text" json:"access_tokens"`
+	RequireRegisteredDevices bool        `sql:"type:boolean" json:"require_registered_devices"`
+	ConnectionLimit          int         `sql:"type:integer" json:"connection_limit"`
+	IdleTimeout              int         `sql:"type:integer" json:"idle_timeout"`
+	MessageRate              int         `sql:"type:integer" json:"message_rate"`
 }
 
 func (c *Channel) validate() error {
@@ -47,6 +117,10 @@ func (c *Channel) validate() error {
 		return errors.New("message rate is negative")
 	}
 
+	if c.IdleTimeout < 0 {
+		return errors.New("idle timeout is negative")
+	}
+
 	if c.Tags == nil {
 		c.Tags = StringSlice(make([]string, 0))
 	}
@@ -55,22 +129,34 @@ func (c *Channel) validate() error {
 		c.Fields = StringMap(make(map[string]string, 0))
 	}
 
-	// enable indexer on all channels
-	// if c.MessageHandlers == nil {
-	// 	c.MessageHandlers = StringSlice(make([]string, 0))
-	// }
-	c.MessageHandlers = []string{"indexer", "logger"}
+	if len(c.MessageHandlers) == 0 {
+		c.MessageHandlers = StringSlice(append([]string{}, DefaultMessageHandlers...))
+	}
 
 	if c.AccessTokens == nil {
 		c.AccessTokens = StringSlice(make([]string, 0))
 	}
 
-	// skip this validation for now
-	// for _, h := range c.MessageHandlers {
-	// 	if _, found := SupportedMessageHandlers[h]; !found {
-	// 		return errors.New("unsupported message handler: " + h)
-	// 	}
-	// }
+	handlerMap := make(map[string]bool, 0)
+	for _, h := range c.MessageHandlers {
+		if _, found := connections.FindMiddleware(h); !found {
+			return errors.New(fmt.Sprintf("unsupported message handler: %s, supported message handlers are %s", h, strings.Join(connections.RegisteredMiddlewares(), ",")))
+		}
+
+		if _, found := handlerMap[h]; found {
+			return errors.New(fmt.Sprintf("duplicate message handler: %s", h))
+		}
+		handlerMap[h] = true
+	}
+
+	// a saved channel can't drop the handlers its configuration relies on
+	if c.Id > 0 {
+		for _, r := range c.requiredMessageHandlers() {
+			if !c.RunsMessageHandler(r[0]) {
+				return errors.New(fmt.Sprintf("message handler %s is required by the %s of the channel", r[0], r[1]))
+			}
+		}
+	}
 
 	if len(c.AccessTokens) == 0 {
 		return errors.New("access_tokens are empty")
@@ -133,15 +219,42 @@ func (c *Channel) AfterCreate() error {
 		return err
 	}
 
-	connections.NewConnectionManager(name)
-	return err
+	cm, err := connections.NewConnectionManager(name)
+	if err == nil {
+		cm.SetConnectionLimit(c.ConnectionLimit)
+		cm.SetIdleTimeout(c.IdleTimeoutDuration())
+	}
+	return nil
+}
+
+func (c *Channel) AfterUpdate() error {
+	name, err := c.HashId()
+	if err != nil {
+		return err
+	}
+
+	// pick up the new connection limit and idle timeout without restarting
+	// the connection manager
+	if cm, found := connections.FindConnectionManager(name); found {
+		cm.SetConnectionLimit(c.ConnectionLimit)
+		cm.SetIdleTimeout(c.IdleTimeoutDuration())
+	}
+	return nil
 }
 
-func (c *Channel) AfterDelete() error {
+func (c *Channel) AfterDelete(tx *gorm.DB) error {
 	name, err := c.HashId()
 	if err != nil {
 		return err
 	}
+
+	// the channel is deleted in a transaction, what the features keep for it
+	// has to go with it
+	for _, h := range channelDeleteHooks {
+		if err = h(tx, c); err != nil {
+			return err
+		}
+	}
 	return connections.CloseConnectionManager(name)
 }
 
@@ -170,6 +283,70 @@ func (c *Channel) BeforeUpdate() error {
 	return c.validate()
 }
 
+// The message handlers the channel runs, in order: the core ones, then the
+// ones it lists or the defaults, skipping the duplicates.
+func (c *Channel) MessageHandlerChain() []string {
+	names := []string(c.MessageHandlers)
+	if len(names) == 0 {
+		names = DefaultMessageHandlers
+	}
+
+	chain := append([]string{}, CoreMessageHandlers...)
+	for _, h := range names {
+		if !StringSliceContains(chain, h) {
+			chain = append(chain, h)
+		}
+	}
+	return chain
+}
+
+func (c *Channel) RunsMessageHandler(name string) bool {
+	return StringSliceContains(c.MessageHandlerChain(), name)
+}
+
+// Pairs of a message handler and the configuration of the channel that does
+// nothing without it.
+func (c *Channel) requiredMessageHandlers() [][2]string {
+	required := [][2]string{}
+	for _, r := range requiredMessageHandlers {
+		if r.inUse(c) {
+			required = append(required, [2]string{r.handler, r.what})
+		}
+	}
+	return required
+}
+
+// Gives the channels still on the legacy message handlers the defaults, so
+// that they pick up the handlers added since. Run with the migrations, it
+// only runs once: channels that list the same handlers afterwards chose them.
+func MigrateMessageHandlers() error {
+	return migrateOnce("legacy_message_handlers", func() error {
+		chs := []*Channel{}
+		if err := DB.Find(&chs).Error; err != nil {
+			return err
+		}
+
+		for _, ch := range chs {
+			if strings.Join(ch.MessageHandlers, ",") != strings.Join(legacyMessageHandlers, ",") {
+				continue
+			}
+			handlers := StringSlice(append([]string{}, DefaultMessageHandlers...))
+			// the columns only, the validations need the handlers registered
+			if err := DB.Model(ch).UpdateColumn("message_handlers", handlers).Error; err != nil {
+				return err
+			}
+			Cache.Delete(fmt.Sprintf("cache.channel:%d", ch.Id))
+		}
+		return nil
+	})
+}
+
+// Idle timeout of the channel's connections, 0 falls back to the configured
+// one.
+func (c *Channel) IdleTimeoutDuration() time.Duration {
+	return time.Duration(c.IdleTimeout) * time.Second
+}
+
 func (c *Channel) Create() error {
 	return DB.Create(c).Error
 }
@@ -201,24 +378,12 @@ func (c *Channel) HashId() (string, error) {
 	return h.Encode([]int{c.Id})
 }
 
-func (c *Channel) IndexStats() (*elastic.IndicesStatsResponse, error) {
-	return IndexClient.IndexStats().Index(GlobalIndexName(c)).Do()
-}
-
-func (c *Channel) Indices() []string {
-	indices := []string{}
-	stats, found := FetchCachedChannelIndexStatsById(c.Id)
-	if found && stats.Indices != nil {
-		for k, _ := range stats.Indices {
-			indices = append(indices, k)
-		}
-	}
-	return indices
+func (c *Channel) IndexStats() (interface{}, error) {
+	return DataStore.IndexStats(c)
 }
 
 func (c *Channel) DeleteIndices() error {
-	_, err := IndexClient.DeleteIndex().Index([]string{GlobalIndexName(c)}).Do()
-	return err
+	return DataStore.DeleteChannel(c)
 }
 
 func FetchCachedChannelById(id int) (*Channel, bool) {
@@ -240,7 +405,7 @@ func FetchCachedChannelById(id int) (*Channel, bool) {
 	}
 }
 
-func FetchCachedChannelIndexStatsById(id int) (*elastic.IndicesStatsResponse, bool) {
+func FetchCachedChannelIndexStatsById(id int) (interface{}, bool) {
 	cacheKey := fmt.Sprintf("cache.channel_stats:%d", id)
 	resp, err := Cache.Fetch(cacheKey, 1*time.Minute, func() (interface{}, error) {
 		c := &Channel{}
@@ -253,7 +418,7 @@ func FetchCachedChannelIndexStatsById(id int) (*elastic.IndicesStatsResponse, bo
 	})
 
 	if err == nil {
-		return resp.(*elastic.IndicesStatsResponse), true
+		return resp, true
 	} else {
 		return nil, false
 	}
@@ -3,6 +3,7 @@ package models
 import (
 	. "github.com/smartystreets/goconvey/convey"
 	. "github.com/eywa/configs"
+	"github.com/eywa/connections"
 	"log"
 	"os"
 	"path"
@@ -11,6 +12,16 @@ import (
 	"testing"
 )
 
+// message_handlers can't be imported from here, so stand-ins are registered
+// for the message handlers channels can choose, as the defaults they are.
+func init() {
+	for _, name := range []string{"rate_limiter", "shadow", "firmware", "monitors", "stream", "indexer", "webhooks", "rpc", "logger"} {
+		connections.RegisterMiddleware(connections.NewMiddleware(name, nil))
+		RegisterDefaultMessageHandler(name)
+	}
+	connections.RegisterMiddleware(connections.NewMiddleware("custom", nil))
+}
+
 func TestChannel(t *testing.T) {
 	pwd, _ := os.Getwd()
 	dbFile := path.Join(pwd, "eywa_test.db")
@@ -30,7 +41,7 @@ func TestChannel(t *testing.T) {
 	InitializeDB()
 	DB.LogMode(true)
 	DB.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
-	DB.AutoMigrate(&Channel{})
+	MigrateAll()
 
 	Convey("creates/updates/deletes channel", t, func() {
 		c := &Channel{
@@ -51,7 +62,7 @@ func TestChannel(t *testing.T) {
 		_c := &Channel{}
 		DB.Model(&Channel{}).First(_c)
 		So(_c.Name, ShouldEqual, "test")
-		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice([]string{"indexer", "logger"})), ShouldBeTrue)
+		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice(DefaultMessageHandlers)), ShouldBeTrue)
 
 		c.Name = "updated test"
 		c.Update()
@@ -59,7 +70,7 @@ func TestChannel(t *testing.T) {
 		_c = &Channel{}
 		DB.Model(&Channel{}).First(_c)
 		So(_c.Name, ShouldEqual, "updated test")
-		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice([]string{"indexer", "logger"})), ShouldBeTrue)
+		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice(DefaultMessageHandlers)), ShouldBeTrue)
 
 		c.Delete()
 		DB.Model(&Channel{}).Count(&count)
@@ -151,6 +162,15 @@ func TestChannel(t *testing.T) {
 		err = c.Create()
 		So(err.Error(), ShouldContainSubstring, "invalid field name")
 
+		delete(c.Fields, "!@#$!@#")
+		c.MessageHandlers = []string{"indexer", "unknown"}
+		err = c.Create()
+		So(err.Error(), ShouldContainSubstring, "unsupported message handler: unknown")
+
+		c.MessageHandlers = []string{"indexer", "logger", "indexer"}
+		err = c.Create()
+		So(err.Error(), ShouldContainSubstring, "duplicate message handler: indexer")
+
 		var count int
 		DB.Model(&Channel{}).Count(&count)
 		So(count, ShouldEqual, 0)
@@ -194,6 +214,128 @@ func TestChannel(t *testing.T) {
 		_c.FindById(c.Id)
 		So(reflect.DeepEqual(_c.Tags, c.Tags), ShouldBeTrue)
 		So(reflect.DeepEqual(_c.Fields, c.Fields), ShouldBeTrue)
+		c.Delete()
+	})
+
+	Convey("keeps the chosen message handlers in order", t, func() {
+		c := &Channel{
+			Name:            "test",
+			Description:     "desc",
+			Tags:            []string{"tag1", "tag2"},
+			Fields:          map[string]string{"field1": "int"},
+			AccessTokens:    []string{"token1"},
+			ConnectionLimit: 5,
+			MessageRate:     1000,
+			MessageHandlers: []string{"custom", "logger"},
+		}
+
+		err := c.Create()
+		So(err, ShouldBeNil)
+
+		_c := &Channel{}
+		_c.FindById(c.Id)
+		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice([]string{"custom", "logger"})), ShouldBeTrue)
+
+		c.MessageHandlers = []string{"logger", "indexer", "custom"}
+		err = c.Update()
+		So(err, ShouldBeNil)
+
+		_c = &Channel{}
+		_c.FindById(c.Id)
+		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice([]string{"logger", "indexer", "custom"})), ShouldBeTrue)
+		c.Delete()
+	})
+
+	Convey("runs the core message handlers first", t, func() {
+		c := &Channel{MessageHandlers: []string{"custom", "logger"}}
+		So(c.MessageHandlerChain(), ShouldResemble, []string{"rate_limiter", "custom", "logger"})
+
+		c.MessageHandlers = []string{"logger", "rate_limiter"}
+		So(c.MessageHandlerChain(), ShouldResemble, []string{"rate_limiter", "logger"})
+
+		c.MessageHandlers = nil
+		So(c.MessageHandlerChain(), ShouldResemble, DefaultMessageHandlers)
+		So(c.RunsMessageHandler("rpc"), ShouldBeTrue)
+	})
+
+	Convey("requires the message handlers its rpc routes rely on", t, func() {
+		c := &Channel{
+			Name:            "test",
+			Description:     "desc",
+			Fields:          map[string]string{"field1": "int"},
+			AccessTokens:    []string{"token1"},
+			ConnectionLimit: 5,
+			MessageRate:     1000,
+		}
+		So(c.Create(), ShouldBeNil)
+
+		r := &RpcRoute{ChannelId: c.Id, Method: "config", Kind: RpcRouteCanned, Response: "{}"}
+		So(r.Create(), ShouldBeNil)
+
+		c.MessageHandlers = []string{"indexer", "logger"}
+		err := c.Update()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "message handler rpc is required by the rpc routes of the channel")
+
+		r.Delete()
+		So(c.Update(), ShouldBeNil)
+
+		r = &RpcRoute{ChannelId: c.Id, Method: "config", Kind: RpcRouteCanned, Response: "{}"}
+		err = r.Create()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "channel doesn't run the rpc message handler")
+		c.Delete()
+	})
+
+	Convey("migrates the channels on the legacy message handlers to the defaults", t, func() {
+		c := &Channel{
+			Name:            "test",
+			Description:     "desc",
+			Fields:          map[string]string{"field1": "int"},
+			AccessTokens:    []string{"token1"},
+			ConnectionLimit: 5,
+			MessageRate:     1000,
+			MessageHandlers: []string{"custom", "logger"},
+		}
+		So(c.Create(), ShouldBeNil)
+		legacy := &Channel{
+			Name:            "legacy",
+			Description:     "desc",
+			Fields:          map[string]string{"field1": "int"},
+			AccessTokens:    []string{"token1"},
+			ConnectionLimit: 5,
+			MessageRate:     1000,
+			MessageHandlers: []string{"indexer", "logger"},
+		}
+		So(legacy.Create(), ShouldBeNil)
+
+		So(MigrateMessageHandlers(), ShouldBeNil)
+
+		_c := &Channel{}
+		_c.FindById(legacy.Id)
+		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice(DefaultMessageHandlers)), ShouldBeTrue)
+		_c = &Channel{}
+		_c.FindById(c.Id)
+		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice([]string{"custom", "logger"})), ShouldBeTrue)
+
+		// the channels that choose the same handlers afterwards keep them
+		chosen := &Channel{
+			Name:            "chosen",
+			Description:     "desc",
+			Fields:          map[string]string{"field1": "int"},
+			AccessTokens:    []string{"token1"},
+			ConnectionLimit: 5,
+			MessageRate:     1000,
+			MessageHandlers: []string{"indexer", "logger"},
+		}
+		So(chosen.Create(), ShouldBeNil)
+		So(MigrateMessageHandlers(), ShouldBeNil)
+		_c = &Channel{}
+		_c.FindById(chosen.Id)
+		So(reflect.DeepEqual(_c.MessageHandlers, StringSlice(legacyMessageHandlers)), ShouldBeTrue)
+		c.Delete()
+		legacy.Delete()
+		chosen.Delete()
 	})
 
 	CloseDB()
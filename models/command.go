@@ -0,0 +1,297 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/loggers"
+	. "github.com/eywa/utils"
+	"sync"
+	"time"
+)
+
+const (
+	CommandPending   = "pending"
+	CommandDelivered = "delivered"
+	CommandExpired   = "expired"
+	CommandCancelled = "cancelled"
+)
+
+var SupportedCommandStatuses = []string{CommandPending, CommandDelivered, CommandExpired, CommandCancelled}
+
+var CommandQueueFullErr = errors.New("command queue of the device is full")
+var commandNotPendingErr = errors.New("command is not pending")
+
+func init() {
+	deleteWithChannel(&Command{})
+}
+
+// Command is a message queued for a device that is not connected. It is sent
+// once the device connects over websocket or mqtt, or polls over http, and is
+// delivered at least once, see Sent.
+type Command struct {
+	Id             int    `sql:"type:integer primary key autoincrement" json:"id"`
+	ChannelId      int    `sql:"type:integer;index" json:"-"`
+	DeviceId       string `sql:"type:varchar(255);index" json:"device_id"`
+	IdempotencyKey string `sql:"type:varchar(255)" json:"idempotency_key,omitempty"`
+	Payload        string `sql:"type:text" json:"payload"`
+	Status         string `sql:"type:varchar(32)" json:"status"`
+	Attempts       int    `sql:"type:integer" json:"attempts"`
+	LastError      string `sql:"type:text" json:"last_error,omitempty"`
+	ExpiresAt      int64  `sql:"type:integer" json:"expires_at"`
+	DeliveredAt    int64  `sql:"type:integer" json:"delivered_at,omitempty"`
+	Created        int64  `sql:"type:integer" json:"created"`
+	Modified       int64  `sql:"type:integer" json:"modified"`
+}
+
+// serializes the queue operations of a device, so that commands are accepted
+// within the max depth and delivered in order.
+var commandLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+type keyedMutex struct {
+	sync.Mutex
+	locks map[string]*keyedLock
+}
+
+func (m *keyedMutex) Lock(key string) {
+	m.Mutex.Lock()
+	l, found := m.locks[key]
+	if !found {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs += 1
+	m.Mutex.Unlock()
+
+	l.Lock()
+}
+
+func (m *keyedMutex) Unlock(key string) {
+	m.Mutex.Lock()
+	l := m.locks[key]
+	l.refs -= 1
+	if l.refs == 0 {
+		delete(m.locks, key)
+	}
+	m.Mutex.Unlock()
+
+	l.Unlock()
+}
+
+func commandLockKey(channelId int, deviceId string) string {
+	return fmt.Sprintf("%d/%s", channelId, deviceId)
+}
+
+func (c *Command) Update() error {
+	c.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+	return DB.Save(c).Error
+}
+
+func (c *Command) FindById(id int) bool {
+	DB.First(c, id)
+	return !DB.NewRecord(c)
+}
+
+func (c *Command) Cancel() error {
+	lockKey := commandLockKey(c.ChannelId, c.DeviceId)
+	commandLocks.Lock(lockKey)
+	defer commandLocks.Unlock(lockKey)
+
+	c.FindById(c.Id)
+	if c.Status != CommandPending {
+		return commandNotPendingErr
+	}
+	c.Status = CommandCancelled
+	return c.Update()
+}
+
+// Queues a command for a device. When a command with the same idempotency key
+// is already queued, that one is returned instead and created is false.
+func EnqueueCommand(c *Command, ttl time.Duration) (created bool, err error) {
+	if len(c.DeviceId) == 0 {
+		return false, errors.New("empty device id")
+	}
+
+	if ttl <= 0 {
+		ttl = Config().Commands.TTL.Duration
+	}
+	if max := Config().Commands.MaxTTL.Duration; max > 0 && ttl > max {
+		return false, errors.New(fmt.Sprintf("ttl is longer than the max ttl %s", max))
+	}
+
+	lockKey := commandLockKey(c.ChannelId, c.DeviceId)
+	commandLocks.Lock(lockKey)
+	defer commandLocks.Unlock(lockKey)
+
+	if len(c.IdempotencyKey) > 0 {
+		existing := &Command{}
+		DB.Where("channel_id = ? AND device_id = ? AND idempotency_key = ?", c.ChannelId, c.DeviceId, c.IdempotencyKey).First(existing)
+		if !DB.NewRecord(existing) {
+			*c = *existing
+			return false, nil
+		}
+	}
+
+	now := time.Now().UTC()
+	expireCommands(c.ChannelId, c.DeviceId, now)
+
+	var depth int
+	DB.Model(&Command{}).Where("channel_id = ? AND device_id = ? AND status = ?", c.ChannelId, c.DeviceId, CommandPending).Count(&depth)
+	if depth >= Config().Commands.MaxDepth {
+		return false, CommandQueueFullErr
+	}
+
+	c.Status = CommandPending
+	c.Attempts = 0
+	c.ExpiresAt = NanoToMilli(now.Add(ttl).UnixNano())
+	c.Created = NanoToMilli(now.UnixNano())
+	c.Modified = c.Created
+	if err := DB.Create(c).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Sends the pending commands of a device in order, at most limit of them,
+// stopping at the first failure. Returns how many were delivered. The send
+// has to return once the command is written to the device, see Sent.
+func DeliverCommands(channelId int, deviceId string, limit int, send func([]byte) error) int {
+	lockKey := commandLockKey(channelId, deviceId)
+	commandLocks.Lock(lockKey)
+	defer commandLocks.Unlock(lockKey)
+
+	delivered := 0
+	for _, c := range pendingCommands(channelId, deviceId, limit) {
+		err := send([]byte(c.Payload))
+		c.sent(err)
+		if err != nil {
+			break
+		}
+		delivered += 1
+	}
+	return delivered
+}
+
+// The pending commands of a device in order, at most limit of them, for the
+// callers which write them to the device themselves and report with Sent.
+func PendingCommands(channelId int, deviceId string, limit int) []*Command {
+	lockKey := commandLockKey(channelId, deviceId)
+	commandLocks.Lock(lockKey)
+	defer commandLocks.Unlock(lockKey)
+
+	return pendingCommands(channelId, deviceId, limit)
+}
+
+// caller must hold the lock of the device
+func pendingCommands(channelId int, deviceId string, limit int) []*Command {
+	expireCommands(channelId, deviceId, time.Now().UTC())
+
+	cmds := []*Command{}
+	DB.Where("channel_id = ? AND device_id = ? AND status = ?", channelId, deviceId, CommandPending).
+		Order("id asc").Limit(limit).Find(&cmds)
+	return cmds
+}
+
+// Records the write of a command to its device. A command is delivered once
+// it has been written without error: the websocket frame or the mqtt publish
+// went out, or the response of the http poll was written. There is no ack
+// from the device, so a command is delivered at least once, a failed write
+// keeps it pending for the next connection of the device, and a command lost
+// after a successful write is not sent again.
+func (c *Command) Sent(err error) {
+	lockKey := commandLockKey(c.ChannelId, c.DeviceId)
+	commandLocks.Lock(lockKey)
+	defer commandLocks.Unlock(lockKey)
+
+	// it could have been cancelled or delivered in the meantime
+	if found := c.FindById(c.Id); !found || c.Status != CommandPending {
+		return
+	}
+	c.sent(err)
+}
+
+// caller must hold the lock of the device
+func (c *Command) sent(err error) {
+	c.Attempts += 1
+	if err != nil {
+		c.LastError = err.Error()
+	} else {
+		c.Status = CommandDelivered
+		c.LastError = ""
+		c.DeliveredAt = NanoToMilli(time.Now().UTC().UnixNano())
+	}
+
+	if e := c.Update(); e != nil {
+		Logger.Error(fmt.Sprintf("failed to update command %d: %s", c.Id, e.Error()))
+	}
+}
+
+// Commands of a device, oldest first, optionally filtered by status.
+func DeviceCommands(channelId int, deviceId string, status string) []*Command {
+	expireCommands(channelId, deviceId, time.Now().UTC())
+
+	cmds := []*Command{}
+	q := DB.Where("channel_id = ? AND device_id = ?", channelId, deviceId)
+	if len(status) > 0 {
+		q = q.Where("status = ?", status)
+	}
+	q.Order("id asc").Find(&cmds)
+	return cmds
+}
+
+func expireCommands(channelId int, deviceId string, now time.Time) {
+	ts := NanoToMilli(now.UnixNano())
+	DB.Model(&Command{}).
+		Where("channel_id = ? AND device_id = ? AND status = ? AND expires_at <= ?", channelId, deviceId, CommandPending, ts).
+		Updates(map[string]interface{}{"status": CommandExpired, "modified": ts})
+}
+
+// Expires the overdue commands of all devices and removes the finished ones
+// older than the retention.
+func SweepCommands() {
+	now := time.Now().UTC()
+	ts := NanoToMilli(now.UnixNano())
+	DB.Model(&Command{}).
+		Where("status = ? AND expires_at <= ?", CommandPending, ts).
+		Updates(map[string]interface{}{"status": CommandExpired, "modified": ts})
+
+	retention := NanoToMilli(now.Add(-Config().Commands.Retention.Duration).UnixNano())
+	DB.Where("status <> ? AND modified <= ?", CommandPending, retention).Delete(&Command{})
+}
+
+var commandSweeperDone chan struct{}
+var commandSweeperWg sync.WaitGroup
+
+func InitializeCommandQueue() error {
+	commandSweeperDone = make(chan struct{})
+	commandSweeperWg.Add(1)
+	go func() {
+		defer commandSweeperWg.Done()
+
+		ticker := time.NewTicker(Config().Commands.SweepInterval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				SweepCommands()
+			case <-commandSweeperDone:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func CloseCommandQueue() error {
+	if commandSweeperDone != nil {
+		close(commandSweeperDone)
+		commandSweeperWg.Wait()
+		commandSweeperDone = nil
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+	dbFile := setupTestDB(&Conf{
+		Commands: &CommandConf{
+			MaxDepth:      3,
+			TTL:           &JSONDuration{time.Hour},
+			MaxTTL:        &JSONDuration{24 * time.Hour},
+			Retention:     &JSONDuration{time.Hour},
+			SweepInterval: &JSONDuration{time.Minute},
+		},
+	})
+	defer teardownTestDB(dbFile)
+
+	Convey("queues commands up to the max depth", t, func() {
+		for _, p := range []string{"a", "b", "c"} {
+			created, err := EnqueueCommand(&Command{ChannelId: 1, DeviceId: "dev1", Payload: p}, 0)
+			So(created, ShouldBeTrue)
+			So(err, ShouldBeNil)
+		}
+
+		_, err := EnqueueCommand(&Command{ChannelId: 1, DeviceId: "dev1", Payload: "d"}, 0)
+		So(err, ShouldEqual, CommandQueueFullErr)
+
+		_, err = EnqueueCommand(&Command{ChannelId: 1, DeviceId: "dev2", Payload: "a"}, 48*time.Hour)
+		So(err, ShouldNotBeNil)
+
+		cmds := DeviceCommands(1, "dev1", CommandPending)
+		So(len(cmds), ShouldEqual, 3)
+		So(cmds[0].Payload, ShouldEqual, "a")
+		So(cmds[0].ExpiresAt-cmds[0].Created, ShouldEqual, NanoToMilli(time.Hour.Nanoseconds()))
+	})
+
+	Convey("dedups commands by idempotency key", t, func() {
+		cmd := &Command{ChannelId: 1, DeviceId: "dev2", IdempotencyKey: "key", Payload: "x"}
+		created, err := EnqueueCommand(cmd, 0)
+		So(created, ShouldBeTrue)
+		So(err, ShouldBeNil)
+
+		dup := &Command{ChannelId: 1, DeviceId: "dev2", IdempotencyKey: "key", Payload: "y"}
+		created, err = EnqueueCommand(dup, 0)
+		So(created, ShouldBeFalse)
+		So(err, ShouldBeNil)
+		So(dup.Id, ShouldEqual, cmd.Id)
+		So(dup.Payload, ShouldEqual, "x")
+	})
+
+	Convey("delivers pending commands in order", t, func() {
+		sent := []string{}
+		failing := errors.New("connection closed")
+		send := func(p []byte) error {
+			if len(sent) == 2 {
+				return failing
+			}
+			sent = append(sent, string(p))
+			return nil
+		}
+
+		So(DeliverCommands(1, "dev1", 10, send), ShouldEqual, 2)
+		So(sent, ShouldResemble, []string{"a", "b"})
+
+		cmds := DeviceCommands(1, "dev1", "")
+		So(cmds[0].Status, ShouldEqual, CommandDelivered)
+		So(cmds[0].DeliveredAt, ShouldBeGreaterThan, 0)
+		So(cmds[2].Status, ShouldEqual, CommandPending)
+		So(cmds[2].Attempts, ShouldEqual, 1)
+		So(cmds[2].LastError, ShouldEqual, "connection closed")
+
+		sent = []string{}
+		So(DeliverCommands(1, "dev1", 1, send), ShouldEqual, 1)
+		So(sent, ShouldResemble, []string{"c"})
+		So(len(DeviceCommands(1, "dev1", CommandPending)), ShouldEqual, 0)
+	})
+
+	Convey("keeps polled commands pending until their write succeeds", t, func() {
+		EnqueueCommand(&Command{ChannelId: 1, DeviceId: "dev5", Payload: "a"}, 0)
+		EnqueueCommand(&Command{ChannelId: 1, DeviceId: "dev5", Payload: "b"}, 0)
+
+		cmds := PendingCommands(1, "dev5", 1)
+		So(len(cmds), ShouldEqual, 1)
+		So(cmds[0].Payload, ShouldEqual, "a")
+		// taking a command doesn't deliver it
+		So(len(PendingCommands(1, "dev5", 10)), ShouldEqual, 2)
+
+		cmds[0].Sent(errors.New("broken pipe"))
+		cmd := PendingCommands(1, "dev5", 1)[0]
+		So(cmd.Payload, ShouldEqual, "a")
+		So(cmd.Attempts, ShouldEqual, 1)
+		So(cmd.LastError, ShouldEqual, "broken pipe")
+
+		cmd.Sent(nil)
+		So(cmd.Status, ShouldEqual, CommandDelivered)
+		So(cmd.Attempts, ShouldEqual, 2)
+		So(PendingCommands(1, "dev5", 1)[0].Payload, ShouldEqual, "b")
+
+		// a cancelled command stays cancelled
+		b := PendingCommands(1, "dev5", 1)[0]
+		So(b.Cancel(), ShouldBeNil)
+		b.Sent(nil)
+		So(b.Status, ShouldEqual, CommandCancelled)
+	})
+
+	Convey("cancels pending commands only", t, func() {
+		cmd := &Command{ChannelId: 1, DeviceId: "dev3", Payload: "a"}
+		EnqueueCommand(cmd, 0)
+		So(cmd.Cancel(), ShouldBeNil)
+		So(cmd.Status, ShouldEqual, CommandCancelled)
+		So(cmd.Cancel(), ShouldNotBeNil)
+		So(DeliverCommands(1, "dev3", 10, func(p []byte) error { return nil }), ShouldEqual, 0)
+	})
+
+	Convey("expires and sweeps commands", t, func() {
+		cmd := &Command{ChannelId: 1, DeviceId: "dev4", Payload: "a"}
+		EnqueueCommand(cmd, time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+
+		So(DeliverCommands(1, "dev4", 10, func(p []byte) error { return nil }), ShouldEqual, 0)
+		cmd.FindById(cmd.Id)
+		So(cmd.Status, ShouldEqual, CommandExpired)
+
+		cmd.Modified = NanoToMilli(time.Now().Add(-2 * time.Hour).UnixNano())
+		DB.Save(cmd)
+		SweepCommands()
+		So((&Command{}).FindById(cmd.Id), ShouldBeFalse)
+	})
+}
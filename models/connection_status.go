@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"gopkg.in/olivere/elastic.v3"
 	. "github.com/eywa/connections"
 	. "github.com/eywa/utils"
 	"time"
@@ -20,6 +19,7 @@ type ConnectionStatus struct {
 	ConnectionType string
 	Duration       time.Duration
 	LastPingedAt   time.Time
+	RoundTripTime  time.Duration
 	Identifier     string
 	Metadata       map[string]string
 	Histories      []*ConnectionHistory
@@ -35,9 +35,19 @@ func NewConnectionStatus(ch *Channel, c Connection) *ConnectionStatus {
 		ConnectionType: c.ConnectionType(),
 		Metadata:       c.Metadata(),
 		Duration:       time.Now().Sub(c.CreatedAt()),
+		RoundTripTime:  roundTripTime(c),
 	}
 }
 
+// Round trip time of the last server ping, 0 for connections that aren't
+// pinged or haven't answered yet.
+func roundTripTime(c Connection) time.Duration {
+	if p, ok := c.(Pinger); ok {
+		return p.RoundTripTime()
+	}
+	return 0
+}
+
 func (h *ConnectionStatus) MarshalJSON() ([]byte, error) {
 	j := make(map[string]interface{})
 
@@ -69,6 +79,10 @@ func (h *ConnectionStatus) MarshalJSON() ([]byte, error) {
 		j["last_pinged_at"] = NanoToMilli(h.LastPingedAt.UnixNano())
 	}
 
+	if int64(h.RoundTripTime) > 0 {
+		j["round_trip_time"] = float64(h.RoundTripTime.Nanoseconds()) / float64(time.Millisecond)
+	}
+
 	if len(h.Identifier) > 0 {
 		j["device_id"] = h.Identifier
 	}
@@ -204,53 +218,33 @@ func FindConnectionStatus(ch *Channel, devId string, withHistory bool) (*Connect
 		s.Status = "online"
 		s.ConnectedAt = conn.CreatedAt()
 		s.LastPingedAt = conn.LastPingedAt()
+		s.RoundTripTime = roundTripTime(conn)
 		s.ConnectionType = conn.ConnectionType()
 		s.Metadata = conn.Metadata()
 		s.Duration = time.Now().Sub(conn.CreatedAt())
 	} else {
-		boolQ := elastic.NewBoolQuery()
-		boolQ.Must(elastic.NewTermQuery("device_id", devId))
-		boolQ.Must(elastic.NewTermQuery("activity", SupportedMessageTypes[TypeDisconnectMessage]))
-
-		resp, err := IndexClient.Search().Index(GlobalIndexName(ch)).Type(IndexTypeActivities).Query(boolQ).Sort("timestamp", false).Size(1).Do()
-		if err == nil && resp.Hits != nil && resp.Hits.Hits != nil && len(resp.Hits.Hits) > 0 {
-			hit := resp.Hits.Hits[0]
-			h := &ConnectionHistory{}
-			err = json.Unmarshal(*hit.Source, h)
-			if err == nil {
-				s.DisconnectedAt = h.Timestamp
-				s.ConnectionType = h.ConnectionType
-				s.Duration = h.Duration
-				if !h.Timestamp.IsZero() && int64(h.Duration) > 0 {
-					s.ConnectedAt = h.Timestamp.Add(-h.Duration)
-				}
-				s.Metadata = h.Metadata
-			} else {
-				return nil, err
+		hs, err := DataStore.Activities(ch, devId, SupportedMessageTypes[TypeDisconnectMessage], 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(hs) > 0 {
+			h := hs[0]
+			s.DisconnectedAt = h.Timestamp
+			s.ConnectionType = h.ConnectionType
+			s.Duration = h.Duration
+			if !h.Timestamp.IsZero() && int64(h.Duration) > 0 {
+				s.ConnectedAt = h.Timestamp.Add(-h.Duration)
 			}
+			s.Metadata = h.Metadata
 		}
 	}
 
 	if withHistory {
-		resp, err := IndexClient.Search().Index(GlobalIndexName(ch)).
-			Type(IndexTypeActivities).
-			Query(elastic.NewTermQuery("device_id", devId)).
-			Sort("timestamp", false).
-			Size(HistoryLength).Do()
-
-		if err == nil {
-			for _, hit := range resp.Hits.Hits {
-				h := &ConnectionHistory{}
-				err := json.Unmarshal(*hit.Source, h)
-				if err != nil {
-					return nil, err
-				} else {
-					s.Histories = append(s.Histories, h)
-				}
-			}
-		} else {
+		hs, err := DataStore.Activities(ch, devId, "", HistoryLength)
+		if err != nil {
 			return nil, err
 		}
+		s.Histories = append(s.Histories, hs...)
 	}
 
 	return s, nil
@@ -6,10 +6,57 @@ import (
 	"github.com/waterwheel"
 	. "github.com/eywa/configs"
 	. "github.com/eywa/loggers"
+	. "github.com/eywa/utils"
+	"time"
 )
 
 var DB *gorm.DB
 
+// Every model that has a table, in the order they are migrated.
+var Models = []interface{}{
+	&Migration{},
+	&Channel{},
+	&Dashboard{},
+	&Webhook{},
+	&Command{},
+	&Device{},
+	&DeviceBan{},
+	&RpcRoute{},
+	&DeviceShadow{},
+	&Firmware{},
+	&Rollout{},
+	&RolloutDevice{},
+	&Monitor{},
+	&MonitorState{},
+	&Alert{},
+}
+
+// Creates the tables of every model and adds their new columns and indices.
+func MigrateAll() error {
+	return DB.AutoMigrate(Models...).Error
+}
+
+// Migration records a one-shot data migration that has run.
+type Migration struct {
+	Id      int    `sql:"type:integer primary key autoincrement" json:"-"`
+	Name    string `sql:"type:varchar(255);unique_index" json:"name"`
+	Created int64  `sql:"type:integer" json:"created"`
+}
+
+// Runs the data migration unless it already ran on the database.
+func migrateOnce(name string, f func() error) error {
+	m := &Migration{}
+	DB.Where("name = ?", name).First(m)
+	if !DB.NewRecord(m) {
+		return nil
+	}
+
+	if err := f(); err != nil {
+		return err
+	}
+	return DB.Create(&Migration{Name: name, Created: NanoToMilli(time.Now().UTC().UnixNano())}).Error
+}
+
 // Initialize database helper
 func InitializeDB() error {
 	db, err := gorm.Open(Config().Database.DbType, Config().Database.DbFile)
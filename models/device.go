@@ -0,0 +1,217 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/eywa/utils"
+	"strings"
+	"time"
+)
+
+var DeviceUnauthorizedErr = errors.New("invalid access token")
+var DeviceDisabledErr = errors.New("device is disabled")
+var DeviceNotRegisteredErr = errors.New("device is not registered")
+
+// Last seen times are only written when they are older than this, so that
+// chatty http devices don't write on every request.
+var DeviceSeenResolution = time.Minute
+
+func init() {
+	deleteWithChannel(&Device{})
+}
+
+// Device is a registered device of a channel. A registered device connects
+// with its own secret instead of the access tokens of the channel, so nobody
+// else can take over its id. Only the hash of the secret is stored, the
+// secret itself is known right after it is set.
+type Device struct {
+	Id         int       `sql:"type:integer primary key autoincrement" json:"-"`
+	ChannelId  int       `sql:"type:integer;index" json:"-"`
+	DeviceId   string    `sql:"type:varchar(255);index" json:"device_id"`
+	Secret     string    `sql:"-" json:"-"`
+	SecretHash string    `sql:"type:varchar(255)" gorm:"column:secret" json:"-"`
+	Enabled    bool      `sql:"type:boolean" json:"enabled"`
+	Labels     StringMap `sql:"type:text" json:"labels"`
+	FirstSeen  int64     `sql:"type:integer" json:"first_seen"`
+	LastSeen   int64     `sql:"type:integer" json:"last_seen"`
+	Created    int64     `sql:"type:integer" json:"created"`
+	Modified   int64     `sql:"type:integer" json:"modified"`
+}
+
+const deviceSecretHashPrefix = "sha256:"
+
+func NewDeviceSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashDeviceSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return deviceSecretHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Whether the token is the secret of the device. Secrets stored before they
+// were hashed are compared as they are until MigrateDeviceSecrets runs.
+func (d *Device) checkSecret(token string) bool {
+	stored := d.SecretHash
+	if strings.HasPrefix(stored, deviceSecretHashPrefix) {
+		token = hashDeviceSecret(token)
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(token)) == 1
+}
+
+// Replaces the secret of the device with a new one, the old one stops
+// working right away.
+func (d *Device) RotateSecret() error {
+	secret, err := NewDeviceSecret()
+	if err != nil {
+		return err
+	}
+	d.Secret = secret
+	return d.Update()
+}
+
+func (d *Device) BeforeSave() error {
+	if len(d.DeviceId) == 0 {
+		return errors.New("device_id is empty")
+	}
+
+	if len(d.DeviceId) > 255 {
+		return errors.New("device_id is too long, at most 255 characters are supported")
+	}
+
+	if len(d.Secret) == 0 && len(d.SecretHash) == 0 {
+		secret, err := NewDeviceSecret()
+		if err != nil {
+			return err
+		}
+		d.Secret = secret
+	}
+	if len(d.Secret) > 0 {
+		d.SecretHash = hashDeviceSecret(d.Secret)
+	}
+
+	if d.Labels == nil {
+		d.Labels = StringMap(make(map[string]string, 0))
+	}
+
+	ch := &Channel{}
+	if found := ch.FindById(d.ChannelId); !found {
+		return errors.New("channel not found")
+	}
+
+	existing := &Device{}
+	DB.Where("channel_id = ? AND device_id = ?", d.ChannelId, d.DeviceId).First(existing)
+	if !DB.NewRecord(existing) && existing.Id != d.Id {
+		return errors.New(fmt.Sprintf("device already registered: %s", d.DeviceId))
+	}
+
+	return nil
+}
+
+func (d *Device) Create() error {
+	return DB.Create(d).Error
+}
+
+func (d *Device) Delete() error {
+	return DB.Delete(d).Error
+}
+
+func (d *Device) Update() error {
+	return DB.Save(d).Error
+}
+
+func (d *Device) FindById(id int) bool {
+	DB.First(d, id)
+	return !DB.NewRecord(d)
+}
+
+// Records that the device connected, skipping the callbacks of a save.
+func (d *Device) Seen(t time.Time) error {
+	ts := NanoToMilli(t.UTC().UnixNano())
+	if ts-d.LastSeen < NanoToMilli(DeviceSeenResolution.Nanoseconds()) {
+		return nil
+	}
+
+	cols := map[string]interface{}{"last_seen": ts}
+	if d.FirstSeen == 0 {
+		cols["first_seen"] = ts
+	}
+	if err := DB.Model(d).UpdateColumns(cols).Error; err != nil {
+		return err
+	}
+
+	d.LastSeen = ts
+	if d.FirstSeen == 0 {
+		d.FirstSeen = ts
+	}
+	return nil
+}
+
+func FindDevice(channelId int, deviceId string) (*Device, bool) {
+	d := &Device{}
+	DB.Where("channel_id = ? AND device_id = ?", channelId, deviceId).First(d)
+	if DB.NewRecord(d) {
+		return nil, false
+	}
+	return d, true
+}
+
+func ChannelDevices(channelId int) []*Device {
+	devices := []*Device{}
+	DB.Where("channel_id = ?", channelId).Order("device_id asc").Find(&devices)
+	return devices
+}
+
+// Checks the token a device connects with. A registered device has to
+// present its own secret and be enabled, other devices use the access tokens
+// of the channel, unless the channel only takes registered devices. The
+// device is returned when it is registered.
+func (c *Channel) AuthenticateDevice(deviceId, token string) (*Device, error) {
+	if len(token) == 0 {
+		return nil, DeviceUnauthorizedErr
+	}
+
+	d, found := FindDevice(c.Id, deviceId)
+	if !found {
+		if c.RequireRegisteredDevices {
+			return nil, DeviceNotRegisteredErr
+		}
+		if !StringSliceContains(c.AccessTokens, token) {
+			return nil, DeviceUnauthorizedErr
+		}
+		return nil, nil
+	}
+
+	if !d.checkSecret(token) {
+		return nil, DeviceUnauthorizedErr
+	}
+	if !d.Enabled {
+		return nil, DeviceDisabledErr
+	}
+	return d, nil
+}
+
+// Hashes the secrets of the devices registered before only their hashes were
+// stored. Run with the migrations, the hashed ones are left alone.
+func MigrateDeviceSecrets() error {
+	devices := []*Device{}
+	if err := DB.Where("secret NOT LIKE ?", deviceSecretHashPrefix+"%").Find(&devices).Error; err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		// the column only, the other fields of the device are unchanged
+		if err := DB.Model(d).UpdateColumn("secret", hashDeviceSecret(d.SecretHash)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
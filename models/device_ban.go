@@ -0,0 +1,171 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"strings"
+	"time"
+)
+
+const (
+	// a banned device is refused when it connects
+	BanModeBan = "ban"
+	// a quarantined device can connect, but its uploads and calls are dropped
+	BanModeQuarantine = "quarantine"
+)
+
+var SupportedBanModes = []string{BanModeBan, BanModeQuarantine}
+
+var DeviceBannedErr = errors.New("device is banned")
+
+var DeviceQuarantinedErr = errors.New("device is quarantined, its message is dropped")
+
+func init() {
+	deleteWithChannel(&DeviceBan{})
+}
+
+// DeviceBan keeps a device of a channel out, until it expires. An ExpiresAt
+// of 0 never expires.
+type DeviceBan struct {
+	Id        int    `sql:"type:integer primary key autoincrement" json:"-"`
+	ChannelId int    `sql:"type:integer;index" json:"-"`
+	DeviceId  string `sql:"type:varchar(255);index" json:"device_id"`
+	Mode      string `sql:"type:varchar(32)" json:"mode"`
+	Reason    string `sql:"type:text" json:"reason"`
+	ExpiresAt int64  `sql:"type:integer" json:"expires_at"`
+	Created   int64  `sql:"type:integer" json:"created"`
+}
+
+func (b *DeviceBan) BeforeSave() error {
+	if len(b.DeviceId) == 0 {
+		return errors.New("device_id is empty")
+	}
+
+	if len(b.Mode) == 0 {
+		b.Mode = BanModeBan
+	}
+
+	if !StringSliceContains(SupportedBanModes, b.Mode) {
+		return errors.New(fmt.Sprintf("unsupported mode: %s, supported modes are %s", b.Mode, strings.Join(SupportedBanModes, ",")))
+	}
+
+	return nil
+}
+
+func (b *DeviceBan) Delete() error {
+	err := DB.Delete(b).Error
+	Cache.Delete(deviceBansCacheKey(b.ChannelId))
+	return err
+}
+
+func (b *DeviceBan) Expired(t time.Time) bool {
+	return b.ExpiresAt > 0 && b.ExpiresAt <= NanoToMilli(t.UnixNano())
+}
+
+// Bans a device, replacing the ban it already has. A ttl of 0 bans it until
+// the ban is lifted.
+func BanDevice(b *DeviceBan, ttl time.Duration) error {
+	now := time.Now().UTC()
+	b.Created = NanoToMilli(now.UnixNano())
+	b.ExpiresAt = 0
+	if ttl > 0 {
+		b.ExpiresAt = NanoToMilli(now.Add(ttl).UnixNano())
+	}
+
+	tx := DB.Begin()
+	if err := tx.Where("channel_id = ? AND device_id = ?", b.ChannelId, b.DeviceId).Delete(&DeviceBan{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	b.Id = 0
+	if err := tx.Create(b).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Commit().Error
+	Cache.Delete(deviceBansCacheKey(b.ChannelId))
+	return err
+}
+
+// The ban of a device in effect.
+func FindDeviceBan(channelId int, deviceId string) (*DeviceBan, bool) {
+	b := &DeviceBan{}
+	DB.Where("channel_id = ? AND device_id = ?", channelId, deviceId).First(b)
+	if DB.NewRecord(b) || b.Expired(time.Now()) {
+		return nil, false
+	}
+	return b, true
+}
+
+// The ban of a device in effect, looked up in the cached bans of its channel
+// so that connects and uploads don't query the database.
+func FindCachedDeviceBan(channelId int, deviceId string) (*DeviceBan, bool) {
+	b, found := FetchCachedDeviceBansByChannelId(channelId)[deviceId]
+	if !found || b.Expired(time.Now()) {
+		return nil, false
+	}
+	return b, true
+}
+
+// Bans of a channel by device id, expired or not.
+func FetchCachedDeviceBansByChannelId(channelId int) map[string]*DeviceBan {
+	bans, err := Cache.Fetch(deviceBansCacheKey(channelId), 1*time.Minute, func() (interface{}, error) {
+		list := []*DeviceBan{}
+		DB.Where("channel_id = ?", channelId).Find(&list)
+
+		bans := make(map[string]*DeviceBan, len(list))
+		for _, b := range list {
+			bans[b.DeviceId] = b
+		}
+		return bans, nil
+	})
+
+	if err != nil {
+		return map[string]*DeviceBan{}
+	}
+	return bans.(map[string]*DeviceBan)
+}
+
+func deviceBansCacheKey(channelId int) string {
+	return fmt.Sprintf("cache.device_bans:%d", channelId)
+}
+
+// Bans of a channel in effect, the expired ones are removed on the way.
+func ChannelDeviceBans(channelId int) []*DeviceBan {
+	ts := NanoToMilli(time.Now().UnixNano())
+	DB.Where("channel_id = ? AND expires_at > 0 AND expires_at <= ?", channelId, ts).Delete(&DeviceBan{})
+
+	bans := []*DeviceBan{}
+	DB.Where("channel_id = ?", channelId).Order("device_id asc").Find(&bans)
+	return bans
+}
+
+// Records what happened to a device out of its own connection, like being
+// kicked or banned by an admin, so that it shows up in the connection history.
+func RecordDeviceActivity(ch *Channel, deviceId, activity string, meta map[string]string) error {
+	if Config().Indices.Disable || BulkIndex == nil {
+		return nil
+	}
+
+	ts := time.Now().UTC()
+	j := make(map[string]interface{})
+	for k, v := range meta {
+		if len(v) > 0 {
+			j[k] = v
+		}
+	}
+	j["device_id"] = deviceId
+	j["channel_name"] = ch.Name
+	j["timestamp"] = NanoToMilli(ts.UnixNano())
+	j["activity"] = activity
+
+	js, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return BulkIndex.Add(NewIndexDocument(TimedIndexName(ch, ts), IndexTypeActivities, uuid.NewV1().String(), js, nil))
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	"testing"
+	"time"
+)
+
+func TestDeviceBan(t *testing.T) {
+	dbFile := setupTestDB(&Conf{})
+	defer teardownTestDB(dbFile)
+
+	Convey("bans devices until the ban is lifted", t, func() {
+		ban := &DeviceBan{ChannelId: 1, DeviceId: "dev1", Reason: "compromised"}
+		So(BanDevice(ban, 0), ShouldBeNil)
+		So(ban.Mode, ShouldEqual, BanModeBan)
+		So(ban.ExpiresAt, ShouldEqual, 0)
+
+		found, ok := FindDeviceBan(1, "dev1")
+		So(ok, ShouldBeTrue)
+		So(found.Reason, ShouldEqual, "compromised")
+		_, ok = FindDeviceBan(2, "dev1")
+		So(ok, ShouldBeFalse)
+
+		So(found.Delete(), ShouldBeNil)
+		_, ok = FindDeviceBan(1, "dev1")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("replaces the ban of a device", t, func() {
+		So(BanDevice(&DeviceBan{ChannelId: 1, DeviceId: "dev2"}, 0), ShouldBeNil)
+		So(BanDevice(&DeviceBan{ChannelId: 1, DeviceId: "dev2", Mode: BanModeQuarantine}, time.Hour), ShouldBeNil)
+		So(BanDevice(&DeviceBan{ChannelId: 1, DeviceId: "dev2", Mode: "jail"}, 0), ShouldNotBeNil)
+
+		bans := ChannelDeviceBans(1)
+		So(len(bans), ShouldEqual, 1)
+		So(bans[0].Mode, ShouldEqual, BanModeQuarantine)
+		So(bans[0].ExpiresAt, ShouldBeGreaterThan, bans[0].Created)
+	})
+
+	Convey("expires bans", t, func() {
+		So(BanDevice(&DeviceBan{ChannelId: 1, DeviceId: "dev3"}, time.Millisecond), ShouldBeNil)
+		time.Sleep(5 * time.Millisecond)
+
+		_, ok := FindDeviceBan(1, "dev3")
+		So(ok, ShouldBeFalse)
+		So(len(ChannelDeviceBans(1)), ShouldEqual, 1)
+
+		var count int
+		DB.Model(&DeviceBan{}).Where("device_id = ?", "dev3").Count(&count)
+		So(count, ShouldEqual, 0)
+	})
+
+	Convey("caches the bans of a channel until they change", t, func() {
+		ban := &DeviceBan{ChannelId: 1, DeviceId: "dev4", Mode: BanModeQuarantine}
+		So(BanDevice(ban, 0), ShouldBeNil)
+		found, ok := FindCachedDeviceBan(1, "dev4")
+		So(ok, ShouldBeTrue)
+		So(found.Mode, ShouldEqual, BanModeQuarantine)
+
+		// unnoticed without the models
+		DB.Model(&DeviceBan{}).Where("device_id = ?", "dev4").UpdateColumn("mode", BanModeBan)
+		found, _ = FindCachedDeviceBan(1, "dev4")
+		So(found.Mode, ShouldEqual, BanModeQuarantine)
+
+		So(BanDevice(&DeviceBan{ChannelId: 1, DeviceId: "dev4"}, 0), ShouldBeNil)
+		found, _ = FindCachedDeviceBan(1, "dev4")
+		So(found.Mode, ShouldEqual, BanModeBan)
+
+		So(found.Delete(), ShouldBeNil)
+		_, ok = FindCachedDeviceBan(1, "dev4")
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,270 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eywa/pubsub"
+	. "github.com/eywa/utils"
+	"reflect"
+	"sync"
+	"time"
+)
+
+func init() {
+	deleteWithChannel(&DeviceShadow{})
+}
+
+// DeviceShadow is the state document of a device. Reported state comes from
+// the fields the device uploads, desired state is set by the apps, and the
+// difference of the two is sent to the device whenever it connects.
+type DeviceShadow struct {
+	Id        int     `sql:"type:integer primary key autoincrement" json:"-"`
+	ChannelId int     `sql:"type:integer;index" json:"-"`
+	DeviceId  string  `sql:"type:varchar(255);index" json:"device_id"`
+	Desired   JsonMap `sql:"type:text" json:"desired"`
+	Reported  JsonMap `sql:"type:text" json:"reported"`
+	Delta     JsonMap `sql:"-" json:"delta"`
+	Version   int64   `sql:"type:integer" json:"version"`
+	Created   int64   `sql:"type:integer" json:"created"`
+	Modified  int64   `sql:"type:integer" json:"modified"`
+}
+
+// serializes the updates of a shadow, so that concurrent patches and reports
+// are merged instead of overwriting each other.
+var shadowLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+
+func (s *DeviceShadow) BeforeSave() error {
+	if len(s.DeviceId) == 0 {
+		return errors.New("device_id is empty")
+	}
+
+	if len(s.DeviceId) > 255 {
+		return errors.New("device_id is too long, at most 255 characters are supported")
+	}
+
+	if s.Desired == nil {
+		s.Desired = JsonMap(make(map[string]interface{}))
+	}
+	if s.Reported == nil {
+		s.Reported = JsonMap(make(map[string]interface{}))
+	}
+
+	ch := &Channel{}
+	if found := ch.FindById(s.ChannelId); !found {
+		return errors.New("channel not found")
+	}
+
+	return nil
+}
+
+func (s *DeviceShadow) AfterFind() error {
+	s.Delta = JsonMap(stateDelta(s.Desired, s.Reported))
+	return nil
+}
+
+func (s *DeviceShadow) AfterSave() error {
+	s.Delta = JsonMap(stateDelta(s.Desired, s.Reported))
+	ShadowPublisher(s.ChannelId, s.DeviceId).Publish(func() string {
+		js, err := json.Marshal(s)
+		if err != nil {
+			return ""
+		}
+		return string(js) + "\n"
+	})
+	return nil
+}
+
+func (s *DeviceShadow) Delete() error {
+	return DB.Delete(s).Error
+}
+
+// The delta as the payload of a send message, false when the device is
+// already in the desired state.
+func (s *DeviceShadow) DeltaMessage() ([]byte, bool) {
+	if len(s.Delta) == 0 {
+		return nil, false
+	}
+	js, err := json.Marshal(map[string]interface{}{"delta": s.Delta, "version": s.Version})
+	if err != nil {
+		return nil, false
+	}
+	return js, true
+}
+
+func FindDeviceShadow(channelId int, deviceId string) (*DeviceShadow, bool) {
+	s := &DeviceShadow{}
+	DB.Where("channel_id = ? AND device_id = ?", channelId, deviceId).First(s)
+	if DB.NewRecord(s) {
+		return nil, false
+	}
+	return s, true
+}
+
+// Merges a patch into the desired state of a device, creating its shadow if
+// needed. Null values remove their keys, objects are merged recursively.
+func PatchDesiredState(channelId int, deviceId string, patch map[string]interface{}) (*DeviceShadow, error) {
+	return updateShadow(channelId, deviceId, patch, func(s *DeviceShadow) map[string]interface{} {
+		return s.Desired
+	})
+}
+
+// Merges the state reported by a device into its shadow. The shadow is only
+// written when the state actually changes.
+func ReportState(channelId int, deviceId string, state map[string]interface{}) (*DeviceShadow, error) {
+	return updateShadow(channelId, deviceId, state, func(s *DeviceShadow) map[string]interface{} {
+		return s.Reported
+	})
+}
+
+func updateShadow(channelId int, deviceId string, patch map[string]interface{}, doc func(*DeviceShadow) map[string]interface{}) (*DeviceShadow, error) {
+	// numbers of different types have to compare equal to what was stored
+	patch, err := normalizeState(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	lockKey := commandLockKey(channelId, deviceId)
+	shadowLocks.Lock(lockKey)
+	defer shadowLocks.Unlock(lockKey)
+
+	s, found := FindDeviceShadow(channelId, deviceId)
+	if !found {
+		s = &DeviceShadow{
+			ChannelId: channelId,
+			DeviceId:  deviceId,
+			Desired:   JsonMap(make(map[string]interface{})),
+			Reported:  JsonMap(make(map[string]interface{})),
+		}
+	}
+
+	if !mergeState(doc(s), patch) && found {
+		return s, nil
+	}
+
+	s.Version += 1
+	s.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+	if !found {
+		s.Created = s.Modified
+		err = DB.Create(s).Error
+	} else {
+		err = DB.Save(s).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func normalizeState(state map[string]interface{}) (map[string]interface{}, error) {
+	js, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make(map[string]interface{})
+	if err = json.Unmarshal(js, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// Applies a json merge patch to a document, returns whether it changed.
+func mergeState(doc, patch map[string]interface{}) bool {
+	changed := false
+	for k, v := range patch {
+		old, found := doc[k]
+		if v == nil {
+			if found {
+				delete(doc, k)
+				changed = true
+			}
+			continue
+		}
+
+		p, isObj := v.(map[string]interface{})
+		if o, wasObj := old.(map[string]interface{}); isObj && wasObj {
+			if mergeState(o, p) {
+				changed = true
+			}
+			continue
+		}
+		if isObj {
+			// a new object must not keep the nulls of the patch
+			o := make(map[string]interface{})
+			mergeState(o, p)
+			v = o
+		}
+
+		if !found || !reflect.DeepEqual(old, v) {
+			doc[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+// The desired values that differ from the reported ones.
+func stateDelta(desired, reported map[string]interface{}) map[string]interface{} {
+	delta := make(map[string]interface{})
+	for k, d := range desired {
+		r, found := reported[k]
+		dObj, isObj := d.(map[string]interface{})
+		if rObj, wasObj := r.(map[string]interface{}); isObj && wasObj {
+			if sub := stateDelta(dObj, rObj); len(sub) > 0 {
+				delta[k] = sub
+			}
+		} else if !found || !reflect.DeepEqual(d, r) {
+			delta[k] = d
+		}
+	}
+	return delta
+}
+
+// Watchers of a shadow are counted by topic rather than by publisher, so
+// that the handlers saving a shadow and the ones watching it don't have to
+// share an instance.
+var shadowWatchers = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+type shadowPublisher struct {
+	topic string
+}
+
+func ShadowPublisher(channelId int, deviceId string) pubsub.Publisher {
+	return &shadowPublisher{topic: fmt.Sprintf("shadow/%d/%s", channelId, deviceId)}
+}
+
+func (p *shadowPublisher) Topic() string { return p.topic }
+
+func (p *shadowPublisher) Attach() {
+	shadowWatchers.Lock()
+	shadowWatchers.counts[p.topic] += 1
+	shadowWatchers.Unlock()
+}
+
+func (p *shadowPublisher) Detach() {
+	shadowWatchers.Lock()
+	shadowWatchers.counts[p.topic] -= 1
+	if shadowWatchers.counts[p.topic] <= 0 {
+		delete(shadowWatchers.counts, p.topic)
+	}
+	shadowWatchers.Unlock()
+}
+
+func (p *shadowPublisher) Attached() bool {
+	shadowWatchers.Lock()
+	defer shadowWatchers.Unlock()
+	return shadowWatchers.counts[p.topic] > 0
+}
+
+func (p *shadowPublisher) Publish(c pubsub.Callback) {
+	if p.Attached() {
+		pubsub.EM.Emit(p.Topic(), c())
+	}
+}
+
+func (p *shadowPublisher) Unpublish() {
+	pubsub.EM.Off(p.Topic())
+}
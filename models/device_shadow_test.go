@@ -0,0 +1,98 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	"testing"
+)
+
+func TestDeviceShadow(t *testing.T) {
+	dbFile := setupTestDB(&Conf{})
+	defer teardownTestDB(dbFile)
+
+	ch := &Channel{
+		Name:            "test",
+		Description:     "desc",
+		Tags:            []string{"tag1", "tag2"},
+		Fields:          map[string]string{"field1": "int"},
+		AccessTokens:    []string{"token1"},
+		ConnectionLimit: 5,
+		MessageRate:     1000,
+	}
+	ch.Create()
+
+	Convey("merges patches into the desired state", t, func() {
+		s, err := PatchDesiredState(ch.Id, "dev", map[string]interface{}{
+			"led":    "on",
+			"config": map[string]interface{}{"interval": 10, "mode": nil},
+		})
+		So(err, ShouldBeNil)
+		So(s.Version, ShouldEqual, 1)
+		So(s.Desired["config"], ShouldResemble, map[string]interface{}{"interval": float64(10)})
+
+		s, err = PatchDesiredState(ch.Id, "dev", map[string]interface{}{
+			"led":    nil,
+			"config": map[string]interface{}{"mode": "eco"},
+		})
+		So(err, ShouldBeNil)
+		So(s.Version, ShouldEqual, 2)
+
+		_s, found := FindDeviceShadow(ch.Id, "dev")
+		So(found, ShouldBeTrue)
+		So(_s.Desired, ShouldResemble, JsonMap{"config": map[string]interface{}{"interval": float64(10), "mode": "eco"}})
+
+		s, err = PatchDesiredState(ch.Id, "dev", map[string]interface{}{"config": map[string]interface{}{"mode": "eco"}})
+		So(err, ShouldBeNil)
+		So(s.Version, ShouldEqual, 2)
+
+		_, err = PatchDesiredState(ch.Id+1, "dev", map[string]interface{}{"led": "on"})
+		So(err.Error(), ShouldContainSubstring, "channel not found")
+		_s.Delete()
+	})
+
+	Convey("computes the delta between desired and reported state", t, func() {
+		PatchDesiredState(ch.Id, "dev", map[string]interface{}{
+			"field1": 1,
+			"config": map[string]interface{}{"interval": 10, "mode": "eco"},
+		})
+		s, err := ReportState(ch.Id, "dev", map[string]interface{}{
+			"field1": int64(2),
+			"config": map[string]interface{}{"interval": 10},
+		})
+		So(err, ShouldBeNil)
+		So(s.Version, ShouldEqual, 2)
+		So(s.Delta, ShouldResemble, JsonMap{"field1": float64(1), "config": map[string]interface{}{"mode": "eco"}})
+
+		msg, ok := s.DeltaMessage()
+		So(ok, ShouldBeTrue)
+		So(string(msg), ShouldEqual, `{"delta":{"config":{"mode":"eco"},"field1":1},"version":2}`)
+
+		s, err = ReportState(ch.Id, "dev", map[string]interface{}{
+			"field1": 1,
+			"config": map[string]interface{}{"mode": "eco"},
+		})
+		So(err, ShouldBeNil)
+		So(s.Version, ShouldEqual, 3)
+		_, ok = s.DeltaMessage()
+		So(ok, ShouldBeFalse)
+
+		s, err = ReportState(ch.Id, "dev", map[string]interface{}{"field1": int32(1)})
+		So(err, ShouldBeNil)
+		So(s.Version, ShouldEqual, 3)
+
+		_s, _ := FindDeviceShadow(ch.Id, "dev")
+		So(len(_s.Delta), ShouldEqual, 0)
+		_s.Delete()
+	})
+
+	Convey("deletes shadows with the channel", t, func() {
+		ReportState(ch.Id, "dev", map[string]interface{}{"field1": 1})
+
+		err := ch.Delete()
+		So(err, ShouldBeNil)
+
+		var count int
+		DB.Model(&DeviceShadow{}).Count(&count)
+		So(count, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	"testing"
+	"time"
+)
+
+func TestDevice(t *testing.T) {
+	dbFile := setupTestDB(&Conf{})
+	defer teardownTestDB(dbFile)
+
+	ch := &Channel{
+		Name:            "device test",
+		Description:     "desc",
+		Fields:          map[string]string{"temp": "float"},
+		AccessTokens:    []string{"token1"},
+		ConnectionLimit: 5,
+		MessageRate:     1000,
+	}
+	if err := ch.Create(); err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Delete()
+
+	var secret string
+	Convey("registers devices with a unique id per channel", t, func() {
+		d := &Device{ChannelId: ch.Id, DeviceId: "dev1", Enabled: true}
+		So(d.Create(), ShouldBeNil)
+		So(len(d.Secret), ShouldEqual, 48)
+		So(d.SecretHash, ShouldNotEqual, d.Secret)
+		secret = d.Secret
+		So(d.Labels, ShouldNotBeNil)
+
+		So((&Device{ChannelId: ch.Id, DeviceId: "dev1"}).Create(), ShouldNotBeNil)
+		So((&Device{ChannelId: ch.Id + 1000, DeviceId: "dev2"}).Create(), ShouldNotBeNil)
+		So((&Device{ChannelId: ch.Id}).Create(), ShouldNotBeNil)
+
+		d.Labels = StringMap(map[string]string{"site": "sf"})
+		So(d.Update(), ShouldBeNil)
+
+		found, ok := FindDevice(ch.Id, "dev1")
+		So(ok, ShouldBeTrue)
+		So(found.Secret, ShouldBeEmpty)
+		So(found.SecretHash, ShouldEqual, d.SecretHash)
+		So(found.Labels["site"], ShouldEqual, "sf")
+		So(len(ChannelDevices(ch.Id)), ShouldEqual, 1)
+	})
+
+	Convey("authenticates devices", t, func() {
+		d, _ := FindDevice(ch.Id, "dev1")
+
+		registered, err := ch.AuthenticateDevice("dev1", secret)
+		So(err, ShouldBeNil)
+		So(registered.Id, ShouldEqual, d.Id)
+
+		_, err = ch.AuthenticateDevice("dev1", "token1")
+		So(err, ShouldEqual, DeviceUnauthorizedErr)
+
+		registered, err = ch.AuthenticateDevice("dev9", "token1")
+		So(err, ShouldBeNil)
+		So(registered, ShouldBeNil)
+
+		_, err = ch.AuthenticateDevice("dev9", "")
+		So(err, ShouldEqual, DeviceUnauthorizedErr)
+
+		d.Enabled = false
+		d.Update()
+		_, err = ch.AuthenticateDevice("dev1", secret)
+		So(err, ShouldEqual, DeviceDisabledErr)
+		d.Enabled = true
+		d.Update()
+
+		ch.RequireRegisteredDevices = true
+		_, err = ch.AuthenticateDevice("dev9", "token1")
+		So(err, ShouldEqual, DeviceNotRegisteredErr)
+		ch.RequireRegisteredDevices = false
+	})
+
+	Convey("rotates the secrets of devices", t, func() {
+		d, _ := FindDevice(ch.Id, "dev1")
+		So(d.RotateSecret(), ShouldBeNil)
+		So(d.Secret, ShouldNotEqual, secret)
+
+		_, err := ch.AuthenticateDevice("dev1", secret)
+		So(err, ShouldEqual, DeviceUnauthorizedErr)
+		_, err = ch.AuthenticateDevice("dev1", d.Secret)
+		So(err, ShouldBeNil)
+		secret = d.Secret
+	})
+
+	Convey("hashes the secrets stored before they were hashed", t, func() {
+		d := &Device{ChannelId: ch.Id, DeviceId: "legacy", Enabled: true}
+		So(d.Create(), ShouldBeNil)
+		DB.Model(d).UpdateColumn("secret", "plain")
+
+		_, err := ch.AuthenticateDevice("legacy", "plain")
+		So(err, ShouldBeNil)
+
+		So(MigrateDeviceSecrets(), ShouldBeNil)
+		So(MigrateDeviceSecrets(), ShouldBeNil)
+		found, _ := FindDevice(ch.Id, "legacy")
+		So(found.SecretHash, ShouldNotEqual, "plain")
+		_, err = ch.AuthenticateDevice("legacy", "plain")
+		So(err, ShouldBeNil)
+		_, err = ch.AuthenticateDevice("dev1", secret)
+		So(err, ShouldBeNil)
+		So(found.Delete(), ShouldBeNil)
+	})
+
+	Convey("records when a device is seen", t, func() {
+		d, _ := FindDevice(ch.Id, "dev1")
+		now := time.Now()
+		So(d.Seen(now), ShouldBeNil)
+		first := d.FirstSeen
+		So(first, ShouldBeGreaterThan, 0)
+		So(d.LastSeen, ShouldEqual, first)
+
+		So(d.Seen(now.Add(time.Second)), ShouldBeNil)
+		So(d.LastSeen, ShouldEqual, first)
+
+		So(d.Seen(now.Add(2*time.Minute)), ShouldBeNil)
+		found, _ := FindDevice(ch.Id, "dev1")
+		So(found.FirstSeen, ShouldEqual, first)
+		So(found.LastSeen, ShouldBeGreaterThan, first)
+	})
+
+	Convey("deletes devices with the channel", t, func() {
+		So(ch.Delete(), ShouldBeNil)
+		So(len(ChannelDevices(ch.Id)), ShouldEqual, 0)
+	})
+}
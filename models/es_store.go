@@ -0,0 +1,454 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/olivere/elastic.v3"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// ESStore keeps the points in weekly Elasticsearch indices.
+type ESStore struct{}
+
+func (s *ESStore) Write(docs []*IndexDocument) ([]error, []bool, error) {
+	req := IndexClient.Bulk()
+	for _, doc := range docs {
+		req.Add(elastic.NewBulkIndexRequest().
+			Index(doc.Index).
+			Type(doc.Type).
+			Id(doc.Id).
+			Doc(doc.Body))
+	}
+
+	resp, err := req.Do()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errs := make([]error, len(docs))
+	retry := make([]bool, len(docs))
+	for i, item := range resp.Items {
+		if i >= len(docs) {
+			break
+		}
+		for _, result := range item {
+			if result.Error != nil || result.Status >= 300 {
+				reason := fmt.Sprintf("status %d", result.Status)
+				if result.Error != nil {
+					reason = result.Error.Type + ": " + result.Error.Reason
+				}
+				errs[i] = errors.New(fmt.Sprintf("failed to index document %s: %s", docs[i].Id, reason))
+				// too many requests or unavailable shards are worth retrying
+				retry[i] = result.Status == 429 || result.Status == 503
+			}
+		}
+	}
+	return errs, retry, nil
+}
+
+func TimedIndices(ch *Channel, tStart, tEnd time.Time) string {
+	allIndices := esChannelIndices(ch)
+
+	indices := []string{}
+	for _, index := range TimedIndexNames(ch, tStart, tEnd) {
+		if StringSliceContains(allIndices, index) {
+			indices = append(indices, index)
+		}
+	}
+	return strings.Join(indices, ",")
+}
+
+func GlobalIndexName(ch *Channel) string {
+	return fmt.Sprintf("channels.%d.*", ch.Id)
+}
+
+func (s *ESStore) QueryValue(q *ValueQuery) (interface{}, error) {
+	filterAgg := elastic.NewFilterAggregation()
+
+	boolQ := elastic.NewBoolQuery()
+
+	termQs := make([]elastic.Query, 0)
+	for tagN, tagV := range q.Tags {
+		termQs = append(termQs, elastic.NewTermQuery(tagN, tagV))
+	}
+	boolQ.Must(termQs...)
+
+	existsQs := elastic.NewExistsQuery(q.Field)
+	boolQ.Must(existsQs)
+
+	if !q.TimeStart.IsZero() {
+		rangeQ := elastic.NewRangeQuery("timestamp").
+			From(NanoToMilli(q.TimeStart.UnixNano())).
+			To(NanoToMilli(q.TimeEnd.UnixNano()))
+		boolQ.Must(rangeQ)
+	}
+
+	filterAgg.Filter(boolQ)
+
+	var agg elastic.Aggregation
+	switch q.SummaryType {
+	case "sum":
+		agg = elastic.NewSumAggregation().Field(q.Field)
+	case "avg":
+		agg = elastic.NewAvgAggregation().Field(q.Field)
+	case "min":
+		agg = elastic.NewMinAggregation().Field(q.Field)
+	case "max":
+		agg = elastic.NewMaxAggregation().Field(q.Field)
+	}
+
+	filterAgg.SubAggregation(ValueAggName, agg)
+
+	if q.SummaryType != "last" {
+		indexName := TimedIndices(q.Channel, q.TimeStart, q.TimeEnd)
+		if len(indexName) == 0 {
+			return nil, nil
+		}
+
+		resp, err := IndexClient.Search().
+			SearchType("count").
+			Index(indexName).
+			Type(IndexTypeMessages).
+			Aggregation("name", filterAgg).
+			Do()
+		if err != nil {
+			return nil, err
+		}
+		filterAggResp, success := resp.Aggregations.Filter("name")
+		if !success {
+			return nil, errors.New("error querying indices")
+		}
+
+		var statsResp *elastic.AggregationValueMetric
+		switch q.SummaryType {
+		case "sum":
+			statsResp, success = filterAggResp.Aggregations.Sum(ValueAggName)
+		case "avg":
+			statsResp, success = filterAggResp.Aggregations.Avg(ValueAggName)
+		case "min":
+			statsResp, success = filterAggResp.Aggregations.Min(ValueAggName)
+		case "max":
+			statsResp, success = filterAggResp.Aggregations.Max(ValueAggName)
+		}
+
+		if !success {
+			return nil, errors.New("error querying indices")
+		}
+
+		return map[string]interface{}{"value": statsResp.Value}, nil
+	} else {
+		resp, err := IndexClient.Search().
+			Index(GlobalIndexName(q.Channel)).
+			Type(IndexTypeMessages).
+			FetchSource(false).
+			Field(q.Field).
+			Query(boolQ).
+			Sort("timestamp", false).
+			From(0).Size(1).
+			Do()
+
+		if err != nil {
+			return nil, err
+		}
+		if resp.TotalHits() == 0 || resp.Hits == nil ||
+			len(resp.Hits.Hits) == 0 {
+			return nil, nil
+		} else if _, found := resp.Hits.Hits[0].Fields[q.Field]; !found {
+			return nil, nil
+		} else {
+			values, ok := resp.Hits.Hits[0].Fields[q.Field].([]interface{})
+			if !ok || len(values) == 0 {
+				return nil, nil
+			} else {
+				return map[string]interface{}{"value": values[0]}, nil
+			}
+		}
+	}
+}
+
+func (s *ESStore) QuerySeries(q *SeriesQuery) (interface{}, error) {
+	series := make([]map[string]interface{}, 0)
+	indexName := TimedIndices(q.Channel, q.TimeStart, q.TimeEnd)
+	if len(indexName) == 0 {
+		return series, nil
+	}
+
+	filterAgg := elastic.NewFilterAggregation()
+
+	boolQ := elastic.NewBoolQuery()
+
+	if q.Device != "" {
+		termQ := elastic.NewTermQuery("device_id", q.Device)
+		boolQ.Must(termQ)
+	}
+
+	termQs := make([]elastic.Query, 0)
+	for tagN, tagV := range q.Tags {
+		termQs = append(termQs, elastic.NewTermQuery(tagN, tagV))
+	}
+	boolQ.Must(termQs...)
+
+	rangeQ := elastic.NewRangeQuery("timestamp").
+		From(NanoToMilli(q.TimeStart.UnixNano())).
+		To(NanoToMilli(q.TimeEnd.UnixNano()))
+	boolQ.Must(rangeQ)
+
+	filterAgg.Filter(boolQ)
+
+	var agg elastic.Aggregation
+	switch q.SummaryType {
+	case "sum":
+		agg = elastic.NewDateHistogramAggregation().
+			Field("timestamp").
+			Interval(q.TimeInterval).
+			SubAggregation(q.SummaryType, elastic.NewSumAggregation().Field(q.Field))
+	case "avg":
+		agg = elastic.NewDateHistogramAggregation().
+			Field("timestamp").
+			Interval(q.TimeInterval).
+			SubAggregation(q.SummaryType, elastic.NewAvgAggregation().Field(q.Field))
+	case "min":
+		agg = elastic.NewDateHistogramAggregation().
+			Field("timestamp").
+			Interval(q.TimeInterval).
+			SubAggregation(q.SummaryType, elastic.NewMinAggregation().Field(q.Field))
+	case "max":
+		agg = elastic.NewDateHistogramAggregation().
+			Field("timestamp").
+			Interval(q.TimeInterval).
+			SubAggregation(q.SummaryType, elastic.NewMaxAggregation().Field(q.Field))
+	}
+
+	filterAgg.SubAggregation(SeriesAggName, agg)
+
+	resp, err := IndexClient.Search().
+		SearchType("count").
+		Index(indexName).
+		Type(IndexTypeMessages).
+		Aggregation("name", filterAgg).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+	filteredResp, success := resp.Aggregations.Filter("name")
+	if !success {
+		return nil, errors.New("error querying indices")
+	}
+	SeriesResp, success := filteredResp.Aggregations.DateHistogram(SeriesAggName)
+	if !success {
+		return nil, errors.New("error querying indices")
+	}
+
+	for _, bkt := range SeriesResp.Buckets {
+		switch q.SummaryType {
+		case "sum":
+			if sum, found := bkt.Aggregations.Sum(q.SummaryType); found {
+				series = append(series, map[string]interface{}{"timestamp": bkt.Key, "value": sum.Value})
+			}
+		case "avg":
+			if avg, found := bkt.Aggregations.Sum(q.SummaryType); found {
+				series = append(series, map[string]interface{}{"timestamp": bkt.Key, "value": avg.Value})
+			}
+		case "min":
+			if min, found := bkt.Aggregations.Sum(q.SummaryType); found {
+				series = append(series, map[string]interface{}{"timestamp": bkt.Key, "value": min.Value})
+			}
+		case "max":
+			if max, found := bkt.Aggregations.Sum(q.SummaryType); found {
+				series = append(series, map[string]interface{}{"timestamp": bkt.Key, "value": max.Value})
+			}
+		}
+	}
+
+	return series, nil
+}
+
+func (s *ESStore) QueryRaw(q *RawQuery) (interface{}, error) {
+	res := map[string]interface{}{}
+
+	indexName := TimedIndices(q.Channel, q.TimeStart, q.TimeEnd)
+	if len(indexName) == 0 {
+		res["size"] = "0b"
+		return res, nil
+	}
+
+	boolQ := elastic.NewBoolQuery()
+
+	termQs := make([]elastic.Query, 0)
+	for tagN, tagV := range q.Tags {
+		termQs = append(termQs, elastic.NewTermQuery(tagN, tagV))
+	}
+	boolQ.Must(termQs...)
+
+	rangeQ := elastic.NewRangeQuery("timestamp").
+		From(NanoToMilli(q.TimeStart.UnixNano())).
+		To(NanoToMilli(q.TimeEnd.UnixNano()))
+	boolQ.Must(rangeQ)
+
+	if q.Nop {
+		filterAgg := elastic.NewFilterAggregation()
+		filterAgg.Filter(boolQ).SubAggregation("bytes", elastic.NewSumAggregation().Field("_size"))
+		resp, err := IndexClient.Search().
+			SearchType("count").
+			Index(indexName).
+			Type(IndexTypeMessages).
+			Aggregation("name", filterAgg).
+			Do()
+
+		if err != nil {
+			return nil, err
+		}
+
+		aggs, success := resp.Aggregations.Filter("name")
+		if !success {
+			return nil, errors.New("error query raw data")
+		}
+		sum, success := aggs.Sum("bytes")
+		if !success {
+			return nil, errors.New("error query raw data")
+		}
+
+		res["size"] = formatRawSize(int64(*sum.Value))
+
+		return res, nil
+
+	} else {
+		tmpFile, err := ioutil.TempFile(os.TempDir(), fmt.Sprintf("%s.raw", q.Channel.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		size := ScrollSize / Config().Indices.NumberOfShards
+		resp, err := IndexClient.Scroll().KeepAlive(KeepAlive).Index(indexName).Type(IndexTypeMessages).Query(boolQ).Size(size).Do()
+		for err == nil {
+			resp, err = IndexClient.Scroll().KeepAlive(KeepAlive).ScrollId(resp.ScrollId).GetNextPage()
+			if err == nil {
+				for _, hit := range resp.Hits.Hits {
+					tmpFile.Write([]byte(*hit.Source))
+					tmpFile.WriteString("\n")
+				}
+			}
+		}
+
+		if err != nil && err != elastic.EOS {
+			return nil, err
+		}
+
+		res["file"] = tmpFile.Name()
+		return res, nil
+	}
+}
+
+func (s *ESStore) QueryTagStats(q *StatsQuery) (interface{}, error) {
+	res := make(map[string]interface{})
+	for _, tag := range q.Channel.Tags {
+		res[tag] = []interface{}{}
+	}
+
+	indexName := TimedIndices(q.Channel, q.TimeStart, q.TimeEnd)
+	if len(indexName) == 0 {
+		return res, nil
+	}
+
+	filterAgg := elastic.NewFilterAggregation()
+
+	boolQ := elastic.NewBoolQuery()
+	rangeQ := elastic.NewRangeQuery("timestamp").
+		From(NanoToMilli(q.TimeStart.UnixNano())).
+		To(NanoToMilli(q.TimeEnd.UnixNano()))
+	boolQ.Must(rangeQ)
+
+	filterAgg.Filter(boolQ)
+
+	for _, tag := range q.Channel.Tags {
+		filterAgg.SubAggregation(tag, elastic.NewTermsAggregation().Field(tag).Size(0))
+	}
+
+	resp, err := IndexClient.Search().
+		SearchType("count").
+		Index(indexName).
+		Type(IndexTypeMessages).
+		Aggregation("name", filterAgg).
+		Do()
+
+	if err != nil {
+		return res, nil
+	} else {
+		if agg, found := resp.Aggregations.Filter("name"); found {
+			for _, tag := range q.Channel.Tags {
+				tagStats, found := agg.Aggregations.Terms(tag)
+				if found {
+					for _, bucket := range tagStats.Buckets {
+						res[tag] = append(res[tag].([]interface{}), bucket.Key)
+					}
+				}
+			}
+			return res, nil
+		}
+		return nil, nil
+	}
+}
+
+func (s *ESStore) Activities(ch *Channel, devId string, activity string, limit int) ([]*ConnectionHistory, error) {
+	boolQ := elastic.NewBoolQuery()
+	boolQ.Must(elastic.NewTermQuery("device_id", devId))
+	if len(activity) > 0 {
+		boolQ.Must(elastic.NewTermQuery("activity", activity))
+	}
+
+	resp, err := IndexClient.Search().Index(GlobalIndexName(ch)).
+		Type(IndexTypeActivities).
+		Query(boolQ).
+		Sort("timestamp", false).
+		Size(limit).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	hs := make([]*ConnectionHistory, 0)
+	if resp.Hits == nil {
+		return hs, nil
+	}
+	for _, hit := range resp.Hits.Hits {
+		h := &ConnectionHistory{}
+		if err := json.Unmarshal(*hit.Source, h); err != nil {
+			return nil, err
+		}
+		hs = append(hs, h)
+	}
+	return hs, nil
+}
+
+func (s *ESStore) IndexStats(ch *Channel) (interface{}, error) {
+	return IndexClient.IndexStats().Index(GlobalIndexName(ch)).Do()
+}
+
+func (s *ESStore) DeleteChannel(ch *Channel) error {
+	_, err := IndexClient.DeleteIndex().Index([]string{GlobalIndexName(ch)}).Do()
+	return err
+}
+
+func (s *ESStore) Close() error {
+	return CloseIndexClient()
+}
+
+func esChannelIndices(ch *Channel) []string {
+	indices := []string{}
+	resp, found := FetchCachedChannelIndexStatsById(ch.Id)
+	if !found {
+		return indices
+	}
+	stats, ok := resp.(*elastic.IndicesStatsResponse)
+	if ok && stats.Indices != nil {
+		for k, _ := range stats.Indices {
+			indices = append(indices, k)
+		}
+	}
+	return indices
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"github.com/jinzhu/gorm"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var FirmwareTooLargeErr = errors.New("firmware is larger than the max size")
+var firmwareEmptyErr = errors.New("firmware is empty")
+var firmwareInUseErr = errors.New("firmware is used by an active rollout")
+
+func init() {
+	// one by one, so that their files are removed too
+	onChannelDelete(func(tx *gorm.DB, c *Channel) error {
+		firmwares := []*Firmware{}
+		tx.Where("channel_id = ?", c.Id).Find(&firmwares)
+		for _, f := range firmwares {
+			if err := tx.Delete(f).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Firmware is a binary artifact that devices of a channel are updated to.
+// The content is kept on local disk under the firmware dir, the record holds
+// its version, size and sha256 checksum.
+type Firmware struct {
+	Id        int    `sql:"type:integer primary key autoincrement" json:"id"`
+	ChannelId int    `sql:"type:integer;index" json:"-"`
+	Version   string `sql:"type:varchar(255)" json:"version"`
+	Filename  string `sql:"type:varchar(255)" json:"filename"`
+	Size      int64  `sql:"type:integer" json:"size"`
+	Checksum  string `sql:"type:varchar(64)" json:"checksum"`
+	Created   int64  `sql:"type:integer" json:"created"`
+	Modified  int64  `sql:"type:integer" json:"modified"`
+}
+
+func (f *Firmware) BeforeSave() error {
+	if len(f.Version) == 0 {
+		return errors.New("version is empty")
+	}
+
+	if len(f.Version) > 255 {
+		return errors.New("version is too long, at most 255 characters are supported")
+	}
+
+	if len(f.Filename) == 0 {
+		f.Filename = f.Version + ".bin"
+	}
+
+	ch := &Channel{}
+	if found := ch.FindById(f.ChannelId); !found {
+		return errors.New("channel not found")
+	}
+
+	existing := &Firmware{}
+	DB.Where("channel_id = ? AND version = ?", f.ChannelId, f.Version).First(existing)
+	if !DB.NewRecord(existing) && existing.Id != f.Id {
+		return errors.New(fmt.Sprintf("firmware version already exists: %s", f.Version))
+	}
+
+	return nil
+}
+
+func (f *Firmware) AfterDelete() error {
+	if err := os.Remove(f.Path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *Firmware) Delete() error {
+	var count int
+	DB.Model(&Rollout{}).Where("firmware_id = ? AND status <> ?", f.Id, RolloutAborted).Count(&count)
+	if count > 0 {
+		return firmwareInUseErr
+	}
+	return DB.Delete(f).Error
+}
+
+func (f *Firmware) FindById(id int) bool {
+	DB.First(f, id)
+	return !DB.NewRecord(f)
+}
+
+// Where the content of the firmware is kept.
+func (f *Firmware) Path() string {
+	return filepath.Join(firmwareChannelDir(f.ChannelId), strconv.Itoa(f.Id)+".bin")
+}
+
+// Open the content of the firmware for serving.
+func (f *Firmware) Open() (*os.File, error) {
+	return os.Open(f.Path())
+}
+
+// Stores the content of a firmware read from r and creates its record. The
+// content is written to a temporary file first, so that a failed upload
+// never leaves a record behind. When checksum is given, the upload has to
+// match it.
+func StoreFirmware(f *Firmware, r io.Reader, checksum string) error {
+	dir := firmwareChannelDir(f.ChannelId)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	max := Config().Firmware.MaxSize
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, max+1))
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return firmwareEmptyErr
+	}
+	if n > max {
+		return FirmwareTooLargeErr
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if len(checksum) > 0 && !strings.EqualFold(checksum, sum) {
+		return errors.New(fmt.Sprintf("checksum mismatch, the upload has checksum %s", sum))
+	}
+
+	f.Size = n
+	f.Checksum = sum
+	f.Created = NanoToMilli(time.Now().UTC().UnixNano())
+	f.Modified = f.Created
+	if err = DB.Create(f).Error; err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), f.Path()); err != nil {
+		DB.Delete(f)
+		return err
+	}
+	return nil
+}
+
+func ChannelFirmwares(channelId int) []*Firmware {
+	firmwares := []*Firmware{}
+	DB.Where("channel_id = ?", channelId).Order("id asc").Find(&firmwares)
+	return firmwares
+}
+
+func firmwareChannelDir(channelId int) string {
+	return filepath.Join(Config().Firmware.Dir, strconv.Itoa(channelId))
+}
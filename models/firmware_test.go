@@ -0,0 +1,98 @@
+package models
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFirmware(t *testing.T) {
+	pwd, _ := os.Getwd()
+	firmwareDir := path.Join(pwd, "firmware_test")
+	dbFile := setupTestDB(&Conf{
+		Firmware: &FirmwareConf{
+			Dir:            firmwareDir,
+			MaxSize:        16,
+			HaltMinDevices: 2,
+		},
+	})
+	defer teardownTestDB(dbFile)
+	defer os.RemoveAll(firmwareDir)
+
+	ch := &Channel{
+		Name:            "test",
+		Description:     "desc",
+		Tags:            []string{"tag1", "tag2"},
+		Fields:          map[string]string{"field1": "int"},
+		AccessTokens:    []string{"token1"},
+		ConnectionLimit: 5,
+		MessageRate:     1000,
+	}
+	ch.Create()
+
+	Convey("stores firmware artifacts with their checksums", t, func() {
+		f := &Firmware{ChannelId: ch.Id, Version: "1.0.0"}
+		err := StoreFirmware(f, bytes.NewReader([]byte("firmware")), "")
+		So(err, ShouldBeNil)
+		So(f.Size, ShouldEqual, 8)
+		So(f.Checksum, ShouldEqual, "c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835")
+		So(f.Filename, ShouldEqual, "1.0.0.bin")
+
+		content, err := f.Open()
+		So(err, ShouldBeNil)
+		b, _ := ioutil.ReadAll(content)
+		content.Close()
+		So(string(b), ShouldEqual, "firmware")
+		So(len(ChannelFirmwares(ch.Id)), ShouldEqual, 1)
+
+		So(f.Delete(), ShouldBeNil)
+		_, err = os.Stat(f.Path())
+		So(os.IsNotExist(err), ShouldBeTrue)
+		So(len(ChannelFirmwares(ch.Id)), ShouldEqual, 0)
+	})
+
+	Convey("rejects invalid uploads without leaving anything behind", t, func() {
+		f := &Firmware{ChannelId: ch.Id, Version: "1.0.0"}
+		err := StoreFirmware(f, bytes.NewReader([]byte("a firmware that is too large")), "")
+		So(err, ShouldEqual, FirmwareTooLargeErr)
+
+		err = StoreFirmware(f, bytes.NewReader([]byte{}), "")
+		So(err.Error(), ShouldContainSubstring, "firmware is empty")
+
+		err = StoreFirmware(f, bytes.NewReader([]byte("firmware")), "abcd")
+		So(err.Error(), ShouldContainSubstring, "checksum mismatch")
+
+		f.Version = ""
+		err = StoreFirmware(f, bytes.NewReader([]byte("firmware")), "")
+		So(err.Error(), ShouldContainSubstring, "version is empty")
+
+		So(len(ChannelFirmwares(ch.Id)), ShouldEqual, 0)
+		files, _ := ioutil.ReadDir(firmwareChannelDir(ch.Id))
+		So(len(files), ShouldEqual, 0)
+
+		f.Version = "1.0.0"
+		So(StoreFirmware(f, bytes.NewReader([]byte("firmware")), "C3BF47EA1F4A4A605470313CACB3A44F4A461F68C6FAEAB07E737610CB5AC835"), ShouldBeNil)
+		dup := &Firmware{ChannelId: ch.Id, Version: "1.0.0"}
+		err = StoreFirmware(dup, bytes.NewReader([]byte("firmware")), "")
+		So(err.Error(), ShouldContainSubstring, "firmware version already exists: 1.0.0")
+		f.Delete()
+	})
+
+	Convey("deletes firmwares and their files with the channel", t, func() {
+		f := &Firmware{ChannelId: ch.Id, Version: "1.0.0"}
+		StoreFirmware(f, bytes.NewReader([]byte("firmware")), "")
+
+		err := ch.Delete()
+		So(err, ShouldBeNil)
+
+		var count int
+		DB.Model(&Firmware{}).Count(&count)
+		So(count, ShouldEqual, 0)
+		_, err = os.Stat(f.Path())
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
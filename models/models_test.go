@@ -0,0 +1,38 @@
+package models
+
+import (
+	. "github.com/eywa/configs"
+	"log"
+	"os"
+	"path"
+)
+
+// Every test of the models runs on a fresh database with all the tables, the
+// database settings are added to the given conf.
+func setupTestDB(conf *Conf) string {
+	pwd, _ := os.Getwd()
+	dbFile := path.Join(pwd, "eywa_test.db")
+	os.Remove(dbFile)
+
+	conf.Database = &DbConf{
+		DbType: "sqlite3",
+		DbFile: dbFile,
+	}
+	conf.Logging = &LogsConf{
+		Database: &LogConf{
+			Level: "debug",
+		},
+	}
+	SetConfig(conf)
+
+	InitializeDB()
+	DB.LogMode(true)
+	DB.SetLogger(log.New(os.Stdout, "", log.LstdFlags))
+	MigrateAll()
+	return dbFile
+}
+
+func teardownTestDB(dbFile string) {
+	CloseDB()
+	os.Remove(dbFile)
+}
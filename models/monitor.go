@@ -0,0 +1,568 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"github.com/jinzhu/gorm"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// compares a summary of a field with a threshold
+	MonitorThreshold = "threshold"
+	// alerts on devices that have been silent for the window
+	MonitorAbsence = "absence"
+)
+
+var SupportedMonitorKinds = []string{MonitorThreshold, MonitorAbsence}
+
+const (
+	// the summary of the window is queried every monitor interval
+	MonitorPeriodic = "periodic"
+	// every uploaded point is compared as it arrives
+	MonitorIngest = "ingest"
+)
+
+var SupportedMonitorEvaluations = []string{MonitorPeriodic, MonitorIngest}
+
+const (
+	MonitorOk       = "ok"
+	MonitorAlerting = "alerting"
+	MonitorResolved = "resolved"
+)
+
+func init() {
+	deleteWithChannel(&Monitor{})
+	deleteWithChannel(&MonitorState{})
+	deleteWithChannel(&Alert{})
+	requireMessageHandler("monitors", "monitors", &Monitor{}, "")
+}
+
+// Monitor watches a field, or the activity of devices, of a channel and
+// notifies when it starts or stops alerting. A monitor only changes its state
+// after Debounce evaluations in a row agree.
+type Monitor struct {
+	Id          int         `sql:"type:integer primary key autoincrement" json:"id"`
+	ChannelId   int         `sql:"type:integer;index" json:"-"`
+	Name        string      `sql:"type:varchar(255)" json:"name"`
+	Kind        string      `sql:"type:varchar(32)" json:"kind"`
+	Field       string      `sql:"type:varchar(255)" json:"field"`
+	SummaryType string      `sql:"type:varchar(32)" json:"summary_type"`
+	Window      string      `sql:"type:varchar(32)" json:"window"`
+	Operator    string      `sql:"type:varchar(32)" json:"operator"`
+	Threshold   float64     `sql:"type:real" json:"threshold"`
+	TagFilters  StringMap   `sql:"type:text" json:"tag_filters"`
+	Evaluation  string      `sql:"type:varchar(32)" json:"evaluation"`
+	Debounce    int         `sql:"type:integer" json:"debounce"`
+	Notifiers   StringSlice `sql:"type:text" json:"notifiers"`
+	Url         string      `sql:"type:text" json:"url"`
+	Secret      string      `sql:"type:varchar(255)" json:"secret"`
+	Created     int64       `sql:"type:integer" json:"created"`
+	Modified    int64       `sql:"type:integer" json:"modified"`
+}
+
+// MonitorState is the state of a monitor, absence monitors keep one for each
+// device.
+type MonitorState struct {
+	Id        int     `sql:"type:integer primary key autoincrement" json:"-"`
+	ChannelId int     `sql:"type:integer;index" json:"-"`
+	MonitorId int     `sql:"type:integer;index" json:"-"`
+	DeviceId  string  `sql:"type:varchar(255)" json:"device_id,omitempty"`
+	State     string  `sql:"type:varchar(32)" json:"state"`
+	Streak    int     `sql:"type:integer" json:"streak"`
+	Value     float64 `sql:"type:real" json:"value"`
+	Modified  int64   `sql:"type:integer" json:"modified"`
+}
+
+// Alert records a monitor starting or stopping to alert.
+type Alert struct {
+	Id        int     `sql:"type:integer primary key autoincrement" json:"id"`
+	ChannelId int     `sql:"type:integer;index" json:"-"`
+	MonitorId int     `sql:"type:integer;index" json:"monitor_id"`
+	Name      string  `sql:"type:varchar(255)" json:"name"`
+	DeviceId  string  `sql:"type:varchar(255)" json:"device_id,omitempty"`
+	State     string  `sql:"type:varchar(32)" json:"state"`
+	Value     float64 `sql:"type:real" json:"value"`
+	Message   string  `sql:"type:text" json:"message"`
+	Created   int64   `sql:"type:integer" json:"created"`
+}
+
+// Notifier tells about an alert of a monitor.
+type Notifier func(*Monitor, *Alert) error
+
+// Notifiers registered by name, monitors list the ones they notify.
+var notifierRegistry = &monitorNotifierRegistry{notifiers: make(map[string]Notifier)}
+
+type monitorNotifierRegistry struct {
+	sync.RWMutex
+	notifiers map[string]Notifier
+}
+
+// Registers a notifier under its name, usually from an init function.
+func RegisterNotifier(name string, n Notifier) error {
+	if len(name) == 0 {
+		return errors.New("notifier name is empty")
+	}
+
+	notifierRegistry.Lock()
+	defer notifierRegistry.Unlock()
+
+	if _, found := notifierRegistry.notifiers[name]; found {
+		return errors.New(fmt.Sprintf("notifier %s is already registered", name))
+	}
+	notifierRegistry.notifiers[name] = n
+	return nil
+}
+
+func FindNotifier(name string) (Notifier, bool) {
+	notifierRegistry.RLock()
+	defer notifierRegistry.RUnlock()
+
+	n, found := notifierRegistry.notifiers[name]
+	return n, found
+}
+
+// Names of all registered notifiers in alphabetical order.
+func RegisteredNotifiers() []string {
+	notifierRegistry.RLock()
+	defer notifierRegistry.RUnlock()
+
+	names := make([]string, 0, len(notifierRegistry.notifiers))
+	for name, _ := range notifierRegistry.notifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serializes the evaluations of a monitor state
+var monitorLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+
+func (m *Monitor) BeforeSave() error {
+	if len(m.Name) == 0 {
+		return errors.New("name is empty")
+	}
+
+	if !StringSliceContains(SupportedMonitorKinds, m.Kind) {
+		return errors.New(fmt.Sprintf("unsupported kind: %s, supported kinds are %s", m.Kind, strings.Join(SupportedMonitorKinds, ",")))
+	}
+
+	window, err := time.ParseDuration(m.Window)
+	if err != nil || window <= 0 {
+		return errors.New("invalid window, a positive duration like 5m is expected")
+	}
+
+	if m.Debounce == 0 {
+		m.Debounce = 1
+	}
+	if m.Debounce < 0 {
+		return errors.New("invalid debounce, it has to be positive")
+	}
+
+	if len(m.Notifiers) == 0 {
+		m.Notifiers = StringSlice([]string{"log"})
+	}
+	for _, name := range m.Notifiers {
+		if _, found := FindNotifier(name); !found {
+			return errors.New(fmt.Sprintf("unsupported notifier: %s, supported notifiers are %s", name, strings.Join(RegisteredNotifiers(), ",")))
+		}
+	}
+
+	if StringSliceContains(m.Notifiers, "webhook") {
+		u, err := url.Parse(m.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return errors.New("invalid url, only http and https urls are supported")
+		}
+		if len(m.Secret) == 0 {
+			return errors.New("secret is empty")
+		}
+	}
+
+	if m.TagFilters == nil {
+		m.TagFilters = StringMap(make(map[string]string, 0))
+	}
+
+	ch := &Channel{}
+	if found := ch.FindById(m.ChannelId); !found {
+		return errors.New("channel not found")
+	}
+
+	if !ch.RunsMessageHandler("monitors") {
+		return errors.New("channel doesn't run the monitors message handler")
+	}
+
+	if m.Kind == MonitorThreshold {
+		if _, found := ch.Fields[m.Field]; !found {
+			return errors.New(fmt.Sprintf("undefined field: %s on channel: %s", m.Field, ch.Name))
+		}
+
+		if len(m.Evaluation) == 0 {
+			m.Evaluation = MonitorPeriodic
+		}
+		if !StringSliceContains(SupportedMonitorEvaluations, m.Evaluation) {
+			return errors.New(fmt.Sprintf("unsupported evaluation: %s, supported evaluations are %s", m.Evaluation, strings.Join(SupportedMonitorEvaluations, ",")))
+		}
+
+		if m.Evaluation == MonitorPeriodic && !StringSliceContains(SupportedSummaryTypes, m.SummaryType) {
+			return errors.New(fmt.Sprintf("unsupported summary_type: %s, supported summary types are %s", m.SummaryType, strings.Join(SupportedSummaryTypes, ",")))
+		}
+
+		if !StringSliceContains(SupportedOperators, m.Operator) {
+			return errors.New(fmt.Sprintf("unsupported operator: %s, supported operators are %s", m.Operator, strings.Join(SupportedOperators, ",")))
+		}
+	} else {
+		m.Evaluation = MonitorPeriodic
+	}
+
+	for tagName, _ := range m.TagFilters {
+		if !StringSliceContains(ch.Tags, tagName) && !StringSliceContains(InternalTags, tagName) {
+			return errors.New(fmt.Sprintf("unknown tag in tag filters: %s", tagName))
+		}
+	}
+
+	return nil
+}
+
+func (m *Monitor) AfterSave() error {
+	Cache.Delete(monitorsCacheKey(m.ChannelId))
+	return nil
+}
+
+func (m *Monitor) AfterDelete(tx *gorm.DB) error {
+	Cache.Delete(monitorsCacheKey(m.ChannelId))
+	return tx.Where("monitor_id = ?", m.Id).Delete(&MonitorState{}).Error
+}
+
+func (m *Monitor) Create() error {
+	return DB.Create(m).Error
+}
+
+func (m *Monitor) Delete() error {
+	return DB.Delete(m).Error
+}
+
+// The state of a monitor starts over when its definition changes.
+func (m *Monitor) Update() error {
+	if err := DB.Save(m).Error; err != nil {
+		return err
+	}
+	return DB.Where("monitor_id = ?", m.Id).Delete(&MonitorState{}).Error
+}
+
+func (m *Monitor) FindById(id int) bool {
+	DB.First(m, id)
+	return !DB.NewRecord(m)
+}
+
+// Hex encoded HMAC-SHA256 of the request body, keyed by the monitor secret.
+func (m *Monitor) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(m.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Monitor) WindowDuration() time.Duration {
+	d, _ := time.ParseDuration(m.Window)
+	return d
+}
+
+func (m *Monitor) States() []*MonitorState {
+	states := []*MonitorState{}
+	DB.Where("monitor_id = ?", m.Id).Order("device_id asc").Find(&states)
+	return states
+}
+
+// Whether a value breaches the threshold.
+func (m *Monitor) Breached(v float64) bool {
+	switch m.Operator {
+	case "eq":
+		return v == m.Threshold
+	case "ne":
+		return v != m.Threshold
+	case "lt":
+		return v < m.Threshold
+	case "gt":
+		return v > m.Threshold
+	case "le":
+		return v <= m.Threshold
+	case "ge":
+		return v >= m.Threshold
+	}
+	return false
+}
+
+func (m *Monitor) matches(tags map[string]string) bool {
+	for k, v := range m.TagFilters {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Feeds one evaluation into the state kept for a device, or for the whole
+// monitor when deviceId is empty. Returns the alert when the state flips.
+func (m *Monitor) Observe(deviceId string, breached bool, value float64, message string) (*Alert, error) {
+	lockKey := fmt.Sprintf("%d/%s", m.Id, deviceId)
+	monitorLocks.Lock(lockKey)
+	defer monitorLocks.Unlock(lockKey)
+
+	s := &MonitorState{}
+	DB.Where("monitor_id = ? AND device_id = ?", m.Id, deviceId).First(s)
+	if DB.NewRecord(s) {
+		s = &MonitorState{ChannelId: m.ChannelId, MonitorId: m.Id, DeviceId: deviceId, State: MonitorOk}
+	}
+	state, streak := s.State, s.Streak
+
+	var alert *Alert
+	if (s.State == MonitorAlerting) == breached {
+		// resolved states settle back to ok once they stay clear
+		s.Streak = 0
+		if s.State == MonitorResolved {
+			s.State = MonitorOk
+		}
+	} else if s.Streak += 1; s.Streak >= m.Debounce {
+		s.Streak = 0
+		if breached {
+			s.State = MonitorAlerting
+		} else {
+			s.State = MonitorResolved
+		}
+		alert = &Alert{
+			ChannelId: m.ChannelId,
+			MonitorId: m.Id,
+			Name:      m.Name,
+			DeviceId:  deviceId,
+			State:     s.State,
+			Value:     value,
+			Message:   message,
+			Created:   NanoToMilli(time.Now().UTC().UnixNano()),
+		}
+		if err := DB.Create(alert).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if !DB.NewRecord(s) && state == s.State && streak == s.Streak {
+		return alert, nil
+	}
+	s.Value = value
+	s.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+	return alert, DB.Save(s).Error
+}
+
+// Compares a point uploaded to the channel of an ingest monitor.
+func (m *Monitor) ObservePoint(p *Point) (*Alert, error) {
+	if !m.matches(p.Tags) {
+		return nil, nil
+	}
+
+	v, ok := monitorNumber(p.Fields[m.Field])
+	if !ok {
+		return nil, nil
+	}
+	breached := m.Breached(v)
+	return m.Observe("", breached, v, m.thresholdMessage(m.Field, v, breached))
+}
+
+// Evaluates a periodic monitor. Threshold monitors without data in the
+// window are skipped.
+func (m *Monitor) Evaluate(now time.Time) ([]*Alert, error) {
+	ch := &Channel{}
+	if found := ch.FindById(m.ChannelId); !found {
+		return nil, errors.New("channel not found")
+	}
+
+	if m.Kind == MonitorAbsence {
+		return m.evaluateAbsence(ch, now)
+	}
+
+	q := &ValueQuery{
+		Channel:     ch,
+		Field:       m.Field,
+		Tags:        m.TagFilters,
+		SummaryType: m.SummaryType,
+		TimeStart:   now.Add(-m.WindowDuration()).UTC(),
+		TimeEnd:     now.UTC(),
+	}
+	res, err := q.Query()
+	if err != nil {
+		return nil, err
+	}
+
+	result, _ := res.(map[string]interface{})
+	v, ok := monitorNumber(result["value"])
+	if !ok {
+		return nil, nil
+	}
+
+	breached := m.Breached(v)
+	alert, err := m.Observe("", breached, v, m.thresholdMessage(m.SummaryType+" of "+m.Field, v, breached))
+	if alert == nil {
+		return nil, err
+	}
+	return []*Alert{alert}, err
+}
+
+func (m *Monitor) thresholdMessage(subject string, v float64, breached bool) string {
+	if breached {
+		return fmt.Sprintf("%s is %v, %s %v", subject, v, m.Operator, m.Threshold)
+	}
+	return fmt.Sprintf("%s is %v, no longer %s %v", subject, v, m.Operator, m.Threshold)
+}
+
+func (m *Monitor) evaluateAbsence(ch *Channel, now time.Time) ([]*Alert, error) {
+	window := m.WindowDuration()
+	alerts := []*Alert{}
+	for deviceId, a := range channelActivities(ch.Id) {
+		if !m.matches(a.meta) {
+			continue
+		}
+
+		silence := now.Sub(a.last)
+		silent := silence >= window
+		msg := fmt.Sprintf("device %s has been silent for %s", deviceId, silence/time.Second*time.Second)
+		if !silent {
+			msg = fmt.Sprintf("device %s is active again", deviceId)
+		}
+
+		alert, err := m.Observe(deviceId, silent, silence.Seconds(), msg)
+		if err != nil {
+			return alerts, err
+		}
+		if alert != nil {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts, nil
+}
+
+func monitorNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case *float64:
+		if n == nil {
+			return 0, false
+		}
+		return *n, true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func ChannelMonitors(channelId int) []*Monitor {
+	monitors := []*Monitor{}
+	DB.Where("channel_id = ?", channelId).Order("id asc").Find(&monitors)
+	return monitors
+}
+
+func FetchCachedMonitorsByChannelId(channelId int) []*Monitor {
+	monitors, err := Cache.Fetch(monitorsCacheKey(channelId), 1*time.Minute, func() (interface{}, error) {
+		return ChannelMonitors(channelId), nil
+	})
+
+	if err != nil {
+		return []*Monitor{}
+	}
+	return monitors.([]*Monitor)
+}
+
+// Monitors of all channels that are evaluated periodically.
+func PeriodicMonitors() []*Monitor {
+	monitors := []*Monitor{}
+	DB.Where("evaluation = ?", MonitorPeriodic).Order("id asc").Find(&monitors)
+	return monitors
+}
+
+// Alert history of a channel, most recent first, optionally filtered by
+// monitor and state.
+func ChannelAlerts(channelId, monitorId int, state string, limit int) []*Alert {
+	alerts := []*Alert{}
+	q := DB.Where("channel_id = ?", channelId)
+	if monitorId > 0 {
+		q = q.Where("monitor_id = ?", monitorId)
+	}
+	if len(state) > 0 {
+		q = q.Where("state = ?", state)
+	}
+	q.Order("id desc").Limit(limit).Find(&alerts)
+	return alerts
+}
+
+// Removes the alerts older than the retention.
+func SweepAlerts() {
+	retention := NanoToMilli(time.Now().UTC().Add(-Config().Monitors.AlertRetention.Duration).UnixNano())
+	DB.Where("created <= ?", retention).Delete(&Alert{})
+}
+
+func monitorsCacheKey(channelId int) string {
+	return fmt.Sprintf("cache.monitors:%d", channelId)
+}
+
+type deviceActivity struct {
+	last time.Time
+	meta map[string]string
+}
+
+// When the devices of each channel were last heard of on this node.
+var activities = struct {
+	sync.Mutex
+	channels map[int]map[string]*deviceActivity
+}{channels: make(map[int]map[string]*deviceActivity)}
+
+// Records that a device was heard of, along with the metadata of its
+// connection that absence monitors filter on.
+func RecordActivity(channelId int, deviceId string, meta map[string]string, t time.Time) {
+	activities.Lock()
+	defer activities.Unlock()
+
+	devices, found := activities.channels[channelId]
+	if !found {
+		devices = make(map[string]*deviceActivity)
+		activities.channels[channelId] = devices
+	}
+	devices[deviceId] = &deviceActivity{last: t, meta: meta}
+}
+
+// Activities recorded on this node, completed with the last seen times of
+// registered devices, which survive restarts.
+func channelActivities(channelId int) map[string]*deviceActivity {
+	result := make(map[string]*deviceActivity)
+	for _, d := range ChannelDevices(channelId) {
+		if d.LastSeen > 0 {
+			result[d.DeviceId] = &deviceActivity{
+				last: time.Unix(MilliSecToSec(d.LastSeen), MilliSecToNano(d.LastSeen)),
+				meta: d.Labels,
+			}
+		}
+	}
+
+	activities.Lock()
+	defer activities.Unlock()
+	for deviceId, a := range activities.channels[channelId] {
+		if known, found := result[deviceId]; !found || a.last.After(known.last) {
+			result[deviceId] = a
+		}
+	}
+	return result
+}
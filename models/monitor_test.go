@@ -0,0 +1,195 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterNotifier("log", func(*Monitor, *Alert) error { return nil })
+	RegisterNotifier("webhook", func(*Monitor, *Alert) error { return nil })
+}
+
+func TestMonitor(t *testing.T) {
+	dbFile := setupTestDB(&Conf{
+		Monitors: &MonitorConf{
+			AlertRetention: &JSONDuration{Duration: time.Hour},
+		},
+	})
+	defer teardownTestDB(dbFile)
+
+	ch := &Channel{
+		Name:            "test",
+		Description:     "desc",
+		Tags:            []string{"tag1", "tag2"},
+		Fields:          map[string]string{"field1": "int"},
+		AccessTokens:    []string{"token1"},
+		ConnectionLimit: 5,
+		MessageRate:     1000,
+	}
+	ch.Create()
+
+	Convey("validates monitors before saving", t, func() {
+		m := &Monitor{ChannelId: ch.Id, Name: "hot", Kind: "unknown", Window: "5m"}
+		err := m.Create()
+		So(err.Error(), ShouldContainSubstring, "unsupported kind")
+
+		m.Kind = MonitorThreshold
+		m.Window = "-5m"
+		err = m.Create()
+		So(err.Error(), ShouldContainSubstring, "invalid window")
+
+		m.Window = "5m"
+		m.Field = "field2"
+		err = m.Create()
+		So(err.Error(), ShouldContainSubstring, "undefined field")
+
+		m.Field = "field1"
+		m.SummaryType = "median"
+		err = m.Create()
+		So(err.Error(), ShouldContainSubstring, "unsupported summary_type")
+
+		m.SummaryType = "avg"
+		m.Operator = "gt"
+		m.Notifiers = []string{"sms"}
+		err = m.Create()
+		So(err.Error(), ShouldContainSubstring, "unsupported notifier")
+
+		m.Notifiers = []string{"webhook"}
+		m.Url = "ftp://example.com"
+		err = m.Create()
+		So(err.Error(), ShouldContainSubstring, "invalid url")
+
+		m.Notifiers = nil
+		m.TagFilters = map[string]string{"tag3": "a"}
+		err = m.Create()
+		So(err.Error(), ShouldContainSubstring, "unknown tag")
+
+		m.TagFilters = map[string]string{"tag1": "a"}
+		So(m.Create(), ShouldBeNil)
+		So(m.Evaluation, ShouldEqual, MonitorPeriodic)
+		So(m.Debounce, ShouldEqual, 1)
+		So(m.Notifiers, ShouldResemble, StringSlice([]string{"log"}))
+		So(FetchCachedMonitorsByChannelId(ch.Id), ShouldHaveLength, 1)
+
+		m.Delete()
+		So(FetchCachedMonitorsByChannelId(ch.Id), ShouldHaveLength, 0)
+	})
+
+	Convey("debounces state changes of a monitor", t, func() {
+		m := &Monitor{ChannelId: ch.Id, Name: "hot", Kind: MonitorThreshold, Field: "field1", Operator: "ge", Threshold: 10, Window: "5m", Evaluation: MonitorIngest, Debounce: 2}
+		m.Create()
+
+		So(m.Breached(10), ShouldBeTrue)
+		So(m.Breached(9), ShouldBeFalse)
+
+		alert, err := m.ObservePoint(&Point{Fields: map[string]interface{}{"field1": int64(12)}})
+		So(err, ShouldBeNil)
+		So(alert, ShouldBeNil)
+
+		// a clear evaluation in between starts the count over
+		m.ObservePoint(&Point{Fields: map[string]interface{}{"field1": int64(1)}})
+		alert, _ = m.ObservePoint(&Point{Fields: map[string]interface{}{"field1": int64(12)}})
+		So(alert, ShouldBeNil)
+
+		alert, _ = m.ObservePoint(&Point{Fields: map[string]interface{}{"field1": int64(15)}})
+		So(alert, ShouldNotBeNil)
+		So(alert.State, ShouldEqual, MonitorAlerting)
+		So(alert.Value, ShouldEqual, 15)
+		So(m.States()[0].State, ShouldEqual, MonitorAlerting)
+
+		alert, _ = m.ObservePoint(&Point{Fields: map[string]interface{}{"field1": int64(20)}})
+		So(alert, ShouldBeNil)
+
+		m.ObservePoint(&Point{Fields: map[string]interface{}{"field1": int64(1)}})
+		alert, _ = m.ObservePoint(&Point{Fields: map[string]interface{}{"field1": int64(2)}})
+		So(alert, ShouldNotBeNil)
+		So(alert.State, ShouldEqual, MonitorResolved)
+
+		alert, _ = m.ObservePoint(&Point{Fields: map[string]interface{}{"field1": int64(2)}})
+		So(alert, ShouldBeNil)
+		So(m.States()[0].State, ShouldEqual, MonitorOk)
+
+		alerts := ChannelAlerts(ch.Id, m.Id, "", 10)
+		So(alerts, ShouldHaveLength, 2)
+		So(alerts[0].State, ShouldEqual, MonitorResolved)
+		So(ChannelAlerts(ch.Id, m.Id, MonitorAlerting, 10), ShouldHaveLength, 1)
+		So(ChannelAlerts(ch.Id, m.Id, "", 1), ShouldHaveLength, 1)
+
+		m.Delete()
+		So(ChannelAlerts(ch.Id, m.Id, "", 10), ShouldHaveLength, 2)
+		var count int
+		DB.Model(&MonitorState{}).Where("monitor_id = ?", m.Id).Count(&count)
+		So(count, ShouldEqual, 0)
+	})
+
+	Convey("ignores points the tag filters don't match", t, func() {
+		m := &Monitor{ChannelId: ch.Id, Name: "hot", Kind: MonitorThreshold, Field: "field1", Operator: "gt", Threshold: 10, Window: "5m", Evaluation: MonitorIngest, TagFilters: map[string]string{"tag1": "a"}}
+		m.Create()
+
+		alert, _ := m.ObservePoint(&Point{Tags: map[string]string{"tag1": "b"}, Fields: map[string]interface{}{"field1": int64(12)}})
+		So(alert, ShouldBeNil)
+
+		alert, _ = m.ObservePoint(&Point{Tags: map[string]string{"tag1": "a"}, Fields: map[string]interface{}{"field1": int64(12)}})
+		So(alert, ShouldNotBeNil)
+
+		m.Delete()
+	})
+
+	Convey("alerts on devices that have been silent for the window", t, func() {
+		m := &Monitor{ChannelId: ch.Id, Name: "silent", Kind: MonitorAbsence, Window: "10m", TagFilters: map[string]string{"tag1": "a"}}
+		So(m.Create(), ShouldBeNil)
+
+		now := time.Now()
+		RecordActivity(ch.Id, "dev1", map[string]string{"tag1": "a"}, now.Add(-20*time.Minute))
+		RecordActivity(ch.Id, "dev2", map[string]string{"tag1": "a"}, now.Add(-time.Minute))
+		RecordActivity(ch.Id, "dev3", map[string]string{"tag1": "b"}, now.Add(-20*time.Minute))
+
+		alerts, err := m.Evaluate(now)
+		So(err, ShouldBeNil)
+		So(alerts, ShouldHaveLength, 1)
+		So(alerts[0].DeviceId, ShouldEqual, "dev1")
+		So(alerts[0].State, ShouldEqual, MonitorAlerting)
+
+		alerts, _ = m.Evaluate(now)
+		So(alerts, ShouldHaveLength, 0)
+
+		RecordActivity(ch.Id, "dev1", map[string]string{"tag1": "a"}, now)
+		alerts, _ = m.Evaluate(now)
+		So(alerts, ShouldHaveLength, 1)
+		So(alerts[0].State, ShouldEqual, MonitorResolved)
+
+		m.Delete()
+	})
+
+	Convey("sweeps alerts older than the retention", t, func() {
+		old := &Alert{ChannelId: ch.Id, State: MonitorAlerting, Created: NanoToMilli(time.Now().Add(-2 * time.Hour).UnixNano())}
+		DB.Create(old)
+		recent := &Alert{ChannelId: ch.Id, State: MonitorAlerting, Created: NanoToMilli(time.Now().UnixNano())}
+		DB.Create(recent)
+
+		SweepAlerts()
+		alerts := ChannelAlerts(ch.Id, 0, "", 100)
+		for _, a := range alerts {
+			So(a.Id, ShouldNotEqual, old.Id)
+		}
+		So(alerts[0].Id, ShouldEqual, recent.Id)
+	})
+
+	Convey("deletes monitors and alerts with the channel", t, func() {
+		m := &Monitor{ChannelId: ch.Id, Name: "silent", Kind: MonitorAbsence, Window: "10m"}
+		m.Create()
+
+		err := ch.Delete()
+		So(err, ShouldBeNil)
+
+		var count int
+		DB.Model(&Monitor{}).Count(&count)
+		So(count, ShouldEqual, 0)
+		DB.Model(&Alert{}).Count(&count)
+		So(count, ShouldEqual, 0)
+	})
+}
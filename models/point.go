@@ -1,6 +1,7 @@
 package models
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	. "github.com/eywa/utils"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,9 +19,10 @@ var IndexTypeMessages = "messages"
 var IndexTypeActivities = "activities"
 
 type Point struct {
-	ch   *Channel
-	conn Connection
-	msg  Message
+	ch      *Channel
+	conn    Connection
+	msg     Message
+	payload []byte
 
 	Id        string
 	Timestamp time.Time
@@ -63,7 +66,7 @@ func (p *Point) MarshalJSON() ([]byte, error) {
 
 func (p *Point) parseJson() error {
 	jsonValues := make(map[string]json.RawMessage)
-	err := json.Unmarshal(p.msg.Payload(), &jsonValues)
+	err := json.Unmarshal(p.payload, &jsonValues)
 	if err != nil {
 		return jsonParsingErr
 	}
@@ -126,7 +129,7 @@ func (p *Point) parseJson() error {
 }
 
 func (p *Point) parseUrl() error {
-	urlValues, err := url.ParseQuery(string(p.msg.Payload()))
+	urlValues, err := url.ParseQuery(string(p.payload))
 	if err != nil {
 		return urlParsingErr
 	}
@@ -199,15 +202,24 @@ func (p *Point) IndexType() string {
 }
 
 func NewPoint(id string, ch *Channel, conn Connection, m Message) (*Point, error) {
+	payload, encoded, err := decodePayload(m)
+	if err != nil {
+		return nil, err
+	}
+	return newPoint(id, ch, conn, m, payload, encoded)
+}
+
+func newPoint(id string, ch *Channel, conn Connection, m Message, payload []byte, encoded bool) (*Point, error) {
 	p := &Point{
-		ch:   ch,
-		conn: conn,
-		msg:  m,
-		Id:   id,
+		ch:      ch,
+		conn:    conn,
+		msg:     m,
+		payload: payload,
+		Id:      id,
 	}
 
 	err := p.parseJson()
-	if err != nil && err == jsonParsingErr {
+	if err != nil && err == jsonParsingErr && !encoded {
 		err = p.parseUrl()
 	}
 	if err != nil {
@@ -218,7 +230,160 @@ func NewPoint(id string, ch *Channel, conn Connection, m Message) (*Point, error
 	return p, nil
 }
 
+// Payloads in a binary encoding are turned into JSON, so that they are
+// parsed into the same tags and fields as the text payloads.
+func decodePayload(m Message) ([]byte, bool, error) {
+	em, ok := m.(EncodedMessage)
+	if !ok || len(em.Encoding()) == 0 {
+		return m.Payload(), false, nil
+	}
+
+	var v interface{}
+	var err error
+	switch em.Encoding() {
+	case EncodingCbor:
+		v, err = CborUnmarshal(m.Payload())
+	case EncodingMsgpack:
+		v, err = MsgpackUnmarshal(m.Payload())
+	default:
+		return nil, true, errors.New("unsupported payload encoding: " + em.Encoding())
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	js, err := json.Marshal(v)
+	return js, true, err
+}
+
+type PointError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// PointsErr lists the entries of a batch that could not be parsed, the
+// other entries of the batch are still good to index.
+type PointsErr struct {
+	Total  int
+	Errors []*PointError
+}
+
+func (e *PointsErr) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, pe := range e.Errors {
+		msgs[i] = fmt.Sprintf("#%d: %s", pe.Index, pe.Error)
+	}
+	return fmt.Sprintf("%d of %d points are invalid: %s", len(e.Errors), e.Total, strings.Join(msgs, ", "))
+}
+
+// Splits a batch payload, either a JSON array or newline-delimited JSON
+// objects, into its entries. Anything else is a single point and nil is
+// returned.
+func splitBatch(payload []byte) [][]byte {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return nil
+	}
+
+	if trimmed[0] == '[' {
+		var raws []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil
+		}
+		entries := make([][]byte, len(raws))
+		for i, raw := range raws {
+			entries[i] = []byte(raw)
+		}
+		return entries
+	}
+
+	// a single object may as well be spread over several lines
+	if trimmed[0] != '{' || !bytes.Contains(trimmed, []byte("\n")) || json.Valid(trimmed) {
+		return nil
+	}
+
+	entries := [][]byte{}
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			entries = append(entries, line)
+		}
+	}
+	if len(entries) < 2 {
+		return nil
+	}
+	return entries
+}
+
+func IsBatch(payload []byte) bool {
+	return splitBatch(payload) != nil
+}
+
+// NewPoints parses an upload into points. Entries of a batch are parsed
+// separately and carry their own timestamps, their ids are suffixed with the
+// index in the batch. When some entries are invalid, the valid points are
+// returned along with a *PointsErr. A single point payload is parsed as
+// NewPoint does.
+func NewPoints(id string, ch *Channel, conn Connection, m Message) ([]*Point, error) {
+	payload, encoded, err := decodePayload(m)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := splitBatch(payload)
+	if entries == nil {
+		p, err := newPoint(id, ch, conn, m, payload, encoded)
+		if err != nil {
+			return nil, err
+		}
+		return []*Point{p}, nil
+	}
+
+	points := make([]*Point, 0, len(entries))
+	errs := []*PointError{}
+	for i, entry := range entries {
+		p := &Point{
+			ch:      ch,
+			conn:    conn,
+			msg:     m,
+			payload: entry,
+			Id:      fmt.Sprintf("%s-%d", id, i),
+		}
+
+		if err := p.parseJson(); err != nil {
+			errs = append(errs, &PointError{Index: i, Error: err.Error()})
+			continue
+		}
+
+		p.Metadata(conn.Metadata())
+		points = append(points, p)
+	}
+
+	if len(errs) > 0 {
+		return points, &PointsErr{Total: len(entries), Errors: errs}
+	}
+	return points, nil
+}
+
 func TimedIndexName(ch *Channel, ts time.Time) string {
 	year, week := ts.ISOWeek()
 	return fmt.Sprintf("channels.%d.%d-%d", ch.Id, year, week)
 }
+
+// Names of the weekly indices covering a time range.
+func TimedIndexNames(ch *Channel, tStart, tEnd time.Time) []string {
+	indices := []string{}
+	oneWeek := 7 * 24 * time.Hour
+	t := tStart
+	for {
+		indices = append(indices, TimedIndexName(ch, t))
+
+		y, w := t.ISOWeek()
+		ey, ew := tEnd.ISOWeek()
+		if y > ey || (y == ey && w >= ew) {
+			break
+		} else {
+			t = t.Add(oneWeek)
+		}
+	}
+	return indices
+}
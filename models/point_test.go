@@ -0,0 +1,112 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/connections"
+	. "github.com/eywa/utils"
+	"testing"
+	"time"
+)
+
+type fakeConn struct {
+	Connection
+	meta map[string]string
+}
+
+func (c *fakeConn) Metadata() map[string]string { return c.meta }
+
+type fakeMessage struct {
+	Message
+	payload  []byte
+	encoding string
+}
+
+func (m *fakeMessage) Payload() []byte  { return m.payload }
+func (m *fakeMessage) Encoding() string { return m.encoding }
+
+func TestPoints(t *testing.T) {
+	ch := &Channel{
+		Tags:   []string{"tag1"},
+		Fields: map[string]string{"field1": "int", "field2": "boolean"},
+	}
+	conn := &fakeConn{meta: map[string]string{"tag1": "meta"}}
+
+	Convey("parses single object and url encoded payloads as one point.", t, func() {
+		ps, err := NewPoints("id", ch, conn, &fakeMessage{payload: []byte(`{"tag1":"a","field1":1}`)})
+		So(err, ShouldBeNil)
+		So(len(ps), ShouldEqual, 1)
+		So(ps[0].Id, ShouldEqual, "id")
+		So(ps[0].Tags["tag1"], ShouldEqual, "a")
+		So(ps[0].Fields["field1"], ShouldEqual, 1)
+
+		ps, err = NewPoints("id", ch, conn, &fakeMessage{payload: []byte("{\n  \"field1\": 2\n}")})
+		So(err, ShouldBeNil)
+		So(len(ps), ShouldEqual, 1)
+		So(ps[0].Tags["tag1"], ShouldEqual, "meta")
+
+		ps, err = NewPoints("id", ch, conn, &fakeMessage{payload: []byte("field1=3&field2=true")})
+		So(err, ShouldBeNil)
+		So(len(ps), ShouldEqual, 1)
+		So(ps[0].Fields["field2"], ShouldEqual, true)
+		So(IsBatch([]byte("field1=3")), ShouldBeFalse)
+	})
+
+	Convey("parses every entry of a json array with its own timestamp.", t, func() {
+		payload := []byte(`[{"timestamp":1000,"field1":1},{"timestamp":2000,"field1":2}]`)
+		So(IsBatch(payload), ShouldBeTrue)
+
+		ps, err := NewPoints("id", ch, conn, &fakeMessage{payload: payload})
+		So(err, ShouldBeNil)
+		So(len(ps), ShouldEqual, 2)
+		So(ps[0].Id, ShouldEqual, "id-0")
+		So(ps[1].Id, ShouldEqual, "id-1")
+		So(ps[0].Timestamp, ShouldResemble, time.Unix(1, 0))
+		So(ps[1].Timestamp, ShouldResemble, time.Unix(2, 0))
+		So(ps[1].Fields["field1"], ShouldEqual, 2)
+		So(ps[1].Tags["tag1"], ShouldEqual, "meta")
+	})
+
+	Convey("reports the invalid entries of newline-delimited json.", t, func() {
+		payload := []byte("{\"field1\":1}\n\n{\"field1\":\"x\"}\nnot json\n{\"field2\":false}\n")
+		So(IsBatch(payload), ShouldBeTrue)
+
+		ps, err := NewPoints("id", ch, conn, &fakeMessage{payload: payload})
+		So(len(ps), ShouldEqual, 2)
+		So(ps[0].Id, ShouldEqual, "id-0")
+		So(ps[1].Id, ShouldEqual, "id-3")
+		So(ps[1].Fields["field2"], ShouldEqual, false)
+
+		pErr, ok := err.(*PointsErr)
+		So(ok, ShouldBeTrue)
+		So(pErr.Total, ShouldEqual, 4)
+		So(len(pErr.Errors), ShouldEqual, 2)
+		So(pErr.Errors[0].Index, ShouldEqual, 1)
+		So(pErr.Errors[1].Index, ShouldEqual, 2)
+	})
+
+	Convey("decodes cbor and msgpack payloads into the same tags and fields.", t, func() {
+		v := map[string]interface{}{"timestamp": 1000, "tag1": "a", "field1": 7, "field2": true}
+		cbor, _ := CborMarshal(v)
+		msgpack, _ := MsgpackMarshal(v)
+
+		for encoding, payload := range map[string][]byte{EncodingCbor: cbor, EncodingMsgpack: msgpack} {
+			ps, err := NewPoints("id", ch, conn, &fakeMessage{payload: payload, encoding: encoding})
+			So(err, ShouldBeNil)
+			So(len(ps), ShouldEqual, 1)
+			So(ps[0].Timestamp, ShouldResemble, time.Unix(1, 0))
+			So(ps[0].Tags["tag1"], ShouldEqual, "a")
+			So(ps[0].Fields["field1"], ShouldEqual, 7)
+			So(ps[0].Fields["field2"], ShouldEqual, true)
+		}
+
+		batch, _ := CborMarshal([]interface{}{v, map[string]interface{}{"field1": "x"}})
+		ps, err := NewPoints("id", ch, conn, &fakeMessage{payload: batch, encoding: EncodingCbor})
+		So(len(ps), ShouldEqual, 1)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewPoint("id", ch, conn, &fakeMessage{payload: []byte{0x01}, encoding: EncodingMsgpack})
+		So(err, ShouldNotBeNil)
+		_, err = NewPoint("id", ch, conn, &fakeMessage{payload: []byte("field1=1"), encoding: EncodingCbor})
+		So(err, ShouldNotBeNil)
+	})
+}
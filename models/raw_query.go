@@ -3,11 +3,7 @@ package models
 import (
 	"errors"
 	"fmt"
-	"gopkg.in/olivere/elastic.v3"
-	. "github.com/eywa/configs"
 	. "github.com/eywa/utils"
-	"io/ioutil"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -85,87 +81,18 @@ func (q *RawQuery) Parse(params map[string]string) error {
 	return nil
 }
 
-func (q *RawQuery) QueryES() (interface{}, error) {
-	res := map[string]interface{}{}
-
-	indexName := TimedIndices(q.Channel, q.TimeStart, q.TimeEnd)
-	if len(indexName) == 0 {
-		res["size"] = "0b"
-		return res, nil
-	}
-
-	boolQ := elastic.NewBoolQuery()
-
-	termQs := make([]elastic.Query, 0)
-	for tagN, tagV := range q.Tags {
-		termQs = append(termQs, elastic.NewTermQuery(tagN, tagV))
-	}
-	boolQ.Must(termQs...)
-
-	rangeQ := elastic.NewRangeQuery("timestamp").
-		From(NanoToMilli(q.TimeStart.UnixNano())).
-		To(NanoToMilli(q.TimeEnd.UnixNano()))
-	boolQ.Must(rangeQ)
-
-	if q.Nop {
-		filterAgg := elastic.NewFilterAggregation()
-		filterAgg.Filter(boolQ).SubAggregation("bytes", elastic.NewSumAggregation().Field("_size"))
-		resp, err := IndexClient.Search().
-			SearchType("count").
-			Index(indexName).
-			Type(IndexTypeMessages).
-			Aggregation("name", filterAgg).
-			Do()
-
-		if err != nil {
-			return nil, err
-		}
-
-		aggs, success := resp.Aggregations.Filter("name")
-		if !success {
-			return nil, errors.New("error query raw data")
-		}
-		sum, success := aggs.Sum("bytes")
-		if !success {
-			return nil, errors.New("error query raw data")
-		}
-
-		bytes := int64(*sum.Value)
-		if bytes < 1024 {
-			res["size"] = fmt.Sprintf("%db", bytes)
-		} else if bytes < 1024*1024 {
-			res["size"] = fmt.Sprintf("%dkb", bytes/1024)
-		} else if bytes < 1024*1024*1024 {
-			res["size"] = fmt.Sprintf("%dmb", bytes/1024/1024)
-		} else {
-			res["size"] = fmt.Sprintf("%dgb", bytes/1024/1024/1024)
-		}
-
-		return res, nil
+func (q *RawQuery) Query() (interface{}, error) {
+	return DataStore.QueryRaw(q)
+}
 
+func formatRawSize(bytes int64) string {
+	if bytes < 1024 {
+		return fmt.Sprintf("%db", bytes)
+	} else if bytes < 1024*1024 {
+		return fmt.Sprintf("%dkb", bytes/1024)
+	} else if bytes < 1024*1024*1024 {
+		return fmt.Sprintf("%dmb", bytes/1024/1024)
 	} else {
-		tmpFile, err := ioutil.TempFile(os.TempDir(), fmt.Sprintf("%s.raw", q.Channel.Name))
-		if err != nil {
-			return nil, err
-		}
-
-		size := ScrollSize / Config().Indices.NumberOfShards
-		resp, err := IndexClient.Scroll().KeepAlive(KeepAlive).Index(indexName).Type(IndexTypeMessages).Query(boolQ).Size(size).Do()
-		for err == nil {
-			resp, err = IndexClient.Scroll().KeepAlive(KeepAlive).ScrollId(resp.ScrollId).GetNextPage()
-			if err == nil {
-				for _, hit := range resp.Hits.Hits {
-					tmpFile.Write([]byte(*hit.Source))
-					tmpFile.WriteString("\n")
-				}
-			}
-		}
-
-		if err != nil && err != elastic.EOS {
-			return nil, err
-		}
-
-		res["file"] = tmpFile.Name()
-		return res, nil
+		return fmt.Sprintf("%dgb", bytes/1024/1024/1024)
 	}
 }
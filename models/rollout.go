@@ -0,0 +1,446 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	. "github.com/eywa/loggers"
+	. "github.com/eywa/utils"
+	"hash/fnv"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	RolloutRunning = "running"
+	RolloutPaused  = "paused"
+	// stopped because too many devices failed to update
+	RolloutHalted  = "halted"
+	RolloutAborted = "aborted"
+)
+
+var SupportedRolloutStatuses = []string{RolloutRunning, RolloutPaused, RolloutHalted, RolloutAborted}
+
+const (
+	RolloutDeviceAnnounced   = "announced"
+	RolloutDeviceDownloading = "downloading"
+	RolloutDeviceUpdated     = "updated"
+	RolloutDeviceFailed      = "failed"
+)
+
+var SupportedRolloutDeviceStatuses = []string{RolloutDeviceAnnounced, RolloutDeviceDownloading, RolloutDeviceUpdated, RolloutDeviceFailed}
+
+// Devices report the version they run and the failures of their updates in
+// these fields of upload messages.
+var FirmwareVersionField = "firmware_version"
+var FirmwareErrorField = "firmware_error"
+
+func init() {
+	deleteWithChannel(&RolloutDevice{})
+	deleteWithChannel(&Rollout{})
+	requireMessageHandler("firmware", "active rollout", &Rollout{}, "status <> ?", RolloutAborted)
+}
+
+// Rollout is a campaign updating the devices of a channel to a firmware. It
+// targets the devices whose connection metadata match the filter, and of
+// those a stable percentage picked by device id.
+type Rollout struct {
+	Id               int            `sql:"type:integer primary key autoincrement" json:"id"`
+	ChannelId        int            `sql:"type:integer;index" json:"-"`
+	FirmwareId       int            `sql:"type:integer" json:"firmware_id"`
+	Percentage       int            `sql:"type:integer" json:"percentage"`
+	Filter           StringMap      `sql:"type:text" json:"filter"`
+	FailureThreshold float64        `sql:"type:real" json:"failure_threshold"`
+	Status           string         `sql:"type:varchar(32)" json:"status"`
+	Reason           string         `sql:"type:text" json:"reason,omitempty"`
+	Counts           map[string]int `sql:"-" json:"counts,omitempty"`
+	Created          int64          `sql:"type:integer" json:"created"`
+	Modified         int64          `sql:"type:integer" json:"modified"`
+}
+
+// RolloutDevice is the progress of a device in a rollout.
+type RolloutDevice struct {
+	Id        int    `sql:"type:integer primary key autoincrement" json:"-"`
+	ChannelId int    `sql:"type:integer;index" json:"-"`
+	RolloutId int    `sql:"type:integer;index" json:"-"`
+	DeviceId  string `sql:"type:varchar(255);index" json:"device_id"`
+	Status    string `sql:"type:varchar(32)" json:"status"`
+	Version   string `sql:"type:varchar(255)" json:"version,omitempty"`
+	Error     string `sql:"type:text" json:"error,omitempty"`
+	Created   int64  `sql:"type:integer" json:"created"`
+	Modified  int64  `sql:"type:integer" json:"modified"`
+}
+
+// serializes the progress updates of a device in a rollout
+var rolloutLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+
+func (r *Rollout) BeforeSave() error {
+	if r.Percentage == 0 {
+		r.Percentage = 100
+	}
+	if r.Percentage < 0 || r.Percentage > 100 {
+		return errors.New("invalid percentage, it has to be between 1 and 100")
+	}
+
+	if r.FailureThreshold < 0 || r.FailureThreshold > 100 {
+		return errors.New("invalid failure_threshold, it has to be between 0 and 100")
+	}
+
+	if len(r.Status) == 0 {
+		r.Status = RolloutRunning
+	}
+	if !StringSliceContains(SupportedRolloutStatuses, r.Status) {
+		return errors.New(fmt.Sprintf("unsupported status: %s, supported statuses are %s", r.Status, strings.Join(SupportedRolloutStatuses, ",")))
+	}
+
+	if r.Filter == nil {
+		r.Filter = StringMap(make(map[string]string, 0))
+	}
+
+	ch := &Channel{}
+	if found := ch.FindById(r.ChannelId); !found {
+		return errors.New("channel not found")
+	}
+
+	if r.Status != RolloutAborted && !ch.RunsMessageHandler("firmware") {
+		return errors.New("channel doesn't run the firmware message handler")
+	}
+
+	f := &Firmware{}
+	if found := f.FindById(r.FirmwareId); !found || f.ChannelId != r.ChannelId {
+		return errors.New("firmware not found")
+	}
+
+	if r.Status != RolloutAborted {
+		existing := &Rollout{}
+		DB.Where("channel_id = ? AND status <> ?", r.ChannelId, RolloutAborted).First(existing)
+		if !DB.NewRecord(existing) && existing.Id != r.Id {
+			return errors.New(fmt.Sprintf("channel already has an active rollout: %d", existing.Id))
+		}
+	}
+
+	return nil
+}
+
+func (r *Rollout) AfterSave() error {
+	Cache.Delete(activeRolloutCacheKey(r.ChannelId))
+	return nil
+}
+
+func (r *Rollout) Create() error {
+	return DB.Create(r).Error
+}
+
+func (r *Rollout) FindById(id int) bool {
+	DB.First(r, id)
+	return !DB.NewRecord(r)
+}
+
+func (r *Rollout) Pause() error {
+	return r.transition(RolloutPaused, "", RolloutRunning)
+}
+
+func (r *Rollout) Resume() error {
+	return r.transition(RolloutRunning, "", RolloutPaused, RolloutHalted)
+}
+
+func (r *Rollout) Abort() error {
+	return r.transition(RolloutAborted, "", RolloutRunning, RolloutPaused, RolloutHalted)
+}
+
+// Changes the status only when the rollout is still in one of the from
+// statuses, so that concurrent changes don't overwrite each other.
+func (r *Rollout) transition(to string, reason string, from ...string) error {
+	ts := NanoToMilli(time.Now().UTC().UnixNano())
+	res := DB.Model(&Rollout{}).Where("id = ? AND status IN (?)", r.Id, from).
+		UpdateColumns(map[string]interface{}{"status": to, "reason": reason, "modified": ts})
+	if res.Error != nil {
+		return res.Error
+	}
+	Cache.Delete(activeRolloutCacheKey(r.ChannelId))
+
+	r.FindById(r.Id)
+	if res.RowsAffected == 0 {
+		return errors.New(fmt.Sprintf("rollout is %s, it can't become %s", r.Status, to))
+	}
+	return nil
+}
+
+// Whether the rollout targets a device connected with the metadata.
+func (r *Rollout) Targets(deviceId string, meta map[string]string) bool {
+	for k, v := range r.Filter {
+		if meta[k] != v {
+			return false
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(fmt.Sprintf("%d/%s", r.Id, deviceId)))
+	return int(h.Sum32()%100) < r.Percentage
+}
+
+// Sends the firmware to a device unless it is already done with it. Returns
+// true when the announcement is sent.
+func (r *Rollout) Announce(deviceId string, send func([]byte) error) bool {
+	if r.Status != RolloutRunning {
+		return false
+	}
+
+	lockKey := rolloutLockKey(r.Id, deviceId)
+	rolloutLocks.Lock(lockKey)
+	defer rolloutLocks.Unlock(lockKey)
+
+	d, found := findRolloutDevice(r.Id, deviceId)
+	if found && (d.Status == RolloutDeviceUpdated || d.Status == RolloutDeviceFailed) {
+		return false
+	}
+
+	msg, err := r.announcement(deviceId)
+	if err != nil {
+		Logger.Error(fmt.Sprintf("failed to announce rollout %d: %s", r.Id, err.Error()))
+		return false
+	}
+	if err = send(msg); err != nil {
+		return false
+	}
+
+	if !found {
+		d = &RolloutDevice{ChannelId: r.ChannelId, RolloutId: r.Id, DeviceId: deviceId, Status: RolloutDeviceAnnounced}
+	}
+	if err = d.save(); err != nil {
+		Logger.Error(fmt.Sprintf("failed to update progress of device %s in rollout %d: %s", deviceId, r.Id, err.Error()))
+	}
+	return true
+}
+
+func (r *Rollout) announcement(deviceId string) ([]byte, error) {
+	f := &Firmware{}
+	if found := f.FindById(r.FirmwareId); !found {
+		return nil, errors.New("firmware not found")
+	}
+
+	ch := &Channel{Id: r.ChannelId}
+	hashId, err := ch.HashId()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"firmware": map[string]interface{}{
+			"rollout_id": r.Id,
+			"version":    f.Version,
+			"size":       f.Size,
+			"checksum":   f.Checksum,
+			"url":        fmt.Sprintf("/channels/%s/devices/%s/firmwares/%d", hashId, url.QueryEscape(deviceId), f.Id),
+		},
+	})
+}
+
+// Number of devices in each status.
+func (r *Rollout) CountDevices() map[string]int {
+	counts := make(map[string]int)
+	for _, s := range SupportedRolloutDeviceStatuses {
+		var n int
+		DB.Model(&RolloutDevice{}).Where("rollout_id = ? AND status = ?", r.Id, s).Count(&n)
+		counts[s] = n
+	}
+	return counts
+}
+
+// Progress of the devices, optionally filtered by status.
+func (r *Rollout) Devices(status string) []*RolloutDevice {
+	devices := []*RolloutDevice{}
+	q := DB.Where("rollout_id = ?", r.Id)
+	if len(status) > 0 {
+		q = q.Where("status = ?", status)
+	}
+	q.Order("device_id asc").Find(&devices)
+	return devices
+}
+
+// Halts the rollout when too many of the devices that are done with it
+// failed.
+func (r *Rollout) checkFailureRate() {
+	if r.FailureThreshold <= 0 || r.Status != RolloutRunning {
+		return
+	}
+
+	counts := r.CountDevices()
+	finished := counts[RolloutDeviceUpdated] + counts[RolloutDeviceFailed]
+	if finished == 0 || finished < Config().Firmware.HaltMinDevices {
+		return
+	}
+
+	rate := float64(counts[RolloutDeviceFailed]) * 100 / float64(finished)
+	if rate > r.FailureThreshold {
+		reason := fmt.Sprintf("failure rate %.1f%% crossed the threshold %.1f%%", rate, r.FailureThreshold)
+		// r may be the cached instance, which must not change under its readers
+		halted := &Rollout{Id: r.Id, ChannelId: r.ChannelId}
+		halted.transition(RolloutHalted, reason, RolloutRunning)
+	}
+}
+
+func (d *RolloutDevice) save() error {
+	d.Modified = NanoToMilli(time.Now().UTC().UnixNano())
+	if DB.NewRecord(d) {
+		d.Created = d.Modified
+		return DB.Create(d).Error
+	}
+	return DB.Save(d).Error
+}
+
+func findRolloutDevice(rolloutId int, deviceId string) (*RolloutDevice, bool) {
+	d := &RolloutDevice{}
+	DB.Where("rollout_id = ? AND device_id = ?", rolloutId, deviceId).First(d)
+	if DB.NewRecord(d) {
+		return nil, false
+	}
+	return d, true
+}
+
+func ChannelRollouts(channelId int) []*Rollout {
+	rollouts := []*Rollout{}
+	DB.Where("channel_id = ?", channelId).Order("id asc").Find(&rollouts)
+	return rollouts
+}
+
+// The rollout of a channel that is not aborted yet, if there is one.
+func FetchCachedActiveRollout(channelId int) (*Rollout, bool) {
+	rollouts, err := Cache.Fetch(activeRolloutCacheKey(channelId), 1*time.Minute, func() (interface{}, error) {
+		rollouts := []*Rollout{}
+		DB.Where("channel_id = ? AND status <> ?", channelId, RolloutAborted).Limit(1).Find(&rollouts)
+		return rollouts, nil
+	})
+
+	if err != nil || len(rollouts.([]*Rollout)) == 0 {
+		return nil, false
+	}
+	return rollouts.([]*Rollout)[0], true
+}
+
+// Records that a device started downloading the firmware of a rollout.
+func FirmwareDownloading(channelId, firmwareId int, deviceId string) {
+	r, found := FetchCachedActiveRollout(channelId)
+	if !found || r.FirmwareId != firmwareId {
+		return
+	}
+
+	lockKey := rolloutLockKey(r.Id, deviceId)
+	rolloutLocks.Lock(lockKey)
+	defer rolloutLocks.Unlock(lockKey)
+
+	if d, found := findRolloutDevice(r.Id, deviceId); found && d.Status == RolloutDeviceAnnounced {
+		d.Status = RolloutDeviceDownloading
+		if err := d.save(); err != nil {
+			Logger.Error(fmt.Sprintf("failed to update progress of device %s in rollout %d: %s", deviceId, r.Id, err.Error()))
+		}
+	}
+}
+
+// Updates the progress of a device in the active rollout of its channel with
+// the version or the failure it reported. Devices that report the version of
+// the rollout count as updated even if they weren't announced to.
+func ReportFirmware(channelId int, deviceId, version, failure string) error {
+	r, found := FetchCachedActiveRollout(channelId)
+	if !found {
+		return nil
+	}
+
+	f := &Firmware{}
+	if found = f.FindById(r.FirmwareId); !found {
+		return nil
+	}
+
+	lockKey := rolloutLockKey(r.Id, deviceId)
+	rolloutLocks.Lock(lockKey)
+
+	d, found := findRolloutDevice(r.Id, deviceId)
+	if !found {
+		if version != f.Version {
+			rolloutLocks.Unlock(lockKey)
+			return nil
+		}
+		d = &RolloutDevice{ChannelId: channelId, RolloutId: r.Id, DeviceId: deviceId}
+	}
+
+	status := d.Status
+	if len(failure) > 0 {
+		status = RolloutDeviceFailed
+	} else if version == f.Version {
+		status = RolloutDeviceUpdated
+	}
+
+	var err error
+	if status != d.Status || (len(version) > 0 && version != d.Version) {
+		d.Status = status
+		if len(version) > 0 {
+			d.Version = version
+		}
+		if status == RolloutDeviceFailed {
+			d.Error = failure
+		} else {
+			d.Error = ""
+		}
+		err = d.save()
+	}
+	rolloutLocks.Unlock(lockKey)
+
+	if err == nil && status == RolloutDeviceFailed {
+		r.checkFailureRate()
+	}
+	return err
+}
+
+// The firmware version and update failure a device reported in an upload, in
+// any of the payload formats points are parsed from. The last entry of a
+// batch wins.
+func FirmwareReport(m Message) (version string, failure string, found bool) {
+	payload, encoded, err := decodePayload(m)
+	if err != nil {
+		return "", "", false
+	}
+
+	entries := splitBatch(payload)
+	if entries == nil {
+		entries = [][]byte{payload}
+	}
+
+	for _, entry := range entries {
+		values := make(map[string]interface{})
+		if err := json.Unmarshal(entry, &values); err != nil {
+			if encoded {
+				continue
+			}
+			query, err := url.ParseQuery(string(entry))
+			if err != nil {
+				continue
+			}
+			for _, k := range []string{FirmwareVersionField, FirmwareErrorField} {
+				if v := query.Get(k); len(v) > 0 {
+					values[k] = v
+				}
+			}
+		}
+
+		if v, ok := values[FirmwareVersionField].(string); ok && len(v) > 0 {
+			version = v
+			found = true
+		}
+		if v, ok := values[FirmwareErrorField].(string); ok && len(v) > 0 {
+			failure = v
+			found = true
+		}
+	}
+	return
+}
+
+func activeRolloutCacheKey(channelId int) string {
+	return fmt.Sprintf("cache.active_rollout:%d", channelId)
+}
+
+func rolloutLockKey(rolloutId int, deviceId string) string {
+	return fmt.Sprintf("%d/%s", rolloutId, deviceId)
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/connections"
+	. "github.com/eywa/utils"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRollout(t *testing.T) {
+	pwd, _ := os.Getwd()
+	firmwareDir := path.Join(pwd, "firmware_test")
+	dbFile := setupTestDB(&Conf{
+		Firmware: &FirmwareConf{
+			Dir:            firmwareDir,
+			MaxSize:        16,
+			HaltMinDevices: 2,
+		},
+	})
+	defer teardownTestDB(dbFile)
+	defer os.RemoveAll(firmwareDir)
+
+	ch := &Channel{
+		Name:            "test",
+		Description:     "desc",
+		Tags:            []string{"tag1", "tag2"},
+		Fields:          map[string]string{"field1": "int"},
+		AccessTokens:    []string{"token1"},
+		ConnectionLimit: 5,
+		MessageRate:     1000,
+	}
+	ch.Create()
+
+	f := &Firmware{ChannelId: ch.Id, Version: "2.0.0"}
+	StoreFirmware(f, bytes.NewReader([]byte("firmware")), "")
+
+	Convey("validates rollouts before saving", t, func() {
+		r := &Rollout{ChannelId: ch.Id, FirmwareId: f.Id + 1}
+		err := r.Create()
+		So(err.Error(), ShouldContainSubstring, "firmware not found")
+
+		r.FirmwareId = f.Id
+		r.Percentage = 101
+		err = r.Create()
+		So(err.Error(), ShouldContainSubstring, "invalid percentage")
+
+		r.Percentage = 0
+		r.FailureThreshold = -1
+		err = r.Create()
+		So(err.Error(), ShouldContainSubstring, "invalid failure_threshold")
+
+		r.FailureThreshold = 0
+		So(r.Create(), ShouldBeNil)
+		So(r.Percentage, ShouldEqual, 100)
+		So(r.Status, ShouldEqual, RolloutRunning)
+
+		other := &Rollout{ChannelId: ch.Id, FirmwareId: f.Id}
+		err = other.Create()
+		So(err.Error(), ShouldContainSubstring, "channel already has an active rollout")
+
+		So(f.Delete().Error(), ShouldContainSubstring, "firmware is used by an active rollout")
+		So(r.Abort(), ShouldBeNil)
+		So(other.Create(), ShouldBeNil)
+		other.Abort()
+	})
+
+	Convey("targets devices by metadata and a stable percentage", t, func() {
+		r := &Rollout{Id: 1, Percentage: 100, Filter: StringMap{"model": "a"}}
+		So(r.Targets("dev", map[string]string{"model": "a", "ip": "127.0.0.1"}), ShouldBeTrue)
+		So(r.Targets("dev", map[string]string{"model": "b"}), ShouldBeFalse)
+		So(r.Targets("dev", map[string]string{}), ShouldBeFalse)
+
+		r = &Rollout{Id: 1, Percentage: 30}
+		targeted := 0
+		for i := 0; i < 1000; i++ {
+			id := fmt.Sprintf("dev%d", i)
+			if r.Targets(id, nil) {
+				targeted += 1
+			}
+			So(r.Targets(id, nil), ShouldEqual, r.Targets(id, nil))
+		}
+		So(targeted, ShouldBeBetween, 250, 350)
+	})
+
+	Convey("tracks the progress of devices and halts on failures", t, func() {
+		r := &Rollout{ChannelId: ch.Id, FirmwareId: f.Id, FailureThreshold: 40}
+		So(r.Create(), ShouldBeNil)
+		r, _ = FetchCachedActiveRollout(ch.Id)
+
+		var sent []byte
+		send := func(msg []byte) error {
+			sent = msg
+			return nil
+		}
+		So(r.Announce("dev1", send), ShouldBeTrue)
+		announcement := map[string]map[string]interface{}{}
+		json.Unmarshal(sent, &announcement)
+		So(announcement["firmware"]["version"], ShouldEqual, "2.0.0")
+		So(announcement["firmware"]["checksum"], ShouldEqual, f.Checksum)
+		hashId, _ := ch.HashId()
+		So(announcement["firmware"]["url"], ShouldEqual, fmt.Sprintf("/channels/%s/devices/dev1/firmwares/%d", hashId, f.Id))
+
+		FirmwareDownloading(ch.Id, f.Id, "dev1")
+		So(r.Devices(RolloutDeviceDownloading)[0].DeviceId, ShouldEqual, "dev1")
+
+		So(ReportFirmware(ch.Id, "dev1", "2.0.0", ""), ShouldBeNil)
+		So(r.CountDevices()[RolloutDeviceUpdated], ShouldEqual, 1)
+		So(r.Announce("dev1", send), ShouldBeFalse)
+
+		// a device reporting an older version before it was announced to is
+		// not part of the rollout yet
+		So(ReportFirmware(ch.Id, "dev2", "1.0.0", ""), ShouldBeNil)
+		So(len(r.Devices("")), ShouldEqual, 1)
+
+		r.Announce("dev2", send)
+		So(ReportFirmware(ch.Id, "dev2", "1.0.0", "checksum mismatch"), ShouldBeNil)
+		d, _ := findRolloutDevice(r.Id, "dev2")
+		So(d.Status, ShouldEqual, RolloutDeviceFailed)
+		So(d.Error, ShouldEqual, "checksum mismatch")
+
+		halted := &Rollout{}
+		halted.FindById(r.Id)
+		So(halted.Status, ShouldEqual, RolloutHalted)
+		So(halted.Reason, ShouldContainSubstring, "failure rate 50.0% crossed the threshold 40.0%")
+		r, _ = FetchCachedActiveRollout(ch.Id)
+		So(r.Announce("dev3", send), ShouldBeFalse)
+
+		So(r.Pause().Error(), ShouldContainSubstring, "rollout is halted, it can't become paused")
+		So(r.Resume(), ShouldBeNil)
+		So(r.Status, ShouldEqual, RolloutRunning)
+		So(r.Reason, ShouldBeEmpty)
+		So(r.Pause(), ShouldBeNil)
+		So(r.Abort(), ShouldBeNil)
+		_, found := FetchCachedActiveRollout(ch.Id)
+		So(found, ShouldBeFalse)
+	})
+
+	Convey("reads reported versions and failures from uploads", t, func() {
+		version, failure, found := FirmwareReport(&fakeMessage{payload: []byte(`{"firmware_version":"2.0.0","field1":1}`)})
+		So(found, ShouldBeTrue)
+		So(version, ShouldEqual, "2.0.0")
+		So(failure, ShouldBeEmpty)
+
+		version, failure, found = FirmwareReport(&fakeMessage{payload: []byte("firmware_version=1.0.0&firmware_error=flash+failed")})
+		So(version, ShouldEqual, "1.0.0")
+		So(failure, ShouldEqual, "flash failed")
+
+		payload, _ := CborMarshal([]interface{}{
+			map[string]interface{}{"firmware_version": "1.0.0"},
+			map[string]interface{}{"firmware_version": "2.0.0"},
+		})
+		version, _, found = FirmwareReport(&fakeMessage{payload: payload, encoding: EncodingCbor})
+		So(found, ShouldBeTrue)
+		So(version, ShouldEqual, "2.0.0")
+
+		_, _, found = FirmwareReport(&fakeMessage{payload: []byte(`{"field1":1}`)})
+		So(found, ShouldBeFalse)
+	})
+
+	Convey("deletes rollouts and their progress with the channel", t, func() {
+		r := &Rollout{ChannelId: ch.Id, FirmwareId: f.Id}
+		r.Create()
+		r.Announce("dev1", func([]byte) error { return nil })
+
+		err := ch.Delete()
+		So(err, ShouldBeNil)
+
+		var count int
+		DB.Model(&Rollout{}).Count(&count)
+		So(count, ShouldEqual, 0)
+		DB.Model(&RolloutDevice{}).Count(&count)
+		So(count, ShouldEqual, 0)
+	})
+}
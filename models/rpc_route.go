@@ -0,0 +1,163 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/eywa/connections"
+	. "github.com/eywa/utils"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// the call is answered by an rpc handler registered in the server
+	RpcRouteHandler = "handler"
+	// the call is posted to a url and answered with the response body
+	RpcRouteWebhook = "webhook"
+	// the call is answered with a fixed response
+	RpcRouteCanned = "canned"
+)
+
+var SupportedRpcRouteKinds = []string{RpcRouteHandler, RpcRouteWebhook, RpcRouteCanned}
+
+// The route of this method takes the calls of methods without their own
+// route.
+var RpcCatchAllMethod = "*"
+
+func init() {
+	deleteWithChannel(&RpcRoute{})
+	requireMessageHandler("rpc", "rpc routes", &RpcRoute{}, "")
+}
+
+// RpcRoute tells where the calls of a method made by the devices of a
+// channel go.
+type RpcRoute struct {
+	Id        int    `sql:"type:integer primary key autoincrement" json:"id"`
+	ChannelId int    `sql:"type:integer;index" json:"-"`
+	Method    string `sql:"type:varchar(255)" json:"method"`
+	Kind      string `sql:"type:varchar(255)" json:"kind"`
+	Handler   string `sql:"type:varchar(255)" json:"handler"`
+	Url       string `sql:"type:text" json:"url"`
+	Secret    string `sql:"type:varchar(255)" json:"secret"`
+	Response  string `sql:"type:text" json:"response"`
+	Created   int64  `sql:"type:integer" json:"created"`
+	Modified  int64  `sql:"type:integer" json:"modified"`
+}
+
+func (r *RpcRoute) BeforeSave() error {
+	if len(r.Method) == 0 {
+		return errors.New("method is empty")
+	}
+
+	if len(r.Method) > 255 || strings.Contains(r.Method, "|") {
+		return errors.New("invalid method, at most 255 characters without pipes are supported")
+	}
+
+	switch r.Kind {
+	case RpcRouteHandler:
+		if _, found := connections.FindRpcHandler(r.Handler); !found {
+			return errors.New(fmt.Sprintf("unsupported rpc handler: %s, supported rpc handlers are %s", r.Handler, strings.Join(connections.RegisteredRpcHandlers(), ",")))
+		}
+	case RpcRouteWebhook:
+		u, err := url.Parse(r.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return errors.New("invalid url, only http and https urls are supported")
+		}
+		if len(r.Secret) == 0 {
+			return errors.New("secret is empty")
+		}
+	case RpcRouteCanned:
+	default:
+		return errors.New(fmt.Sprintf("unsupported kind: %s, supported kinds are %s", r.Kind, strings.Join(SupportedRpcRouteKinds, ",")))
+	}
+
+	ch := &Channel{}
+	if found := ch.FindById(r.ChannelId); !found {
+		return errors.New("channel not found")
+	}
+
+	if !ch.RunsMessageHandler("rpc") {
+		return errors.New("channel doesn't run the rpc message handler")
+	}
+
+	existing := &RpcRoute{}
+	DB.Where("channel_id = ? AND method = ?", r.ChannelId, r.Method).First(existing)
+	if !DB.NewRecord(existing) && existing.Id != r.Id {
+		return errors.New(fmt.Sprintf("method already routed: %s", r.Method))
+	}
+
+	return nil
+}
+
+func (r *RpcRoute) AfterSave() error {
+	Cache.Delete(rpcRoutesCacheKey(r.ChannelId))
+	return nil
+}
+
+func (r *RpcRoute) AfterDelete() error {
+	Cache.Delete(rpcRoutesCacheKey(r.ChannelId))
+	return nil
+}
+
+func (r *RpcRoute) Create() error {
+	return DB.Create(r).Error
+}
+
+func (r *RpcRoute) Delete() error {
+	return DB.Delete(r).Error
+}
+
+func (r *RpcRoute) Update() error {
+	return DB.Save(r).Error
+}
+
+func (r *RpcRoute) FindById(id int) bool {
+	DB.First(r, id)
+	return !DB.NewRecord(r)
+}
+
+// Hex encoded HMAC-SHA256 of the request body, keyed by the route secret.
+func (r *RpcRoute) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(r.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func ChannelRpcRoutes(channelId int) []*RpcRoute {
+	routes := []*RpcRoute{}
+	DB.Where("channel_id = ?", channelId).Find(&routes)
+	return routes
+}
+
+func FetchCachedRpcRoutesByChannelId(channelId int) []*RpcRoute {
+	routes, err := Cache.Fetch(rpcRoutesCacheKey(channelId), 1*time.Minute, func() (interface{}, error) {
+		return ChannelRpcRoutes(channelId), nil
+	})
+
+	if err != nil {
+		return []*RpcRoute{}
+	}
+	return routes.([]*RpcRoute)
+}
+
+// The route of a method, falling back to the catch-all route.
+func FindCachedRpcRoute(channelId int, method string) (*RpcRoute, bool) {
+	var catchAll *RpcRoute
+	for _, r := range FetchCachedRpcRoutesByChannelId(channelId) {
+		if r.Method == method {
+			return r, true
+		}
+		if r.Method == RpcCatchAllMethod {
+			catchAll = r
+		}
+	}
+	return catchAll, catchAll != nil
+}
+
+func rpcRoutesCacheKey(channelId int) string {
+	return fmt.Sprintf("cache.rpc_routes:%d", channelId)
+}
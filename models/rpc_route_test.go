@@ -0,0 +1,129 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	"github.com/eywa/connections"
+	"testing"
+)
+
+func TestRpcRoute(t *testing.T) {
+	dbFile := setupTestDB(&Conf{})
+	defer teardownTestDB(dbFile)
+
+	ch := &Channel{
+		Name:            "test",
+		Description:     "desc",
+		Tags:            []string{"tag1", "tag2"},
+		Fields:          map[string]string{"field1": "int"},
+		AccessTokens:    []string{"token1"},
+		ConnectionLimit: 5,
+		MessageRate:     1000,
+	}
+	ch.Create()
+
+	connections.RegisterRpcHandler("test_config", func(call *connections.RpcCall) ([]byte, error) {
+		return []byte("config"), nil
+	})
+
+	Convey("creates/updates/deletes rpc routes", t, func() {
+		r := &RpcRoute{
+			ChannelId: ch.Id,
+			Method:    "config",
+			Kind:      RpcRouteHandler,
+			Handler:   "test_config",
+		}
+
+		err := r.Create()
+		So(err, ShouldBeNil)
+		So(len(FetchCachedRpcRoutesByChannelId(ch.Id)), ShouldEqual, 1)
+
+		r.Kind = RpcRouteCanned
+		r.Response = "{}"
+		err = r.Update()
+		So(err, ShouldBeNil)
+
+		_r := &RpcRoute{}
+		_r.FindById(r.Id)
+		So(_r.Response, ShouldEqual, "{}")
+		So(FetchCachedRpcRoutesByChannelId(ch.Id)[0].Kind, ShouldEqual, RpcRouteCanned)
+
+		r.Delete()
+		So(len(ChannelRpcRoutes(ch.Id)), ShouldEqual, 0)
+		So(len(FetchCachedRpcRoutesByChannelId(ch.Id)), ShouldEqual, 0)
+	})
+
+	Convey("validates rpc routes before saving", t, func() {
+		r := &RpcRoute{ChannelId: ch.Id, Kind: RpcRouteCanned}
+		err := r.Create()
+		So(err.Error(), ShouldContainSubstring, "method is empty")
+
+		r.Method = "a|b"
+		err = r.Create()
+		So(err.Error(), ShouldContainSubstring, "invalid method")
+
+		r.Method = "config"
+		r.Kind = "queue"
+		err = r.Create()
+		So(err.Error(), ShouldContainSubstring, "unsupported kind: queue")
+
+		r.Kind = RpcRouteHandler
+		r.Handler = "unknown"
+		err = r.Create()
+		So(err.Error(), ShouldContainSubstring, "unsupported rpc handler: unknown")
+
+		r.Kind = RpcRouteWebhook
+		r.Url = "ftp://localhost/rpc"
+		err = r.Create()
+		So(err.Error(), ShouldContainSubstring, "invalid url")
+
+		r.Url = "http://localhost/rpc"
+		err = r.Create()
+		So(err.Error(), ShouldContainSubstring, "secret is empty")
+
+		r.Secret = "secret"
+		r.ChannelId = ch.Id + 1
+		err = r.Create()
+		So(err.Error(), ShouldContainSubstring, "channel not found")
+
+		r.ChannelId = ch.Id
+		So(r.Create(), ShouldBeNil)
+		dup := &RpcRoute{ChannelId: ch.Id, Method: "config", Kind: RpcRouteCanned}
+		err = dup.Create()
+		So(err.Error(), ShouldContainSubstring, "method already routed: config")
+		r.Delete()
+	})
+
+	Convey("finds the route of a method, falling back to the catch-all route", t, func() {
+		config := &RpcRoute{ChannelId: ch.Id, Method: "config", Kind: RpcRouteCanned, Response: "config"}
+		config.Create()
+		_, found := FindCachedRpcRoute(ch.Id, "license")
+		So(found, ShouldBeFalse)
+
+		catchAll := &RpcRoute{ChannelId: ch.Id, Method: RpcCatchAllMethod, Kind: RpcRouteCanned, Response: "other"}
+		catchAll.Create()
+		r, found := FindCachedRpcRoute(ch.Id, "config")
+		So(found, ShouldBeTrue)
+		So(r.Response, ShouldEqual, "config")
+		r, found = FindCachedRpcRoute(ch.Id, "license")
+		So(found, ShouldBeTrue)
+		So(r.Response, ShouldEqual, "other")
+
+		config.Secret = "secret"
+		So(config.Sign([]byte("payload")), ShouldEqual, "b82fcb791acec57859b989b430a826488ce2e479fdf92326bd0a2e8375a42ba4")
+		config.Delete()
+		catchAll.Delete()
+	})
+
+	Convey("deletes rpc routes with the channel", t, func() {
+		r := &RpcRoute{ChannelId: ch.Id, Method: "config", Kind: RpcRouteCanned}
+		r.Create()
+
+		err := ch.Delete()
+		So(err, ShouldBeNil)
+
+		var count int
+		DB.Model(&RpcRoute{}).Count(&count)
+		So(count, ShouldEqual, 0)
+	})
+}
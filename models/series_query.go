@@ -2,7 +2,6 @@ package models
 
 import (
 	"errors"
-	"gopkg.in/olivere/elastic.v3"
 	. "github.com/eywa/utils"
 	"regexp"
 	"strconv"
@@ -102,99 +101,6 @@ func (q *SeriesQuery) Parse(params map[string]string) error {
 	return nil
 }
 
-func (q *SeriesQuery) QueryES() (interface{}, error) {
-	series := make([]map[string]interface{}, 0)
-	indexName := TimedIndices(q.Channel, q.TimeStart, q.TimeEnd)
-	if len(indexName) == 0 {
-		return series, nil
-	}
-
-	filterAgg := elastic.NewFilterAggregation()
-
-	boolQ := elastic.NewBoolQuery()
-
-	if q.Device != "" {
-		termQ := elastic.NewTermQuery("device_id", q.Device)
-		boolQ.Must(termQ)
-	}
-
-	termQs := make([]elastic.Query, 0)
-	for tagN, tagV := range q.Tags {
-		termQs = append(termQs, elastic.NewTermQuery(tagN, tagV))
-	}
-	boolQ.Must(termQs...)
-
-	rangeQ := elastic.NewRangeQuery("timestamp").
-		From(NanoToMilli(q.TimeStart.UnixNano())).
-		To(NanoToMilli(q.TimeEnd.UnixNano()))
-	boolQ.Must(rangeQ)
-
-	filterAgg.Filter(boolQ)
-
-	var agg elastic.Aggregation
-	switch q.SummaryType {
-	case "sum":
-		agg = elastic.NewDateHistogramAggregation().
-			Field("timestamp").
-			Interval(q.TimeInterval).
-			SubAggregation(q.SummaryType, elastic.NewSumAggregation().Field(q.Field))
-	case "avg":
-		agg = elastic.NewDateHistogramAggregation().
-			Field("timestamp").
-			Interval(q.TimeInterval).
-			SubAggregation(q.SummaryType, elastic.NewAvgAggregation().Field(q.Field))
-	case "min":
-		agg = elastic.NewDateHistogramAggregation().
-			Field("timestamp").
-			Interval(q.TimeInterval).
-			SubAggregation(q.SummaryType, elastic.NewMinAggregation().Field(q.Field))
-	case "max":
-		agg = elastic.NewDateHistogramAggregation().
-			Field("timestamp").
-			Interval(q.TimeInterval).
-			SubAggregation(q.SummaryType, elastic.NewMaxAggregation().Field(q.Field))
-	}
-
-	filterAgg.SubAggregation(SeriesAggName, agg)
-
-	resp, err := IndexClient.Search().
-		SearchType("count").
-		Index(indexName).
-		Type(IndexTypeMessages).
-		Aggregation("name", filterAgg).
-		Do()
-	if err != nil {
-		return nil, err
-	}
-	filteredResp, success := resp.Aggregations.Filter("name")
-	if !success {
-		return nil, errors.New("error querying indices")
-	}
-	SeriesResp, success := filteredResp.Aggregations.DateHistogram(SeriesAggName)
-	if !success {
-		return nil, errors.New("error querying indices")
-	}
-
-	for _, bkt := range SeriesResp.Buckets {
-		switch q.SummaryType {
-		case "sum":
-			if sum, found := bkt.Aggregations.Sum(q.SummaryType); found {
-				series = append(series, map[string]interface{}{"timestamp": bkt.Key, "value": sum.Value})
-			}
-		case "avg":
-			if avg, found := bkt.Aggregations.Sum(q.SummaryType); found {
-				series = append(series, map[string]interface{}{"timestamp": bkt.Key, "value": avg.Value})
-			}
-		case "min":
-			if min, found := bkt.Aggregations.Sum(q.SummaryType); found {
-				series = append(series, map[string]interface{}{"timestamp": bkt.Key, "value": min.Value})
-			}
-		case "max":
-			if max, found := bkt.Aggregations.Sum(q.SummaryType); found {
-				series = append(series, map[string]interface{}{"timestamp": bkt.Key, "value": max.Value})
-			}
-		}
-	}
-
-	return series, nil
+func (q *SeriesQuery) Query() (interface{}, error) {
+	return DataStore.QuerySeries(q)
 }
@@ -0,0 +1,611 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	. "github.com/eywa/utils"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sqliteTableRegexp = regexp.MustCompile(`^points_(\d+)_(\d+)_(\d+)$`)
+var sqliteIntervalRegexp = regexp.MustCompile(`^(\d+)([yMwdhms])$`)
+
+// SqliteStore keeps the points in a local sqlite file, with one table per
+// channel and week, named after the Elasticsearch index it replaces. It needs
+// no external service, so it suits small deployments and tests.
+type SqliteStore struct {
+	sync.RWMutex
+	db *gorm.DB
+	// existing tables by index name
+	tables map[string]string
+}
+
+func NewSqliteStore(file string) (*SqliteStore, error) {
+	if len(file) == 0 {
+		return nil, errors.New("missing store_file for sqlite store")
+	}
+
+	db, err := gorm.Open("sqlite3", file)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite takes one writer at a time anyway
+	db.DB().SetMaxOpenConns(1)
+
+	s := &SqliteStore{db: &db, tables: make(map[string]string)}
+
+	rows, err := s.db.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'points_%'").Rows()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if m := sqliteTableRegexp.FindStringSubmatch(table); m != nil {
+			y, _ := strconv.Atoi(m[2])
+			w, _ := strconv.Atoi(m[3])
+			s.tables[fmt.Sprintf("channels.%s.%d-%d", m[1], y, w)] = table
+		}
+	}
+	return s, nil
+}
+
+func sqliteTableName(index string) (string, error) {
+	var chId, y, w int
+	if _, err := fmt.Sscanf(index, "channels.%d.%d-%d", &chId, &y, &w); err != nil {
+		return "", errors.New(fmt.Sprintf("invalid index name: %s", index))
+	}
+	return fmt.Sprintf("points_%d_%04d_%02d", chId, y, w), nil
+}
+
+func (s *SqliteStore) ensureTable(index string) (string, error) {
+	s.RLock()
+	table, found := s.tables[index]
+	s.RUnlock()
+	if found {
+		return table, nil
+	}
+
+	table, err := sqliteTableName(index)
+	if err != nil {
+		return "", err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			device_id TEXT,
+			activity TEXT,
+			timestamp INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			body TEXT NOT NULL
+		)`, table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_timestamp ON %s (type, timestamp)", table, table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_device_id ON %s (device_id, timestamp)", table, table),
+	}
+	for _, stmt := range stmts {
+		if err := s.db.Exec(stmt).Error; err != nil {
+			return "", err
+		}
+	}
+	s.tables[index] = table
+	return table, nil
+}
+
+func (s *SqliteStore) Write(docs []*IndexDocument) ([]error, []bool, error) {
+	errs := make([]error, len(docs))
+	retry := make([]bool, len(docs))
+
+	tables := make([]string, len(docs))
+	for i, doc := range docs {
+		table, err := s.ensureTable(doc.Index)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		tables[i] = table
+	}
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, nil, tx.Error
+	}
+	for i, doc := range docs {
+		if errs[i] != nil {
+			continue
+		}
+
+		point := make(map[string]interface{})
+		if err := json.Unmarshal(doc.Body, &point); err != nil {
+			errs[i] = errors.New(fmt.Sprintf("failed to index document %s: %s", doc.Id, err.Error()))
+			continue
+		}
+		ts, _ := point["timestamp"].(float64)
+		devId, _ := point["device_id"].(string)
+		activity, _ := point["activity"].(string)
+
+		err := tx.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %s (id, type, device_id, activity, timestamp, size, body) VALUES (?, ?, ?, ?, ?, ?, ?)", tables[i]),
+			doc.Id, doc.Type, devId, activity, int64(ts), len(doc.Body), string(doc.Body)).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, nil, err
+	}
+	return errs, retry, nil
+}
+
+// Tables of a channel covering a time range, all of them when the range is
+// not given, oldest first.
+func (s *SqliteStore) channelTables(ch *Channel, tStart, tEnd time.Time) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	tables := []string{}
+	if tStart.IsZero() {
+		prefix := fmt.Sprintf("channels.%d.", ch.Id)
+		for index, table := range s.tables {
+			if strings.HasPrefix(index, prefix) {
+				tables = append(tables, table)
+			}
+		}
+	} else {
+		for _, index := range TimedIndexNames(ch, tStart, tEnd) {
+			if table, found := s.tables[index]; found {
+				tables = append(tables, table)
+			}
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+type sqlitePointFilter struct {
+	Type      string
+	Device    string
+	Activity  string
+	Tags      map[string]string
+	TimeStart time.Time
+	TimeEnd   time.Time
+	Desc      bool
+}
+
+// Calls fn with every point matching the filter in time order, until fn
+// returns false.
+func (s *SqliteStore) each(ch *Channel, f *sqlitePointFilter, fn func(point map[string]interface{}, size int64, body string) bool) error {
+	tables := s.channelTables(ch, f.TimeStart, f.TimeEnd)
+	order := "ASC"
+	if f.Desc {
+		order = "DESC"
+		for i, j := 0, len(tables)-1; i < j; i, j = i+1, j-1 {
+			tables[i], tables[j] = tables[j], tables[i]
+		}
+	}
+
+	conds := []string{"type = ?"}
+	args := []interface{}{f.Type}
+	if len(f.Device) > 0 {
+		conds = append(conds, "device_id = ?")
+		args = append(args, f.Device)
+	}
+	if len(f.Activity) > 0 {
+		conds = append(conds, "activity = ?")
+		args = append(args, f.Activity)
+	}
+	if !f.TimeStart.IsZero() {
+		conds = append(conds, "timestamp >= ? AND timestamp <= ?")
+		args = append(args, NanoToMilli(f.TimeStart.UnixNano()), NanoToMilli(f.TimeEnd.UnixNano()))
+	}
+
+	for _, table := range tables {
+		sql := fmt.Sprintf("SELECT size, body FROM %s WHERE %s ORDER BY timestamp %s", table, strings.Join(conds, " AND "), order)
+		rows, err := s.db.Raw(sql, args...).Rows()
+		if err != nil {
+			return err
+		}
+
+		more := true
+		for more && rows.Next() {
+			var size int64
+			var body string
+			if err = rows.Scan(&size, &body); err != nil {
+				break
+			}
+			point := make(map[string]interface{})
+			if err = json.Unmarshal([]byte(body), &point); err != nil {
+				break
+			}
+			if sqliteTagsMatch(point, f.Tags) {
+				more = fn(point, size, body)
+			}
+		}
+		rows.Close()
+
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+func sqliteTagsMatch(point map[string]interface{}, tags map[string]string) bool {
+	for tagN, tagV := range tags {
+		if v, ok := point[tagN].(string); !ok || v != tagV {
+			return false
+		}
+	}
+	return true
+}
+
+// Accumulates the numeric values of a field the way the Elasticsearch
+// metric aggregations do.
+type sqliteMetric struct {
+	summaryType string
+	count       int
+	value       float64
+}
+
+func (m *sqliteMetric) add(v float64) {
+	switch {
+	case m.count == 0:
+		m.value = v
+	case m.summaryType == "sum" || m.summaryType == "avg":
+		m.value += v
+	case m.summaryType == "min" && v < m.value:
+		m.value = v
+	case m.summaryType == "max" && v > m.value:
+		m.value = v
+	}
+	m.count += 1
+}
+
+func (m *sqliteMetric) result() *float64 {
+	if m.count == 0 {
+		if m.summaryType == "sum" {
+			zero := 0.0
+			return &zero
+		}
+		return nil
+	}
+	v := m.value
+	if m.summaryType == "avg" {
+		v = v / float64(m.count)
+	}
+	return &v
+}
+
+func sqliteNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (s *SqliteStore) QueryValue(q *ValueQuery) (interface{}, error) {
+	f := &sqlitePointFilter{
+		Type:      IndexTypeMessages,
+		Tags:      q.Tags,
+		TimeStart: q.TimeStart,
+		TimeEnd:   q.TimeEnd,
+	}
+
+	if q.SummaryType == "last" {
+		f.Desc = true
+		var value interface{}
+		err := s.each(q.Channel, f, func(point map[string]interface{}, size int64, body string) bool {
+			v, found := point[q.Field]
+			if found {
+				value = v
+			}
+			return !found
+		})
+		if err != nil || value == nil {
+			return nil, err
+		}
+		return map[string]interface{}{"value": value}, nil
+	}
+
+	if len(s.channelTables(q.Channel, q.TimeStart, q.TimeEnd)) == 0 {
+		return nil, nil
+	}
+
+	m := &sqliteMetric{summaryType: q.SummaryType}
+	err := s.each(q.Channel, f, func(point map[string]interface{}, size int64, body string) bool {
+		if v, ok := sqliteNumber(point[q.Field]); ok {
+			m.add(v)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"value": m.result()}, nil
+}
+
+// Start of the date histogram bucket a timestamp falls in, in milliseconds.
+func sqliteBucket(ts int64, n int64, unit string) int64 {
+	var size int64
+	switch unit {
+	case "s":
+		size = 1000
+	case "m":
+		size = 60 * 1000
+	case "h":
+		size = 60 * 60 * 1000
+	case "d":
+		size = 24 * 60 * 60 * 1000
+	case "w":
+		// weeks start on monday, the 5th of january 1970 was one
+		week := int64(7 * 24 * 60 * 60 * 1000)
+		monday := int64(4 * 24 * 60 * 60 * 1000)
+		return floorDiv(ts-monday, n*week)*n*week + monday
+	case "M", "y":
+		t := time.Unix(MilliSecToSec(ts), MilliSecToNano(ts)).UTC()
+		months := int64(t.Year()-1970)*12 + int64(t.Month()-1)
+		if unit == "y" {
+			n = n * 12
+		}
+		months = floorDiv(months, n) * n
+		start := time.Date(1970+int(floorDiv(months, 12)), time.Month(months-floorDiv(months, 12)*12+1), 1, 0, 0, 0, 0, time.UTC)
+		return NanoToMilli(start.UnixNano())
+	}
+	return floorDiv(ts, n*size) * n * size
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q -= 1
+	}
+	return q
+}
+
+func (s *SqliteStore) QuerySeries(q *SeriesQuery) (interface{}, error) {
+	series := make([]map[string]interface{}, 0)
+
+	m := sqliteIntervalRegexp.FindStringSubmatch(q.TimeInterval)
+	if m == nil {
+		return nil, errors.New("invalid time_interval format: " + q.TimeInterval)
+	}
+	n, _ := strconv.ParseInt(m[1], 10, 64)
+	if n <= 0 {
+		return nil, errors.New("invalid time_interval format: " + q.TimeInterval)
+	}
+
+	keys := []int64{}
+	buckets := make(map[int64]*sqliteMetric)
+	f := &sqlitePointFilter{
+		Type:      IndexTypeMessages,
+		Device:    q.Device,
+		Tags:      q.Tags,
+		TimeStart: q.TimeStart,
+		TimeEnd:   q.TimeEnd,
+	}
+	err := s.each(q.Channel, f, func(point map[string]interface{}, size int64, body string) bool {
+		ts, _ := point["timestamp"].(float64)
+		key := sqliteBucket(int64(ts), n, m[2])
+		bkt, found := buckets[key]
+		if !found {
+			bkt = &sqliteMetric{summaryType: q.SummaryType}
+			buckets[key] = bkt
+			keys = append(keys, key)
+		}
+		if v, ok := sqliteNumber(point[q.Field]); ok {
+			bkt.add(v)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(int64s(keys))
+	for _, key := range keys {
+		series = append(series, map[string]interface{}{"timestamp": key, "value": buckets[key].result()})
+	}
+	return series, nil
+}
+
+func (s *SqliteStore) QueryRaw(q *RawQuery) (interface{}, error) {
+	res := map[string]interface{}{}
+	f := &sqlitePointFilter{
+		Type:      IndexTypeMessages,
+		Tags:      q.Tags,
+		TimeStart: q.TimeStart,
+		TimeEnd:   q.TimeEnd,
+	}
+
+	if q.Nop {
+		var bytes int64
+		err := s.each(q.Channel, f, func(point map[string]interface{}, size int64, body string) bool {
+			bytes += size
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		res["size"] = formatRawSize(bytes)
+		return res, nil
+	}
+
+	tmpFile, err := ioutil.TempFile(os.TempDir(), fmt.Sprintf("%s.raw", q.Channel.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer tmpFile.Close()
+
+	err = s.each(q.Channel, f, func(point map[string]interface{}, size int64, body string) bool {
+		tmpFile.WriteString(body)
+		tmpFile.WriteString("\n")
+		return true
+	})
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+
+	res["file"] = tmpFile.Name()
+	return res, nil
+}
+
+func (s *SqliteStore) QueryTagStats(q *StatsQuery) (interface{}, error) {
+	res := make(map[string]interface{})
+	counts := make(map[string]map[string]int)
+	for _, tag := range q.Channel.Tags {
+		res[tag] = []interface{}{}
+		counts[tag] = make(map[string]int)
+	}
+
+	f := &sqlitePointFilter{
+		Type:      IndexTypeMessages,
+		TimeStart: q.TimeStart,
+		TimeEnd:   q.TimeEnd,
+	}
+	err := s.each(q.Channel, f, func(point map[string]interface{}, size int64, body string) bool {
+		for _, tag := range q.Channel.Tags {
+			if v, ok := point[tag].(string); ok {
+				counts[tag][v] += 1
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return res, nil
+	}
+
+	// most frequent values first, like the terms aggregation
+	for _, tag := range q.Channel.Tags {
+		values := []string{}
+		for v, _ := range counts[tag] {
+			values = append(values, v)
+		}
+		sort.Sort(&valuesByCount{values, counts[tag]})
+		for _, v := range values {
+			res[tag] = append(res[tag].([]interface{}), v)
+		}
+	}
+	return res, nil
+}
+
+func (s *SqliteStore) Activities(ch *Channel, devId string, activity string, limit int) ([]*ConnectionHistory, error) {
+	hs := make([]*ConnectionHistory, 0)
+	f := &sqlitePointFilter{
+		Type:     IndexTypeActivities,
+		Device:   devId,
+		Activity: activity,
+		Desc:     true,
+	}
+
+	var err error
+	e := s.each(ch, f, func(point map[string]interface{}, size int64, body string) bool {
+		h := &ConnectionHistory{}
+		if err = json.Unmarshal([]byte(body), h); err != nil {
+			return false
+		}
+		hs = append(hs, h)
+		return len(hs) < limit
+	})
+	if e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hs, nil
+}
+
+func (s *SqliteStore) IndexStats(ch *Channel) (interface{}, error) {
+	indices := make(map[string]interface{})
+
+	s.RLock()
+	prefix := fmt.Sprintf("channels.%d.", ch.Id)
+	tables := make(map[string]string)
+	for index, table := range s.tables {
+		if strings.HasPrefix(index, prefix) {
+			tables[index] = table
+		}
+	}
+	s.RUnlock()
+
+	for index, table := range tables {
+		var count, size int64
+		row := s.db.Raw(fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM %s", table)).Row()
+		if err := row.Scan(&count, &size); err != nil {
+			return nil, err
+		}
+		indices[index] = map[string]interface{}{
+			"docs": map[string]interface{}{"count": count},
+			"size": map[string]interface{}{"size_in_bytes": size},
+		}
+	}
+	return map[string]interface{}{"indices": indices}, nil
+}
+
+func (s *SqliteStore) DeleteChannel(ch *Channel) error {
+	s.Lock()
+	defer s.Unlock()
+
+	prefix := fmt.Sprintf("channels.%d.", ch.Id)
+	for index, table := range s.tables {
+		if strings.HasPrefix(index, prefix) {
+			if err := s.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table)).Error; err != nil {
+				return err
+			}
+			delete(s.tables, index)
+		}
+	}
+	return nil
+}
+
+func (s *SqliteStore) Close() error {
+	return s.db.Close()
+}
+
+type valuesByCount struct {
+	values []string
+	counts map[string]int
+}
+
+func (a *valuesByCount) Len() int      { return len(a.values) }
+func (a *valuesByCount) Swap(i, j int) { a.values[i], a.values[j] = a.values[j], a.values[i] }
+func (a *valuesByCount) Less(i, j int) bool {
+	ci, cj := a.counts[a.values[i]], a.counts[a.values[j]]
+	if ci != cj {
+		return ci > cj
+	}
+	return a.values[i] < a.values[j]
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSqliteStore(t *testing.T) {
+	pwd, _ := os.Getwd()
+	storeFile := path.Join(pwd, "indices_test.db")
+	os.Remove(storeFile)
+	defer os.Remove(storeFile)
+
+	s, err := NewSqliteStore(storeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DataStore = s
+	defer s.Close()
+
+	ch := &Channel{
+		Id:     1,
+		Name:   "test",
+		Tags:   []string{"city"},
+		Fields: map[string]string{"temp": "float"},
+	}
+
+	start := time.Date(2016, 3, 7, 0, 0, 0, 0, time.UTC)
+	docs := []*IndexDocument{}
+	for i, city := range []string{"sf", "sf", "nyc", "sf"} {
+		ts := start.Add(time.Duration(i) * 24 * time.Hour * 5)
+		js, _ := json.Marshal(map[string]interface{}{
+			"device_id":    "dev1",
+			"channel_name": ch.Name,
+			"timestamp":    NanoToMilli(ts.UnixNano()),
+			"message_type": "upload",
+			"city":         city,
+			"temp":         float64(i + 1),
+		})
+		docs = append(docs, NewIndexDocument(TimedIndexName(ch, ts), IndexTypeMessages, fmt.Sprintf("m%d", i), js, nil))
+	}
+	for i, act := range []string{"connect", "disconnect"} {
+		ts := start.Add(time.Duration(i) * time.Hour)
+		js, _ := json.Marshal(map[string]interface{}{
+			"device_id":       "dev1",
+			"timestamp":       NanoToMilli(ts.UnixNano()),
+			"activity":        act,
+			"duration":        1000,
+			"connection_type": "websocket",
+		})
+		docs = append(docs, NewIndexDocument(TimedIndexName(ch, ts), IndexTypeActivities, fmt.Sprintf("a%d", i), js, nil))
+	}
+	docs = append(docs, NewIndexDocument("invalid", IndexTypeMessages, "bad", []byte(`{}`), nil))
+
+	timeRange := fmt.Sprintf("%d:%d", NanoToMilli(start.UnixNano()), NanoToMilli(start.Add(30*24*time.Hour).UnixNano()))
+
+	Convey("writes documents into weekly tables", t, func() {
+		errs, _, err := s.Write(docs)
+		So(err, ShouldBeNil)
+		So(errs[len(errs)-1], ShouldNotBeNil)
+		for _, e := range errs[:len(errs)-1] {
+			So(e, ShouldBeNil)
+		}
+		So(len(s.channelTables(ch, time.Time{}, time.Time{})), ShouldEqual, 3)
+
+		reopened, err := NewSqliteStore(storeFile)
+		So(err, ShouldBeNil)
+		So(len(reopened.channelTables(ch, time.Time{}, time.Time{})), ShouldEqual, 3)
+		reopened.Close()
+	})
+
+	Convey("queries values", t, func() {
+		q := &ValueQuery{Channel: ch}
+		So(q.Parse(map[string]string{"field": "temp", "summary_type": "avg", "time_range": timeRange}), ShouldBeNil)
+		v, err := q.Query()
+		So(err, ShouldBeNil)
+		So(*(v.(map[string]interface{})["value"].(*float64)), ShouldEqual, 2.5)
+
+		q = &ValueQuery{Channel: ch}
+		q.Parse(map[string]string{"field": "temp", "summary_type": "max", "time_range": timeRange, "tags": "city:eq:sf"})
+		v, _ = q.Query()
+		So(*(v.(map[string]interface{})["value"].(*float64)), ShouldEqual, 4)
+
+		q = &ValueQuery{Channel: ch}
+		q.Parse(map[string]string{"field": "temp", "summary_type": "last"})
+		v, _ = q.Query()
+		So(v.(map[string]interface{})["value"], ShouldEqual, 4)
+	})
+
+	Convey("queries series", t, func() {
+		q := &SeriesQuery{Channel: ch}
+		So(q.Parse(map[string]string{"field": "temp", "summary_type": "sum", "time_range": timeRange, "time_interval": "1w"}), ShouldBeNil)
+		v, err := q.Query()
+		So(err, ShouldBeNil)
+		series := v.([]map[string]interface{})
+		So(len(series), ShouldEqual, 3)
+		So(series[0]["timestamp"], ShouldEqual, NanoToMilli(start.UnixNano()))
+		So(*(series[0]["value"].(*float64)), ShouldEqual, 3)
+		So(*(series[2]["value"].(*float64)), ShouldEqual, 4)
+
+		So(sqliteBucket(NanoToMilli(time.Date(2016, 3, 17, 5, 0, 0, 0, time.UTC).UnixNano()), 1, "M"), ShouldEqual, NanoToMilli(time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC).UnixNano()))
+		So(sqliteBucket(NanoToMilli(time.Date(2016, 3, 17, 5, 0, 0, 0, time.UTC).UnixNano()), 1, "y"), ShouldEqual, NanoToMilli(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()))
+		So(sqliteBucket(NanoToMilli(time.Date(2016, 3, 17, 5, 30, 0, 0, time.UTC).UnixNano()), 6, "h"), ShouldEqual, NanoToMilli(time.Date(2016, 3, 17, 0, 0, 0, 0, time.UTC).UnixNano()))
+	})
+
+	Convey("exports raw data", t, func() {
+		q := &RawQuery{Channel: ch}
+		q.Parse(map[string]string{"time_range": timeRange, "tags": "city:eq:sf"})
+		v, err := q.Query()
+		So(err, ShouldBeNil)
+		So(v.(map[string]interface{})["size"], ShouldEndWith, "b")
+
+		q.Nop = false
+		v, err = q.Query()
+		So(err, ShouldBeNil)
+		file := v.(map[string]interface{})["file"].(string)
+		defer os.Remove(file)
+		content, _ := ioutil.ReadFile(file)
+		So(len(strings.Split(strings.TrimSpace(string(content)), "\n")), ShouldEqual, 3)
+	})
+
+	Convey("queries tag stats", t, func() {
+		q := &StatsQuery{Channel: ch}
+		q.Parse(map[string]string{"time_range": timeRange})
+		v, err := q.Query()
+		So(err, ShouldBeNil)
+		So(v.(map[string]interface{})["city"], ShouldResemble, []interface{}{"sf", "nyc"})
+	})
+
+	Convey("finds activities of a device", t, func() {
+		hs, err := DataStore.Activities(ch, "dev1", "disconnect", 1)
+		So(err, ShouldBeNil)
+		So(len(hs), ShouldEqual, 1)
+		So(hs[0].Activity, ShouldEqual, "disconnect")
+		So(hs[0].Duration, ShouldEqual, time.Second)
+
+		hs, _ = DataStore.Activities(ch, "dev1", "", 10)
+		So(len(hs), ShouldEqual, 2)
+		So(hs[0].Activity, ShouldEqual, "disconnect")
+	})
+
+	Convey("drops the tables of a channel", t, func() {
+		stats, err := ch.IndexStats()
+		So(err, ShouldBeNil)
+		So(len(stats.(map[string]interface{})["indices"].(map[string]interface{})), ShouldEqual, 3)
+
+		So(ch.DeleteIndices(), ShouldBeNil)
+		So(len(s.channelTables(ch, time.Time{}, time.Time{})), ShouldEqual, 0)
+
+		q := &ValueQuery{Channel: ch}
+		q.Parse(map[string]string{"field": "temp", "summary_type": "sum", "time_range": timeRange})
+		v, _ := q.Query()
+		So(v, ShouldBeNil)
+	})
+}
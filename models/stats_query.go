@@ -2,7 +2,6 @@ package models
 
 import (
 	"errors"
-	"gopkg.in/olivere/elastic.v3"
 	. "github.com/eywa/utils"
 	"strconv"
 	"strings"
@@ -47,52 +46,6 @@ func (q *StatsQuery) Parse(params map[string]string) error {
 	return nil
 }
 
-func (q *StatsQuery) QueryES() (interface{}, error) {
-	res := make(map[string]interface{})
-	for _, tag := range q.Channel.Tags {
-		res[tag] = []interface{}{}
-	}
-
-	indexName := TimedIndices(q.Channel, q.TimeStart, q.TimeEnd)
-	if len(indexName) == 0 {
-		return res, nil
-	}
-
-	filterAgg := elastic.NewFilterAggregation()
-
-	boolQ := elastic.NewBoolQuery()
-	rangeQ := elastic.NewRangeQuery("timestamp").
-		From(NanoToMilli(q.TimeStart.UnixNano())).
-		To(NanoToMilli(q.TimeEnd.UnixNano()))
-	boolQ.Must(rangeQ)
-
-	filterAgg.Filter(boolQ)
-
-	for _, tag := range q.Channel.Tags {
-		filterAgg.SubAggregation(tag, elastic.NewTermsAggregation().Field(tag).Size(0))
-	}
-
-	resp, err := IndexClient.Search().
-		SearchType("count").
-		Index(indexName).
-		Type(IndexTypeMessages).
-		Aggregation("name", filterAgg).
-		Do()
-
-	if err != nil {
-		return res, nil
-	} else {
-		if agg, found := resp.Aggregations.Filter("name"); found {
-			for _, tag := range q.Channel.Tags {
-				tagStats, found := agg.Aggregations.Terms(tag)
-				if found {
-					for _, bucket := range tagStats.Buckets {
-						res[tag] = append(res[tag].([]interface{}), bucket.Key)
-					}
-				}
-			}
-			return res, nil
-		}
-		return nil, nil
-	}
+func (q *StatsQuery) Query() (interface{}, error) {
+	return DataStore.QueryTagStats(q)
 }
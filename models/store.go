@@ -0,0 +1,59 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/eywa/configs"
+	"strings"
+)
+
+var SupportedStores = []string{"elasticsearch", "sqlite"}
+
+// Store keeps the points of the channels and answers the queries on them.
+type Store interface {
+	// Writes a batch of documents. A returned error means nothing was
+	// written, otherwise the slices hold the error of every document, nil
+	// for the written ones, and whether the failed ones are worth retrying.
+	Write(docs []*IndexDocument) ([]error, []bool, error)
+
+	QueryValue(q *ValueQuery) (interface{}, error)
+	QuerySeries(q *SeriesQuery) (interface{}, error)
+	QueryRaw(q *RawQuery) (interface{}, error)
+	QueryTagStats(q *StatsQuery) (interface{}, error)
+
+	// Activities of a device, most recent first. An empty activity matches
+	// all of them.
+	Activities(ch *Channel, devId string, activity string, limit int) ([]*ConnectionHistory, error)
+
+	IndexStats(ch *Channel) (interface{}, error)
+	DeleteChannel(ch *Channel) error
+	Close() error
+}
+
+var DataStore Store
+
+func InitializeStore() error {
+	switch Config().Indices.Store {
+	case "", "elasticsearch":
+		if err := InitializeIndexClient(); err != nil {
+			return err
+		}
+		DataStore = &ESStore{}
+	case "sqlite":
+		s, err := NewSqliteStore(Config().Indices.StoreFile)
+		if err != nil {
+			return err
+		}
+		DataStore = s
+	default:
+		return errors.New(fmt.Sprintf("unsupported store: %s, supported stores are %s", Config().Indices.Store, strings.Join(SupportedStores, ",")))
+	}
+	return nil
+}
+
+func CloseStore() error {
+	if DataStore == nil {
+		return nil
+	}
+	return DataStore.Close()
+}
@@ -43,4 +43,18 @@ func (s *StringSlice) Scan(src interface{}) error {
 
 func (s StringSlice) Value() (driver.Value, error) {
 	return strings.Join(s, ","), nil
-}
\ No newline at end of file
+}
+// JsonMap keeps a json object in a text column.
+type JsonMap map[string]interface{}
+
+func (m *JsonMap) Scan(value interface{}) error {
+	return json.Unmarshal(value.([]byte), m)
+}
+
+func (m JsonMap) Value() (driver.Value, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
@@ -2,8 +2,6 @@ package models
 
 import (
 	"errors"
-	"fmt"
-	"gopkg.in/olivere/elastic.v3"
 	. "github.com/eywa/utils"
 	"strconv"
 	"strings"
@@ -94,133 +92,6 @@ func (q *ValueQuery) Parse(params map[string]string) error {
 	return nil
 }
 
-func TimedIndices(ch *Channel, tStart, tEnd time.Time) string {
-	allIndices := ch.Indices()
-
-	indices := []string{}
-	oneWeek := 7 * 24 * time.Hour
-	t := tStart
-	for {
-		index := TimedIndexName(ch, t)
-		if StringSliceContains(allIndices, index) {
-			indices = append(indices, index)
-		}
-
-		y, w := t.ISOWeek()
-		ey, ew := tEnd.ISOWeek()
-		if y > ey || (y == ey && w >= ew) {
-			break
-		} else {
-			t = t.Add(oneWeek)
-		}
-	}
-	return strings.Join(indices, ",")
-}
-
-func GlobalIndexName(ch *Channel) string {
-	return fmt.Sprintf("channels.%d.*", ch.Id)
-}
-
-func (q *ValueQuery) QueryES() (interface{}, error) {
-	filterAgg := elastic.NewFilterAggregation()
-
-	boolQ := elastic.NewBoolQuery()
-
-	termQs := make([]elastic.Query, 0)
-	for tagN, tagV := range q.Tags {
-		termQs = append(termQs, elastic.NewTermQuery(tagN, tagV))
-	}
-	boolQ.Must(termQs...)
-
-	existsQs := elastic.NewExistsQuery(q.Field)
-	boolQ.Must(existsQs)
-
-	if !q.TimeStart.IsZero() {
-		rangeQ := elastic.NewRangeQuery("timestamp").
-			From(NanoToMilli(q.TimeStart.UnixNano())).
-			To(NanoToMilli(q.TimeEnd.UnixNano()))
-		boolQ.Must(rangeQ)
-	}
-
-	filterAgg.Filter(boolQ)
-
-	var agg elastic.Aggregation
-	switch q.SummaryType {
-	case "sum":
-		agg = elastic.NewSumAggregation().Field(q.Field)
-	case "avg":
-		agg = elastic.NewAvgAggregation().Field(q.Field)
-	case "min":
-		agg = elastic.NewMinAggregation().Field(q.Field)
-	case "max":
-		agg = elastic.NewMaxAggregation().Field(q.Field)
-	}
-
-	filterAgg.SubAggregation(ValueAggName, agg)
-
-	if q.SummaryType != "last" {
-		indexName := TimedIndices(q.Channel, q.TimeStart, q.TimeEnd)
-		if len(indexName) == 0 {
-			return nil, nil
-		}
-
-		resp, err := IndexClient.Search().
-			SearchType("count").
-			Index(indexName).
-			Type(IndexTypeMessages).
-			Aggregation("name", filterAgg).
-			Do()
-		if err != nil {
-			return nil, err
-		}
-		filterAggResp, success := resp.Aggregations.Filter("name")
-		if !success {
-			return nil, errors.New("error querying indices")
-		}
-
-		var statsResp *elastic.AggregationValueMetric
-		switch q.SummaryType {
-		case "sum":
-			statsResp, success = filterAggResp.Aggregations.Sum(ValueAggName)
-		case "avg":
-			statsResp, success = filterAggResp.Aggregations.Avg(ValueAggName)
-		case "min":
-			statsResp, success = filterAggResp.Aggregations.Min(ValueAggName)
-		case "max":
-			statsResp, success = filterAggResp.Aggregations.Max(ValueAggName)
-		}
-
-		if !success {
-			return nil, errors.New("error querying indices")
-		}
-
-		return map[string]interface{}{"value": statsResp.Value}, nil
-	} else {
-		resp, err := IndexClient.Search().
-			Index(GlobalIndexName(q.Channel)).
-			Type(IndexTypeMessages).
-			FetchSource(false).
-			Field(q.Field).
-			Query(boolQ).
-			Sort("timestamp", false).
-			From(0).Size(1).
-			Do()
-
-		if err != nil {
-			return nil, err
-		}
-		if resp.TotalHits() == 0 || resp.Hits == nil ||
-			len(resp.Hits.Hits) == 0 {
-			return nil, nil
-		} else if _, found := resp.Hits.Hits[0].Fields[q.Field]; !found {
-			return nil, nil
-		} else {
-			values, ok := resp.Hits.Hits[0].Fields[q.Field].([]interface{})
-			if !ok || len(values) == 0 {
-				return nil, nil
-			} else {
-				return map[string]interface{}{"value": values[0]}, nil
-			}
-		}
-	}
+func (q *ValueQuery) Query() (interface{}, error) {
+	return DataStore.QueryValue(q)
 }
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	. "github.com/eywa/connections"
+	. "github.com/eywa/utils"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Message types that can be delivered to a webhook, keyed by the event name.
+var SupportedWebhookEvents = map[string]MessageType{
+	"upload":     TypeUploadMessage,
+	"connect":    TypeConnectMessage,
+	"disconnect": TypeDisconnectMessage,
+	"response":   TypeResponseMessage,
+}
+
+func init() {
+	deleteWithChannel(&Webhook{})
+	requireMessageHandler("webhooks", "webhooks", &Webhook{}, "")
+}
+
+// The secret is never rendered, the api only shows it once when the webhook
+// is created.
+type Webhook struct {
+	Id         int         `sql:"type:integer primary key autoincrement" json:"id"`
+	ChannelId  int         `sql:"type:integer;index" json:"-"`
+	Url        string      `sql:"type:text" json:"url"`
+	Secret     string      `sql:"type:varchar(255)" json:"-"`
+	Events     StringSlice `sql:"type:text" json:"events"`
+	TagFilters StringMap   `sql:"type:text" json:"tag_filters"`
+	Created    int64       `sql:"type:integer" json:"created"`
+	Modified   int64       `sql:"type:integer" json:"modified"`
+}
+
+func (w *Webhook) BeforeSave() error {
+	u, err := url.Parse(w.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.New("invalid url, only http and https urls are supported")
+	}
+
+	if len(w.Secret) == 0 {
+		return errors.New("secret is empty")
+	}
+
+	if len(w.Events) == 0 {
+		return errors.New("events are empty")
+	}
+
+	events := make([]string, 0, len(SupportedWebhookEvents))
+	for e, _ := range SupportedWebhookEvents {
+		events = append(events, e)
+	}
+	for _, e := range w.Events {
+		if _, found := SupportedWebhookEvents[e]; !found {
+			return errors.New(fmt.Sprintf("unsupported event: %s, supported events are %s", e, strings.Join(events, ",")))
+		}
+	}
+
+	if w.TagFilters == nil {
+		w.TagFilters = StringMap(make(map[string]string, 0))
+	}
+
+	ch := &Channel{}
+	if found := ch.FindById(w.ChannelId); !found {
+		return errors.New("channel not found")
+	}
+
+	if !ch.RunsMessageHandler("webhooks") {
+		return errors.New("channel doesn't run the webhooks message handler")
+	}
+
+	for tagName, _ := range w.TagFilters {
+		if !StringSliceContains(ch.Tags, tagName) && !StringSliceContains(InternalTags, tagName) {
+			return errors.New(fmt.Sprintf("unknown tag in tag filters: %s", tagName))
+		}
+	}
+
+	return nil
+}
+
+func (w *Webhook) AfterSave() error {
+	Cache.Delete(webhooksCacheKey(w.ChannelId))
+	return nil
+}
+
+func (w *Webhook) AfterDelete() error {
+	Cache.Delete(webhooksCacheKey(w.ChannelId))
+	return nil
+}
+
+func (w *Webhook) Create() error {
+	return DB.Create(w).Error
+}
+
+func (w *Webhook) Delete() error {
+	return DB.Delete(w).Error
+}
+
+func (w *Webhook) Update() error {
+	return DB.Save(w).Error
+}
+
+func (w *Webhook) FindById(id int) bool {
+	DB.First(w, id)
+	return !DB.NewRecord(w)
+}
+
+// A webhook is interested in a point when it subscribes to the event and
+// every tag filter matches the tags of the point.
+func (w *Webhook) Matches(event string, tags map[string]string) bool {
+	if !StringSliceContains(w.Events, event) {
+		return false
+	}
+
+	for k, v := range w.TagFilters {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Hex encoded HMAC-SHA256 of the request body, keyed by the webhook secret.
+func (w *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func ChannelWebhooks(channelId int) []*Webhook {
+	hooks := []*Webhook{}
+	DB.Where("channel_id = ?", channelId).Find(&hooks)
+	return hooks
+}
+
+func FetchCachedWebhooksByChannelId(channelId int) []*Webhook {
+	hooks, err := Cache.Fetch(webhooksCacheKey(channelId), 1*time.Minute, func() (interface{}, error) {
+		return ChannelWebhooks(channelId), nil
+	})
+
+	if err != nil {
+		return []*Webhook{}
+	}
+	return hooks.([]*Webhook)
+}
+
+func webhooksCacheKey(channelId int) string {
+	return fmt.Sprintf("cache.webhooks:%d", channelId)
+}
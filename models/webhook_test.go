@@ -0,0 +1,120 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	dbFile := setupTestDB(&Conf{})
+	defer teardownTestDB(dbFile)
+
+	ch := &Channel{
+		Name:            "test",
+		Description:     "desc",
+		Tags:            []string{"tag1", "tag2"},
+		Fields:          map[string]string{"field1": "int"},
+		AccessTokens:    []string{"token1"},
+		ConnectionLimit: 5,
+		MessageRate:     1000,
+	}
+	ch.Create()
+
+	Convey("creates/updates/deletes webhook", t, func() {
+		w := &Webhook{
+			ChannelId:  ch.Id,
+			Url:        "http://localhost:8000/hooks",
+			Secret:     "secret",
+			Events:     []string{"upload", "connect"},
+			TagFilters: map[string]string{"tag1": "a"},
+		}
+
+		err := w.Create()
+		So(err, ShouldBeNil)
+		So(len(FetchCachedWebhooksByChannelId(ch.Id)), ShouldEqual, 1)
+
+		w.Url = "https://localhost:8000/hooks"
+		err = w.Update()
+		So(err, ShouldBeNil)
+
+		_w := &Webhook{}
+		_w.FindById(w.Id)
+		So(_w.Url, ShouldEqual, "https://localhost:8000/hooks")
+		So(FetchCachedWebhooksByChannelId(ch.Id)[0].Url, ShouldEqual, "https://localhost:8000/hooks")
+
+		w.Delete()
+		So(len(ChannelWebhooks(ch.Id)), ShouldEqual, 0)
+		So(len(FetchCachedWebhooksByChannelId(ch.Id)), ShouldEqual, 0)
+	})
+
+	Convey("validates webhook before saving", t, func() {
+		w := &Webhook{
+			ChannelId: ch.Id,
+			Url:       "ftp://localhost/hooks",
+			Secret:    "secret",
+			Events:    []string{"upload"},
+		}
+		err := w.Create()
+		So(err.Error(), ShouldContainSubstring, "invalid url")
+
+		w.Url = "http://localhost/hooks"
+		w.Secret = ""
+		err = w.Create()
+		So(err.Error(), ShouldContainSubstring, "secret is empty")
+
+		w.Secret = "secret"
+		w.Events = []string{}
+		err = w.Create()
+		So(err.Error(), ShouldContainSubstring, "events are empty")
+
+		w.Events = []string{"upload", "send"}
+		err = w.Create()
+		So(err.Error(), ShouldContainSubstring, "unsupported event: send")
+
+		w.Events = []string{"upload"}
+		w.TagFilters = map[string]string{"tag3": "a"}
+		err = w.Create()
+		So(err.Error(), ShouldContainSubstring, "unknown tag in tag filters: tag3")
+
+		w.TagFilters = map[string]string{"device_id": "a"}
+		w.ChannelId = ch.Id + 1
+		err = w.Create()
+		So(err.Error(), ShouldContainSubstring, "channel not found")
+
+		var count int
+		DB.Model(&Webhook{}).Count(&count)
+		So(count, ShouldEqual, 0)
+	})
+
+	Convey("matches events and tags, and signs payloads", t, func() {
+		w := &Webhook{
+			Secret:     "secret",
+			Events:     []string{"upload"},
+			TagFilters: map[string]string{"tag1": "a"},
+		}
+		So(w.Matches("upload", map[string]string{"tag1": "a", "tag2": "b"}), ShouldBeTrue)
+		So(w.Matches("upload", map[string]string{"tag1": "b"}), ShouldBeFalse)
+		So(w.Matches("upload", map[string]string{}), ShouldBeFalse)
+		So(w.Matches("connect", map[string]string{"tag1": "a"}), ShouldBeFalse)
+
+		So(w.Sign([]byte("payload")), ShouldEqual, "b82fcb791acec57859b989b430a826488ce2e479fdf92326bd0a2e8375a42ba4")
+	})
+
+	Convey("deletes webhooks with the channel", t, func() {
+		w := &Webhook{
+			ChannelId: ch.Id,
+			Url:       "http://localhost:8000/hooks",
+			Secret:    "secret",
+			Events:    []string{"upload"},
+		}
+		w.Create()
+
+		err := ch.Delete()
+		So(err, ShouldBeNil)
+
+		var count int
+		DB.Model(&Webhook{}).Count(&count)
+		So(count, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,248 @@
+package pubsub
+
+import (
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"sync"
+	"time"
+)
+
+// The stream settings, falling back to the defaults for the ones that are not
+// configured, so that the streams work without a config.
+func StreamSettings() *StreamConf {
+	conf := &StreamConf{
+		BufferSize:   256,
+		Backlog:      1024,
+		ResumeWindow: &JSONDuration{time.Minute},
+		KeepAlive:    &JSONDuration{30 * time.Second},
+	}
+	cfg := Config()
+	if cfg == nil || cfg.Streams == nil {
+		return conf
+	}
+
+	streams := cfg.Streams
+	if streams.BufferSize > 0 {
+		conf.BufferSize = streams.BufferSize
+	}
+	if streams.Backlog > 0 {
+		conf.Backlog = streams.Backlog
+	}
+	if streams.ResumeWindow != nil {
+		conf.ResumeWindow = streams.ResumeWindow
+	}
+	if streams.KeepAlive != nil && streams.KeepAlive.Duration > 0 {
+		conf.KeepAlive = streams.KeepAlive
+	}
+	return conf
+}
+
+// StreamEvent is an event of a stream topic. Seq increases by one for every
+// event published to the topic, subscribers resume from the last one they
+// got.
+type StreamEvent struct {
+	Seq   uint64
+	Data  []byte
+	Value interface{}
+}
+
+type StreamFilter func(*StreamEvent) bool
+
+// StreamSubscription receives the events of a topic that pass its filter.
+// A subscriber that can't keep up with the topic fills up its buffer and is
+// dropped, Events is closed then and Overflowed tells why.
+type StreamSubscription struct {
+	topic      *streamTopic
+	filter     StreamFilter
+	events     chan *StreamEvent
+	overflowed bool
+}
+
+func (s *StreamSubscription) Events() <-chan *StreamEvent { return s.events }
+
+// Only meaningful after Events is closed.
+func (s *StreamSubscription) Overflowed() bool { return s.overflowed }
+
+// Every topic has its own lock, so the filters of a busy topic don't hold up
+// the others.
+type streamTopic struct {
+	sync.Mutex
+	// set once the topic is dropped from the hub
+	removed  bool
+	seq      uint64
+	backlog  []*StreamEvent
+	next     int
+	full     bool
+	subs     map[*StreamSubscription]bool
+	detached time.Time
+}
+
+// events of the backlog after the cursor, oldest first
+// caller must hold the lock of the topic
+func (t *streamTopic) since(cursor uint64) []*StreamEvent {
+	n := t.next
+	if t.full {
+		n = len(t.backlog)
+	}
+
+	events := make([]*StreamEvent, 0, n)
+	for i := n; i > 0; i-- {
+		e := t.backlog[(t.next-i+len(t.backlog))%len(t.backlog)]
+		if e.Seq > cursor {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// StreamHub fans the events of a topic out to its subscribers. It keeps the
+// most recent events of a topic so that subscribers can resume after a
+// reconnect, and keeps collecting them for the resume window after the last
+// subscriber of a topic left. The lock of the hub only guards the topics.
+type StreamHub struct {
+	sync.Mutex
+	topics       map[string]*streamTopic
+	backlog      int
+	resumeWindow time.Duration
+}
+
+func NewStreamHub(backlog int, resumeWindow time.Duration) *StreamHub {
+	if backlog <= 0 {
+		backlog = 1
+	}
+	return &StreamHub{
+		topics:       make(map[string]*streamTopic),
+		backlog:      backlog,
+		resumeWindow: resumeWindow,
+	}
+}
+
+func (h *StreamHub) topic(name string) *streamTopic {
+	h.Lock()
+	defer h.Unlock()
+	return h.topics[name]
+}
+
+// Whether events of the topic are wanted. Publishers check it first so that
+// nothing is prepared for topics nobody streams.
+func (h *StreamHub) Subscribed(topic string) bool {
+	t := h.topic(topic)
+	if t == nil {
+		return false
+	}
+
+	t.Lock()
+	idle := t.removed || (len(t.subs) == 0 && time.Since(t.detached) > h.resumeWindow)
+	t.removed = idle
+	t.Unlock()
+	if !idle {
+		return true
+	}
+
+	h.Lock()
+	if h.topics[topic] == t {
+		delete(h.topics, topic)
+	}
+	h.Unlock()
+	return false
+}
+
+// Publishes an event to the subscribers of a topic, returns its seq or 0 when
+// the topic isn't subscribed.
+func (h *StreamHub) Publish(topic string, data []byte, value interface{}) uint64 {
+	t := h.topic(topic)
+	if t == nil {
+		return 0
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.removed {
+		return 0
+	}
+
+	t.seq += 1
+	e := &StreamEvent{Seq: t.seq, Data: data, Value: value}
+	t.backlog[t.next] = e
+	t.next = (t.next + 1) % len(t.backlog)
+	if t.next == 0 {
+		t.full = true
+	}
+
+	for s, _ := range t.subs {
+		if s.filter != nil && !s.filter(e) {
+			continue
+		}
+
+		select {
+		case s.events <- e:
+		default:
+			s.overflowed = true
+			t.remove(s)
+		}
+	}
+	return e.Seq
+}
+
+// Subscribes to a topic with a buffer of bufferSize events. With a cursor,
+// the events after it that are still in the backlog are delivered first. A
+// cursor ahead of the topic, like one from before a restart, replays the
+// whole backlog.
+func (h *StreamHub) Subscribe(topic string, cursor uint64, bufferSize int, filter StreamFilter) *StreamSubscription {
+	for {
+		h.Lock()
+		t, found := h.topics[topic]
+		if !found {
+			t = &streamTopic{
+				backlog: make([]*StreamEvent, h.backlog),
+				subs:    make(map[*StreamSubscription]bool),
+			}
+			h.topics[topic] = t
+		}
+		h.Unlock()
+
+		t.Lock()
+		// the topic was dropped in the meantime, it is created again
+		if t.removed {
+			t.Unlock()
+			continue
+		}
+
+		var replay []*StreamEvent
+		if cursor > 0 {
+			if cursor > t.seq {
+				cursor = 0
+			}
+			replay = t.since(cursor)
+		}
+
+		s := &StreamSubscription{topic: t, filter: filter}
+		s.events = make(chan *StreamEvent, bufferSize+len(replay))
+		for _, e := range replay {
+			if filter == nil || filter(e) {
+				s.events <- e
+			}
+		}
+		t.subs[s] = true
+		t.Unlock()
+		return s
+	}
+}
+
+func (h *StreamHub) Unsubscribe(s *StreamSubscription) {
+	s.topic.Lock()
+	defer s.topic.Unlock()
+	s.topic.remove(s)
+}
+
+// caller must hold the lock of the topic
+func (t *streamTopic) remove(s *StreamSubscription) {
+	if !t.subs[s] {
+		return
+	}
+	delete(t.subs, s)
+	close(s.events)
+	if len(t.subs) == 0 {
+		t.detached = time.Now()
+	}
+}
@@ -0,0 +1,103 @@
+package pubsub
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/eywa/configs"
+	. "github.com/eywa/utils"
+	"testing"
+	"time"
+)
+
+func seqs(s *StreamSubscription) []uint64 {
+	ns := []uint64{}
+	for {
+		select {
+		case e, ok := <-s.Events():
+			if !ok {
+				return ns
+			}
+			ns = append(ns, e.Seq)
+		default:
+			return ns
+		}
+	}
+}
+
+func TestStreamHub(t *testing.T) {
+
+	Convey("publishes the events that pass the filter of a subscriber", t, func() {
+		h := NewStreamHub(8, time.Minute)
+		So(h.Publish("t", nil, 1), ShouldEqual, 0)
+		So(h.Subscribed("t"), ShouldBeFalse)
+
+		all := h.Subscribe("t", 0, 8, nil)
+		even := h.Subscribe("t", 0, 8, func(e *StreamEvent) bool { return e.Value.(int)%2 == 0 })
+		So(h.Subscribed("t"), ShouldBeTrue)
+
+		for i := 1; i <= 4; i++ {
+			So(h.Publish("t", nil, i), ShouldEqual, uint64(i))
+		}
+		So(seqs(all), ShouldResemble, []uint64{1, 2, 3, 4})
+		So(seqs(even), ShouldResemble, []uint64{2, 4})
+	})
+
+	Convey("resumes from a cursor with the backlog", t, func() {
+		h := NewStreamHub(3, time.Minute)
+		s := h.Subscribe("t", 0, 8, nil)
+		for i := 1; i <= 5; i++ {
+			h.Publish("t", nil, i)
+		}
+		h.Unsubscribe(s)
+
+		// the backlog only holds the last 3 events
+		So(seqs(h.Subscribe("t", 1, 8, nil)), ShouldResemble, []uint64{3, 4, 5})
+		So(seqs(h.Subscribe("t", 4, 8, nil)), ShouldResemble, []uint64{5})
+		// a cursor from before a restart replays the whole backlog
+		So(seqs(h.Subscribe("t", 100, 8, nil)), ShouldResemble, []uint64{3, 4, 5})
+		So(seqs(h.Subscribe("t", 0, 8, nil)), ShouldBeEmpty)
+
+		odd := h.Subscribe("t", 2, 8, func(e *StreamEvent) bool { return e.Value.(int)%2 == 1 })
+		So(seqs(odd), ShouldResemble, []uint64{3, 5})
+	})
+
+	Convey("drops the subscribers that can't keep up", t, func() {
+		h := NewStreamHub(8, time.Minute)
+		slow := h.Subscribe("t", 0, 1, nil)
+		fast := h.Subscribe("t", 0, 8, nil)
+		h.Publish("t", nil, 1)
+		h.Publish("t", nil, 2)
+
+		So(seqs(slow), ShouldResemble, []uint64{1})
+		_, ok := <-slow.Events()
+		So(ok, ShouldBeFalse)
+		So(slow.Overflowed(), ShouldBeTrue)
+		So(seqs(fast), ShouldResemble, []uint64{1, 2})
+	})
+
+	Convey("keeps a topic for the resume window after the last subscriber left", t, func() {
+		h := NewStreamHub(8, 20*time.Millisecond)
+		h.Unsubscribe(h.Subscribe("t", 0, 8, nil))
+		So(h.Publish("t", nil, 1), ShouldEqual, 1)
+		So(h.Subscribed("t"), ShouldBeTrue)
+
+		time.Sleep(30 * time.Millisecond)
+		So(h.Subscribed("t"), ShouldBeFalse)
+		So(h.Publish("t", nil, 2), ShouldEqual, 0)
+
+		// a new subscriber starts the topic over
+		s := h.Subscribe("t", 1, 8, nil)
+		So(h.Publish("t", nil, 3), ShouldEqual, 1)
+		So(seqs(s), ShouldResemble, []uint64{1})
+	})
+
+	Convey("falls back to the default stream settings", t, func() {
+		SetConfig(&Conf{})
+		So(StreamSettings().BufferSize, ShouldEqual, 256)
+		So(StreamSettings().KeepAlive.Duration, ShouldEqual, 30*time.Second)
+
+		SetConfig(&Conf{Streams: &StreamConf{BufferSize: 8, KeepAlive: &JSONDuration{}}})
+		So(StreamSettings().BufferSize, ShouldEqual, 8)
+		So(StreamSettings().Backlog, ShouldEqual, 1024)
+		So(StreamSettings().KeepAlive.Duration, ShouldEqual, 30*time.Second)
+	})
+}
@@ -22,6 +22,7 @@ func DeviceRouter() http.Handler {
 	DeviceRouter.Post("/channels/:channel_id/devices/:device_id/upload", handlers.HttpPushHandler)
 	DeviceRouter.Post("/channels/:channel_id/devices/:device_id/push", handlers.HttpPushHandler)
 	DeviceRouter.Get("/channels/:channel_id/devices/:device_id/poll", handlers.HttpLongPollingHandler)
+	DeviceRouter.Get("/channels/:channel_id/devices/:device_id/firmwares/:firmware_id", handlers.DownloadFirmware)
 
 	DeviceRouter.Compile()
 
@@ -41,6 +42,7 @@ func HttpRouter() http.Handler {
 
 	httpRouter.Handle("/admin/*", AdminRouter())
 	httpRouter.Handle("/api/*", ApiRouter())
+	httpRouter.Handle("/cluster/*", ClusterRouter())
 
 	fs := http.FileServer(http.Dir(Config().Service.Assets))
 	httpRouter.Handle("/*", fs)
@@ -58,7 +60,7 @@ func AdminRouter() http.Handler {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedHeaders:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "DELETE", "PUT"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE", "PUT", "PATCH"},
 		AllowCredentials: true,
 	})
 	admin.Use(c.Handler)
@@ -69,15 +71,62 @@ func AdminRouter() http.Handler {
 	admin.Put("/configs", handlers.UpdateConfig)
 
 	admin.Get("/summary", handlers.GetSummary)
+	admin.Get("/summary/memory", handlers.GetMemorySummary)
 
 	admin.Get("/tail", handlers.TailLog)
 
+	admin.Get("/message_handlers", handlers.ListMessageHandlers)
+	admin.Get("/rpc_handlers", handlers.ListRpcHandlers)
+	admin.Get("/notifiers", handlers.ListNotifiers)
+
 	admin.Get("/channels", handlers.ListChannels)
 	admin.Post("/channels", handlers.CreateChannel)
 	admin.Get("/channels/:id", handlers.GetChannel)
 	admin.Delete("/channels/:id", handlers.DeleteChannel)
 	admin.Put("/channels/:id", handlers.UpdateChannel)
 
+	admin.Get("/channels/:id/webhooks", handlers.ListWebhooks)
+	admin.Post("/channels/:id/webhooks", handlers.CreateWebhook)
+	admin.Get("/channels/:id/webhooks/:webhook_id", handlers.GetWebhook)
+	admin.Delete("/channels/:id/webhooks/:webhook_id", handlers.DeleteWebhook)
+	admin.Put("/channels/:id/webhooks/:webhook_id", handlers.UpdateWebhook)
+	admin.Get("/channels/:id/webhooks/:webhook_id/deliveries", handlers.ListWebhookDeliveries)
+
+	admin.Get("/channels/:id/rpc_routes", handlers.ListRpcRoutes)
+	admin.Post("/channels/:id/rpc_routes", handlers.CreateRpcRoute)
+	admin.Get("/channels/:id/rpc_routes/:route_id", handlers.GetRpcRoute)
+	admin.Delete("/channels/:id/rpc_routes/:route_id", handlers.DeleteRpcRoute)
+	admin.Put("/channels/:id/rpc_routes/:route_id", handlers.UpdateRpcRoute)
+
+	admin.Get("/channels/:id/firmwares", handlers.ListFirmwares)
+	admin.Post("/channels/:id/firmwares", handlers.UploadFirmware)
+	admin.Get("/channels/:id/firmwares/:firmware_id", handlers.GetFirmware)
+	admin.Delete("/channels/:id/firmwares/:firmware_id", handlers.DeleteFirmware)
+
+	admin.Get("/channels/:id/rollouts", handlers.ListRollouts)
+	admin.Post("/channels/:id/rollouts", handlers.CreateRollout)
+	admin.Get("/channels/:id/rollouts/:rollout_id", handlers.GetRollout)
+	admin.Get("/channels/:id/rollouts/:rollout_id/devices", handlers.ListRolloutDevices)
+	admin.Post("/channels/:id/rollouts/:rollout_id/pause", handlers.PauseRollout)
+	admin.Post("/channels/:id/rollouts/:rollout_id/resume", handlers.ResumeRollout)
+	admin.Post("/channels/:id/rollouts/:rollout_id/abort", handlers.AbortRollout)
+
+	admin.Get("/channels/:id/monitors", handlers.ListMonitors)
+	admin.Post("/channels/:id/monitors", handlers.CreateMonitor)
+	admin.Get("/channels/:id/monitors/:monitor_id", handlers.GetMonitor)
+	admin.Delete("/channels/:id/monitors/:monitor_id", handlers.DeleteMonitor)
+	admin.Put("/channels/:id/monitors/:monitor_id", handlers.UpdateMonitor)
+	admin.Get("/channels/:id/monitors/:monitor_id/states", handlers.ListMonitorStates)
+	admin.Get("/channels/:id/alerts", handlers.ListAlerts)
+
+	admin.Get("/channels/:id/devices", handlers.ListDevices)
+	admin.Post("/channels/:id/devices", handlers.CreateDevice)
+	admin.Post("/channels/:id/devices/bulk", handlers.BulkCreateDevices)
+	admin.Get("/channels/:id/devices/:device_id", handlers.GetDevice)
+	admin.Delete("/channels/:id/devices/:device_id", handlers.DeleteDevice)
+	admin.Put("/channels/:id/devices/:device_id", handlers.UpdateDevice)
+	admin.Post("/channels/:id/devices/:device_id/secret", handlers.RotateDeviceSecret)
+
 	admin.Get("/dashboards", handlers.ListDashboards)
 	admin.Post("/dashboards", handlers.CreateDashboard)
 	admin.Get("/dashboards/:id", handlers.GetDashboard)
@@ -87,19 +136,41 @@ func AdminRouter() http.Handler {
 	admin.Get("/channels/:id/value", handlers.QueryValue)
 	admin.Get("/channels/:id/series", handlers.QuerySeries)
 	admin.Get("/channels/:id/raw", handlers.QueryRaw)
+	admin.Get("/channels/:id/stream", handlers.StreamPoints)
+	admin.Get("/channels/:id/presence", handlers.StreamChannelPresence)
 	admin.Get("/channels/:id/tag_stats", handlers.GetChannelTagStats)
 	admin.Get("/channels/:id/index_stats", handlers.GetChannelIndexStats)
 	admin.Get("/channels/:id/request_template", handlers.GetChannelRequestTemplate)
 
 	admin.Get("/channels/:id/devices/:device_id/series", handlers.QuerySeries)
 
+	admin.Get("/cluster/nodes", handlers.ListClusterNodes)
+
+	admin.Get("/indexer/stats", handlers.GetIndexerStats)
+
 	admin.Get("/connections/counts", handlers.ConnectionCounts)
+	admin.Get("/presence", handlers.StreamPresence)
 	admin.Get("/channels/:channel_id/connections/count", handlers.ConnectionCount)
+	admin.Get("/channels/:channel_id/connections/stats", handlers.ConnectionStats)
 	admin.Get("/channels/:channel_id/connections/scan", handlers.ScanConnections)
 	admin.Get("/channels/:channel_id/devices/:device_id/attach", handlers.AttachConnection)
 	admin.Get("/channels/:channel_id/devices/:device_id/status", handlers.ConnectionStatus)
 	admin.Post("/channels/:channel_id/devices/:device_id/send", handlers.SendToDevice)
 	admin.Post("/channels/:channel_id/devices/:device_id/request", handlers.RequestToDevice)
+	admin.Get("/channels/:channel_id/devices/:device_id/commands", handlers.ListCommands)
+	admin.Get("/channels/:channel_id/devices/:device_id/commands/:command_id", handlers.GetCommand)
+	admin.Delete("/channels/:channel_id/devices/:device_id/commands/:command_id", handlers.CancelCommand)
+	admin.Delete("/channels/:channel_id/devices/:device_id/connection", handlers.KickDevice)
+	admin.Get("/channels/:channel_id/devices/:device_id/shadow", handlers.GetShadow)
+	admin.Patch("/channels/:channel_id/devices/:device_id/shadow/desired", handlers.PatchDesiredState)
+	admin.Get("/channels/:channel_id/devices/:device_id/shadow/watch", handlers.WatchShadow)
+	admin.Post("/channels/:channel_id/fanout/send", handlers.FanOutSend)
+	admin.Post("/channels/:channel_id/fanout/request", handlers.FanOutRequest)
+	admin.Get("/channels/:channel_id/fanout/jobs/:job_id", handlers.GetFanOutJob)
+	admin.Get("/channels/:channel_id/bans", handlers.ListDeviceBans)
+	admin.Get("/channels/:channel_id/devices/:device_id/ban", handlers.GetDeviceBan)
+	admin.Put("/channels/:channel_id/devices/:device_id/ban", handlers.BanDevice)
+	admin.Delete("/channels/:channel_id/devices/:device_id/ban", handlers.LiftDeviceBan)
 
 	return admin
 }
@@ -111,10 +182,28 @@ func ApiRouter() http.Handler {
 
 	api.Get("/channels/:id/value", handlers.QueryValue)
 	api.Get("/channels/:id/series", handlers.QuerySeries)
+	api.Get("/channels/:id/stream", handlers.StreamPoints)
 
 	api.Get("/channels/:channel_id/devices/:device_id/status", handlers.ConnectionStatus)
 	api.Post("/channels/:channel_id/devices/:device_id/send", handlers.SendToDevice)
 	api.Post("/channels/:channel_id/devices/:device_id/request", handlers.RequestToDevice)
+	api.Get("/channels/:channel_id/devices/:device_id/shadow", handlers.GetShadow)
+	api.Patch("/channels/:channel_id/devices/:device_id/shadow/desired", handlers.PatchDesiredState)
+	api.Get("/channels/:channel_id/devices/:device_id/shadow/watch", handlers.WatchShadow)
+	api.Post("/channels/:channel_id/fanout/send", handlers.FanOutSend)
+	api.Post("/channels/:channel_id/fanout/request", handlers.FanOutRequest)
+	api.Get("/channels/:channel_id/fanout/jobs/:job_id", handlers.GetFanOutJob)
 
 	return api
 }
+
+func ClusterRouter() http.Handler {
+	cluster := web.New()
+	cluster.Use(middleware.SubRouter)
+	cluster.Use(middlewares.ClusterAuthenticator)
+
+	cluster.Post("/gossip", handlers.ClusterGossip)
+	cluster.Get("/channels/:channel_id/devices/:device_id", handlers.ClusterFindDevice)
+
+	return cluster
+}
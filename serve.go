@@ -1,15 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"github.com/eywa/cluster"
 	"github.com/eywa/configs"
 	"github.com/eywa/connections"
+	"github.com/eywa/handlers"
 	. "github.com/eywa/loggers"
+	"github.com/eywa/message_handlers"
 	"github.com/eywa/models"
 	"github.com/eywa/pubsub"
 	"github.com/zenazn/goji/graceful"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"strconv"
 )
@@ -65,6 +70,38 @@ func serve() {
 
 	}()
 
+	var mqttListener net.Listener
+	if configs.Config().Service.MqttPort > 0 {
+		addr := ":" + strconv.Itoa(configs.Config().Service.MqttPort)
+		var err error
+		if len(cert) > 0 && len(key) > 0 {
+			var c tls.Certificate
+			c, err = tls.LoadX509KeyPair(cert, key)
+			if err == nil {
+				mqttListener, err = tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{c}})
+			}
+		} else {
+			mqttListener, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			log.Fatalln(fmt.Sprintf("error listening to mqtt port: %s\n", err.Error()))
+		}
+
+		go func() {
+			Logger.Info(fmt.Sprintf("MQTT broker started listening to port %d", configs.Config().Service.MqttPort))
+			for {
+				nc, err := mqttListener.Accept()
+				if err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Temporary() {
+						continue
+					}
+					return
+				}
+				go handlers.MqttHandler(nc)
+			}
+		}()
+	}
+
 	graceful.HandleSignals()
 	graceful.PreHook(func() {
 		Logger.Info("Eywa received signal, gracefully stopping...")
@@ -74,13 +111,33 @@ func serve() {
 		close(connections.HttpCloseChan)
 	})
 
+	graceful.PreHook(func() { cluster.Close() })
+
+	graceful.PreHook(func() {
+		if mqttListener != nil {
+			mqttListener.Close()
+		}
+	})
+
 	graceful.PostHook(func() {
 		Logger.Info("Waiting for websockets to drain...")
 		connections.CloseCMs()
 		Logger.Info("Connection Manager closed.")
 	})
+	graceful.PostHook(func() {
+		Logger.Info("Waiting for webhooks to drain...")
+		message_handlers.CloseWebhooks()
+		Logger.Info("Webhooks closed.")
+	})
+	graceful.PostHook(func() { message_handlers.CloseMonitors() })
+	graceful.PostHook(func() {
+		Logger.Info("Waiting for bulk indexer to drain...")
+		models.CloseBulkIndexer()
+		Logger.Info("Bulk indexer closed.")
+	})
+	graceful.PostHook(func() { models.CloseCommandQueue() })
 	graceful.PostHook(func() { models.CloseDB() })
-	graceful.PostHook(func() { models.CloseIndexClient() })
+	graceful.PostHook(func() { models.CloseStore() })
 	graceful.PostHook(func() {
 		Logger.Info("Eywa stopped")
 	})
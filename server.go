@@ -5,9 +5,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/eywa/cluster"
 	"github.com/eywa/configs"
 	"github.com/eywa/connections"
 	. "github.com/eywa/loggers"
+	"github.com/eywa/message_handlers"
 	"github.com/eywa/models"
 	. "github.com/eywa/utils"
 	"os"
@@ -38,7 +40,10 @@ func main() {
 	switch args[1] {
 	case "serve":
 		FatalIfErr(models.InitializeDB())
-		FatalIfErr(models.InitializeIndexClient())
+		FatalIfErr(models.InitializeStore())
+		FatalIfErr(models.InitializeBulkIndexer())
+		FatalIfErr(models.InitializeCommandQueue())
+		FatalIfErr(message_handlers.InitializeMonitors())
 		names := make([]string, 0)
 		chs := models.Channels()
 		for _, ch := range chs {
@@ -50,6 +55,12 @@ func main() {
 		}
 		connections.InitWsUpgraders()
 		FatalIfErr(connections.InitializeCMs(names))
+		for i, ch := range chs {
+			cm, _ := connections.FindConnectionManager(names[i])
+			cm.SetConnectionLimit(ch.ConnectionLimit)
+			cm.SetIdleTimeout(ch.IdleTimeoutDuration())
+		}
+		FatalIfErr(cluster.Initialize())
 		serve()
 	case "migrate":
 		FatalIfErr(models.InitializeDB())
@@ -40,3 +40,9 @@ func (self *cache) Fetch(key string, dur time.Duration, f func() (interface{}, e
 	self.caches[key] = newContent
 	return newContent.content, nil
 }
+
+func (self *cache) Delete(key string) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.caches, key)
+}
@@ -0,0 +1,413 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A small CBOR (RFC 7049) codec for the payloads of devices. Maps are
+// decoded into map[string]interface{}, arrays into []interface{}, integers
+// into int64, or uint64 when they don't fit, and floats into float64. Tags
+// are dropped and their content is kept.
+
+var cborTruncatedErr = errors.New("cbor: unexpected end of data")
+var cborBreak = &struct{}{}
+
+const (
+	cborUint    = 0
+	cborNegInt  = 1
+	cborBytes   = 2
+	cborText    = 3
+	cborArray   = 4
+	cborMap     = 5
+	cborTag     = 6
+	cborSimple  = 7
+	cborIndef   = 31
+	cborMaxNest = 64
+)
+
+func CborUnmarshal(data []byte) (interface{}, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if v == cborBreak {
+		return nil, errors.New("cbor: unexpected break")
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New(fmt.Sprintf("cbor: %d trailing bytes", len(d.data)-d.pos))
+	}
+	return v, nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, cborTruncatedErr
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// Reads the argument that follows the initial byte of an item.
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		b, err := d.next(1)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(b[0]), nil
+	case info == 25:
+		b, err := d.next(2)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.next(4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.next(8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b), nil
+	default:
+		return 0, errors.New(fmt.Sprintf("cbor: invalid additional info %d", info))
+	}
+}
+
+func (d *cborDecoder) length(info byte) (int, error) {
+	n, err := d.argument(info)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)) {
+		return 0, cborTruncatedErr
+	}
+	return int(n), nil
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxNest {
+		return nil, errors.New("cbor: nested too deeply")
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+
+	switch major {
+	case cborUint:
+		n, err := d.argument(info)
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case cborNegInt:
+		n, err := d.argument(info)
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		var s []byte
+		if info == cborIndef {
+			s, err = d.chunks(major)
+		} else {
+			var n int
+			if n, err = d.length(info); err == nil {
+				s, err = d.next(n)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(s), nil
+		}
+		return append([]byte{}, s...), nil
+	case cborArray:
+		arr := []interface{}{}
+		if info == cborIndef {
+			for {
+				v, err := d.decode(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				if v == cborBreak {
+					return arr, nil
+				}
+				arr = append(arr, v)
+			}
+		}
+		n, err := d.length(info)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if v == cborBreak {
+				return nil, errors.New("cbor: unexpected break")
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case cborMap:
+		m := make(map[string]interface{})
+		n := -1
+		if info != cborIndef {
+			if n, err = d.length(info); err != nil {
+				return nil, err
+			}
+		}
+		for i := 0; n < 0 || i < n; i++ {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if k == cborBreak {
+				if n < 0 {
+					return m, nil
+				}
+				return nil, errors.New("cbor: unexpected break")
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("cbor: unsupported map key %v", k))
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if v == cborBreak {
+				return nil, errors.New("cbor: unexpected break")
+			}
+			m[key] = v
+		}
+		return m, nil
+	case cborTag:
+		if _, err := d.argument(info); err != nil {
+			return nil, err
+		}
+		return d.decode(depth + 1)
+	default:
+		return d.simple(info)
+	}
+}
+
+// Concatenates the chunks of an indefinite length string.
+func (d *cborDecoder) chunks(major byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	for {
+		b, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 0xff {
+			return buf.Bytes(), nil
+		}
+		if b[0]>>5 != major || b[0]&0x1f == cborIndef {
+			return nil, errors.New("cbor: invalid chunk of indefinite length string")
+		}
+		n, err := d.length(b[0] & 0x1f)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(chunk)
+	}
+}
+
+func (d *cborDecoder) simple(info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		b, err := d.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return halfToFloat(binary.BigEndian.Uint16(b)), nil
+	case 26:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 27:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case cborIndef:
+		return cborBreak, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("cbor: unsupported simple value %d", info))
+	}
+}
+
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+// CborMarshal encodes nil, booleans, numbers, strings, byte slices and
+// arrays and string keyed maps of them.
+func CborMarshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := cborEncode(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func cborInt(buf *bytes.Buffer, n int64) {
+	if n < 0 {
+		cborHead(buf, cborNegInt, uint64(-1-n))
+	} else {
+		cborHead(buf, cborUint, uint64(n))
+	}
+}
+
+func cborEncode(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if t {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case int:
+		cborInt(buf, int64(t))
+	case int8:
+		cborInt(buf, int64(t))
+	case int16:
+		cborInt(buf, int64(t))
+	case int32:
+		cborInt(buf, int64(t))
+	case int64:
+		cborInt(buf, t)
+	case uint:
+		cborHead(buf, cborUint, uint64(t))
+	case uint8:
+		cborHead(buf, cborUint, uint64(t))
+	case uint16:
+		cborHead(buf, cborUint, uint64(t))
+	case uint32:
+		cborHead(buf, cborUint, uint64(t))
+	case uint64:
+		cborHead(buf, cborUint, t)
+	case float32:
+		buf.WriteByte(0xfa)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(t))
+	case float64:
+		buf.WriteByte(0xfb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(t))
+	case string:
+		cborHead(buf, cborText, uint64(len(t)))
+		buf.WriteString(t)
+	case []byte:
+		cborHead(buf, cborBytes, uint64(len(t)))
+		buf.Write(t)
+	case []interface{}:
+		cborHead(buf, cborArray, uint64(len(t)))
+		for _, e := range t {
+			if err := cborEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		cborHead(buf, cborMap, uint64(len(t)))
+		for k, e := range t {
+			cborHead(buf, cborText, uint64(len(k)))
+			buf.WriteString(k)
+			if err := cborEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]string:
+		cborHead(buf, cborMap, uint64(len(t)))
+		for k, e := range t {
+			cborHead(buf, cborText, uint64(len(k)))
+			buf.WriteString(k)
+			cborHead(buf, cborText, uint64(len(e)))
+			buf.WriteString(e)
+		}
+	default:
+		return errors.New(fmt.Sprintf("cbor: unsupported type %T", v))
+	}
+	return nil
+}
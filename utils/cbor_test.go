@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"encoding/hex"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func cborHex(s string) (interface{}, error) {
+	b, _ := hex.DecodeString(s)
+	return CborUnmarshal(b)
+}
+
+func TestCbor(t *testing.T) {
+
+	Convey("decodes the examples of the rfc", t, func() {
+		examples := map[string]interface{}{
+			"00":                         int64(0),
+			"17":                         int64(23),
+			"1818":                       int64(24),
+			"1903e8":                     int64(1000),
+			"1bffffffffffffffff":         uint64(18446744073709551615),
+			"20":                         int64(-1),
+			"3863":                       int64(-100),
+			"f93c00":                     1.0,
+			"f97bff":                     65504.0,
+			"fb3ff199999999999a":         1.1,
+			"f4":                         false,
+			"f5":                         true,
+			"f6":                         nil,
+			"6449455446":                 "IETF",
+			"4401020304":                 []byte{1, 2, 3, 4},
+			"c11a514b67b0":               int64(1363896240),
+			"7f657374726561646d696e67ff": "streaming",
+		}
+		for h, expected := range examples {
+			v, err := cborHex(h)
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, expected)
+		}
+
+		v, err := cborHex("a26161016162820203")
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}})
+
+		v, err = cborHex("9f018202039f0405ffff")
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}})
+
+		v, err = cborHex("bf6346756ef563416d7421ff")
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, map[string]interface{}{"Fun": true, "Amt": int64(-2)})
+	})
+
+	Convey("rejects malformed data", t, func() {
+		for _, h := range []string{"", "19", "62616263", "a1016161", "ff", "0000", "9f01"} {
+			_, err := cborHex(h)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("encodes what it decodes", t, func() {
+		v := map[string]interface{}{
+			"int":    int64(-300),
+			"uint":   int64(70000),
+			"float":  1.5,
+			"str":    "hello",
+			"bool":   true,
+			"nil":    nil,
+			"array":  []interface{}{int64(1), "two"},
+			"nested": map[string]interface{}{"k": "v"},
+		}
+		b, err := CborMarshal(v)
+		So(err, ShouldBeNil)
+		decoded, err := CborUnmarshal(b)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, v)
+
+		_, err = CborMarshal(struct{}{})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,349 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A small MessagePack codec for the payloads of devices, decoding into the
+// same values as CborUnmarshal. Extension types are not supported.
+
+var msgpackTruncatedErr = errors.New("msgpack: unexpected end of data")
+
+const msgpackMaxNest = 64
+
+func MsgpackUnmarshal(data []byte) (interface{}, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New(fmt.Sprintf("msgpack: %d trailing bytes", len(d.data)-d.pos))
+	}
+	return v, nil
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, msgpackTruncatedErr
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// Reads a big endian unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *msgpackDecoder) length(size int) (int, error) {
+	n, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)) {
+		return 0, msgpackTruncatedErr
+	}
+	return int(n), nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > msgpackMaxNest {
+		return nil, errors.New("msgpack: nested too deeply")
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.decodeMap(int(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return d.decodeArray(int(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		s, err := d.next(int(c & 0x1f))
+		if err != nil {
+			return nil, err
+		}
+		return string(s), nil
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, s...), nil
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(n), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(s), nil
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	default:
+		return nil, errors.New(fmt.Sprintf("msgpack: unsupported format 0x%x", c))
+	}
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (interface{}, error) {
+	arr := []interface{}{}
+	for i := 0; i < n; i++ {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("msgpack: unsupported map key %v", k))
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// MsgpackMarshal encodes the same values as CborMarshal.
+func MsgpackMarshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := msgpackEncode(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func msgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0:
+		msgpackUint(buf, uint64(n))
+	case n >= -32:
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func msgpackUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n <= 0x7f:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// Writes the header of a string, binary, array or map, picking the smallest
+// of the fix, 8, 16 and 32 bit formats available.
+func msgpackHead(buf *bytes.Buffer, fix byte, fixMax int, codes []byte, n int) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint8 && codes[0] != 0:
+		buf.WriteByte(codes[0])
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(codes[1])
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(codes[2])
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func msgpackString(buf *bytes.Buffer, s string) {
+	msgpackHead(buf, 0xa0, 31, []byte{0xd9, 0xda, 0xdb}, len(s))
+	buf.WriteString(s)
+}
+
+func msgpackEncode(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		msgpackInt(buf, int64(t))
+	case int8:
+		msgpackInt(buf, int64(t))
+	case int16:
+		msgpackInt(buf, int64(t))
+	case int32:
+		msgpackInt(buf, int64(t))
+	case int64:
+		msgpackInt(buf, t)
+	case uint:
+		msgpackUint(buf, uint64(t))
+	case uint8:
+		msgpackUint(buf, uint64(t))
+	case uint16:
+		msgpackUint(buf, uint64(t))
+	case uint32:
+		msgpackUint(buf, uint64(t))
+	case uint64:
+		msgpackUint(buf, t)
+	case float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(t))
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(t))
+	case string:
+		msgpackString(buf, t)
+	case []byte:
+		// bin formats have no fix variant
+		msgpackHead(buf, 0, -1, []byte{0xc4, 0xc5, 0xc6}, len(t))
+		buf.Write(t)
+	case []interface{}:
+		msgpackHead(buf, 0x90, 15, []byte{0, 0xdc, 0xdd}, len(t))
+		for _, e := range t {
+			if err := msgpackEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		msgpackHead(buf, 0x80, 15, []byte{0, 0xde, 0xdf}, len(t))
+		for k, e := range t {
+			msgpackString(buf, k)
+			if err := msgpackEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]string:
+		msgpackHead(buf, 0x80, 15, []byte{0, 0xde, 0xdf}, len(t))
+		for k, e := range t {
+			msgpackString(buf, k)
+			msgpackString(buf, e)
+		}
+	default:
+		return errors.New(fmt.Sprintf("msgpack: unsupported type %T", v))
+	}
+	return nil
+}
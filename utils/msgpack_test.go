@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"encoding/hex"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func msgpackHex(s string) (interface{}, error) {
+	b, _ := hex.DecodeString(s)
+	return MsgpackUnmarshal(b)
+}
+
+func TestMsgpack(t *testing.T) {
+
+	Convey("decodes the formats of the spec", t, func() {
+		examples := map[string]interface{}{
+			"00":                 int64(0),
+			"7f":                 int64(127),
+			"ff":                 int64(-1),
+			"d09c":               int64(-100),
+			"cd03e8":             int64(1000),
+			"cfffffffffffffffff": uint64(18446744073709551615),
+			"ca3fc00000":         1.5,
+			"cb3ff199999999999a": 1.1,
+			"c0":                 nil,
+			"c2":                 false,
+			"c3":                 true,
+			"a449455446":         "IETF",
+			"d90449455446":       "IETF",
+			"c40401020304":       []byte{1, 2, 3, 4},
+		}
+		for h, expected := range examples {
+			v, err := msgpackHex(h)
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, expected)
+		}
+
+		v, err := msgpackHex("82a16101a1629202dc00020304")
+		So(err, ShouldBeNil)
+		So(v, ShouldResemble, map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), []interface{}{int64(3), int64(4)}}})
+	})
+
+	Convey("rejects malformed data", t, func() {
+		for _, h := range []string{"", "cd03", "a4616263", "81016161", "c1", "0000", "d40100"} {
+			_, err := msgpackHex(h)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("encodes what it decodes", t, func() {
+		v := map[string]interface{}{
+			"int":    int64(-300),
+			"uint":   int64(70000),
+			"float":  1.5,
+			"str":    strings.Repeat("s", 40),
+			"bytes":  []byte{1, 2},
+			"bool":   false,
+			"nil":    nil,
+			"array":  []interface{}{int64(1), "two"},
+			"nested": map[string]interface{}{"k": "v"},
+		}
+		b, err := MsgpackMarshal(v)
+		So(err, ShouldBeNil)
+		decoded, err := MsgpackUnmarshal(b)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, v)
+	})
+}
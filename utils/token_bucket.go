@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket refills tokens continuously at rate tokens per second, up to
+// burst tokens. Each Take consumes one token.
+type TokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Update the rate and burst, tokens are kept but capped at the new burst.
+func (b *TokenBucket) SetRate(rate float64, burst int) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *TokenBucket) Rate() float64 {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.rate
+}
+
+// Take one token from the bucket, returns false if the bucket is empty.
+func (b *TokenBucket) Take() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// Give back one token, used when a later check rejects the message after
+// the token was taken.
+func (b *TokenBucket) Return() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens += 1
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	Convey("takes tokens up to the burst size", t, func() {
+		b := NewTokenBucket(10, 3)
+		So(b.Take(), ShouldBeTrue)
+		So(b.Take(), ShouldBeTrue)
+		So(b.Take(), ShouldBeTrue)
+		So(b.Take(), ShouldBeFalse)
+	})
+
+	Convey("refills tokens over time", t, func() {
+		b := NewTokenBucket(20, 1)
+		So(b.Take(), ShouldBeTrue)
+		So(b.Take(), ShouldBeFalse)
+		time.Sleep(100 * time.Millisecond)
+		So(b.Take(), ShouldBeTrue)
+	})
+
+	Convey("returns tokens and caps them at burst size", t, func() {
+		b := NewTokenBucket(1, 1)
+		So(b.Take(), ShouldBeTrue)
+		b.Return()
+		b.Return()
+		So(b.Take(), ShouldBeTrue)
+		So(b.Take(), ShouldBeFalse)
+	})
+
+	Convey("updates the rate", t, func() {
+		b := NewTokenBucket(1, 5)
+		b.SetRate(2, 1)
+		So(b.Rate(), ShouldEqual, 2)
+		So(b.Take(), ShouldBeTrue)
+		So(b.Take(), ShouldBeFalse)
+	})
+}